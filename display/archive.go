@@ -0,0 +1,535 @@
+package monteverdi
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	Mo "github.com/maroda/monteverdi/obvy"
+	Mp "github.com/maroda/monteverdi/plugin"
+	Ms "github.com/maroda/monteverdi/server"
+	Mt "github.com/maroda/monteverdi/types"
+	"go.opentelemetry.io/otel"
+)
+
+const (
+	defaultPulseLimit    = 100
+	maxPulseLimit        = 1000
+	defaultRollupBuckets = 500
+	maxRollupBuckets     = 5000
+	defaultSQLRows       = 1000
+	maxSQLRows           = 10000
+	sqlTimeout           = 10 * time.Second
+)
+
+// OpenArchive opens the pulse archive at location, a SQLite file when it
+// ends in .db, .sqlite, or .sqlite3 and otherwise a BadgerDB directory with
+// the retention and rollup interval from the environment, recording each
+// retention pass in stats
+func OpenArchive(location string, stats *Mo.StatsInternal) (Mp.OutputAdapter, error) {
+	if IsSQLiteLocation(location) {
+		return OpenSQLiteArchive(location, 100)
+	}
+
+	output, err := Mp.NewBadgerOutputWithRetention(location, 100, NewRetentionFromEnv())
+	if err != nil {
+		return nil, err
+	}
+
+	output.StartRetention(func(pass Mp.RetentionPass, err error) {
+		switch {
+		case stats == nil:
+		case err != nil:
+			stats.RecRetentionError()
+		default:
+			stats.RecRetention(pass.Duration.Seconds(), pass.Trimmed, pass.Rewrites, pass.Size)
+		}
+	})
+
+	seconds := Ms.FillEnvVarInt("MONTEVERDI_PLUGIN_BADGER_ROLLUP_INTERVAL_SECONDS", 60)
+	if seconds <= 0 {
+		slog.Warn("Invalid archive rollup interval, using default", slog.Int("seconds", seconds))
+		seconds = 60
+	}
+	output.StartRollups(time.Duration(seconds) * time.Second)
+
+	return output, nil
+}
+
+// IsSQLiteLocation tells whether the archive at location is a SQLite file
+func IsSQLiteLocation(location string) bool {
+	switch strings.ToLower(filepath.Ext(location)) {
+	case ".db", ".sqlite", ".sqlite3":
+		return true
+	}
+	return false
+}
+
+// OpenSQLiteArchive opens the SQLite pulse archive at location, naming patterns as the API does
+func OpenSQLiteArchive(location string, batchSize int) (*Mp.SQLiteOutput, error) {
+	output, err := Mp.NewSQLiteOutput(location, batchSize)
+	if err != nil {
+		return nil, err
+	}
+	output.PatternName = PulseName
+	return output, nil
+}
+
+// NewRetentionFromEnv reads the retention of the pulse archive:
+//
+//	MONTEVERDI_PLUGIN_BADGER_TTL_HOURS            hours to keep each dimension from D1, e.g. 72,2160
+//	MONTEVERDI_PLUGIN_BADGER_MAX_MB               size cap, the oldest pulses are deleted over it
+//	MONTEVERDI_PLUGIN_BADGER_GC_INTERVAL_SECONDS  between retention passes, default 300
+func NewRetentionFromEnv() *Mp.Retention {
+	r := &Mp.Retention{}
+
+	if raw := Ms.FillEnvVar("MONTEVERDI_PLUGIN_BADGER_TTL_HOURS"); raw != "ENOENT" {
+		for _, v := range strings.Split(raw, ",") {
+			hours, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil || hours < 0 {
+				slog.Warn("Invalid archive TTL, keeping pulses forever", slog.String("value", raw))
+				r.TTL = nil
+				break
+			}
+			r.TTL = append(r.TTL, time.Duration(hours)*time.Hour)
+		}
+	}
+
+	mb := Ms.FillEnvVarInt("MONTEVERDI_PLUGIN_BADGER_MAX_MB", 0)
+	if mb < 0 {
+		slog.Warn("Invalid archive size cap, using none", slog.Int("mb", mb))
+		mb = 0
+	}
+	r.MaxBytes = int64(mb) << 20
+
+	seconds := Ms.FillEnvVarInt("MONTEVERDI_PLUGIN_BADGER_GC_INTERVAL_SECONDS", 300)
+	if seconds <= 0 {
+		slog.Warn("Invalid archive GC interval, using default", slog.Int("seconds", seconds))
+		seconds = 300
+	}
+	r.Interval = time.Duration(seconds) * time.Second
+
+	return r
+}
+
+// PulseRecord is an archived pulse as the API returns it
+type PulseRecord struct {
+	Endpoint  string      `json:"endpoint"`
+	Endpoints []string    `json:"endpoints,omitempty"` // endpoint of each metric of a Cascade
+	Metric    []string    `json:"metric"`
+	Pattern   string      `json:"pattern"`          // PulseName
+	Custom    bool        `json:"custom,omitempty"` // Pattern is the name of a user-defined pattern
+	Dimension int         `json:"dimension"`
+	StartTime time.Time   `json:"startTime"`
+	Duration  int64       `json:"duration"`           // nanoseconds
+	Parent    *time.Time  `json:"parent,omitempty"`   // StartTime of the parent
+	Children  []time.Time `json:"children,omitempty"` // StartTimes of the children
+}
+
+// PulsesData is a page of archived pulses
+type PulsesData struct {
+	Start  time.Time     `json:"start"`
+	End    time.Time     `json:"end"`
+	Pulses []PulseRecord `json:"pulses"`
+	Next   string        `json:"next,omitempty"` // cursor for the next page
+}
+
+// NewPulseRecord returns the API form of a pulse
+func NewPulseRecord(p *Mt.PulseEvent) PulseRecord {
+	pr := PulseRecord{
+		Endpoint:  p.Endpoint,
+		Endpoints: p.Endpoints,
+		Metric:    p.Metric,
+		Pattern:   PulseName(*p),
+		Custom:    p.Pattern == Mt.Custom,
+		Dimension: p.Dimension,
+		StartTime: p.StartTime,
+		Duration:  p.Duration.Nanoseconds(),
+		Children:  p.Children,
+	}
+	if !p.Parent.IsZero() {
+		parent := p.Parent
+		pr.Parent = &parent
+	}
+	return pr
+}
+
+// PulsesHandler queries the pulse archive:
+//
+//	GET /api/pulses?start=-6h&end=now&metric=latency&pattern=iamb&limit=100
+//
+// start and end are RFC3339, "now", or a duration from now (default the last hour),
+// endpoint, metric, dimension, and pattern filter the pulses,
+// and cursor continues from the "next" of the previous page.
+func (v *View) PulsesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ctx, span := otel.Tracer("monteverdi/api").Start(ctx, "PulsesHandler")
+	defer span.End()
+
+	if r.Method != http.MethodGet {
+		span.RecordError(fmt.Errorf("invalid method: %s", r.Method))
+		http.Error(w, "invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	v.MU.Lock()
+	output := v.QNet.Output
+	v.MU.Unlock()
+
+	archive, ok := output.(Mp.PulseQuerier)
+	if !ok {
+		span.RecordError(fmt.Errorf("no pulse archive configured"))
+		http.Error(w, "no pulse archive configured", http.StatusNotFound)
+		return
+	}
+
+	pq, err := ParsePulseQuery(r.URL.Query(), time.Now())
+	if err != nil {
+		span.RecordError(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, err := archive.Query(pq)
+	if err != nil {
+		span.RecordError(err)
+		http.Error(w, "error querying pulses", http.StatusInternalServerError)
+		return
+	}
+
+	data := PulsesData{
+		Start:  pq.Start,
+		End:    pq.End,
+		Pulses: make([]PulseRecord, 0, len(page.Pulses)),
+	}
+	for _, p := range page.Pulses {
+		data.Pulses = append(data.Pulses, NewPulseRecord(p))
+	}
+	if page.Next != nil {
+		data.Next = hex.EncodeToString(page.Next)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
+
+// ParsePulseQuery reads the filters of PulsesHandler, times are relative to now
+func ParsePulseQuery(query url.Values, now time.Time) (Mp.PulseQuery, error) {
+	get := query.Get
+	pq := Mp.PulseQuery{
+		Endpoint: get("endpoint"),
+		Metric:   get("metric"),
+		Limit:    defaultPulseLimit,
+	}
+
+	var err error
+	if pq.End, err = ParseQueryTime(get("end"), now, now); err != nil {
+		return pq, fmt.Errorf("invalid end: %w", err)
+	}
+	if pq.Start, err = ParseQueryTime(get("start"), pq.End.Add(-time.Hour), now); err != nil {
+		return pq, fmt.Errorf("invalid start: %w", err)
+	}
+	if !pq.Start.Before(pq.End) {
+		return pq, fmt.Errorf("start %s is not before end %s", pq.Start.Format(time.RFC3339), pq.End.Format(time.RFC3339))
+	}
+
+	if raw := get("dimension"); raw != "" {
+		if pq.Dimension, err = strconv.Atoi(raw); err != nil || pq.Dimension < 1 {
+			return pq, fmt.Errorf("invalid dimension: %s", raw)
+		}
+	}
+
+	if raw := get("pattern"); raw != "" {
+		pattern := PulsePatternFromString(raw)
+		if pattern == Mt.Custom && raw != "custom" {
+			pq.Name = raw // a user-defined pattern by name
+		}
+		pq.Pattern = &pattern
+	}
+
+	if raw := get("limit"); raw != "" {
+		if pq.Limit, err = strconv.Atoi(raw); err != nil || pq.Limit < 1 || pq.Limit > maxPulseLimit {
+			return pq, fmt.Errorf("invalid limit: %s, from 1 to %d", raw, maxPulseLimit)
+		}
+	}
+
+	if raw := get("cursor"); raw != "" {
+		if pq.After, err = hex.DecodeString(raw); err != nil {
+			return pq, fmt.Errorf("invalid cursor: %s", raw)
+		}
+	}
+
+	return pq, nil
+}
+
+// RollupRecord is a rollup as the API returns it
+type RollupRecord struct {
+	Start        time.Time      `json:"start"`
+	Count        int            `json:"count"`
+	Duration     int64          `json:"duration"`     // total of the pulses, nanoseconds
+	MeanDuration int64          `json:"meanDuration"` // nanoseconds
+	Patterns     map[string]int `json:"patterns"`     // by PulseName
+	Dimensions   map[int]int    `json:"dimensions"`
+	Metrics      map[string]int `json:"metrics"`
+	Endpoints    map[string]int `json:"endpoints"`
+}
+
+// RollupsData is the rollups of a range at one resolution
+type RollupsData struct {
+	Start      time.Time      `json:"start"`
+	End        time.Time      `json:"end"`
+	Resolution string         `json:"resolution"` // minute, hour, or day
+	Buckets    []RollupRecord `json:"buckets"`    // only those with pulses
+}
+
+// NewRollupRecord returns the API form of a rollup,
+// Custom pulses are counted by their name
+func NewRollupRecord(r *Mp.Rollup) RollupRecord {
+	rr := RollupRecord{
+		Start:        r.Start,
+		Count:        r.Count,
+		Duration:     r.Duration.Nanoseconds(),
+		MeanDuration: r.MeanDuration().Nanoseconds(),
+		Patterns:     make(map[string]int),
+		Dimensions:   r.Dimensions,
+		Metrics:      r.Metrics,
+		Endpoints:    r.Endpoints,
+	}
+
+	unnamed := r.Patterns[Mt.Custom]
+	for name, n := range r.Names {
+		rr.Patterns[name] += n
+		unnamed -= n
+	}
+	for pattern, n := range r.Patterns {
+		if pattern != Mt.Custom {
+			rr.Patterns[PulsePatternToString(pattern)] += n
+		}
+	}
+	if unnamed > 0 {
+		rr.Patterns[PulsePatternToString(Mt.Custom)] += unnamed
+	}
+	return rr
+}
+
+// RollupsHandler returns pulse counts over time from the archive's rollups:
+//
+//	GET /api/rollups?start=-720h&end=now&resolution=auto&buckets=500
+//
+// start and end are as in PulsesHandler, resolution is minute, hour, day,
+// or auto (the default) for the finest with at most buckets buckets in the range.
+func (v *View) RollupsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ctx, span := otel.Tracer("monteverdi/api").Start(ctx, "RollupsHandler")
+	defer span.End()
+
+	if r.Method != http.MethodGet {
+		span.RecordError(fmt.Errorf("invalid method: %s", r.Method))
+		http.Error(w, "invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	v.MU.Lock()
+	output := v.QNet.Output
+	v.MU.Unlock()
+
+	archive, ok := output.(Mp.RollupQuerier)
+	if !ok {
+		span.RecordError(fmt.Errorf("no pulse archive configured"))
+		http.Error(w, "no pulse archive configured", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	now := time.Now()
+	end, err := ParseQueryTime(query.Get("end"), now, now)
+	if err != nil {
+		span.RecordError(err)
+		http.Error(w, fmt.Sprintf("invalid end: %v", err), http.StatusBadRequest)
+		return
+	}
+	start, err := ParseQueryTime(query.Get("start"), end.Add(-24*time.Hour), now)
+	if err != nil {
+		span.RecordError(err)
+		http.Error(w, fmt.Sprintf("invalid start: %v", err), http.StatusBadRequest)
+		return
+	}
+	if !start.Before(end) {
+		span.RecordError(fmt.Errorf("start is not before end"))
+		http.Error(w, "start is not before end", http.StatusBadRequest)
+		return
+	}
+
+	buckets := defaultRollupBuckets
+	if raw := query.Get("buckets"); raw != "" {
+		if buckets, err = strconv.Atoi(raw); err != nil || buckets < 1 || buckets > maxRollupBuckets {
+			span.RecordError(fmt.Errorf("invalid buckets: %s", raw))
+			http.Error(w, fmt.Sprintf("invalid buckets: %s, from 1 to %d", raw, maxRollupBuckets), http.StatusBadRequest)
+			return
+		}
+	}
+
+	resolution, ok := RollupResolutionFromString(query.Get("resolution"), start, end, buckets)
+	if !ok {
+		span.RecordError(fmt.Errorf("invalid resolution: %s", query.Get("resolution")))
+		http.Error(w, "invalid resolution, one of auto, minute, hour, day", http.StatusBadRequest)
+		return
+	}
+
+	rollups, err := archive.Rollups(start, end, resolution)
+	if err != nil {
+		span.RecordError(err)
+		http.Error(w, "error querying rollups", http.StatusInternalServerError)
+		return
+	}
+
+	data := RollupsData{
+		Start:      start,
+		End:        end,
+		Resolution: RollupResolutionToString(resolution),
+		Buckets:    make([]RollupRecord, 0, len(rollups)),
+	}
+	for _, r := range rollups {
+		data.Buckets = append(data.Buckets, NewRollupRecord(r))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
+
+// RollupResolutionFromString is the resolution named minute, hour, or day,
+// and for auto or none the finest with at most buckets from start to end
+func RollupResolutionFromString(name string, start, end time.Time, buckets int) (time.Duration, bool) {
+	switch name {
+	case "", "auto":
+		return Mp.RollupResolution(start, end, buckets), true
+	case "minute":
+		return time.Minute, true
+	case "hour":
+		return time.Hour, true
+	case "day":
+		return 24 * time.Hour, true
+	}
+	return 0, false
+}
+
+// RollupResolutionToString names a resolution of Mp.RollupResolutions
+func RollupResolutionToString(resolution time.Duration) string {
+	switch resolution {
+	case time.Minute:
+		return "minute"
+	case time.Hour:
+		return "hour"
+	}
+	return "day"
+}
+
+// ParseQueryTime reads RFC3339, "now", or a duration from now like "-6h",
+// returning def when raw is empty
+func ParseQueryTime(raw string, def, now time.Time) (time.Time, error) {
+	switch raw {
+	case "":
+		return def, nil
+	case "now":
+		return now, nil
+	}
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		return def, fmt.Errorf("%s is not RFC3339, now, or a duration", raw)
+	}
+	return now.Add(d), nil
+}
+
+// PulsePatternFromString is the pattern named by PulsePatternToString,
+// Custom for any other name
+func PulsePatternFromString(name string) Mt.PulsePattern {
+	for p := Mt.Iamb; p < Mt.Custom; p++ {
+		if PulsePatternToString(p) == name {
+			return p
+		}
+	}
+	return Mt.Custom
+}
+
+// SQLHandler runs a read-only SQL query on the SQLite archive:
+//
+//	GET /api/sql?q=SELECT endpoint, count(*) FROM pulses GROUP BY endpoint&rows=1000
+//	POST /api/sql with the query as the body
+//
+// Only one SELECT (or WITH) statement is run, on a connection that can't write,
+// for at most sqlTimeout. rows caps the rows returned, the result says when it was truncated.
+func (v *View) SQLHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ctx, span := otel.Tracer("monteverdi/api").Start(ctx, "SQLHandler")
+	defer span.End()
+
+	var q string
+	switch r.Method {
+	case http.MethodGet:
+		q = r.URL.Query().Get("q")
+	case http.MethodPost:
+		body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+		if err != nil {
+			span.RecordError(err)
+			http.Error(w, "error reading query", http.StatusBadRequest)
+			return
+		}
+		q = string(body)
+	default:
+		span.RecordError(fmt.Errorf("invalid method: %s", r.Method))
+		http.Error(w, "invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	v.MU.Lock()
+	output := v.QNet.Output
+	v.MU.Unlock()
+
+	archive, ok := output.(Mp.SQLQuerier)
+	if !ok {
+		span.RecordError(fmt.Errorf("no SQL archive configured"))
+		http.Error(w, "no SQL archive configured", http.StatusNotFound)
+		return
+	}
+
+	if strings.TrimSpace(q) == "" {
+		span.RecordError(fmt.Errorf("no query"))
+		http.Error(w, "no query", http.StatusBadRequest)
+		return
+	}
+
+	rows := defaultSQLRows
+	if raw := r.URL.Query().Get("rows"); raw != "" {
+		var err error
+		if rows, err = strconv.Atoi(raw); err != nil || rows < 1 || rows > maxSQLRows {
+			span.RecordError(fmt.Errorf("invalid rows: %s", raw))
+			http.Error(w, fmt.Sprintf("invalid rows: %s, from 1 to %d", raw, maxSQLRows), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, sqlTimeout)
+	defer cancel()
+
+	result, err := archive.QuerySQL(ctx, q, rows)
+	if err != nil {
+		span.RecordError(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
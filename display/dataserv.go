@@ -5,12 +5,14 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	Mp "github.com/maroda/monteverdi/plugin"
 	Ms "github.com/maroda/monteverdi/server"
+	Mt "github.com/maroda/monteverdi/types"
 	"go.opentelemetry.io/otel"
 )
 
@@ -19,6 +21,7 @@ import (
 // - Websocket specialized for D3.js UI
 // - Version for programmatic use
 // - Metrics Data for UI feedback
+// - Pulses from the archive, their export, and their replay
 func (v *View) SetupMux() *mux.Router {
 	r := mux.NewRouter()
 
@@ -27,6 +30,12 @@ func (v *View) SetupMux() *mux.Router {
 	r.HandleFunc("/ws", v.WebsocketHandler)
 	r.HandleFunc("/api/version", v.VersionHandler)
 	r.HandleFunc("/api/metrics-data", v.MetricsDataHandler)
+	r.HandleFunc("/api/period-preview", v.PeriodPreviewHandler)
+	r.HandleFunc("/api/pulses", v.PulsesHandler)
+	r.HandleFunc("/api/rollups", v.RollupsHandler)
+	r.HandleFunc("/api/export", v.ExportHandler)
+	r.HandleFunc("/api/sql", v.SQLHandler)
+	r.PathPrefix("/api/replay").HandlerFunc(v.ReplayHandler)
 
 	// Plugin controls
 	r.PathPrefix("/api/plugin").HandlerFunc(v.PluginControlHandler)
@@ -71,20 +80,23 @@ func (v *View) MetricsDataHandler(w http.ResponseWriter, r *http.Request) {
 		ep.MU.RLock()
 		for _, metricName := range ep.Metric {
 			currentVal := ep.Mdata[metricName]
-			maxVal := ep.Maxval[metricName]
-			isAccent := currentVal >= maxVal
-			percentUsed := 0.0
-			if maxVal > 0 {
-				percentUsed = Ms.FloatPrecise((float64(currentVal)/float64(maxVal))*100, 2)
+			th := ep.Threshold(metricName)
+
+			// The poll goroutine keeps learning after the lock is released
+			var adaptive *AdaptiveData
+			if a, ok := ep.Adaptive[metricName]; ok {
+				adaptive = &AdaptiveData{Config: a.Config, Seen: a.Seen, Ready: a.Ready}
 			}
 
 			allMetrics = append(allMetrics, MetricData{
 				Endpoint:    ep.ID,
 				Metric:      metricName,
 				CurrentVal:  currentVal,
-				MaxVal:      maxVal,
-				IsAccent:    isAccent,
-				PercentUsed: percentUsed,
+				MaxVal:      ep.Maxval[metricName],
+				IsAccent:    ep.InAccent(metricName),
+				PercentUsed: th.Percent(currentVal),
+				Threshold:   th,
+				Adaptive:    adaptive,
 			})
 		}
 		ep.MU.RUnlock()
@@ -113,6 +125,80 @@ func (v *View) MetricsDataHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// PeriodPreviewHandler shows how proposed D1 period ratios would move a metric's recent pulses:
+//
+//	/api/period-preview?endpoint=DB&metric=latency&iamb_start=0.25&trochee_end=0.75
+//
+// Ratios that aren't given keep the metric's current value.
+func (v *View) PeriodPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ctx, span := otel.Tracer("monteverdi/api").Start(ctx, "PeriodPreviewHandler")
+	defer span.End()
+
+	query := r.URL.Query()
+	endpointID := query.Get("endpoint")
+	metric := query.Get("metric")
+
+	// Each ratio is optional
+	var pc Ms.PeriodConfig
+	ratios := map[string]**float64{
+		"iamb_start":    &pc.IambStart,
+		"iamb_end":      &pc.IambEnd,
+		"trochee_start": &pc.TrocheeStart,
+		"trochee_end":   &pc.TrocheeEnd,
+	}
+	for name, dest := range ratios {
+		raw := query.Get(name)
+		if raw == "" {
+			continue
+		}
+		ratio, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			span.RecordError(err)
+			http.Error(w, fmt.Sprintf("invalid %s: %s", name, raw), http.StatusBadRequest)
+			return
+		}
+		*dest = &ratio
+	}
+
+	v.QNet.MU.RLock()
+	defer v.QNet.MU.RUnlock()
+
+	for _, ep := range v.QNet.Network {
+		if ep.ID != endpointID {
+			continue
+		}
+
+		ep.MU.RLock()
+		defer ep.MU.RUnlock()
+
+		if _, ok := ep.Sequence[metric]; !ok {
+			break
+		}
+
+		current := ep.PulseConfig(metric)
+		proposed, err := pc.Apply(current)
+		if err != nil {
+			span.RecordError(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(PeriodPreviewData{
+			Endpoint: ep.ID,
+			Metric:   metric,
+			Current:  current,
+			Proposed: proposed,
+			Pulses:   ep.PreviewPeriods(metric, proposed),
+		})
+		return
+	}
+
+	span.RecordError(fmt.Errorf("unknown metric: %s %s", endpointID, metric))
+	http.Error(w, "unknown endpoint or metric", http.StatusNotFound)
+}
+
 func (v *View) PluginControlHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	ctx, span := otel.Tracer("monteverdi/api").Start(ctx, "PluginControlHandler")
@@ -194,12 +280,29 @@ func (v *View) PluginControlHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 type MetricData struct {
-	Endpoint    string  `json:"endpoint"`
-	Metric      string  `json:"metric"`
-	CurrentVal  int64   `json:"currentVal"`
-	MaxVal      int64   `json:"maxVal"`
-	IsAccent    bool    `json:"isAccent"`
-	PercentUsed float64 `json:"percentUsed"`
+	Endpoint    string        `json:"endpoint"`
+	Metric      string        `json:"metric"`
+	CurrentVal  int64         `json:"currentVal"`
+	MaxVal      int64         `json:"maxVal"`
+	IsAccent    bool          `json:"isAccent"`
+	PercentUsed float64       `json:"percentUsed"`        // 100 is on the accent threshold
+	Threshold   *Ms.Threshold `json:"threshold"`          // effective threshold, learned when adaptive
+	Adaptive    *AdaptiveData `json:"adaptive,omitempty"` // learning progress
+}
+
+// AdaptiveData is a snapshot of an adaptive threshold's learning progress
+type AdaptiveData struct {
+	Config Ms.AdaptiveConfig `json:"config"`
+	Seen   int               `json:"seen"`  // values observed
+	Ready  bool              `json:"ready"` // warmup is over
+}
+
+type PeriodPreviewData struct {
+	Endpoint string             `json:"endpoint"`
+	Metric   string             `json:"metric"`
+	Current  Mt.PulseConfig     `json:"current"`  // ratios in use
+	Proposed Mt.PulseConfig     `json:"proposed"` // ratios being previewed
+	Pulses   []Ms.PeriodPreview `json:"pulses"`   // recent D1 pulses under both
 }
 
 type SystemInfo struct {
@@ -4,12 +4,18 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	Md "github.com/maroda/monteverdi/display"
 	Mo "github.com/maroda/monteverdi/obvy"
+	Mp "github.com/maroda/monteverdi/plugin"
 	Ms "github.com/maroda/monteverdi/server"
+	Mt "github.com/maroda/monteverdi/types"
 )
 
 func TestView_SetupMux(t *testing.T) {
@@ -81,6 +87,430 @@ func TestView_MetricsDataHandler(t *testing.T) {
 		view.MetricsDataHandler(w, r)
 		assertStatus(t, w.Code, http.StatusOK)
 	})
+
+	t.Run("Honours min thresholds", func(t *testing.T) {
+		min := int64(512)
+		eps := Ms.NewEndpointsFromConfig([]Ms.ConfigFile{{
+			ID:      "MEM",
+			URL:     "http://localhost:8090/metrics",
+			Delim:   "=",
+			Metrics: map[string]Ms.MetricConfig{"MEMFREE": {Type: "gauge", Min: &min}},
+		}})
+		qn := Ms.NewQNet(*eps)
+		qn.IngestMetric(0, "MEMFREE", 256, time.Now())
+		view := &Md.View{QNet: qn, Stats: Mo.NewStatsInternal()}
+
+		r := httptest.NewRequest("GET", "/api/metrics-data", nil)
+		w := httptest.NewRecorder()
+		view.MetricsDataHandler(w, r)
+		assertStatus(t, w.Code, http.StatusOK)
+
+		var got struct {
+			Metrics []Md.MetricData `json:"metrics"`
+		}
+		err := json.Unmarshal(w.Body.Bytes(), &got)
+		assertError(t, err, nil)
+
+		metric := got.Metrics[0]
+		if !metric.IsAccent || metric.PercentUsed != 200 || metric.Threshold.Mode != Ms.ThresholdBelow {
+			t.Errorf("Expected a below accent at 200%%, got %+v", metric)
+		}
+	})
+
+	t.Run("Exposes the learned threshold", func(t *testing.T) {
+		eps := Ms.NewEndpointsFromConfig([]Ms.ConfigFile{{
+			ID:    "LEARN",
+			URL:   "http://localhost:8090/metrics",
+			Delim: "=",
+			Metrics: map[string]Ms.MetricConfig{
+				"LATENCY": {Type: "gauge", Adaptive: &Ms.AdaptiveConfig{Method: Ms.AdaptivePercentile, Window: 10}},
+			},
+		}})
+		qn := Ms.NewQNet(*eps)
+		view := &Md.View{QNet: qn, Stats: Mo.NewStatsInternal()}
+
+		getMetric := func() map[string]interface{} {
+			r := httptest.NewRequest("GET", "/api/metrics-data", nil)
+			w := httptest.NewRecorder()
+			view.MetricsDataHandler(w, r)
+			var got struct {
+				Metrics []map[string]interface{} `json:"metrics"`
+			}
+			err := json.Unmarshal(w.Body.Bytes(), &got)
+			assertError(t, err, nil)
+			return got.Metrics[0]
+		}
+
+		qn.IngestMetric(0, "LATENCY", 100, time.Now())
+		metric := getMetric()
+		if metric["threshold"].(map[string]interface{})["mode"] != Ms.ThresholdWarmup {
+			t.Errorf("Expected warmup, got %v", metric["threshold"])
+		}
+		if metric["adaptive"].(map[string]interface{})["seen"] != 1.0 {
+			t.Errorf("Expected one value seen, got %v", metric["adaptive"])
+		}
+
+		for i := 0; i < 10; i++ {
+			qn.IngestMetric(0, "LATENCY", 100, time.Now())
+		}
+		threshold := getMetric()["threshold"].(map[string]interface{})
+		if threshold["mode"] != Ms.ThresholdAbove || threshold["enter"] != 101.0 {
+			t.Errorf("Expected a learned threshold of 101, got %v", threshold)
+		}
+	})
+}
+
+func TestView_PeriodPreviewHandler(t *testing.T) {
+	start := time.Date(2023, 10, 1, 14, 0, 0, 0, time.UTC)
+	eps := Ms.NewEndpointsFromConfig([]Ms.ConfigFile{{
+		ID:      "DB",
+		URL:     "http://localhost:8090/db",
+		Delim:   "=",
+		Metrics: map[string]Ms.MetricConfig{"latency": {Type: "gauge", Max: 100}},
+	}})
+	qn := Ms.NewQNet(*eps)
+	clock := Ms.NewManualClock(start)
+	qn.SetClock(clock)
+	for i := 0; i < 12; i++ {
+		var value int64
+		if i%2 == 1 {
+			value = 150
+		}
+		qn.IngestMetric(0, "latency", value, clock.Now())
+		clock.Advance(5 * time.Second)
+	}
+	view := &Md.View{QNet: qn, Stats: Mo.NewStatsInternal()}
+
+	t.Run("Previews the proposed ratios", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/api/period-preview?endpoint=DB&metric=latency&iamb_start=0", nil)
+		w := httptest.NewRecorder()
+		view.PeriodPreviewHandler(w, r)
+		assertStatus(t, w.Code, http.StatusOK)
+
+		var got Md.PeriodPreviewData
+		if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if got.Current.IambStartPeriod != 0.5 || got.Proposed.IambStartPeriod != 0 || got.Proposed.IambEndPeriod != 0.5 {
+			t.Errorf("Expected only iamb_start to change, got %+v -> %+v", got.Current, got.Proposed)
+		}
+		if len(got.Pulses) == 0 {
+			t.Fatal("Expected recent pulses")
+		}
+		for _, p := range got.Pulses {
+			if p.Pattern == "iamb" && p.Start.Sub(p.NewStart) != 2500*time.Millisecond {
+				t.Errorf("Expected the Iamb to start 2.5s earlier, got %v", p.Start.Sub(p.NewStart))
+			}
+		}
+	})
+
+	t.Run("Rejects invalid ratios", func(t *testing.T) {
+		for _, query := range []string{"iamb_end=2", "trochee_start=half"} {
+			r := httptest.NewRequest("GET", "/api/period-preview?endpoint=DB&metric=latency&"+query, nil)
+			w := httptest.NewRecorder()
+			view.PeriodPreviewHandler(w, r)
+			assertStatus(t, w.Code, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("Errors on unknown metrics", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/api/period-preview?endpoint=DB&metric=craquemattic", nil)
+		w := httptest.NewRecorder()
+		view.PeriodPreviewHandler(w, r)
+		assertStatus(t, w.Code, http.StatusNotFound)
+	})
+}
+
+func TestView_PulsesHandler(t *testing.T) {
+	end := time.Now().Truncate(time.Second)
+	start := end.Add(-30 * time.Minute)
+	output, err := Mp.NewBadgerOutput(t.TempDir(), 1)
+	assertError(t, err, nil)
+	defer output.Close()
+
+	// 12 pulses a minute apart, alternating endpoints and patterns
+	for i := 0; i < 12; i++ {
+		p := &Mt.PulseEvent{
+			Dimension: 1,
+			Endpoint:  "DB",
+			Metric:    []string{"latency"},
+			Pattern:   Mt.Iamb,
+			StartTime: start.Add(time.Duration(i) * time.Minute),
+			Duration:  5 * time.Second,
+		}
+		if i%2 == 1 {
+			p.Endpoint, p.Pattern = "API", Mt.Trochee
+		}
+		assertError(t, output.WritePulse(p), nil)
+	}
+
+	view := &Md.View{QNet: Ms.NewQNet(Ms.Endpoints{}), Stats: Mo.NewStatsInternal()}
+	view.QNet.Output = output
+
+	get := func(t *testing.T, query string) (int, Md.PulsesData) {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/api/pulses?"+query, nil)
+		w := httptest.NewRecorder()
+		view.PulsesHandler(w, r)
+
+		var data Md.PulsesData
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&data); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+		}
+		return w.Code, data
+	}
+
+	t.Run("Returns the last hour by default", func(t *testing.T) {
+		code, data := get(t, "")
+		assertStatus(t, code, http.StatusOK)
+		assertInt(t, len(data.Pulses), 12)
+		assertString(t, data.Pulses[0].Pattern, "iamb")
+		assertString(t, data.Pulses[0].Endpoint, "DB")
+		assertInt64(t, data.Pulses[0].Duration, int64(5*time.Second))
+		assertString(t, data.Next, "")
+	})
+
+	t.Run("Filters the pulses", func(t *testing.T) {
+		tests := []struct {
+			name  string
+			query string
+			count int
+		}{
+			{"By endpoint", "endpoint=API", 6},
+			{"By pattern", "pattern=trochee", 6},
+			{"By metric", "metric=latency", 12},
+			{"By unknown metric", "metric=craquemattic", 0},
+			{"By dimension", "dimension=2", 0},
+			{"By relative start", "start=-" + time.Since(start.Add(5*time.Minute+30*time.Second)).String(), 6},
+			{"By RFC3339 range", "start=" + start.Format(time.RFC3339) + "&end=" + start.Add(3*time.Minute).Format(time.RFC3339), 3},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				code, data := get(t, tt.query)
+				assertStatus(t, code, http.StatusOK)
+				assertInt(t, len(data.Pulses), tt.count)
+			})
+		}
+	})
+
+	t.Run("Pages with the cursor", func(t *testing.T) {
+		var seen []time.Time
+		query := "limit=5"
+		for pages := 0; pages < 5; pages++ {
+			code, data := get(t, query)
+			assertStatus(t, code, http.StatusOK)
+			for _, p := range data.Pulses {
+				seen = append(seen, p.StartTime)
+			}
+			if data.Next == "" {
+				break
+			}
+			query = "limit=5&cursor=" + data.Next
+		}
+		assertInt(t, len(seen), 12)
+		for i := 1; i < len(seen); i++ {
+			if !seen[i].After(seen[i-1]) {
+				t.Errorf("Expected pulses in order without repeats, got %v after %v", seen[i], seen[i-1])
+			}
+		}
+	})
+
+	t.Run("Rejects invalid parameters", func(t *testing.T) {
+		for _, query := range []string{"start=yesterday", "start=now&end=-1h", "dimension=0", "limit=5000", "cursor=zz"} {
+			code, _ := get(t, query)
+			assertStatus(t, code, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("Rejects other methods", func(t *testing.T) {
+		r := httptest.NewRequest("POST", "/api/pulses", nil)
+		w := httptest.NewRecorder()
+		view.PulsesHandler(w, r)
+		assertStatus(t, w.Code, http.StatusMethodNotAllowed)
+	})
+
+	t.Run("Errors without an archive", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/api/pulses", nil)
+		w := httptest.NewRecorder()
+		makeTestView(t).PulsesHandler(w, r)
+		assertStatus(t, w.Code, http.StatusNotFound)
+	})
+}
+
+func TestView_RollupsHandler(t *testing.T) {
+	start := time.Now().Add(-48 * time.Hour).Truncate(24 * time.Hour)
+	archive := makeReplayArchive(t, start, 12, 4*time.Hour)
+	_, err := archive.RunRollups()
+	assertError(t, err, nil)
+
+	view := &Md.View{QNet: Ms.NewQNet(Ms.Endpoints{}), Stats: Mo.NewStatsInternal()}
+	view.QNet.Output = archive
+
+	get := func(t *testing.T, query string) (int, Md.RollupsData) {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/api/rollups?"+query, nil)
+		w := httptest.NewRecorder()
+		view.RollupsHandler(w, r)
+
+		var data Md.RollupsData
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&data); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+		}
+		return w.Code, data
+	}
+	from := "start=" + start.Format(time.RFC3339)
+
+	t.Run("Chooses the resolution for the range", func(t *testing.T) {
+		code, data := get(t, from)
+		assertStatus(t, code, http.StatusOK)
+		assertString(t, data.Resolution, "hour")
+		assertInt(t, len(data.Buckets), 12)
+
+		code, data = get(t, from+"&buckets=10")
+		assertStatus(t, code, http.StatusOK)
+		assertString(t, data.Resolution, "day")
+		assertInt(t, len(data.Buckets), 2)
+		assertInt(t, data.Buckets[0].Count, 6)
+		assertInt(t, data.Buckets[0].Patterns["iamb"], 6)
+		assertInt(t, data.Buckets[0].Endpoints["DB"], 6)
+		if data.Buckets[0].MeanDuration != (5 * time.Second).Nanoseconds() {
+			t.Errorf("Expected a mean of 5s, got %d", data.Buckets[0].MeanDuration)
+		}
+	})
+
+	t.Run("Uses the resolution asked for", func(t *testing.T) {
+		code, data := get(t, from+"&resolution=minute")
+		assertStatus(t, code, http.StatusOK)
+		assertString(t, data.Resolution, "minute")
+		assertInt(t, len(data.Buckets), 12)
+	})
+
+	t.Run("Rejects invalid queries", func(t *testing.T) {
+		for _, query := range []string{"resolution=week", "buckets=0", "start=yesterday", "start=now&end=-1h"} {
+			code, _ := get(t, query)
+			assertStatus(t, code, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("Errors without an archive", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		makeTestView(t).RollupsHandler(w, httptest.NewRequest("GET", "/api/rollups", nil))
+		assertStatus(t, w.Code, http.StatusNotFound)
+	})
+}
+
+func TestView_SQLHandler(t *testing.T) {
+	output, err := Md.OpenArchive(filepath.Join(t.TempDir(), "pulses.sqlite"), nil)
+	assertError(t, err, nil)
+	t.Cleanup(func() { output.Close() })
+	archive, ok := output.(*Mp.SQLiteOutput)
+	if !ok {
+		t.Fatalf("Expected a SQLite archive, got %s", output.Type())
+	}
+
+	start := time.Date(2023, 10, 1, 14, 0, 0, 0, time.UTC)
+	assertError(t, archive.WriteBatch([]*Mt.PulseEvent{
+		{Dimension: 1, Endpoint: "DB", Metric: []string{"latency"}, Pattern: Mt.Amphibrach, StartTime: start},
+		{Dimension: 1, Endpoint: "DB", Metric: []string{"latency"}, Pattern: Mt.Amphibrach, StartTime: start.Add(time.Minute)},
+		{Dimension: 1, Endpoint: "DB", Metric: []string{"latency"}, Pattern: Mt.Iamb, StartTime: start.Add(2 * time.Minute)},
+	}), nil)
+
+	view := &Md.View{QNet: Ms.NewQNet(Ms.Endpoints{}), Stats: Mo.NewStatsInternal()}
+	view.QNet.Output = archive
+
+	run := func(r *http.Request) (int, Mp.SQLResult) {
+		w := httptest.NewRecorder()
+		view.SQLHandler(w, r)
+
+		var result Mp.SQLResult
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+		}
+		return w.Code, result
+	}
+	get := func(query string) (int, Mp.SQLResult) {
+		return run(httptest.NewRequest("GET", "/api/sql?"+query, nil))
+	}
+
+	t.Run("Names patterns as the API does", func(t *testing.T) {
+		code, result := get("q=" + url.QueryEscape("SELECT pattern, count(*) AS n FROM pulses GROUP BY pattern ORDER BY pattern"))
+		assertStatus(t, code, http.StatusOK)
+		assertInt(t, len(result.Rows), 2)
+		assertString(t, result.Columns[1], "n")
+		assertString(t, result.Rows[0][0].(string), "amphibrach")
+		assertInt(t, int(result.Rows[0][1].(float64)), 2)
+	})
+
+	t.Run("Takes the query as a POST body", func(t *testing.T) {
+		code, result := run(httptest.NewRequest("POST", "/api/sql?rows=1", strings.NewReader("SELECT * FROM pulses")))
+		assertStatus(t, code, http.StatusOK)
+		assertInt(t, len(result.Rows), 1)
+		if !result.Truncated {
+			t.Error("Expected the result to be truncated")
+		}
+	})
+
+	t.Run("Rejects invalid queries", func(t *testing.T) {
+		for _, query := range []string{"", "q=", "q=DELETE+FROM+pulses", "q=SELECT+1&rows=0", "q=SELECT+*+FROM+nowhere"} {
+			code, _ := get(query)
+			assertStatus(t, code, http.StatusBadRequest)
+		}
+
+		w := httptest.NewRecorder()
+		view.SQLHandler(w, httptest.NewRequest("PUT", "/api/sql", nil))
+		assertStatus(t, w.Code, http.StatusMethodNotAllowed)
+	})
+
+	t.Run("Errors without a SQLite archive", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		makeTestView(t).SQLHandler(w, httptest.NewRequest("GET", "/api/sql?q=SELECT+1", nil))
+		assertStatus(t, w.Code, http.StatusNotFound)
+
+		view.QNet.Output = makeReplayArchive(t, start, 1, time.Second)
+		code, _ := get("q=SELECT+1")
+		assertStatus(t, code, http.StatusNotFound)
+	})
+}
+
+func TestIsSQLiteLocation(t *testing.T) {
+	for location, want := range map[string]bool{
+		"/var/lib/monteverdi/pulses.db":  true,
+		"pulses.SQLite":                  true,
+		"archive.sqlite3":                true,
+		"/var/lib/monteverdi/badger":     false,
+		"/var/lib/monteverdi.db/archive": false,
+	} {
+		if got := Md.IsSQLiteLocation(location); got != want {
+			t.Errorf("%s: got %v, want %v", location, got, want)
+		}
+	}
+}
+
+func TestParsePulseQuery(t *testing.T) {
+	now := time.Date(2023, 10, 1, 14, 0, 0, 0, time.UTC)
+
+	t.Run("Names custom patterns", func(t *testing.T) {
+		pq, err := Md.ParsePulseQuery(url.Values{"pattern": {"pyrrhic"}}, now)
+		assertError(t, err, nil)
+		if pq.Pattern == nil || *pq.Pattern != Mt.Custom {
+			t.Fatalf("Expected a custom pattern, got %v", pq.Pattern)
+		}
+		assertString(t, pq.Name, "pyrrhic")
+	})
+
+	t.Run("Reads times relative to now", func(t *testing.T) {
+		pq, err := Md.ParsePulseQuery(url.Values{"start": {"-6h"}, "end": {"-1h"}}, now)
+		assertError(t, err, nil)
+		if !pq.Start.Equal(now.Add(-6*time.Hour)) || !pq.End.Equal(now.Add(-time.Hour)) {
+			t.Errorf("Expected 08:00 to 13:00, got %v to %v", pq.Start, pq.End)
+		}
+	})
 }
 
 func TestView_PluginControlHandlerNoOutput(t *testing.T) {
@@ -144,3 +574,30 @@ func makeNewTestQNet(t *testing.T) *Ms.QNet {
 		Network: Ms.Endpoints{endpoint},
 	}
 }
+
+func TestNewRetentionFromEnv(t *testing.T) {
+	t.Run("Reads TTLs by dimension", func(t *testing.T) {
+		t.Setenv("MONTEVERDI_PLUGIN_BADGER_TTL_HOURS", "72, 2160")
+		t.Setenv("MONTEVERDI_PLUGIN_BADGER_MAX_MB", "10")
+		r := Md.NewRetentionFromEnv()
+		if len(r.TTL) != 2 || r.TTL[0] != 72*time.Hour || r.TTL[1] != 2160*time.Hour {
+			t.Errorf("Expected 72h and 2160h, got %v", r.TTL)
+		}
+		assertInt64(t, r.MaxBytes, 10<<20)
+		if r.Interval != 300*time.Second {
+			t.Errorf("Expected the default interval, got %v", r.Interval)
+		}
+	})
+
+	t.Run("Keeps forever on an invalid TTL", func(t *testing.T) {
+		t.Setenv("MONTEVERDI_PLUGIN_BADGER_TTL_HOURS", "72,3d")
+		t.Setenv("MONTEVERDI_PLUGIN_BADGER_GC_INTERVAL_SECONDS", "-1")
+		r := Md.NewRetentionFromEnv()
+		if r.TTL != nil {
+			t.Errorf("Expected no TTL, got %v", r.TTL)
+		}
+		if r.Interval != 300*time.Second {
+			t.Errorf("Expected the default interval, got %v", r.Interval)
+		}
+	})
+}
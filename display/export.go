@@ -0,0 +1,270 @@
+package monteverdi
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	Mp "github.com/maroda/monteverdi/plugin"
+	Mt "github.com/maroda/monteverdi/types"
+	"github.com/parquet-go/parquet-go"
+	"go.opentelemetry.io/otel"
+)
+
+const (
+	exportPage     = 1000     // pulses read from the archive at a time
+	exportRowGroup = 10000    // pulses buffered in a Parquet row group
+	exportFlush    = 64 << 10 // bytes written to the client between flushes
+)
+
+// ExportFormats are the formats pulses can be exported in, by content type
+var ExportFormats = map[string]string{
+	"csv":     "text/csv",
+	"ndjson":  "application/x-ndjson",
+	"parquet": "application/vnd.apache.parquet",
+}
+
+// PulseWriter writes archived pulses to a stream in one of ExportFormats
+type PulseWriter interface {
+	Write(p *Mt.PulseEvent) error
+	Flush() error // sends what's buffered, a Parquet row group is only sent when full
+	Close() error // finishes the stream, leaving the underlying writer open
+}
+
+// NewPulseWriter returns a PulseWriter of the format writing to w
+func NewPulseWriter(format string, w io.Writer) (PulseWriter, error) {
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		if err := cw.Write(csvHeader); err != nil {
+			return nil, fmt.Errorf("csv header error: %w", err)
+		}
+		return &csvPulseWriter{cw: cw}, nil
+	case "ndjson":
+		return &ndjsonPulseWriter{enc: json.NewEncoder(w)}, nil
+	case "parquet":
+		return &parquetPulseWriter{pw: parquet.NewGenericWriter[ParquetPulse](w,
+			parquet.Compression(&parquet.Zstd),
+			parquet.MaxRowsPerRowGroup(exportRowGroup))}, nil
+	}
+	return nil, fmt.Errorf("invalid export format %q, one of csv, ndjson, parquet", format)
+}
+
+// ExportPulses writes the pulses of the query to pw in time order,
+// reading the archive a page at a time and flushing after each.
+// The query's Limit and cursor are ignored. Returns how many were written.
+func ExportPulses(archive Mp.PulseQuerier, pq Mp.PulseQuery, pw PulseWriter) (int, error) {
+	pq.Limit = exportPage
+	pq.After = nil
+
+	written := 0
+	for {
+		page, err := archive.Query(pq)
+		if err != nil {
+			return written, fmt.Errorf("export query error: %w", err)
+		}
+		for _, p := range page.Pulses {
+			if err := pw.Write(p); err != nil {
+				return written, fmt.Errorf("export write error: %w", err)
+			}
+			written++
+		}
+		if err := pw.Flush(); err != nil {
+			return written, fmt.Errorf("export flush error: %w", err)
+		}
+		if page.Next == nil {
+			break
+		}
+		pq.After = page.Next
+	}
+
+	return written, pw.Close()
+}
+
+// ExportHandler streams archived pulses as a file:
+//
+//	GET /api/export?format=csv&start=-24h&end=now&metric=latency
+//
+// format is csv, ndjson, or parquet, the rest are the filters of PulsesHandler.
+// The whole range is written, no more than a page of it in memory at once.
+func (v *View) ExportHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ctx, span := otel.Tracer("monteverdi/api").Start(ctx, "ExportHandler")
+	defer span.End()
+
+	if r.Method != http.MethodGet {
+		span.RecordError(fmt.Errorf("invalid method: %s", r.Method))
+		http.Error(w, "invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	v.MU.Lock()
+	output := v.QNet.Output
+	v.MU.Unlock()
+
+	archive, ok := output.(Mp.PulseQuerier)
+	if !ok {
+		span.RecordError(fmt.Errorf("no pulse archive configured"))
+		http.Error(w, "no pulse archive configured", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = "ndjson"
+	}
+	contentType, ok := ExportFormats[format]
+	if !ok {
+		span.RecordError(fmt.Errorf("invalid format: %s", format))
+		http.Error(w, "invalid format, one of csv, ndjson, parquet", http.StatusBadRequest)
+		return
+	}
+
+	query.Del("limit")
+	pq, err := ParsePulseQuery(query, time.Now())
+	if err != nil {
+		span.RecordError(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", ExportFileName(pq, format)))
+
+	pw, err := NewPulseWriter(format, &flushWriter{w: w})
+	if err != nil {
+		span.RecordError(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Once streaming the status is sent, errors can only cut the file short
+	written, err := ExportPulses(archive, pq, pw)
+	if err != nil {
+		span.RecordError(err)
+		slog.Error("Export failed", slog.Int("written", written), slog.Any("error", err))
+		return
+	}
+	slog.Info("Exported pulses", slog.String("format", format), slog.Int("count", written))
+}
+
+// ExportFileName names the export of a query, e.g. pulses-20231001T140000Z-20231001T150000Z.csv
+func ExportFileName(pq Mp.PulseQuery, format string) string {
+	const stamp = "20060102T150405Z"
+	return fmt.Sprintf("pulses-%s-%s.%s", pq.Start.UTC().Format(stamp), pq.End.UTC().Format(stamp), format)
+}
+
+// flushWriter sends the response to the client every exportFlush bytes
+type flushWriter struct {
+	w       http.ResponseWriter
+	pending int
+}
+
+func (fw *flushWriter) Write(b []byte) (int, error) {
+	n, err := fw.w.Write(b)
+	fw.pending += n
+	if f, ok := fw.w.(http.Flusher); ok && fw.pending >= exportFlush {
+		f.Flush()
+		fw.pending = 0
+	}
+	return n, err
+}
+
+/*
+
+	Formats
+
+	Each row is a pulse with the fields of PulseRecord: the endpoint, metrics,
+	pattern name, dimension, start, duration, parent, and children.
+	In CSV the metrics and children are joined by semicolons,
+	times are RFC3339 with nanoseconds, and durations are nanoseconds.
+
+*/
+
+var csvHeader = []string{"endpoint", "metric", "pattern", "custom", "dimension", "start", "duration", "parent", "children"}
+
+type csvPulseWriter struct {
+	cw *csv.Writer
+}
+
+func (c *csvPulseWriter) Write(p *Mt.PulseEvent) error {
+	pr := NewPulseRecord(p)
+	var parent string
+	if pr.Parent != nil {
+		parent = pr.Parent.Format(time.RFC3339Nano)
+	}
+	children := make([]string, 0, len(pr.Children))
+	for _, c := range pr.Children {
+		children = append(children, c.Format(time.RFC3339Nano))
+	}
+
+	return c.cw.Write([]string{
+		pr.Endpoint,
+		strings.Join(pr.Metric, ";"),
+		pr.Pattern,
+		strconv.FormatBool(pr.Custom),
+		strconv.Itoa(pr.Dimension),
+		pr.StartTime.Format(time.RFC3339Nano),
+		strconv.FormatInt(pr.Duration, 10),
+		parent,
+		strings.Join(children, ";"),
+	})
+}
+
+func (c *csvPulseWriter) Flush() error {
+	c.cw.Flush()
+	return c.cw.Error()
+}
+
+func (c *csvPulseWriter) Close() error { return c.Flush() }
+
+type ndjsonPulseWriter struct {
+	enc *json.Encoder
+}
+
+func (n *ndjsonPulseWriter) Write(p *Mt.PulseEvent) error { return n.enc.Encode(NewPulseRecord(p)) }
+func (n *ndjsonPulseWriter) Flush() error                 { return nil }
+func (n *ndjsonPulseWriter) Close() error                 { return nil }
+
+// ParquetPulse is the Parquet row of a pulse
+type ParquetPulse struct {
+	Endpoint  string      `parquet:"endpoint,dict"`
+	Metric    []string    `parquet:"metric,list"`
+	Pattern   string      `parquet:"pattern,dict"`
+	Custom    bool        `parquet:"custom"`
+	Dimension int32       `parquet:"dimension"`
+	StartTime time.Time   `parquet:"start,timestamp(nanosecond)"`
+	Duration  int64       `parquet:"duration"` // nanoseconds
+	Parent    *time.Time  `parquet:"parent,optional,timestamp(nanosecond)"`
+	Children  []time.Time `parquet:"children,list" parquet-element:",timestamp(nanosecond)"`
+}
+
+type parquetPulseWriter struct {
+	pw *parquet.GenericWriter[ParquetPulse]
+}
+
+func (pp *parquetPulseWriter) Write(p *Mt.PulseEvent) error {
+	pr := NewPulseRecord(p)
+	_, err := pp.pw.Write([]ParquetPulse{{
+		Endpoint:  pr.Endpoint,
+		Metric:    pr.Metric,
+		Pattern:   pr.Pattern,
+		Custom:    pr.Custom,
+		Dimension: int32(pr.Dimension),
+		StartTime: pr.StartTime,
+		Duration:  pr.Duration,
+		Parent:    pr.Parent,
+		Children:  pr.Children,
+	}})
+	return err
+}
+
+func (pp *parquetPulseWriter) Flush() error { return nil }
+func (pp *parquetPulseWriter) Close() error { return pp.pw.Close() }
@@ -0,0 +1,155 @@
+package monteverdi_test
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	Md "github.com/maroda/monteverdi/display"
+	Mo "github.com/maroda/monteverdi/obvy"
+	Mp "github.com/maroda/monteverdi/plugin"
+	Ms "github.com/maroda/monteverdi/server"
+	Mt "github.com/maroda/monteverdi/types"
+	"github.com/parquet-go/parquet-go"
+)
+
+func TestExportPulses(t *testing.T) {
+	start := time.Date(2023, 10, 1, 14, 0, 0, 0, time.UTC)
+	archive := makeReplayArchive(t, start, 2500, time.Second)
+	consort := &Mt.PulseEvent{
+		Dimension: 2,
+		Endpoint:  "DB",
+		Metric:    []string{"latency"},
+		Pattern:   Mt.Custom,
+		Name:      "pyrrhic",
+		Parent:    start.Add(-time.Hour),
+		Children:  []time.Time{start.Add(time.Hour), start.Add(time.Hour + time.Second)},
+		StartTime: start.Add(time.Hour),
+		Duration:  2 * time.Second,
+	}
+	assertError(t, archive.WriteBatch([]*Mt.PulseEvent{consort}), nil)
+
+	export := func(t *testing.T, format string, pq Mp.PulseQuery) *bytes.Buffer {
+		t.Helper()
+		var buf bytes.Buffer
+		pw, err := Md.NewPulseWriter(format, &buf)
+		assertError(t, err, nil)
+		_, err = Md.ExportPulses(archive, pq, pw)
+		assertError(t, err, nil)
+		return &buf
+	}
+
+	t.Run("Writes every page of the range", func(t *testing.T) {
+		var buf bytes.Buffer
+		pw, err := Md.NewPulseWriter("ndjson", &buf)
+		assertError(t, err, nil)
+		written, err := Md.ExportPulses(archive, Mp.PulseQuery{Limit: 10}, pw)
+		assertError(t, err, nil)
+		assertInt(t, written, 2501)
+		assertInt(t, strings.Count(buf.String(), "\n"), 2501)
+	})
+
+	t.Run("Writes NDJSON records", func(t *testing.T) {
+		buf := export(t, "ndjson", Mp.PulseQuery{Dimension: 2})
+		var got Md.PulseRecord
+		assertError(t, json.Unmarshal(buf.Bytes(), &got), nil)
+		assertString(t, got.Pattern, "pyrrhic")
+		assertInt(t, len(got.Children), 2)
+		if got.Parent == nil || !got.Parent.Equal(consort.Parent) {
+			t.Errorf("Expected the parent, got %v", got.Parent)
+		}
+	})
+
+	t.Run("Writes CSV with a header", func(t *testing.T) {
+		buf := export(t, "csv", Mp.PulseQuery{Start: start, End: start.Add(2 * time.Second)})
+		rows, err := csv.NewReader(buf).ReadAll()
+		assertError(t, err, nil)
+		assertInt(t, len(rows), 3)
+		assertString(t, rows[0][0], "endpoint")
+		assertString(t, rows[1][2], "iamb")
+		assertString(t, rows[1][5], start.Format(time.RFC3339Nano))
+		assertString(t, rows[1][6], "5000000000")
+
+		buf = export(t, "csv", Mp.PulseQuery{Dimension: 2})
+		rows, err = csv.NewReader(buf).ReadAll()
+		assertError(t, err, nil)
+		assertString(t, rows[1][8], start.Add(time.Hour).Format(time.RFC3339Nano)+";"+start.Add(time.Hour+time.Second).Format(time.RFC3339Nano))
+	})
+
+	t.Run("Writes Parquet", func(t *testing.T) {
+		buf := export(t, "parquet", Mp.PulseQuery{})
+		rows, err := parquet.Read[Md.ParquetPulse](bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		assertError(t, err, nil)
+		assertInt(t, len(rows), 2501)
+
+		got := rows[len(rows)-1]
+		assertString(t, got.Pattern, "pyrrhic")
+		assertInt(t, int(got.Dimension), 2)
+		if !got.StartTime.Equal(consort.StartTime) || got.Parent == nil || !got.Parent.Equal(consort.Parent) {
+			t.Errorf("Expected the consort's times, got %v %v", got.StartTime, got.Parent)
+		}
+		if len(got.Children) != 2 || !got.Children[1].Equal(consort.Children[1]) {
+			t.Errorf("Expected the consort's children, got %v", got.Children)
+		}
+		if rows[0].Parent != nil {
+			t.Errorf("Expected no parent for a D1 pulse, got %v", rows[0].Parent)
+		}
+	})
+
+	t.Run("Rejects other formats", func(t *testing.T) {
+		_, err := Md.NewPulseWriter("xlsx", &bytes.Buffer{})
+		assertGotError(t, err)
+	})
+}
+
+func TestView_ExportHandler(t *testing.T) {
+	end := time.Now().Truncate(time.Second)
+	start := end.Add(-30 * time.Minute)
+	view := &Md.View{QNet: Ms.NewQNet(Ms.Endpoints{}), Stats: Mo.NewStatsInternal()}
+	view.QNet.Output = makeReplayArchive(t, start, 12, time.Minute)
+
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		view.ExportHandler(w, httptest.NewRequest("GET", "/api/export?"+query, nil))
+		return w
+	}
+	from := "&start=" + start.Format(time.RFC3339)
+
+	t.Run("Streams the range as a file", func(t *testing.T) {
+		w := get("format=csv&limit=1" + from)
+		assertStatus(t, w.Code, http.StatusOK)
+		assertString(t, w.Header().Get("Content-Type"), "text/csv")
+		assertStringContains(t, w.Header().Get("Content-Disposition"), ".csv")
+
+		rows, err := csv.NewReader(w.Body).ReadAll()
+		assertError(t, err, nil)
+		assertInt(t, len(rows), 13)
+	})
+
+	t.Run("Defaults to NDJSON", func(t *testing.T) {
+		w := get("metric=latency" + from)
+		assertStatus(t, w.Code, http.StatusOK)
+		assertString(t, w.Header().Get("Content-Type"), "application/x-ndjson")
+		assertInt(t, strings.Count(w.Body.String(), "\n"), 12)
+	})
+
+	t.Run("Rejects invalid exports", func(t *testing.T) {
+		assertStatus(t, get("format=xlsx").Code, http.StatusBadRequest)
+		assertStatus(t, get("start=yesterday").Code, http.StatusBadRequest)
+
+		w := httptest.NewRecorder()
+		view.ExportHandler(w, httptest.NewRequest("POST", "/api/export", nil))
+		assertStatus(t, w.Code, http.StatusMethodNotAllowed)
+	})
+
+	t.Run("Errors without an archive", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		makeTestView(t).ExportHandler(w, httptest.NewRequest("GET", "/api/export", nil))
+		assertStatus(t, w.Code, http.StatusNotFound)
+	})
+}
@@ -13,6 +13,20 @@ import (
 )
 
 func InitMIDIOutput(view *View, outputLocation string) error {
+	output, err := NewMIDIOutputFromEnv()
+	if err != nil {
+		slog.Error("Failed to create adapter",
+			slog.String("output", outputLocation),
+			slog.Any("error", err))
+		return err
+	}
+	view.QNet.Output = output
+	slog.Info("MIDI Adapter Enabled", slog.String("output", outputLocation))
+	return nil
+}
+
+// NewMIDIOutputFromEnv opens the MIDI output configured by the MONTEVERDI_PLUGIN_MIDI_* variables
+func NewMIDIOutputFromEnv() (Mp.OutputAdapter, error) {
 	midiPort := Ms.FillEnvVarInt("MONTEVERDI_PLUGIN_MIDI_PORT", 0)
 	midiRoot := uint8(Ms.FillEnvVarInt("MONTEVERDI_PLUGIN_MIDI_ROOT", 60))
 	midiArpD := Ms.FillEnvVarInt("MONTEVERDI_PLUGIN_MIDI_ARP_DELAY", 300)
@@ -42,14 +56,9 @@ func InitMIDIOutput(view *View, outputLocation string) error {
 
 	output, err := Mp.NewMIDIOutput(midiPort, midiArpD, midiArpI, midiRoot, scaleI)
 	if err != nil {
-		slog.Error("Failed to create adapter",
-			slog.String("output", outputLocation),
-			slog.Any("error", err))
-		return err
+		return nil, err
 	}
-	view.QNet.Output = output
-	slog.Info("MIDI Adapter Enabled", slog.String("output", outputLocation))
-	return nil
+	return output, nil
 }
 
 func (v *View) getMIDISystemInfo(systemInfo *SystemInfo) {
@@ -5,9 +5,15 @@ package monteverdi
 import (
 	"fmt"
 	"log/slog"
+
+	Mp "github.com/maroda/monteverdi/plugin"
 )
 
 func InitMIDIOutput(view *View, outputLocation string) error {
 	slog.Warn("MIDI support not compiled in this build")
 	return fmt.Errorf("MIDI support not available")
 }
+
+func NewMIDIOutputFromEnv() (Mp.OutputAdapter, error) {
+	return nil, fmt.Errorf("MIDI support not available")
+}
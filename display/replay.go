@@ -0,0 +1,566 @@
+package monteverdi
+
+/*
+
+	Replay
+
+	Archived pulses are played back in their original relative timing.
+	The replay has its own Position in archive time, which moves Speed
+	times as fast as real time while it plays. Pulses are emitted as
+	Position passes their StartTime, and the Harmony View draws them
+	around Position the way it draws live pulses around now.
+
+	The archive is read a page at a time with key-range seeks,
+	so a long range never has to fit in memory.
+
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	Mp "github.com/maroda/monteverdi/plugin"
+	Mt "github.com/maroda/monteverdi/types"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	replayPageSize = 500                   // pulses read from the archive at a time
+	replayTick     = 50 * time.Millisecond // how often a playing replay moves
+	replayWindow   = 600 * time.Second     // pulses kept for the rings, as the TemporalGrouper does
+	maxReplaySpeed = 3600.0                // an hour a second
+)
+
+// Replay plays archived pulses back into the Harmony View, and the MIDI output when set
+type Replay struct {
+	MU       sync.Mutex
+	Archive  Mp.PulseQuerier  // where the pulses are read from
+	MIDI     Mp.OutputAdapter // also plays the pulses and is closed with the replay, nil for none
+	Start    time.Time        // beginning of the replayed range
+	End      time.Time        // end of the replayed range
+	Speed    float64          // archive time per real time
+	Loop     bool             // starts over at End
+	Position time.Time        // archive time being played
+	Playing  bool             // false when paused or finished
+	Played   []*Mt.PulseEvent // pulses of the last replayWindow before Position
+	pending  []*Mt.PulseEvent // read ahead of Position
+	cursor   []byte           // continues reading the archive, nil when it's all read
+	done     bool             // nothing left to read before End
+	stopChan chan struct{}    // stops the playing loop
+	wg       sync.WaitGroup   // waits for the playing loop
+}
+
+// ReplayStatus is what the API reports about a replay
+type ReplayStatus struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Position time.Time `json:"position"`
+	Speed    float64   `json:"speed"`
+	Loop     bool      `json:"loop"`
+	Playing  bool      `json:"playing"`
+	MIDI     bool      `json:"midi"`
+	Pulses   int       `json:"pulses"` // on the rings
+}
+
+// NewReplay is a paused replay of start to end, positioned at start
+func NewReplay(archive Mp.PulseQuerier, start, end time.Time, speed float64, loop bool) (*Replay, error) {
+	if !start.Before(end) {
+		return nil, fmt.Errorf("start %s is not before end %s", start.Format(time.RFC3339), end.Format(time.RFC3339))
+	}
+	if err := checkReplaySpeed(speed); err != nil {
+		return nil, err
+	}
+
+	r := &Replay{
+		Archive: archive,
+		Start:   start,
+		End:     end,
+		Speed:   speed,
+		Loop:    loop,
+	}
+	if err := r.seek(start); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Run plays in real time until Stop
+func (r *Replay) Run() {
+	r.MU.Lock()
+	defer r.MU.Unlock()
+	if r.stopChan != nil {
+		return
+	}
+
+	r.stopChan = make(chan struct{})
+	r.wg.Add(1)
+	go func(stop chan struct{}) {
+		defer r.wg.Done()
+		ticker := time.NewTicker(replayTick)
+		defer ticker.Stop()
+
+		last := time.Now()
+		for {
+			select {
+			case now := <-ticker.C:
+				if err := r.Advance(now.Sub(last)); err != nil {
+					slog.Error("Replay failed to read the archive, pausing", slog.Any("error", err))
+					r.Pause()
+				}
+				last = now
+			case <-stop:
+				return
+			}
+		}
+	}(r.stopChan)
+}
+
+// Stop ends the playing loop and closes the MIDI output
+func (r *Replay) Stop() {
+	r.MU.Lock()
+	stop := r.stopChan
+	r.stopChan = nil
+	r.Playing = false
+	r.MU.Unlock()
+
+	if stop != nil {
+		close(stop)
+		r.wg.Wait()
+	}
+
+	if r.MIDI != nil {
+		if err := r.MIDI.Close(); err != nil {
+			slog.Error("Replay failed to close MIDI output", slog.Any("error", err))
+		}
+	}
+}
+
+// Play continues from Position, from Start when the replay has finished
+func (r *Replay) Play() error {
+	r.MU.Lock()
+	defer r.MU.Unlock()
+
+	if !r.Position.Before(r.End) {
+		if err := r.seek(r.Start); err != nil {
+			return err
+		}
+	}
+	r.Playing = true
+	return nil
+}
+
+// Pause holds Position
+func (r *Replay) Pause() {
+	r.MU.Lock()
+	defer r.MU.Unlock()
+	r.Playing = false
+}
+
+// Seek moves Position to t, within Start and End
+func (r *Replay) Seek(t time.Time) error {
+	r.MU.Lock()
+	defer r.MU.Unlock()
+	return r.seek(t)
+}
+
+// SetSpeed changes how fast Position moves
+func (r *Replay) SetSpeed(speed float64) error {
+	if err := checkReplaySpeed(speed); err != nil {
+		return err
+	}
+
+	r.MU.Lock()
+	defer r.MU.Unlock()
+	r.Speed = speed
+	return nil
+}
+
+// Advance moves Position by elapsed real time and emits the pulses it passes
+func (r *Replay) Advance(elapsed time.Duration) error {
+	r.MU.Lock()
+	if !r.Playing {
+		r.MU.Unlock()
+		return nil
+	}
+
+	target := r.Position.Add(time.Duration(float64(elapsed) * r.Speed))
+	if target.After(r.End) {
+		target = r.End
+	}
+	emitted, err := r.emit(target)
+	if err != nil {
+		r.MU.Unlock()
+		return err
+	}
+	r.Position = target
+
+	if !r.Position.Before(r.End) {
+		if r.Loop {
+			err = r.seek(r.Start)
+		} else {
+			r.Playing = false
+			slog.Info("Replay finished", slog.Time("end", r.End))
+		}
+	}
+	midi, speed := r.MIDI, r.Speed
+	r.MU.Unlock()
+
+	if midi != nil {
+		playMIDI(midi, emitted, speed)
+	}
+	return err
+}
+
+// Status reports the replay
+func (r *Replay) Status() ReplayStatus {
+	r.MU.Lock()
+	defer r.MU.Unlock()
+
+	return ReplayStatus{
+		Start:    r.Start,
+		End:      r.End,
+		Position: r.Position,
+		Speed:    r.Speed,
+		Loop:     r.Loop,
+		Playing:  r.Playing,
+		MIDI:     r.MIDI != nil,
+		Pulses:   len(r.Played),
+	}
+}
+
+// PulseDataD3 draws the played pulses around Position
+func (r *Replay) PulseDataD3(v *View) []PulseDataD3 {
+	r.MU.Lock()
+	defer r.MU.Unlock()
+
+	pulses := make([]PulseDataD3, 0, len(r.Played))
+	for _, pulse := range r.Played {
+		for mi, metric := range pulse.Metric {
+			d3pulse := PulseDataD3{
+				Ring:      CalcRingAt(pulse.StartTime, r.Position),
+				Angle:     CalcAngleAt(pulse.StartTime, r.Position),
+				Type:      PulseName(*pulse),
+				Intensity: 0.5,
+				Speed:     v.CalcSpeedForPulse(*pulse, r.Position) * r.Speed,
+				Metric:    metric,
+				Dimension: pulse.Dimension,
+				StartTime: pulse.StartTime.UnixNano(),
+				Duration:  pulse.Duration.Nanoseconds(),
+				Endpoint:  pulse.Endpoint,
+				Custom:    pulse.Pattern == Mt.Custom,
+			}
+
+			// Cascades link metrics, as they are drawn live
+			if pulse.Pattern == Mt.Cascade {
+				d3pulse.Intensity = 1.0
+				d3pulse.Linked = pulse.Metric
+				if mi < len(pulse.Endpoints) {
+					d3pulse.Endpoint = pulse.Endpoints[mi]
+				}
+			}
+			pulses = append(pulses, d3pulse)
+		}
+	}
+	return pulses
+}
+
+// seek positions the replay at t with the pulses of the window before it.
+// NB: Caller must hold r.MU
+func (r *Replay) seek(t time.Time) error {
+	if t.Before(r.Start) {
+		t = r.Start
+	}
+	if t.After(r.End) {
+		t = r.End
+	}
+
+	from := t.Add(-replayWindow)
+	if from.Before(r.Start) {
+		from = r.Start
+	}
+
+	var played []*Mt.PulseEvent
+	if from.Before(t) {
+		page, err := r.Archive.Query(Mp.PulseQuery{Start: from, End: t})
+		if err != nil {
+			return fmt.Errorf("replay seek error: %w", err)
+		}
+		played = page.Pulses
+	}
+
+	r.Position = t
+	r.Played = played
+	r.pending = nil
+	r.cursor = nil
+	r.done = false
+	return nil
+}
+
+// emit moves pending pulses that start before target to Played,
+// reading the archive as it runs out, and drops what leaves the window.
+// NB: Caller must hold r.MU
+func (r *Replay) emit(target time.Time) ([]*Mt.PulseEvent, error) {
+	var emitted []*Mt.PulseEvent
+	for {
+		if len(r.pending) == 0 {
+			if r.done {
+				break
+			}
+			if err := r.read(); err != nil {
+				return emitted, err
+			}
+			continue
+		}
+
+		p := r.pending[0]
+		if !p.StartTime.Before(target) {
+			break
+		}
+		r.pending = r.pending[1:]
+		emitted = append(emitted, p)
+	}
+
+	r.Played = append(r.Played, emitted...)
+	cutoff := target.Add(-replayWindow)
+	trim := 0
+	for trim < len(r.Played) && r.Played[trim].StartTime.Before(cutoff) {
+		trim++
+	}
+	r.Played = r.Played[trim:]
+
+	return emitted, nil
+}
+
+// read fetches the next page of pulses from Position to End.
+// NB: Caller must hold r.MU
+func (r *Replay) read() error {
+	page, err := r.Archive.Query(Mp.PulseQuery{
+		Start: r.Position,
+		End:   r.End,
+		After: r.cursor,
+		Limit: replayPageSize,
+	})
+	if err != nil {
+		return fmt.Errorf("replay read error: %w", err)
+	}
+
+	r.pending = page.Pulses
+	r.cursor = page.Next
+	r.done = page.Next == nil
+	return nil
+}
+
+// playMIDI sends pulses to MIDI as if they happened now,
+// their durations shortened or lengthened by the speed of the replay
+func playMIDI(midi Mp.OutputAdapter, pulses []*Mt.PulseEvent, speed float64) {
+	now := time.Now()
+	for _, p := range pulses {
+		replayed := *p
+		replayed.StartTime = now
+		replayed.Duration = time.Duration(float64(p.Duration) / speed)
+		if err := midi.WritePulse(&replayed); err != nil {
+			slog.Error("Replay failed to play pulse on MIDI", slog.Any("error", err))
+		}
+	}
+}
+
+// checkReplaySpeed allows anything up to maxReplaySpeed above zero
+func checkReplaySpeed(speed float64) error {
+	if speed <= 0 || speed > maxReplaySpeed {
+		return fmt.Errorf("invalid speed: %v, above 0 up to %v", speed, maxReplaySpeed)
+	}
+	return nil
+}
+
+// ReplayHandler controls the replay of archived pulses into the Harmony View:
+//
+//	GET  /api/replay                     status of the replay
+//	POST /api/replay/start?start=-6h&end=now&speed=10&loop=true&midi=true
+//	POST /api/replay/pause
+//	POST /api/replay/play                continue, or start over when finished
+//	POST /api/replay/seek?to=30m         RFC3339, or a duration from the start
+//	POST /api/replay/speed?value=60
+//	POST /api/replay/stop                back to live pulses
+//
+// start and end are read as in PulsesHandler, speed defaults to 1.
+func (v *View) ReplayHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ctx, span := otel.Tracer("monteverdi/api").Start(ctx, "ReplayHandler")
+	defer span.End()
+
+	control := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/replay"), "/")
+	if r.Method == http.MethodGet && control == "" {
+		replay := v.replay()
+		if replay == nil {
+			http.Error(w, "no replay", http.StatusNotFound)
+			return
+		}
+		writeReplayStatus(w, replay)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		span.RecordError(fmt.Errorf("invalid method: %s", r.Method))
+		http.Error(w, "invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	if control == "start" {
+		v.startReplay(w, query.Get, span)
+		return
+	}
+
+	replay := v.replay()
+	if replay == nil {
+		span.RecordError(fmt.Errorf("no replay"))
+		http.Error(w, "no replay, POST /api/replay/start first", http.StatusNotFound)
+		return
+	}
+
+	switch control {
+	case "pause":
+		replay.Pause()
+	case "play":
+		if err := replay.Play(); err != nil {
+			span.RecordError(err)
+			http.Error(w, "error playing replay", http.StatusInternalServerError)
+			return
+		}
+	case "seek":
+		raw := query.Get("to")
+		to, err := ParseQueryTime(raw, replay.Start, replay.Start)
+		if raw == "" || err != nil {
+			span.RecordError(fmt.Errorf("invalid seek: %s", raw))
+			http.Error(w, fmt.Sprintf("invalid to: %s", raw), http.StatusBadRequest)
+			return
+		}
+		if err = replay.Seek(to); err != nil {
+			span.RecordError(err)
+			http.Error(w, "error seeking replay", http.StatusInternalServerError)
+			return
+		}
+	case "speed":
+		speed, err := strconv.ParseFloat(query.Get("value"), 64)
+		if err == nil {
+			err = replay.SetSpeed(speed)
+		}
+		if err != nil {
+			span.RecordError(err)
+			http.Error(w, fmt.Sprintf("invalid speed: %s", query.Get("value")), http.StatusBadRequest)
+			return
+		}
+	case "stop":
+		v.MU.Lock()
+		if v.Replay == replay {
+			v.Replay = nil
+		}
+		v.MU.Unlock()
+		replay.Stop()
+		slog.Info("Replay stopped")
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "REPLAY STOPPED"})
+		return
+	default:
+		span.RecordError(fmt.Errorf("invalid control: %s", control))
+		http.Error(w, "invalid control", http.StatusBadRequest)
+		return
+	}
+
+	writeReplayStatus(w, replay)
+}
+
+// startReplay replaces any replay with a new one, playing
+func (v *View) startReplay(w http.ResponseWriter, get func(string) string, span trace.Span) {
+	v.MU.Lock()
+	output := v.QNet.Output
+	v.MU.Unlock()
+
+	archive, ok := output.(Mp.PulseQuerier)
+	if !ok {
+		span.RecordError(fmt.Errorf("no pulse archive configured"))
+		http.Error(w, "no pulse archive configured", http.StatusNotFound)
+		return
+	}
+
+	now := time.Now()
+	end, err := ParseQueryTime(get("end"), now, now)
+	if err != nil {
+		span.RecordError(err)
+		http.Error(w, fmt.Sprintf("invalid end: %v", err), http.StatusBadRequest)
+		return
+	}
+	start, err := ParseQueryTime(get("start"), end.Add(-time.Hour), now)
+	if err != nil || !start.Before(end) {
+		span.RecordError(fmt.Errorf("invalid start: %s", get("start")))
+		http.Error(w, fmt.Sprintf("invalid start: %s, it must be before end", get("start")), http.StatusBadRequest)
+		return
+	}
+
+	speed := 1.0
+	if raw := get("speed"); raw != "" {
+		if speed, err = strconv.ParseFloat(raw, 64); err == nil {
+			err = checkReplaySpeed(speed)
+		}
+		if err != nil {
+			span.RecordError(err)
+			http.Error(w, fmt.Sprintf("invalid speed: %s", raw), http.StatusBadRequest)
+			return
+		}
+	}
+
+	replay, err := NewReplay(archive, start, end, speed, get("loop") == "true")
+	if err != nil {
+		span.RecordError(err)
+		http.Error(w, "error reading the pulse archive", http.StatusInternalServerError)
+		return
+	}
+
+	if get("midi") == "true" {
+		midi, err := NewMIDIOutputFromEnv()
+		if err != nil {
+			span.RecordError(err)
+			http.Error(w, "error opening MIDI output", http.StatusInternalServerError)
+			return
+		}
+		replay.MIDI = midi
+	}
+
+	v.MU.Lock()
+	previous := v.Replay
+	v.Replay = replay
+	v.MU.Unlock()
+	if previous != nil {
+		previous.Stop()
+	}
+
+	replay.Play()
+	replay.Run()
+	slog.Info("Replay started",
+		slog.Time("start", start),
+		slog.Time("end", end),
+		slog.Float64("speed", speed),
+		slog.Bool("midi", replay.MIDI != nil))
+
+	writeReplayStatus(w, replay)
+}
+
+// replay is the running replay, nil when live
+func (v *View) replay() *Replay {
+	v.MU.Lock()
+	defer v.MU.Unlock()
+	return v.Replay
+}
+
+func writeReplayStatus(w http.ResponseWriter, replay *Replay) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(replay.Status())
+}
@@ -0,0 +1,327 @@
+package monteverdi_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	Md "github.com/maroda/monteverdi/display"
+	Mo "github.com/maroda/monteverdi/obvy"
+	Mp "github.com/maroda/monteverdi/plugin"
+	Ms "github.com/maroda/monteverdi/server"
+	Mt "github.com/maroda/monteverdi/types"
+)
+
+func TestReplay_Advance(t *testing.T) {
+	start := time.Date(2023, 10, 1, 14, 0, 0, 0, time.UTC)
+	archive := makeReplayArchive(t, start, 12, 10*time.Second)
+
+	setup := func(t *testing.T, loop bool) *Md.Replay {
+		t.Helper()
+		replay, err := Md.NewReplay(archive, start, start.Add(2*time.Minute), 10, loop)
+		assertError(t, err, nil)
+		assertError(t, replay.Play(), nil)
+		return replay
+	}
+
+	t.Run("Emits pulses in their original timing at speed", func(t *testing.T) {
+		replay := setup(t, false)
+
+		assertError(t, replay.Advance(time.Second), nil)
+		status := replay.Status()
+		if !status.Position.Equal(start.Add(10 * time.Second)) {
+			t.Errorf("Expected ten seconds of archive in one second, got %v", status.Position.Sub(start))
+		}
+		assertInt(t, status.Pulses, 1)
+
+		assertError(t, replay.Advance(5*time.Second), nil)
+		assertInt(t, replay.Status().Pulses, 6)
+	})
+
+	t.Run("Holds its position when paused", func(t *testing.T) {
+		replay := setup(t, false)
+		replay.Pause()
+
+		assertError(t, replay.Advance(time.Minute), nil)
+		if !replay.Status().Position.Equal(start) {
+			t.Error("Expected the paused replay not to move")
+		}
+	})
+
+	t.Run("Seeks with the pulses before the position", func(t *testing.T) {
+		replay := setup(t, false)
+
+		assertError(t, replay.Seek(start.Add(90*time.Second)), nil)
+		assertInt(t, replay.Status().Pulses, 9)
+
+		assertError(t, replay.Advance(time.Second), nil)
+		assertInt(t, replay.Status().Pulses, 10)
+
+		assertError(t, replay.Seek(start.Add(-time.Hour)), nil)
+		if !replay.Status().Position.Equal(start) {
+			t.Error("Expected the seek to stop at the start")
+		}
+	})
+
+	t.Run("Finishes at the end", func(t *testing.T) {
+		replay := setup(t, false)
+
+		assertError(t, replay.Advance(time.Minute), nil)
+		status := replay.Status()
+		if status.Playing || !status.Position.Equal(start.Add(2*time.Minute)) {
+			t.Errorf("Expected the replay to stop at the end, got %+v", status)
+		}
+		assertInt(t, status.Pulses, 12)
+
+		// Playing again starts over
+		assertError(t, replay.Play(), nil)
+		if !replay.Status().Position.Equal(start) {
+			t.Error("Expected the replay to start over")
+		}
+	})
+
+	t.Run("Starts over when looping", func(t *testing.T) {
+		replay := setup(t, true)
+
+		assertError(t, replay.Advance(time.Minute), nil)
+		status := replay.Status()
+		if !status.Playing || !status.Position.Equal(start) {
+			t.Errorf("Expected the replay to loop, got %+v", status)
+		}
+		assertInt(t, status.Pulses, 0)
+	})
+
+	t.Run("Plays the pulses on MIDI as if they were now", func(t *testing.T) {
+		replay := setup(t, false)
+		midi := &RecordingOutput{}
+		replay.MIDI = midi
+
+		before := time.Now()
+		assertError(t, replay.Advance(3*time.Second), nil)
+		assertInt(t, len(midi.Pulses), 3)
+		for _, p := range midi.Pulses {
+			if p.StartTime.Before(before) {
+				t.Errorf("Expected the pulse to start now, got %v", p.StartTime)
+			}
+			if p.Duration != 500*time.Millisecond {
+				t.Errorf("Expected the duration at ten times speed, got %v", p.Duration)
+			}
+		}
+
+		replay.Stop()
+		if !midi.Closed {
+			t.Error("Expected MIDI to be closed with the replay")
+		}
+	})
+
+	t.Run("Reads the archive a page at a time", func(t *testing.T) {
+		many := makeReplayArchive(t, start, 1200, 500*time.Millisecond)
+		replay, err := Md.NewReplay(many, start, start.Add(time.Hour), 30, false)
+		assertError(t, err, nil)
+		assertError(t, replay.Play(), nil)
+
+		for i := 0; i < 4; i++ {
+			assertError(t, replay.Advance(5*time.Second), nil)
+		}
+		assertInt(t, replay.Status().Pulses, 1200)
+	})
+
+	t.Run("Rejects invalid speeds and ranges", func(t *testing.T) {
+		_, err := Md.NewReplay(archive, start, start.Add(time.Minute), 0, false)
+		assertGotError(t, err)
+		_, err = Md.NewReplay(archive, start, start, 1, false)
+		assertGotError(t, err)
+		assertGotError(t, setup(t, false).SetSpeed(-1))
+	})
+}
+
+func TestReplay_PulseDataD3(t *testing.T) {
+	start := time.Date(2023, 10, 1, 14, 0, 0, 0, time.UTC)
+	archive := makeReplayArchive(t, start, 1, time.Second)
+	assertError(t, archive.WritePulse(&Mt.PulseEvent{
+		Dimension: 2,
+		Endpoint:  "DB",
+		Endpoints: []string{"DB", "API"},
+		Metric:    []string{"latency", "errors"},
+		Pattern:   Mt.Cascade,
+		StartTime: start.Add(10 * time.Second),
+		Duration:  30 * time.Second,
+	}), nil)
+
+	replay, err := Md.NewReplay(archive, start, start.Add(time.Minute), 10, false)
+	assertError(t, err, nil)
+	assertError(t, replay.Play(), nil)
+	assertError(t, replay.Advance(2*time.Second), nil)
+
+	view := &Md.View{QNet: Ms.NewQNet(Ms.Endpoints{}), Stats: Mo.NewStatsInternal()}
+	endpoints := map[string]string{}
+	for _, p := range replay.PulseDataD3(view) {
+		if p.Type != "cascade" {
+			assertString(t, p.Endpoint, "DB")
+			continue
+		}
+		if len(p.Linked) != 2 || p.Linked[0] != "latency" || p.Linked[1] != "errors" {
+			t.Errorf("Expected the cascade to link its metrics, got %v", p.Linked)
+		}
+		endpoints[p.Metric] = p.Endpoint
+	}
+	assertInt(t, len(endpoints), 2)
+	assertString(t, endpoints["latency"], "DB")
+	assertString(t, endpoints["errors"], "API")
+}
+
+func TestView_ReplayHandler(t *testing.T) {
+	end := time.Now().Truncate(time.Second)
+	start := end.Add(-30 * time.Minute)
+	archive := makeReplayArchive(t, start, 12, time.Minute)
+
+	view := &Md.View{QNet: Ms.NewQNet(Ms.Endpoints{}), Stats: Mo.NewStatsInternal()}
+	view.QNet.Output = archive
+	defer func() {
+		if view.Replay != nil {
+			view.Replay.Stop()
+		}
+	}()
+
+	request := func(method, target string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		w := httptest.NewRecorder()
+		view.ReplayHandler(w, r)
+		return w
+	}
+	status := func(t *testing.T, w *httptest.ResponseRecorder) Md.ReplayStatus {
+		t.Helper()
+		assertStatus(t, w.Code, http.StatusOK)
+		var got Md.ReplayStatus
+		if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		return got
+	}
+
+	t.Run("Errors without a replay", func(t *testing.T) {
+		assertStatus(t, request("GET", "/api/replay").Code, http.StatusNotFound)
+		assertStatus(t, request("POST", "/api/replay/pause").Code, http.StatusNotFound)
+	})
+
+	t.Run("Rejects invalid starts", func(t *testing.T) {
+		for _, query := range []string{"start=yesterday", "start=now&end=-1h", "speed=0", "speed=fast"} {
+			assertStatus(t, request("POST", "/api/replay/start?"+query).Code, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("Starts a replay of the range", func(t *testing.T) {
+		got := status(t, request("POST", "/api/replay/start?speed=60&start="+start.Format(time.RFC3339)))
+		if !got.Playing || got.Speed != 60 || got.MIDI {
+			t.Errorf("Expected a playing replay at 60 times speed, got %+v", got)
+		}
+		if view.Replay == nil {
+			t.Fatal("Expected the view to have the replay")
+		}
+	})
+
+	t.Run("Controls the replay", func(t *testing.T) {
+		got := status(t, request("POST", "/api/replay/pause"))
+		if got.Playing {
+			t.Error("Expected the replay to pause")
+		}
+
+		got = status(t, request("POST", "/api/replay/seek?to=9m30s"))
+		if !got.Position.Equal(got.Start.Add(9*time.Minute + 30*time.Second)) {
+			t.Errorf("Expected the position 9m30s from the start, got %v", got.Position.Sub(got.Start))
+		}
+		assertInt(t, got.Pulses, 10)
+
+		got = status(t, request("POST", "/api/replay/speed?value=120"))
+		if got.Speed != 120 {
+			t.Errorf("Expected the new speed, got %v", got.Speed)
+		}
+
+		got = status(t, request("POST", "/api/replay/play"))
+		if !got.Playing {
+			t.Error("Expected the replay to play")
+		}
+		request("POST", "/api/replay/pause")
+	})
+
+	t.Run("Rejects invalid controls", func(t *testing.T) {
+		assertStatus(t, request("POST", "/api/replay/seek").Code, http.StatusBadRequest)
+		assertStatus(t, request("POST", "/api/replay/speed?value=0").Code, http.StatusBadRequest)
+		assertStatus(t, request("POST", "/api/replay/rewind").Code, http.StatusBadRequest)
+		assertStatus(t, request("DELETE", "/api/replay").Code, http.StatusMethodNotAllowed)
+	})
+
+	t.Run("Sends the replay to the websocket", func(t *testing.T) {
+		pulses := view.GetPulseDataD3()
+		if len(pulses) == 0 {
+			t.Fatal("Expected replayed pulses")
+		}
+		for _, p := range pulses {
+			assertString(t, p.Endpoint, "DB")
+		}
+	})
+
+	t.Run("Goes back to live when stopped", func(t *testing.T) {
+		assertStatus(t, request("POST", "/api/replay/stop").Code, http.StatusOK)
+		if view.Replay != nil {
+			t.Error("Expected no replay")
+		}
+		assertInt(t, len(view.GetPulseDataD3()), 0)
+	})
+
+	t.Run("Errors without an archive", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		makeTestView(t).ReplayHandler(w, httptest.NewRequest("POST", "/api/replay/start", nil))
+		assertStatus(t, w.Code, http.StatusNotFound)
+	})
+}
+
+// Helpers //
+
+// makeReplayArchive writes count iambs every apart from start
+func makeReplayArchive(t *testing.T, start time.Time, count int, every time.Duration) *Mp.BadgerOutput {
+	t.Helper()
+	archive, err := Mp.NewBadgerOutput(t.TempDir(), 1)
+	assertError(t, err, nil)
+	t.Cleanup(func() { archive.Close() })
+
+	pulses := make([]*Mt.PulseEvent, 0, count)
+	for i := 0; i < count; i++ {
+		pulses = append(pulses, &Mt.PulseEvent{
+			Dimension: 1,
+			Endpoint:  "DB",
+			Metric:    []string{"latency"},
+			Pattern:   Mt.Iamb,
+			StartTime: start.Add(time.Duration(i) * every),
+			Duration:  5 * time.Second,
+		})
+	}
+	assertError(t, archive.WriteBatch(pulses), nil)
+	return archive
+}
+
+// RecordingOutput keeps the pulses written to it
+type RecordingOutput struct {
+	Pulses []*Mt.PulseEvent
+	Closed bool
+}
+
+func (ro *RecordingOutput) WritePulse(pulse *Mt.PulseEvent) error {
+	ro.Pulses = append(ro.Pulses, pulse)
+	return nil
+}
+
+func (ro *RecordingOutput) WriteBatch(pulses []*Mt.PulseEvent) error {
+	ro.Pulses = append(ro.Pulses, pulses...)
+	return nil
+}
+
+func (ro *RecordingOutput) QueryRange(start, end time.Time) (interface{}, error) {
+	return ro.Pulses, nil
+}
+
+func (ro *RecordingOutput) Flush() error { return nil }
+func (ro *RecordingOutput) Close() error { ro.Closed = true; return nil }
+func (ro *RecordingOutput) Type() string { return "Recording" }
@@ -0,0 +1,128 @@
+package monteverdi
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	Ms "github.com/maroda/monteverdi/server"
+)
+
+// Snapshots saves the engine state to Path every Interval,
+// see server/snapshot.go for what is kept
+type Snapshots struct {
+	Path     string         // MONTEVERDI_SNAPSHOT_PATH
+	Interval time.Duration  // MONTEVERDI_SNAPSHOT_INTERVAL_SECONDS
+	stopChan chan struct{}  // stops the saving loop
+	wg       sync.WaitGroup // waits for the saving loop
+}
+
+// NewSnapshots returns nil when MONTEVERDI_SNAPSHOT_PATH is not set
+func NewSnapshots() *Snapshots {
+	path := Ms.FillEnvVar("MONTEVERDI_SNAPSHOT_PATH")
+	if path == "ENOENT" {
+		return nil
+	}
+
+	seconds := Ms.FillEnvVarInt("MONTEVERDI_SNAPSHOT_INTERVAL_SECONDS", 60)
+	if seconds <= 0 {
+		slog.Warn("Invalid snapshot interval, using default", slog.Int("seconds", seconds))
+		seconds = 60
+	}
+
+	return &Snapshots{
+		Path:     path,
+		Interval: time.Duration(seconds) * time.Second,
+	}
+}
+
+// RestoreSnapshot brings back the engine state saved at the last shutdown
+func (v *View) RestoreSnapshot() {
+	if v.Snapshots == nil {
+		return
+	}
+
+	s, err := Ms.LoadSnapshot(v.Snapshots.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		slog.Info("No snapshot to restore", slog.String("path", v.Snapshots.Path))
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to load snapshot, starting fresh",
+			slog.String("path", v.Snapshots.Path),
+			slog.Any("error", err))
+		return
+	}
+
+	v.MU.Lock()
+	defer v.MU.Unlock()
+	restored := v.QNet.Restore(s)
+	slog.Info("Snapshot restored",
+		slog.String("path", v.Snapshots.Path),
+		slog.Time("taken", s.Taken),
+		slog.Int("metrics", restored))
+}
+
+// SaveSnapshot writes the current engine state.
+// NB: Caller must not hold v.MU
+func (v *View) SaveSnapshot() {
+	if v.Snapshots == nil {
+		return
+	}
+
+	v.MU.Lock()
+	qn := v.QNet
+	v.MU.Unlock()
+
+	s, err := qn.Snapshot()
+	if err == nil {
+		err = Ms.SaveSnapshot(v.Snapshots.Path, s)
+	}
+	if err != nil {
+		slog.Error("Failed to save snapshot",
+			slog.String("path", v.Snapshots.Path),
+			slog.Any("error", err))
+	}
+}
+
+// StartSnapshots saves the engine state every Interval until StopSnapshots
+func (v *View) StartSnapshots() {
+	if v.Snapshots == nil {
+		return
+	}
+
+	slog.Info("Saving snapshots",
+		slog.String("path", v.Snapshots.Path),
+		slog.Duration("interval", v.Snapshots.Interval))
+
+	v.Snapshots.stopChan = make(chan struct{})
+	v.Snapshots.wg.Add(1)
+	go func() {
+		defer v.Snapshots.wg.Done()
+		ticker := time.NewTicker(v.Snapshots.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				v.SaveSnapshot()
+			case <-v.Snapshots.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// StopSnapshots stops the saving loop and saves one last time
+func (v *View) StopSnapshots() {
+	if v.Snapshots == nil || v.Snapshots.stopChan == nil {
+		return
+	}
+
+	close(v.Snapshots.stopChan)
+	v.Snapshots.wg.Wait()
+	v.Snapshots.stopChan = nil
+	v.SaveSnapshot()
+}
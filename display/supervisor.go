@@ -8,14 +8,15 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
-	Mp "github.com/maroda/monteverdi/plugin"
 	Ms "github.com/maroda/monteverdi/server"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // PollSupervisor is a wrapper around the View that manages polling goroutines
@@ -24,12 +25,14 @@ type PollSupervisor struct {
 	View    *View
 	Pollers []*EndpointPoller
 	WG      sync.WaitGroup
+	MU      sync.RWMutex // held by every poll, Reconfigure locks it to change the Network
 }
 
 // EndpointPoller manages per-endpoint polling
 type EndpointPoller struct {
 	QNet     *Ms.QNet
-	Index    int          // Index in QNet.Network
+	Endpoint *Ms.Endpoint // polled endpoint, Reconfigure may move it in the Network
+	Index    int          // Index in QNet.Network, guarded by PollSupervisor.MU
 	Ticker   *time.Ticker // Frequency
 	StopChan chan struct{}
 }
@@ -42,18 +45,30 @@ func (v *View) NewPollSupervisor() *PollSupervisor {
 	}
 
 	// Create a poller for each endpoint
-	for i := range v.QNet.Network {
+	v.QNet.MU.RLock()
+	for i, ep := range v.QNet.Network {
 		ps.Pollers[i] = &EndpointPoller{
-			QNet:  v.QNet,
-			Index: i,
+			QNet:     v.QNet,
+			Endpoint: ep,
+			Index:    i,
 		}
 	}
+	v.QNet.MU.RUnlock()
 
 	return ps
 }
 
-// ReloadConfig performs an automatic restart after filling QNet with the new config
-func (v *View) ReloadConfig(ctx context.Context, c []Ms.ConfigFile) {
+// ReloadSummary is what a config reload changed
+type ReloadSummary struct {
+	Ms.ConfigDiff
+	Output string `json:"output"` // "kept", "reopened", or "none"
+}
+
+// ReloadConfig applies the new config to the running QNet:
+// only endpoints whose config changed get a new poller,
+// thresholds and period ratios are updated in place,
+// and the output stays open unless its settings changed
+func (v *View) ReloadConfig(ctx context.Context, c []Ms.ConfigFile) *ReloadSummary {
 	ctx, span := otel.Tracer("monteverdi/supervisor").Start(ctx, "ReloadConfig")
 	defer span.End()
 
@@ -61,7 +76,86 @@ func (v *View) ReloadConfig(ctx context.Context, c []Ms.ConfigFile) {
 	v.MU.Lock()
 	defer v.MU.Unlock()
 
-	// Stop output, QNet will reinitialize with a new one
+	summary := &ReloadSummary{ConfigDiff: v.QNet.DiffConfig(c)}
+
+	// Output is configured by the environment, not the config file
+	settings := outputSettings()
+	switch {
+	case settings != v.OutputSettings:
+		v.reopenOutput(span)
+		v.OutputSettings = settings
+		summary.Output = "reopened"
+	case v.QNet.Output != nil:
+		summary.Output = "kept"
+	default:
+		summary.Output = "none"
+	}
+
+	// Swap in the new endpoints, polling only what changed
+	if v.Supervisor == nil {
+		v.QNet.Reconfigure(c, summary.ConfigDiff)
+		v.Supervisor = v.NewPollSupervisor()
+		v.Supervisor.Start()
+	} else {
+		v.Supervisor.Reconfigure(c, summary.ConfigDiff)
+	}
+
+	span.SetAttributes(
+		attribute.Int("endpoints.added", len(summary.Added)),
+		attribute.Int("endpoints.removed", len(summary.Removed)),
+		attribute.Int("endpoints.restarted", len(summary.Restarted)),
+		attribute.Int("endpoints.updated", len(summary.Updated)),
+	)
+	slog.Info("Config reloaded",
+		slog.Any("added", summary.Added),
+		slog.Any("removed", summary.Removed),
+		slog.Any("restarted", summary.Restarted),
+		slog.Any("updated", summary.Updated),
+		slog.String("output", summary.Output))
+
+	return summary
+}
+
+// outputSettings is what the output adapter is opened with, empty when there is none
+func outputSettings() string {
+	location := Ms.FillEnvVar("MONTEVERDI_OUTPUT")
+	switch location {
+	case "ENOENT":
+		return ""
+	case "MIDI":
+		return envSettings(location,
+			"MONTEVERDI_PLUGIN_MIDI_PORT",
+			"MONTEVERDI_PLUGIN_MIDI_ROOT",
+			"MONTEVERDI_PLUGIN_MIDI_ARP_DELAY",
+			"MONTEVERDI_PLUGIN_MIDI_ARP_INTERVAL",
+			"MONTEVERDI_PLUGIN_MIDI_SCALE")
+	}
+	return envSettings(location,
+		"MONTEVERDI_PLUGIN_BADGER_TTL_HOURS",
+		"MONTEVERDI_PLUGIN_BADGER_MAX_MB",
+		"MONTEVERDI_PLUGIN_BADGER_GC_INTERVAL_SECONDS",
+		"MONTEVERDI_PLUGIN_BADGER_ROLLUP_INTERVAL_SECONDS")
+}
+
+// envSettings joins the location with the values of the variables
+func envSettings(location string, vars ...string) string {
+	settings := []string{location}
+	for _, ev := range vars {
+		settings = append(settings, os.Getenv(ev))
+	}
+	return strings.Join(settings, " ")
+}
+
+// reopenOutput closes the output and opens it again from MONTEVERDI_OUTPUT.
+// Nothing should raise an error, but everything should log it.
+// NB: Caller must hold v.MU
+func (v *View) reopenOutput(span trace.Span) {
+	// A replay reads from the output being closed
+	if v.Replay != nil {
+		v.Replay.Stop()
+		v.Replay = nil
+	}
+
 	if v.QNet.Output != nil {
 		err := v.QNet.Output.Close()
 		if err != nil {
@@ -70,20 +164,9 @@ func (v *View) ReloadConfig(ctx context.Context, c []Ms.ConfigFile) {
 				slog.Any("output", v.QNet.Output),
 				slog.Any("error", err))
 		}
+		v.QNet.Output = nil
 	}
 
-	// Stop current polling
-	if v.Supervisor != nil {
-		v.Supervisor.Stop()
-	}
-
-	// Build new endpoints from config
-	// and replace the existing QNet
-	eps := Ms.NewEndpointsFromConfig(c)
-	v.QNet = Ms.NewQNet(*eps)
-
-	// Refresh output, allowing for a new config
-	// Nothing should raise an error, but everything should log it
 	outputLocation := Ms.FillEnvVar("MONTEVERDI_OUTPUT")
 	switch outputLocation {
 	case "ENOENT":
@@ -97,24 +180,17 @@ func (v *View) ReloadConfig(ctx context.Context, c []Ms.ConfigFile) {
 			slog.Info("MIDI Adapter Enabled", slog.String("output", outputLocation))
 		}
 	default:
-		batchSize := 100
-		output, err := Mp.NewBadgerOutput(outputLocation, batchSize)
+		output, err := OpenArchive(outputLocation, v.Stats)
 		if err != nil {
 			span.RecordError(err)
-			slog.Error("Failed to reinitialize BadgerDB after reload",
+			slog.Error("Failed to reinitialize archive after reload",
 				slog.String("output", outputLocation),
 				slog.Any("error", err))
 		} else {
 			v.QNet.Output = output
-			slog.Info("BadgerOutput reinitialized after reload", slog.String("output", outputLocation))
+			slog.Info("Archive reinitialized after reload", slog.String("type", output.Type()), slog.String("output", outputLocation))
 		}
 	}
-
-	// Create and start new supervisor
-	v.Supervisor = v.NewPollSupervisor()
-	v.Supervisor.Start()
-
-	slog.Info("Config reloaded and polling restarted!")
 }
 
 // ConfHandler receives the new JSON config, validates, and reloads
@@ -135,9 +211,10 @@ func (v *View) ConfHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// Never echo credentials
 		w.WriteHeader(http.StatusOK)
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(loadConfig)
+		json.NewEncoder(w).Encode(Ms.RedactConfig(loadConfig))
 	case "POST":
 		ctx := r.Context()
 		ctx, span := otel.Tracer("monteverdi/conf").Start(ctx, "ConfHandlerPost")
@@ -159,6 +236,32 @@ func (v *View) ConfHandler(w http.ResponseWriter, r *http.Request) {
 			span.RecordError(err)
 			span.SetStatus(codes.Error, err.Error())
 			http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err = Ms.ValidatePeriods(testConfig); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			http.Error(w, fmt.Sprintf("Invalid periods: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		// Secrets come back redacted from GET, keep the ones on disk
+		// unless the endpoint would send them somewhere else
+		prevConfig, _ := Ms.LoadConfigFileName(configPath)
+		restored, err := Ms.UnredactConfig(testConfig, prevConfig)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			http.Error(w, fmt.Sprintf("Invalid secrets: %v", err), http.StatusBadRequest)
+			return
+		}
+		if restored {
+			if body, err = json.MarshalIndent(testConfig, "", "  "); err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				http.Error(w, fmt.Sprintf("Failed to encode config: %v", err), http.StatusInternalServerError)
+				return
+			}
 		}
 
 		// Write JSON to disk
@@ -180,12 +283,13 @@ func (v *View) ConfHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Reload with new config
-		v.ReloadConfig(ctx, loadConfig)
+		summary := v.ReloadConfig(ctx, loadConfig)
 
 		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]string{
+		json.NewEncoder(w).Encode(map[string]interface{}{
 			"status":  "success",
 			"message": "Configuration reloaded",
+			"changes": summary,
 		})
 
 		slog.Info("Configuration reloaded", slog.String("path", configPath))
@@ -206,7 +310,9 @@ func (ps *PollSupervisor) Start() {
 }
 
 func (ps *PollSupervisor) startEndpointPoller(poller *EndpointPoller) {
-	interval := poller.QNet.Network[poller.Index].Interval
+	// The goroutine never reads the Network, Reconfigure swaps it out
+	epID := poller.Endpoint.ID
+	interval := poller.Endpoint.Interval
 	if interval == 0 {
 		slog.Warn("Poller interval is 0, using default of 15s")
 		interval = 15 * time.Second
@@ -220,7 +326,6 @@ func (ps *PollSupervisor) startEndpointPoller(poller *EndpointPoller) {
 		defer ps.WG.Done()
 		defer poller.Ticker.Stop()
 
-		epID := poller.QNet.Network[poller.Index].ID
 		slog.Info("Endpoint poller started",
 			slog.String("endpoint", epID),
 			slog.Duration("interval", interval))
@@ -238,7 +343,7 @@ func (ps *PollSupervisor) startEndpointPoller(poller *EndpointPoller) {
 					attribute.Int("interval.sec", int(interval)),
 				)
 
-				poller.QNet.PollEndpoint(poller.Index)
+				ps.poll(poller)
 
 				ps.View.Stats.RecPollTimer(time.Since(start).Seconds())
 			case <-poller.StopChan:
@@ -249,20 +354,92 @@ func (ps *PollSupervisor) startEndpointPoller(poller *EndpointPoller) {
 	}()
 }
 
+// poll fetches the poller's endpoint,
+// unless a reload stopped the poller while it waited
+func (ps *PollSupervisor) poll(poller *EndpointPoller) {
+	ps.MU.RLock()
+	defer ps.MU.RUnlock()
+
+	select {
+	case <-poller.StopChan:
+		return
+	default:
+	}
+	poller.QNet.PollEndpoint(poller.Index)
+}
+
+// Reconfigure swaps the new config into the QNet, see Ms.QNet.Reconfigure.
+// Pollers of endpoints still in the Network keep running,
+// pointed at their new index, the rest are stopped,
+// and endpoints new to the Network get a poller.
+func (ps *PollSupervisor) Reconfigure(c []Ms.ConfigFile, diff Ms.ConfigDiff) {
+	ps.MU.Lock()
+
+	qn := ps.View.QNet
+	qn.Reconfigure(c, diff)
+
+	qn.MU.RLock()
+	network := qn.Network
+	qn.MU.RUnlock()
+
+	index := make(map[*Ms.Endpoint]int, len(network))
+	for i, ep := range network {
+		index[ep] = i
+	}
+
+	polled := make(map[*Ms.Endpoint]bool)
+	pollers := make([]*EndpointPoller, 0, len(network))
+	for _, poller := range ps.Pollers {
+		var ep *Ms.Endpoint
+		if poller.QNet == qn {
+			ep = poller.Endpoint
+		}
+		if i, ok := index[ep]; ok && !polled[ep] {
+			poller.Index = i
+			polled[ep] = true
+			pollers = append(pollers, poller)
+			continue
+		}
+		stopPoller(poller)
+	}
+
+	var started []*EndpointPoller
+	for i, ep := range network {
+		if !polled[ep] {
+			poller := &EndpointPoller{QNet: qn, Endpoint: ep, Index: i}
+			started = append(started, poller)
+			pollers = append(pollers, poller)
+		}
+	}
+	ps.Pollers = pollers
+	ps.MU.Unlock()
+
+	for _, poller := range started {
+		ps.startEndpointPoller(poller)
+	}
+}
+
+// stopPoller closes the poller's StopChan, if it is running
+func stopPoller(poller *EndpointPoller) {
+	if poller.StopChan != nil {
+		select {
+		case <-poller.StopChan: // Already closed, noop
+		default:
+			close(poller.StopChan)
+		}
+	}
+}
+
 // Stop the PollSupervisor
 // This is idempotent and will run even if stopped
 func (ps *PollSupervisor) Stop() {
 	slog.Info("Stopping Poll Supervisor")
 
+	ps.MU.RLock()
 	for _, poller := range ps.Pollers {
-		if poller.StopChan != nil {
-			select {
-			case <-poller.StopChan: // Already closed, noop
-			default:
-				close(poller.StopChan)
-			}
-		}
+		stopPoller(poller)
 	}
+	ps.MU.RUnlock()
 
 	ps.WG.Wait()
 	slog.Info("All endpoint pollers stopped", slog.Int("endpoints", len(ps.Pollers)))
@@ -17,7 +17,9 @@ import (
 
 	Md "github.com/maroda/monteverdi/display"
 	Mo "github.com/maroda/monteverdi/obvy"
+	Mp "github.com/maroda/monteverdi/plugin"
 	Ms "github.com/maroda/monteverdi/server"
+	Mt "github.com/maroda/monteverdi/types"
 )
 
 func TestPollSupervisor(t *testing.T) {
@@ -184,6 +186,159 @@ NETOUT=777`
 			t.Error("Metric CPU should not exist after reload")
 		}
 	})
+
+	t.Run("Keeps the state of unchanged metrics when restarting", func(t *testing.T) {
+		config := func(mem Ms.MetricConfig) []Ms.ConfigFile {
+			return []Ms.ConfigFile{{
+				ID:       "test1",
+				URL:      metricsServ1.URL,
+				Delim:    "=",
+				Interval: 60,
+				Metrics: map[string]Ms.MetricConfig{
+					"CPU": {Type: "gauge", Max: 50},
+					"MEM": mem,
+				},
+			}}
+		}
+
+		view := makeTestViewWithScreen(t, nil)
+		view.QNet = Ms.NewQNet(*Ms.NewEndpointsFromConfig(config(Ms.MetricConfig{Type: "gauge", Max: 500})))
+		start := time.Now().Add(-time.Minute)
+		for i := 0; i < 12; i++ {
+			value := int64(i%2) * 100
+			ts := start.Add(time.Duration(i) * 5 * time.Second)
+			view.QNet.IngestMetric(0, "CPU", value, ts)
+			view.QNet.IngestMetric(0, "MEM", value*10, ts)
+		}
+		cpuBefore := len(view.QNet.Network[0].Sequence["CPU"].Events)
+		pulsesBefore := len(view.QNet.Network[0].Pulses.Buffer)
+
+		summary := view.ReloadConfig(context.Background(), config(Ms.MetricConfig{Type: "gauge", Transformer: "calc_rate", Max: 500}))
+		view.Supervisor.Stop()
+		assertInt(t, len(summary.Restarted), 1)
+
+		view.MU.Lock()
+		defer view.MU.Unlock()
+		ep := view.QNet.Network[0]
+		ep.MU.RLock()
+		defer ep.MU.RUnlock()
+
+		if got := len(ep.Sequence["CPU"].Events); got < cpuBefore {
+			t.Errorf("Expected CPU to keep its %d ictus, got %d", cpuBefore, got)
+		}
+		if pulsesBefore == 0 || len(ep.Pulses.Buffer) == 0 {
+			t.Error("Expected CPU pulses to survive the reload")
+		}
+		for _, p := range ep.Pulses.Buffer {
+			for _, m := range p.Metric {
+				if m == "MEM" {
+					t.Error("Expected MEM pulses to be dropped with its changed config")
+				}
+			}
+		}
+		if seq := ep.Sequence["MEM"]; seq != nil && len(seq.Events) >= cpuBefore {
+			t.Errorf("Expected MEM to start fresh, got %d ictus", len(seq.Events))
+		}
+	})
+}
+
+func TestView_ReloadConfigIncremental(t *testing.T) {
+	metricsServ := makeMockWebServBody(0, "CPU=44\nMEM=555\nNETIN=6")
+	defer metricsServ.Close()
+
+	endpoint := func(id string, cpuMax int64) Ms.ConfigFile {
+		return Ms.ConfigFile{
+			ID:       id,
+			URL:      metricsServ.URL,
+			Delim:    "=",
+			Interval: 60,
+			Metrics: map[string]Ms.MetricConfig{
+				"CPU": {Type: "gauge", Max: cpuMax},
+				"MEM": {Type: "gauge", Max: 500},
+			},
+		}
+	}
+
+	setup := func(t *testing.T, cf []Ms.ConfigFile) *Md.View {
+		t.Helper()
+		view := makeTestViewWithScreen(t, nil)
+		view.QNet = Ms.NewQNet(*Ms.NewEndpointsFromConfig(cf))
+		view.Supervisor = view.NewPollSupervisor()
+		view.Supervisor.Start()
+		t.Cleanup(func() { view.Supervisor.Stop() })
+		return view
+	}
+
+	t.Run("Updates thresholds in place", func(t *testing.T) {
+		view := setup(t, []Ms.ConfigFile{endpoint("db", 50), endpoint("api", 50)})
+		db := view.QNet.Network[0]
+		poller := view.Supervisor.Pollers[0]
+
+		summary := view.ReloadConfig(context.Background(), []Ms.ConfigFile{endpoint("db", 80), endpoint("api", 50)})
+
+		if view.QNet.Network[0] != db {
+			t.Error("Expected the endpoint to be kept")
+		}
+		if view.Supervisor.Pollers[0] != poller {
+			t.Error("Expected the poller to keep running")
+		}
+		assertInt64(t, db.Maxval["CPU"], 80)
+		assertInt64(t, db.Threshold("CPU").Enter, 80)
+		assertString(t, strings.Join(summary.Updated["db"], ","), "CPU")
+		assertString(t, strings.Join(summary.Unchanged, ","), "api")
+		assertInt(t, len(summary.Restarted), 0)
+		assertString(t, summary.Output, "none")
+	})
+
+	t.Run("Adds and removes only the affected pollers", func(t *testing.T) {
+		view := setup(t, []Ms.ConfigFile{endpoint("db", 50), endpoint("api", 50)})
+		api := view.QNet.Network[1]
+		apiPoller := view.Supervisor.Pollers[1]
+
+		summary := view.ReloadConfig(context.Background(), []Ms.ConfigFile{endpoint("api", 50), endpoint("cache", 50)})
+
+		assertInt(t, len(view.QNet.Network), 2)
+		assertInt(t, len(view.Supervisor.Pollers), 2)
+		if view.QNet.Network[0] != api || view.Supervisor.Pollers[0] != apiPoller {
+			t.Error("Expected api and its poller to be kept")
+		}
+		assertInt(t, apiPoller.Index, 0)
+		assertString(t, view.QNet.Network[1].ID, "cache")
+		assertString(t, strings.Join(summary.Added, ","), "cache")
+		assertString(t, strings.Join(summary.Removed, ","), "db")
+	})
+
+	t.Run("Restarts an endpoint whose connection changed", func(t *testing.T) {
+		view := setup(t, []Ms.ConfigFile{endpoint("db", 50)})
+		db := view.QNet.Network[0]
+
+		moved := endpoint("db", 50)
+		moved.Interval = 30
+		summary := view.ReloadConfig(context.Background(), []Ms.ConfigFile{moved})
+
+		if view.QNet.Network[0] == db {
+			t.Error("Expected the endpoint to be rebuilt")
+		}
+		if view.QNet.Network[0].Interval != 30*time.Second {
+			t.Errorf("Expected the new interval, got %v", view.QNet.Network[0].Interval)
+		}
+		assertString(t, strings.Join(summary.Restarted, ","), "db")
+	})
+
+	t.Run("Keeps the output open", func(t *testing.T) {
+		view := setup(t, []Ms.ConfigFile{endpoint("db", 50)})
+		output, err := Mp.NewBadgerOutput(t.TempDir(), 1)
+		assertError(t, err, nil)
+		defer output.Close()
+		view.QNet.Output = output
+
+		summary := view.ReloadConfig(context.Background(), []Ms.ConfigFile{endpoint("db", 90)})
+		assertString(t, summary.Output, "kept")
+		if view.QNet.Output != output {
+			t.Error("Expected the same output")
+		}
+		assertError(t, output.WritePulse(&Mt.PulseEvent{Pattern: Mt.Iamb, StartTime: time.Now()}), nil)
+	})
 }
 
 func TestView_ConfHandler(t *testing.T) {
@@ -265,6 +420,30 @@ func TestView_ConfHandler(t *testing.T) {
 		if view.QNet.Network[0].ID != "test2" {
 			t.Errorf("Expected ID %s, got %s", "test2", view.QNet.Network[0].ID)
 		}
+
+		// And the response says what changed
+		var resp struct {
+			Status  string           `json:"status"`
+			Changes Md.ReloadSummary `json:"changes"`
+		}
+		err := json.Unmarshal(w.Body.Bytes(), &resp)
+		assertError(t, err, nil)
+		assertString(t, resp.Status, "success")
+		assertString(t, strings.Join(resp.Changes.Added, ","), "test2")
+		assertString(t, strings.Join(resp.Changes.Removed, ","), "test1")
+	})
+
+	t.Run("Rejects invalid periods without reloading", func(t *testing.T) {
+		badConfig := `[{"id": "test3", "url": "http://localhost:8888/metrics", "delim": "=", "periods": {"iamb_start": 1.5}, "metrics": {"MEM": {"type": "gauge", "max": 200}}}]`
+		r := httptest.NewRequest(http.MethodPost, "/conf", strings.NewReader(badConfig))
+		w := httptest.NewRecorder()
+
+		view.ConfHandler(w, r)
+		assertStatus(t, w.Code, http.StatusBadRequest)
+		assertStringContains(t, w.Body.String(), "iamb_start")
+		if view.QNet.Network[0].ID != "test2" {
+			t.Errorf("Expected the running config to stay, got %s", view.QNet.Network[0].ID)
+		}
 	})
 
 	t.Run("Errors on invalid JSON POST", func(t *testing.T) {
@@ -287,6 +466,63 @@ func TestView_ConfHandler(t *testing.T) {
 	})
 }
 
+func TestView_ConfHandlerSecrets(t *testing.T) {
+	secretConfig := `[{"id": "secure", "url": "http://localhost:9999/metrics", "delim": "=", "metrics": {"CPU": {"type": "gauge", "max": 100}}, "auth": {"username": "ops", "password": "hunter2", "headers": {"X-Api-Key": "abc123"}}}]`
+	configFile, delConfig := createTempFile(t, secretConfig)
+	defer delConfig()
+
+	loadConfig, _ := Ms.LoadConfigFileName(configFile.Name())
+	eps := Ms.NewEndpointsFromConfig(loadConfig)
+	view := &Md.View{
+		QNet:       Ms.NewQNet(*eps),
+		Stats:      Mo.NewStatsInternal(),
+		ConfigPath: configFile.Name(),
+	}
+	view.Supervisor = view.NewPollSupervisor()
+	view.Supervisor.Start()
+	defer view.Supervisor.Stop()
+
+	var readBack []byte
+
+	t.Run("GET does not echo secrets", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/conf", nil)
+		w := httptest.NewRecorder()
+		view.ConfHandler(w, r)
+		assertStatus(t, w.Code, http.StatusOK)
+
+		readBack = w.Body.Bytes()
+		if strings.Contains(string(readBack), "hunter2") || strings.Contains(string(readBack), "abc123") {
+			t.Errorf("Secrets were echoed: %s", readBack)
+		}
+		assertStringContains(t, string(readBack), Ms.RedactedSecret)
+	})
+
+	t.Run("POST of the redacted config keeps the secrets", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/conf", strings.NewReader(string(readBack)))
+		w := httptest.NewRecorder()
+		view.ConfHandler(w, r)
+		assertStatus(t, w.Code, http.StatusOK)
+
+		saved, err := Ms.LoadConfigFileName(configFile.Name())
+		assertError(t, err, nil)
+		if saved[0].Auth.Password != "hunter2" || saved[0].Auth.Headers["X-Api-Key"] != "abc123" {
+			t.Errorf("Expected secrets to be kept, got %+v", saved[0].Auth)
+		}
+	})
+
+	t.Run("POST of the redacted config with a new url is refused", func(t *testing.T) {
+		moved := strings.Replace(string(readBack), "localhost:9999", "elsewhere.example.com", 1)
+		r := httptest.NewRequest(http.MethodPost, "/conf", strings.NewReader(moved))
+		w := httptest.NewRecorder()
+		view.ConfHandler(w, r)
+		assertStatus(t, w.Code, http.StatusBadRequest)
+
+		saved, err := Ms.LoadConfigFileName(configFile.Name())
+		assertError(t, err, nil)
+		assertStringContains(t, saved[0].URL, "localhost:9999")
+	})
+}
+
 // Helpers //
 
 type errorReader struct{}
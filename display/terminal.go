@@ -1,19 +1,21 @@
 package monteverdi
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime/debug"
 	"strconv"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gdamore/tcell/v2"
 	Mo "github.com/maroda/monteverdi/obvy"
-	Mp "github.com/maroda/monteverdi/plugin"
 	Ms "github.com/maroda/monteverdi/server"
 	Mt "github.com/maroda/monteverdi/types"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
@@ -25,20 +27,23 @@ const (
 
 // View is updated by whatever is in the QNet
 type View struct {
-	MU          sync.Mutex        // State locks to read data
-	QNet        *Ms.QNet          // Quality Network
-	Screen      tcell.Screen      // the screen itself
-	Display     []string          // rune display sequence
-	Stats       *Mo.StatsInternal // Internal status for prometheus
-	server      *http.Server      // Prometheus metrics server
-	SelectEP    int               // Selected Endpoint with MouseClick
-	ShowEP      bool              // Display Endpoint ID
-	SelectMe    string            // Selected Metric with MouseClick
-	ShowMe      bool              // Display Metric ID
-	ShowPulse   bool              // Display pulse view overlay
-	PulseFilter *Mt.PulsePattern  // For filtering the display
-	Supervisor  *PollSupervisor   // Supervisor for performing QNet polling
-	ConfigPath  string            // Path to JSON configuration
+	MU             sync.Mutex        // State locks to read data
+	QNet           *Ms.QNet          // Quality Network
+	Screen         tcell.Screen      // the screen itself
+	Display        []string          // rune display sequence
+	Stats          *Mo.StatsInternal // Internal status for prometheus
+	server         *http.Server      // Prometheus metrics server
+	SelectEP       int               // Selected Endpoint with MouseClick
+	ShowEP         bool              // Display Endpoint ID
+	SelectMe       string            // Selected Metric with MouseClick
+	ShowMe         bool              // Display Metric ID
+	ShowPulse      bool              // Display pulse view overlay
+	PulseFilter    *Mt.PulsePattern  // For filtering the display
+	Supervisor     *PollSupervisor   // Supervisor for performing QNet polling
+	ConfigPath     string            // Path to JSON configuration
+	Snapshots      *Snapshots        // Engine state saved across restarts, nil when off
+	OutputSettings string            // What the output was opened with, reopened on reload when they change
+	Replay         *Replay           // Archived pulses shown in place of live ones, nil when live
 }
 
 // NewViewWithScreen inits the tcell screen that displays HarmonyView.
@@ -57,9 +62,7 @@ func NewViewWithScreen(q *Ms.QNet, screen tcell.Screen) (*View, error) {
 	// Get all configured metrics from all Endpoints
 	display := make([]string, 0)
 	for _, ep := range q.Network {
-		for _, mv := range ep.Metric {
-			display = append(display, mv)
-		}
+		display = append(display, ep.Metrics()...)
 	}
 
 	// create an attached prometheus registry
@@ -82,7 +85,7 @@ func (v *View) CalcTimeseriesY(endpointIndex, metricIndex, gutter int) int {
 	// Calculate cumulative offset from all previous endpoints
 	offset := 0
 	for i := 0; i < endpointIndex; i++ {
-		offset += len(v.QNet.Network[i].Metric)
+		offset += len(v.QNet.Network[i].Metrics())
 	}
 	return gutter + offset + metricIndex
 }
@@ -93,7 +96,7 @@ func (v *View) CalcTimePos(pulseStartTime time.Time) int {
 	width, _ := v.GetScreenSize()
 	timelineW := width - 2 // room for border drawing
 
-	now := time.Now()
+	now := v.QNet.Now()
 	secondsAgo := int(now.Sub(pulseStartTime).Seconds())
 
 	// Timeline position (0 to timelineWidth-1, where timelineWidth-1 is most recent)
@@ -139,6 +142,15 @@ func (v *View) GetPulseRune(pattern Mt.PulsePattern, isAccent bool) (rune, tcell
 	case Mt.Dactyl:
 		baseColor = tcell.ColorDodgerBlue
 		symbol = '☶'
+	case Mt.Period:
+		baseColor = tcell.ColorGold
+		symbol = '☰'
+	case Mt.Cascade:
+		baseColor = tcell.ColorHotPink
+		symbol = '☍'
+	case Mt.Custom:
+		baseColor = tcell.ColorChartreuse
+		symbol = '⚹'
 	}
 
 	// Shade based on accent state
@@ -184,15 +196,19 @@ func (v *View) DrawPulseView() {
 			filterText = "Trochee Only"
 		case Mt.Amphibrach:
 			filterText = "Amphibrach Only"
+		case Mt.Anapest:
+			filterText = "Anapest Only"
+		case Mt.Dactyl:
+			filterText = "Dactyl Only"
 		}
 	}
 
 	v.DrawText(1, 1, width-10, 2, fmt.Sprintf("PULSE VIEW - %s (triple ictus analysis)", filterText))
-	v.DrawText(1, 2, width-10, 3, "i=Iamb | t=Trochee | a=Amphibrach | x=All | ► stacked long pulses ◄ ")
+	v.DrawText(1, 2, width-10, 3, "i=Iamb | t=Trochee | a=Amphibrach | n=Anapest | d=Dactyl | x=All | ► stacked long pulses ◄ ")
 
 	// Draw pulse visualization for each endpoint/metric
 	for ni := range v.QNet.Network {
-		for di, dm := range v.QNet.Network[ni].Metric {
+		for di, dm := range v.QNet.Network[ni].Metrics() {
 			yTS := v.CalcTimeseriesY(ni, di, screenGutter)
 
 			// Pass the filter for display
@@ -201,7 +217,7 @@ func (v *View) DrawPulseView() {
 
 			// Track long pulse boundaries
 			var longPulseStart, longPulseEnd = -1, -1
-			now := time.Now()
+			now := v.QNet.Network[ni].Now()
 
 			for _, point := range timelineData {
 				pulseAge := now.Sub(point.StartTime).Seconds()
@@ -378,9 +394,9 @@ func (v *View) DrawHarmonyViewMulti() {
 		// step through all Network endpoints
 		for ni := range v.QNet.Network {
 			// step through metrics listed in View.display
-			for di, dm := range v.QNet.Network[ni].Metric {
+			for di, dm := range v.QNet.Network[ni].Metrics() {
 				// look up the key in this Network's Endpoint Metric data.
-				ddm := v.QNet.Network[ni].Mdata[dm]
+				ddm, dda := v.QNet.Network[ni].Value(dm)
 
 				// Calculate unique y position for each endpoint/metric combination
 				yTS := v.CalcTimeseriesY(ni, di, screenGutter)
@@ -389,7 +405,6 @@ func (v *View) DrawHarmonyViewMulti() {
 				v.DrawTimeseries(1, yTS, ni, dm)
 
 				// See an Accent happen
-				dda := v.QNet.Network[ni].Accent[dm]
 				if dda != nil {
 					// now get the second from the Timestamp. this is the X position on the display
 					newTime := time.Unix(dda.Timestamp/1e9, dda.Timestamp%1e9)
@@ -406,11 +421,11 @@ func (v *View) DrawHarmonyViewMulti() {
 		if showMe {
 			for ni := range v.QNet.Network {
 				if ni == selectEP {
-					for di, dm := range v.QNet.Network[ni].Metric {
+					for di, dm := range v.QNet.Network[ni].Metrics() {
 						if dm == selectMe {
 							yTS := v.CalcTimeseriesY(ni, di, screenGutter)
 
-							mdata := v.QNet.Network[ni].Mdata[dm]
+							mdata, _ := v.QNet.Network[ni].Value(dm)
 							label := fmt.Sprintf("... %s ...", dm) // The Metric
 							data := fmt.Sprintf("%d", mdata)       // The raw data
 							v.DrawText(2, yTS, width, yTS, data)
@@ -441,10 +456,10 @@ func (v *View) showMetricWithState(by, g, dx, lx int, showMe bool, selectEP int,
 	if showMe {
 		for ni := range v.QNet.Network {
 			if ni == selectEP {
-				for di, dm := range v.QNet.Network[ni].Metric {
+				for di, dm := range v.QNet.Network[ni].Metrics() {
 					if dm == selectMe {
 						yTS := v.CalcTimeseriesY(ni, di, g)
-						mdata := v.QNet.Network[ni].Mdata[dm]
+						mdata, _ := v.QNet.Network[ni].Value(dm)
 						data := fmt.Sprintf("%d", mdata)       // The raw data
 						label := fmt.Sprintf("... %s ...", dm) // The Metric
 
@@ -486,7 +501,7 @@ func (v *View) HandleMouseClick(x, y int) {
 
 	// Check for a click on any timeseries graph
 	for ni := range v.QNet.Network {
-		for di, dm := range v.QNet.Network[ni].Metric {
+		for di, dm := range v.QNet.Network[ni].Metrics() {
 			// yTS is the same as drawHarmonyViewMulti
 			yTS := v.CalcTimeseriesY(ni, di, screenGutter)
 
@@ -587,6 +602,16 @@ func (v *View) handleEvent() {
 					amphibrach := Mt.Amphibrach
 					v.PulseFilter = &amphibrach
 					v.MU.Unlock()
+				case 'n':
+					v.MU.Lock()
+					anapest := Mt.Anapest
+					v.PulseFilter = &anapest
+					v.MU.Unlock()
+				case 'd':
+					v.MU.Lock()
+					dactyl := Mt.Dactyl
+					v.PulseFilter = &dactyl
+					v.MU.Unlock()
 				case 'i':
 					v.MU.Lock()
 					iamb := Mt.Iamb
@@ -615,10 +640,17 @@ func (v *View) handleEvent() {
 
 // exit cleanly
 func (v *View) exit() {
+	// Saving takes the lock itself
+	v.SaveSnapshot()
+
 	v.MU.Lock()
 	defer v.MU.Unlock()
 	v.Screen.Fini()
 
+	if v.Replay != nil {
+		v.Replay.Stop()
+	}
+
 	if v.QNet.Output != nil {
 		err := v.QNet.Output.Close()
 		if err != nil {
@@ -681,6 +713,7 @@ func StartHarmonyViewWebOnly(c []Ms.ConfigFile, path string) error {
 	}
 
 	// Configure output if set
+	view.OutputSettings = outputSettings()
 	outputLocation := Ms.FillEnvVar("MONTEVERDI_OUTPUT")
 	switch outputLocation {
 	case "ENOENT":
@@ -706,9 +739,8 @@ func StartHarmonyViewWebOnly(c []Ms.ConfigFile, path string) error {
 
 		slog.Info("MIDI Adapter Enabled", slog.String("output", outputLocation))
 	default:
-		// configure BadgerDB at MONTEVERDI_OUTPUT
-		batchSize := 100
-		output, err := Mp.NewBadgerOutput(outputLocation, batchSize)
+		// configure the BadgerDB or SQLite archive at MONTEVERDI_OUTPUT
+		output, err := OpenArchive(outputLocation, view.Stats)
 		if err != nil {
 			slog.Error("Failed to create adapter",
 				slog.String("output", outputLocation),
@@ -718,7 +750,7 @@ func StartHarmonyViewWebOnly(c []Ms.ConfigFile, path string) error {
 		view.QNet.Output = output
 		defer output.Close()
 
-		slog.Info("BadgerOutput Adapter Enabled", slog.String("output", outputLocation))
+		slog.Info("Archive Adapter Enabled", slog.String("type", output.Type()), slog.String("output", outputLocation))
 	}
 
 	// Register config file location
@@ -733,11 +765,30 @@ func StartHarmonyViewWebOnly(c []Ms.ConfigFile, path string) error {
 			})),
 	}
 
+	// Bring back the engine state from the last run
+	view.Snapshots = NewSnapshots()
+	view.RestoreSnapshot()
+
+	// Save state periodically, and once more after polling stops
+	view.StartSnapshots()
+	defer view.StopSnapshots()
+
 	// Create new Poll Supervisor to handle data fetches per endpoint
 	view.Supervisor = view.NewPollSupervisor()
 	view.Supervisor.Start()
 	defer view.Supervisor.Stop()
 
+	// Shut down the web server on a signal so the deferred cleanup runs
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		slog.Info("Shutting down Monteverdi web server...")
+		if err := view.server.Shutdown(context.Background()); err != nil {
+			slog.Error("Could not shut down", slog.Any("Error", err))
+		}
+	}()
+
 	// Run web endpoint (blocks)
 	addr := ":8090"
 	slog.Info("Starting Monteverdi web server...", slog.String("Port", addr))
@@ -780,6 +831,7 @@ func StartHarmonyView(c []Ms.ConfigFile, path string) error {
 	}
 
 	// Configure output if set
+	view.OutputSettings = outputSettings()
 	outputLocation := Ms.FillEnvVar("MONTEVERDI_OUTPUT")
 	switch outputLocation {
 	case "ENOENT":
@@ -793,9 +845,8 @@ func StartHarmonyView(c []Ms.ConfigFile, path string) error {
 
 		slog.Debug("MIDI Adapter Enabled", slog.String("output", outputLocation))
 	default:
-		// configure BadgerDB at MONTEVERDI_OUTPUT
-		batchSize := 100
-		output, err := Mp.NewBadgerOutput(outputLocation, batchSize)
+		// configure the BadgerDB or SQLite archive at MONTEVERDI_OUTPUT
+		output, err := OpenArchive(outputLocation, view.Stats)
 		if err != nil {
 			slog.Error("Failed to create adapter",
 				slog.String("output", outputLocation),
@@ -805,7 +856,7 @@ func StartHarmonyView(c []Ms.ConfigFile, path string) error {
 		view.QNet.Output = output
 		defer output.Close()
 
-		slog.Debug("BadgerOutput Adapter Enabled", slog.String("output", outputLocation))
+		slog.Debug("Archive Adapter Enabled", slog.String("type", output.Type()), slog.String("output", outputLocation))
 	}
 
 	// Register config file location
@@ -820,11 +871,26 @@ func StartHarmonyView(c []Ms.ConfigFile, path string) error {
 			})),
 	}
 
+	// Bring back the engine state from the last run
+	view.Snapshots = NewSnapshots()
+	view.RestoreSnapshot()
+
 	// Create new Poll Supervisor to handle data fetches per endpoint
 	view.Supervisor = view.NewPollSupervisor()
 	view.Supervisor.Start()
 	defer view.Supervisor.Stop()
 
+	// Save state periodically, exit() saves the last one
+	view.StartSnapshots()
+
+	// A signal exits the same way as the keyboard
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		view.exit()
+	}()
+
 	// Run HarmonyView in the terminal
 	go view.runTUI()
 
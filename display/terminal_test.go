@@ -7,6 +7,7 @@ import (
 	"net/http/httptest"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -738,6 +739,8 @@ func TestView_DrawPulseView(t *testing.T) {
 		{"Iamb", Mt.Iamb},
 		{"Trochee", Mt.Trochee},
 		{"Amphibrach", Mt.Amphibrach},
+		{"Anapest", Mt.Anapest},
+		{"Dactyl", Mt.Dactyl},
 	}
 
 	for _, ff := range filtertests {
@@ -815,6 +818,52 @@ func TestView_DrawHarmonyViewMulti_Concurrent(t *testing.T) {
 	wg.Wait() // Should not deadlock or panic
 }
 
+func TestView_DrawWhilePollingSeries(t *testing.T) {
+	// Each poll answers with one more series than the last
+	var polls atomic.Int32
+	mockServ := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(polls.Add(1))
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(w, "http_requests_total{code=\"200\",pod=\"api-%d\"} %d\n", i, i*10)
+		}
+	}))
+	defer mockServ.Close()
+
+	config := []Ms.ConfigFile{{
+		ID:       "PROM",
+		URL:      mockServ.URL,
+		Format:   "prometheus",
+		Interval: 1,
+		Metrics: map[string]Ms.MetricConfig{
+			"requests_200": {Type: "gauge", Max: 5, Selector: `http_requests_total{code="200"}`},
+		},
+	}}
+	eps := Ms.NewEndpointsFromConfig(config)
+	view := makeTestViewWithScreen(t, *eps)
+	defer view.Screen.Fini()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			view.QNet.PollEndpoint(0)
+		}
+	}()
+
+	for drawing := true; drawing; {
+		select {
+		case <-done:
+			drawing = false
+		default:
+		}
+		view.DrawHarmonyViewMulti()
+		view.DrawPulseView()
+		view.HandleMouseClick(2, 3)
+	}
+
+	assertInt(t, len(view.QNet.Network[0].Metrics()), 20)
+}
+
 func TestView_DrawHarmonyViewMulti_EmptyQNet(t *testing.T) {
 	view := makeTestViewWithScreen(t, []*Ms.Endpoint{})
 	defer view.Screen.Fini()
@@ -882,6 +931,9 @@ func TestView_GetPulseRune(t *testing.T) {
 			{"Amphibrach", Mt.Amphibrach, '☵', tcell.ColorAquaMarine},
 			{"Anapest", Mt.Anapest, '☳', tcell.ColorAzure},
 			{"Dactyl", Mt.Dactyl, '☶', tcell.ColorDodgerBlue},
+			{"Period", Mt.Period, '☰', tcell.ColorGold},
+			{"Cascade", Mt.Cascade, '☍', tcell.ColorHotPink},
+			{"Custom", Mt.Custom, '⚹', tcell.ColorChartreuse},
 		}
 
 		for _, tt := range tests {
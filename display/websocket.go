@@ -14,16 +14,18 @@ import (
 )
 
 type PulseDataD3 struct {
-	Ring      int     `json:"ring"`      // 0=60sec, 1=10min, 2=1hr
-	Angle     float64 `json:"angle"`     // 0-360 degrees
-	Type      string  `json:"type"`      // PulsePattern Types
-	Intensity float64 `json:"intensity"` // 0.0-1.0
-	Speed     float64 `json:"speed"`     // degrees per frame
-	Metric    string  `json:"metric"`    // Which system metric
-	Dimension int     `json:"dimension"` // Dimension for viz placement
-	StartTime int64   `json:"startTime"` // StartTime key for the pulse
-	Duration  int64   `json:"duration"`  // Pulse Duration
-	Endpoint  string  `json:"endpoint"`  // Endpoint ID
+	Ring      int      `json:"ring"`             // 0=60sec, 1=10min, 2=1hr
+	Angle     float64  `json:"angle"`            // 0-360 degrees
+	Type      string   `json:"type"`             // PulsePattern Types
+	Intensity float64  `json:"intensity"`        // 0.0-1.0
+	Speed     float64  `json:"speed"`            // degrees per frame
+	Metric    string   `json:"metric"`           // Which system metric
+	Dimension int      `json:"dimension"`        // Dimension for viz placement
+	StartTime int64    `json:"startTime"`        // StartTime key for the pulse
+	Duration  int64    `json:"duration"`         // Pulse Duration
+	Endpoint  string   `json:"endpoint"`         // Endpoint ID
+	Linked    []string `json:"linked,omitempty"` // Cascade: the metrics it links, leader first
+	Custom    bool     `json:"custom,omitempty"` // Type is the name of a user-defined pattern
 }
 
 var upgrader = websocket.Upgrader{
@@ -61,6 +63,11 @@ func (v *View) WebsocketHandler(w http.ResponseWriter, r *http.Request) {
 
 // GetPulseDataD3 prepares the websocket data payload
 func (v *View) GetPulseDataD3() []PulseDataD3 {
+	// A replay is shown in place of the live pulses
+	if replay := v.replay(); replay != nil {
+		return replay.PulseDataD3(v)
+	}
+
 	// Make sure we're not nil
 	if v.QNet == nil || v.QNet.Network == nil {
 		return []PulseDataD3{}
@@ -78,19 +85,21 @@ func (v *View) GetPulseDataD3() []PulseDataD3 {
 
 		// Process pulses from TemporalGrouper
 		if endpoint.Pulses != nil {
+			now := endpoint.Now()
 			for _, pulse := range endpoint.Pulses.Buffer {
 				for _, metric := range pulse.Metric {
 					d3pulse := PulseDataD3{
-						Ring:      CalcRing(pulse.StartTime),
-						Angle:     CalcAngle(pulse.StartTime),
-						Type:      PulsePatternToString(pulse.Pattern),
+						Ring:      CalcRingAt(pulse.StartTime, now),
+						Angle:     CalcAngleAt(pulse.StartTime, now),
+						Type:      PulseName(pulse),
 						Intensity: CalcIntensity(endpoint),
-						Speed:     v.CalcSpeedForPulse(pulse),
+						Speed:     v.CalcSpeedForPulse(pulse, now),
 						Metric:    metric,
 						Dimension: pulse.Dimension,
 						StartTime: pulse.StartTime.UnixNano(),
 						Duration:  pulse.Duration.Nanoseconds(),
 						Endpoint:  endpoint.ID,
+						Custom:    pulse.Pattern == Mt.Custom,
 					}
 
 					pulses = append(pulses, d3pulse)
@@ -108,6 +117,26 @@ func (v *View) GetPulseDataD3() []PulseDataD3 {
 		endpoint.MU.RUnlock()
 	}
 
+	// Cascades link metrics, both ends are drawn on their own metric's ring
+	now := v.QNet.Now()
+	for _, cascade := range v.QNet.Cascade.Cascades() {
+		for mi, metric := range cascade.Metric {
+			pulses = append(pulses, PulseDataD3{
+				Ring:      CalcRingAt(cascade.StartTime, now),
+				Angle:     CalcAngleAt(cascade.StartTime, now),
+				Type:      PulsePatternToString(cascade.Pattern),
+				Intensity: 1.0,
+				Speed:     v.CalcSpeedForPulse(cascade.PulseEvent, now),
+				Metric:    metric,
+				Dimension: cascade.Dimension,
+				StartTime: cascade.StartTime.UnixNano(),
+				Duration:  cascade.Duration.Nanoseconds(),
+				Endpoint:  cascade.Endpoints[mi],
+				Linked:    cascade.Metric,
+			})
+		}
+	}
+
 	return pulses
 }
 
@@ -124,16 +153,34 @@ func PulsePatternToString(pattern Mt.PulsePattern) string {
 		return "anapest"
 	case Mt.Dactyl:
 		return "dactyl"
+	case Mt.Period:
+		return "period"
+	case Mt.Cascade:
+		return "cascade"
+	case Mt.Custom:
+		return "custom"
 	default:
 		return "unknown"
 	}
 }
 
+// PulseName is the pattern of a pulse, or its name when it's user-defined.
+func PulseName(pulse Mt.PulseEvent) string {
+	if pulse.Pattern == Mt.Custom && pulse.Name != "" {
+		return pulse.Name
+	}
+	return PulsePatternToString(pulse.Pattern)
+}
+
 // CalcAngle returns the pulse's place along the ring.
 func CalcAngle(ps time.Time) float64 {
-	now := time.Now()
+	return CalcAngleAt(ps, time.Now())
+}
+
+// CalcAngleAt returns the pulse's place along the ring at time now.
+func CalcAngleAt(ps, now time.Time) float64 {
 	age := now.Sub(ps)
-	ring := CalcRing(ps)
+	ring := CalcRingAt(ps, now)
 
 	var angleInWindow float64
 
@@ -188,7 +235,11 @@ func CalcIntensity(ep *Ms.Endpoint) float64 {
 
 // CalcRing returns which ring the pulse belongs based on age
 func CalcRing(ps time.Time) int {
-	now := time.Now()
+	return CalcRingAt(ps, time.Now())
+}
+
+// CalcRingAt returns which ring the pulse belongs based on its age at time now
+func CalcRingAt(ps, now time.Time) int {
 	age := now.Sub(ps)
 	aSec := age.Seconds()
 
@@ -225,7 +276,12 @@ type SpeedConfig struct {
 // Middle ring completes full rotation in ~36 seconds
 // Outer ring completes full rotation in ~72 seconds
 func CalcSpeed(ps time.Time, config SpeedConfig) float64 {
-	ring := CalcRing(ps)
+	return CalcSpeedAt(ps, time.Now(), config)
+}
+
+// CalcSpeedAt is CalcSpeed for the pulse's age at time now
+func CalcSpeedAt(ps, now time.Time, config SpeedConfig) float64 {
+	ring := CalcRingAt(ps, now)
 
 	var baseSpeed float64
 	switch ring {
@@ -242,7 +298,7 @@ func CalcSpeed(ps time.Time, config SpeedConfig) float64 {
 }
 
 // CalcSpeedForPulse is a wrapper for CalcSpeed to provide a configuration
-func (v *View) CalcSpeedForPulse(pe Mt.PulseEvent) float64 {
+func (v *View) CalcSpeedForPulse(pe Mt.PulseEvent, now time.Time) float64 {
 	// Default configuration - completely configurable
 	config := SpeedConfig{
 		InnerBase:  0.3,   // Ring 0: 0.3°/50ms = 6°/s = 60s/rotation
@@ -251,5 +307,5 @@ func (v *View) CalcSpeedForPulse(pe Mt.PulseEvent) float64 {
 		GlobalBase: 1.0,
 	}
 
-	return CalcSpeed(pe.StartTime, config)
+	return CalcSpeedAt(pe.StartTime, now, config)
 }
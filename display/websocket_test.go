@@ -29,6 +29,9 @@ func TestPulsePatternToString(t *testing.T) {
 		{"amphibrach", Mt.Amphibrach},
 		{"anapest", Mt.Anapest},
 		{"dactyl", Mt.Dactyl},
+		{"period", Mt.Period},
+		{"cascade", Mt.Cascade},
+		{"custom", Mt.Custom},
 		{"unknown", 99},
 	}
 
@@ -65,6 +68,31 @@ func TestCalcRing(t *testing.T) {
 	})
 }
 
+func TestCalcRingAt(t *testing.T) {
+	// A pulse from the past, placed by a simulated clock
+	start := time.Date(2023, 10, 1, 14, 0, 0, 0, time.UTC)
+
+	t.Run("Places the pulse by the given time", func(t *testing.T) {
+		assertInt(t, Md.CalcRingAt(start, start.Add(30*time.Second)), 0)
+		assertInt(t, Md.CalcRingAt(start, start.Add(5*time.Minute)), 1)
+		assertInt(t, Md.CalcRingAt(start, start.Add(30*time.Minute)), 2)
+		assertInt(t, Md.CalcRing(start), -1)
+	})
+
+	t.Run("Angle and speed follow the ring", func(t *testing.T) {
+		// Half a minute in, half way around the inner ring
+		angle := Md.CalcAngleAt(start, start.Add(30*time.Second))
+		if math.Abs(angle-90.0) > 0.001 {
+			t.Errorf("Expected angle 90, got %f", angle)
+		}
+
+		config := Md.SpeedConfig{InnerBase: 0.3, MiddleBase: 0.03, OuterBase: 0.005, GlobalBase: 1.0}
+		if got := Md.CalcSpeedAt(start, start.Add(5*time.Minute), config); got != 0.03 {
+			t.Errorf("Expected middle ring speed 0.03, got %f", got)
+		}
+	})
+}
+
 func TestCalcAngle(t *testing.T) {
 	now := time.Now()
 
@@ -362,6 +390,69 @@ func TestAmphibrachFlowToD3(t *testing.T) {
 	})
 }
 
+func TestTernaryFeetFlowToD3(t *testing.T) {
+	feet := []struct {
+		name     string
+		sequence []Mt.PulsePattern
+	}{
+		{"anapest", []Mt.PulsePattern{Mt.Iamb, Mt.Iamb, Mt.Trochee}},
+		{"dactyl", []Mt.PulsePattern{Mt.Trochee, Mt.Iamb, Mt.Iamb}},
+	}
+
+	for _, foot := range feet {
+		t.Run(foot.name+" appears in the D2 ring", func(t *testing.T) {
+			endpoint := makeEndpoint("TEST", "http://test")
+			now := time.Now()
+
+			// Detected by the grouper from D1 pulses two minutes old
+			for i, pattern := range foot.sequence {
+				endpoint.Pulses.AddPulse(Mt.PulseEvent{
+					Dimension: 1,
+					Pattern:   pattern,
+					StartTime: now.Add(-2*time.Minute + time.Duration(i*5)*time.Second),
+					Duration:  4 * time.Second,
+					Metric:    []string{"CPU1"},
+				})
+			}
+
+			view := &Md.View{QNet: &Ms.QNet{Network: Ms.Endpoints{endpoint}}}
+			found := 0
+			for _, pulse := range view.GetPulseDataD3() {
+				if pulse.Dimension == 2 && pulse.Type == foot.name {
+					found++
+					if pulse.Ring != 1 {
+						t.Errorf("%s in wrong ring: %d", foot.name, pulse.Ring)
+					}
+				}
+			}
+			assertInt(t, found, 1)
+		})
+	}
+}
+
+func TestCascadeFlowToD3(t *testing.T) {
+	now := time.Now().Add(-2 * time.Minute)
+	qn := &Ms.QNet{Network: Ms.Endpoints{}, Cascade: Ms.NewCascadeDetector(5 * time.Second)}
+	qn.Cascade.AddPulse("DB", Mt.PulseEvent{Dimension: 1, Pattern: Mt.Iamb, StartTime: now, Duration: time.Second, Metric: []string{"latency"}})
+	qn.Cascade.AddPulse("API", Mt.PulseEvent{Dimension: 1, Pattern: Mt.Iamb, StartTime: now.Add(2 * time.Second), Duration: time.Second, Metric: []string{"errors"}})
+
+	view := &Md.View{QNet: qn}
+	ends := map[string]string{}
+	for _, pulse := range view.GetPulseDataD3() {
+		if pulse.Type != "cascade" {
+			continue
+		}
+		ends[pulse.Metric] = pulse.Endpoint
+		assertInt(t, pulse.Ring, 1)
+		assertInt(t, len(pulse.Linked), 2)
+		assertString(t, pulse.Linked[0], "latency")
+	}
+
+	// Drawn on both metrics' rings
+	assertString(t, ends["latency"], "DB")
+	assertString(t, ends["errors"], "API")
+}
+
 func TestCalcAngleForAmphibrach(t *testing.T) {
 	now := time.Now()
 
@@ -394,6 +485,39 @@ func TestView_GetPulseDataD3(t *testing.T) {
 			t.Errorf("View.GetPulseDataD3() = %+v, want %+v", got, want)
 		}
 	})
+
+	t.Run("Custom pulses are sent by name", func(t *testing.T) {
+		endpoint := makeEndpoint("TEST", "http://test")
+		endpoint.Pulses.Buffer = []Mt.PulseEvent{
+			{
+				Dimension: 2,
+				Pattern:   Mt.Custom,
+				Name:      "surge",
+				StartTime: time.Now().Add(-2 * time.Minute),
+				Duration:  30 * time.Second,
+				Metric:    []string{"CPU1"},
+			},
+			{
+				Dimension: 1,
+				Pattern:   Mt.Iamb,
+				StartTime: time.Now().Add(-10 * time.Second),
+				Duration:  5 * time.Second,
+				Metric:    []string{"CPU1"},
+			},
+		}
+		view := &Md.View{QNet: &Ms.QNet{Network: Ms.Endpoints{endpoint}}}
+
+		got := view.GetPulseDataD3()
+		assertInt(t, len(got), 2)
+		assertString(t, got[0].Type, "surge")
+		if !got[0].Custom {
+			t.Error("Expected the surge to be marked custom")
+		}
+		assertString(t, got[1].Type, "iamb")
+		if got[1].Custom {
+			t.Error("Expected the iamb to be built in")
+		}
+	})
 }
 
 func TestWebsocketHandler(t *testing.T) {
@@ -692,3 +816,10 @@ func assertStringContains(t *testing.T, full, want string) {
 		t.Errorf("Did not find %q, expected string contains %q", want, full)
 	}
 }
+
+func assertString(t *testing.T, got, want string) {
+	t.Helper()
+	if got != want {
+		t.Errorf("did not get correct string, got %q, want %q", got, want)
+	}
+}
@@ -13,6 +13,7 @@ import (
 
 	Md "github.com/maroda/monteverdi/display"
 	Mo "github.com/maroda/monteverdi/obvy"
+	Mp "github.com/maroda/monteverdi/plugin"
 	Ms "github.com/maroda/monteverdi/server"
 )
 
@@ -77,6 +78,13 @@ func main() {
 	// check if headless for container use
 	configfile := flag.String("config", "config.json", "Path to configuration JSON")
 	headless := flag.Bool("headless", false, "Container mode: no Terminal UI, logs sink to STDOUT")
+	backfill := flag.String("backfill", "", "Replay history and exit: a Prometheus text file with timestamps, or \"range\" to query each endpoint's source")
+	from := flag.String("from", "", "Backfill or export range start (RFC3339)")
+	to := flag.String("to", "", "Backfill or export range end (RFC3339, default: now)")
+	step := flag.Duration("step", 0, "Backfill range step (default: each endpoint's interval)")
+	rewrite := flag.String("rewrite", "", "Rewrite the BadgerDB archive at this path in the current pulse encoding and exit")
+	export := flag.String("export", "", "Export the pulses archived at MONTEVERDI_OUTPUT and exit: csv, ndjson, or parquet")
+	out := flag.String("out", "", "Export file (default: pulses-<from>-<to>.<format>)")
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Monteverdi - Seconda Practica Observability\n\n")
 		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n\n", os.Args[0])
@@ -86,16 +94,38 @@ func main() {
 		fmt.Fprintf(os.Stderr, "  MONTEVERDI_CONFIG_FILE\n")
 		fmt.Fprintf(os.Stderr, "        Path to configuration file (default: config.json)\n")
 		fmt.Fprintf(os.Stderr, "  MONTEVERDI_OUTPUT\n")
-		fmt.Fprintf(os.Stderr, "        Location for output, currently sets a BadgerDB database path.\n")
+		fmt.Fprintf(os.Stderr, "        Location for output: MIDI, a SQLite file (.db, .sqlite), or a BadgerDB directory.\n")
+		fmt.Fprintf(os.Stderr, "  MONTEVERDI_PLUGIN_BADGER_TTL_HOURS\n")
+		fmt.Fprintf(os.Stderr, "        Hours to keep archived pulses by dimension, e.g. 72,2160 (default: forever)\n")
+		fmt.Fprintf(os.Stderr, "  MONTEVERDI_PLUGIN_BADGER_MAX_MB\n")
+		fmt.Fprintf(os.Stderr, "        Size cap of the archive, the oldest pulses are deleted first (default: none)\n")
+		fmt.Fprintf(os.Stderr, "  MONTEVERDI_PLUGIN_BADGER_GC_INTERVAL_SECONDS\n")
+		fmt.Fprintf(os.Stderr, "        Seconds between archive retention passes (default: 300)\n")
+		fmt.Fprintf(os.Stderr, "  MONTEVERDI_PLUGIN_BADGER_ROLLUP_INTERVAL_SECONDS\n")
+		fmt.Fprintf(os.Stderr, "        Seconds between archive rollups of new pulses (default: 60)\n")
 		fmt.Fprintf(os.Stderr, "  MONTEVERDI_LOGLEVEL\n")
 		fmt.Fprintf(os.Stderr, "        Log level: debug or info (default: info)\n")
 		fmt.Fprintf(os.Stderr, "  MONTEVERDI_TUI_TSDB_VISUAL_WINDOW\n")
 		fmt.Fprintf(os.Stderr, "        TUI display width in characters (default: 80)\n")
 		fmt.Fprintf(os.Stderr, "  MONTEVERDI_PULSE_WINDOW_SECONDS\n")
 		fmt.Fprintf(os.Stderr, "        Pulse lifecycle window in seconds (default: 3600)\n")
+		fmt.Fprintf(os.Stderr, "  MONTEVERDI_PULSE_DIMENSIONS\n")
+		fmt.Fprintf(os.Stderr, "        Highest pulse dimension detected, 2 turns off Periods (default: 3)\n")
+		fmt.Fprintf(os.Stderr, "  MONTEVERDI_SERIES_EXPIRE_POLLS\n")
+		fmt.Fprintf(os.Stderr, "        Polls a Prometheus series is kept after it stops being exposed, 0 keeps it (default: 10)\n")
+		fmt.Fprintf(os.Stderr, "  MONTEVERDI_CASCADE_TOLERANCE_SECONDS\n")
+		fmt.Fprintf(os.Stderr, "        Seconds between pulses on two metrics to form a Cascade, 0 turns it off (default: 10)\n")
+		fmt.Fprintf(os.Stderr, "  MONTEVERDI_SNAPSHOT_PATH\n")
+		fmt.Fprintf(os.Stderr, "        File to save engine state to and restore it from across restarts (default: off)\n")
+		fmt.Fprintf(os.Stderr, "  MONTEVERDI_SNAPSHOT_INTERVAL_SECONDS\n")
+		fmt.Fprintf(os.Stderr, "        Seconds between engine state snapshots (default: 60)\n")
 		fmt.Fprintf(os.Stderr, "\nExamples:\n")
 		fmt.Fprintf(os.Stderr, "  %s -config=/path/to/config.json\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s -headless\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -backfill=outage.prom\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -backfill=range -from=2025-10-01T14:00:00Z -to=2025-10-01T16:00:00Z\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -rewrite=/path/to/archive\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -export=parquet -from=2025-10-01T00:00:00Z -out=october.parquet\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  MONTEVERDI_CONFIG_FILE=myconfig.json %s\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "\nRun with no options to start the terminal UI with webserver (port 8090).\n")
 		fmt.Fprintf(os.Stderr, "There is a short warmup before pulses will appear in the web UI.\n")
@@ -103,6 +133,26 @@ func main() {
 	}
 	flag.Parse()
 
+	// Rewrite upgrades an archive in place and exits, it needs no config
+	if *rewrite != "" {
+		if err := runRewrite(*rewrite); err != nil {
+			slog.Error("Rewrite failed", slog.Any("Error", err))
+			fmt.Fprintf(os.Stderr, "Rewrite failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Export writes the archive to a file and exits, it needs no config
+	if *export != "" {
+		if err := runExport(*export, *from, *to, *out); err != nil {
+			slog.Error("Export failed", slog.Any("Error", err))
+			fmt.Fprintf(os.Stderr, "Export failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Determine config path: flag > env var > default
 	configPath := *configfile
 	if configPath == "" {
@@ -121,6 +171,16 @@ func main() {
 		panic("Error loading config.json")
 	}
 
+	// Backfill replays history into the output and exits
+	if *backfill != "" {
+		if err = runBackfill(config, *backfill, *from, *to, *step); err != nil {
+			slog.Error("Backfill failed", slog.Any("Error", err))
+			fmt.Fprintf(os.Stderr, "Backfill failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Graceful shutdown
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
@@ -148,3 +208,160 @@ func main() {
 		slog.Error("Error shutting down tracer", slog.Any("error", err))
 	}
 }
+
+// runBackfill replays history for every configured endpoint
+// into the archive at MONTEVERDI_OUTPUT, or just reports the pulses found.
+func runBackfill(config []Ms.ConfigFile, mode, from, to string, step time.Duration) error {
+	qn := Ms.NewQNet(*Ms.NewEndpointsFromConfig(config))
+
+	outputLocation := Ms.FillEnvVar("MONTEVERDI_OUTPUT")
+	switch outputLocation {
+	case "ENOENT", "MIDI":
+		slog.Warn("Backfill output not configured, reporting pulses only")
+	default:
+		var output Mp.OutputAdapter
+		var err error
+		if Md.IsSQLiteLocation(outputLocation) {
+			output, err = Md.OpenSQLiteArchive(outputLocation, 100)
+		} else {
+			output, err = Mp.NewBadgerOutputWithRetention(outputLocation, 100, Md.NewRetentionFromEnv())
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create adapter: %w", err)
+		}
+		qn.Output = output
+		defer output.Close()
+	}
+
+	var reports []*Ms.BackfillReport
+	if mode == "range" {
+		start, err := time.Parse(time.RFC3339, from)
+		if err != nil {
+			return fmt.Errorf("invalid -from: %w", err)
+		}
+		end := time.Now()
+		if to != "" {
+			if end, err = time.Parse(time.RFC3339, to); err != nil {
+				return fmt.Errorf("invalid -to: %w", err)
+			}
+		}
+
+		for ni, ep := range qn.Network {
+			report, err := qn.BackfillRange(ni, start, end, step)
+			if err != nil {
+				slog.Warn("Endpoint not backfilled", slog.String("endpoint", ep.ID), slog.Any("error", err))
+				continue
+			}
+			reports = append(reports, report)
+		}
+	} else {
+		file, err := os.Open(mode)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		expo, err := Ms.ParsePromExposition(file)
+		if err != nil {
+			return err
+		}
+		for ni := range qn.Network {
+			reports = append(reports, qn.BackfillExposition(ni, expo))
+		}
+	}
+
+	for _, report := range reports {
+		fmt.Printf("%s: %d samples replayed, %d skipped", report.Endpoint, report.Samples, report.Skipped)
+		if report.Samples > 0 {
+			fmt.Printf(" (%s to %s)", report.Start.Format(time.RFC3339), report.End.Format(time.RFC3339))
+		}
+		fmt.Println()
+		for pattern, n := range report.Pulses {
+			fmt.Printf("  %-10s %d\n", Md.PulsePatternToString(pattern), n)
+		}
+	}
+
+	return nil
+}
+
+// runRewrite rewrites the pulses of the BadgerDB at path with the current keys
+// and encoding. Monteverdi can't have the archive open while it runs.
+func runRewrite(path string) error {
+	output, err := Mp.NewBadgerOutput(path, 1)
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer output.Close()
+
+	rewritten, err := output.RewritePulses()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: %d pulses rewritten in encoding version %d\n", path, rewritten, Mp.EncodingVersion)
+	return nil
+}
+
+// runExport writes the pulses archived at MONTEVERDI_OUTPUT from from to to
+// into a file in the format. Monteverdi can't have the archive open while it runs,
+// the /api/export endpoint exports from a running one.
+func runExport(format, from, to, out string) error {
+	if _, ok := Md.ExportFormats[format]; !ok {
+		return fmt.Errorf("invalid -export %q, one of csv, ndjson, parquet", format)
+	}
+	location := Ms.FillEnvVar("MONTEVERDI_OUTPUT")
+	if location == "ENOENT" || location == "MIDI" {
+		return fmt.Errorf("MONTEVERDI_OUTPUT is not a pulse archive")
+	}
+
+	pq := Mp.PulseQuery{End: time.Now()}
+	var err error
+	if from != "" {
+		if pq.Start, err = time.Parse(time.RFC3339, from); err != nil {
+			return fmt.Errorf("invalid -from: %w", err)
+		}
+	}
+	if to != "" {
+		if pq.End, err = time.Parse(time.RFC3339, to); err != nil {
+			return fmt.Errorf("invalid -to: %w", err)
+		}
+	}
+	if out == "" {
+		out = Md.ExportFileName(pq, format)
+	}
+
+	var archive interface {
+		Mp.OutputAdapter
+		Mp.PulseQuerier
+	}
+	if Md.IsSQLiteLocation(location) {
+		archive, err = Md.OpenSQLiteArchive(location, 1)
+	} else {
+		archive, err = Mp.OpenBadgerReadOnly(location)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer archive.Close()
+
+	file, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	pw, err := Md.NewPulseWriter(format, file)
+	if err != nil {
+		return err
+	}
+	written, err := Md.ExportPulses(archive, pq, pw)
+	if err != nil {
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: %d pulses exported\n", out, written)
+	return nil
+}
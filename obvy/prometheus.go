@@ -14,6 +14,13 @@ type StatsInternal struct {
 	WWWStats    *prometheus.CounterVec
 	PollSingle  prometheus.Counter
 	PollTimer   prometheus.Histogram
+
+	// Pulse archive retention
+	ArchiveTimer    prometheus.Histogram
+	ArchiveErrors   prometheus.Counter
+	ArchiveTrimmed  prometheus.Counter
+	ArchiveRewrites prometheus.Counter
+	ArchiveSize     prometheus.Gauge
 }
 
 func NewStatsInternal() *StatsInternal {
@@ -45,6 +52,26 @@ func NewStatsInternal() *StatsInternal {
 		prometheus.HistogramOpts{Name: "poll_requests_seconds"})
 	si.WWWRegistry.MustRegister(si.PollTimer)
 
+	si.ArchiveTimer = prometheus.NewHistogram(
+		prometheus.HistogramOpts{Name: "archive_retention_seconds"})
+	si.WWWRegistry.MustRegister(si.ArchiveTimer)
+
+	si.ArchiveErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "archive_retention_errors_total"})
+	si.WWWRegistry.MustRegister(si.ArchiveErrors)
+
+	si.ArchiveTrimmed = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "archive_pulses_trimmed_total"})
+	si.WWWRegistry.MustRegister(si.ArchiveTrimmed)
+
+	si.ArchiveRewrites = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "archive_vlog_rewrites_total"})
+	si.WWWRegistry.MustRegister(si.ArchiveRewrites)
+
+	si.ArchiveSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "archive_size_bytes"})
+	si.WWWRegistry.MustRegister(si.ArchiveSize)
+
 	return si
 }
 
@@ -61,6 +88,18 @@ func (si *StatsInternal) RecPollTimer(duration float64) {
 	si.PollSingle.Inc()
 }
 
+// RecRetention records one retention pass of the pulse archive
+func (si *StatsInternal) RecRetention(duration float64, trimmed, rewrites int, size int64) {
+	si.ArchiveTimer.Observe(duration)
+	si.ArchiveTrimmed.Add(float64(trimmed))
+	si.ArchiveRewrites.Add(float64(rewrites))
+	si.ArchiveSize.Set(float64(size))
+}
+
+func (si *StatsInternal) RecRetentionError() {
+	si.ArchiveErrors.Inc()
+}
+
 func (si *StatsInternal) Handler() http.Handler {
 	return promhttp.HandlerFor(si.WWWRegistry, promhttp.HandlerOpts{})
 }
@@ -8,6 +8,8 @@ package plugin
 */
 
 import (
+	"context"
+	"slices"
 	"time"
 
 	Mt "github.com/maroda/monteverdi/types"
@@ -25,6 +27,55 @@ type MetricTransformer interface {
 	Type() string       // Unique ID for the transformer
 }
 
+// DataSource polls a system for metrics, returned by metric key.
+// Configure receives the endpoint "url", "delim" and "metrics" (the config keys),
+// "metric_config" (each metric's config object by key),
+// along with anything from the endpoint's "config" stanza.
+type DataSource interface {
+	Poll() (map[string]int64, error)               // Fetch current values by metric key
+	Configure(config map[string]interface{}) error // Apply the endpoint configuration
+	ID() string                                    // Unique ID for the source
+}
+
+// RangeSource is a DataSource that can also return the history
+// of its metrics between start and end, used to backfill.
+type RangeSource interface {
+	DataSource
+	PollRange(start, end time.Time, step time.Duration) (map[string][]Sample, error)
+}
+
+// Sample is one timestamped value of a metric
+type Sample struct {
+	Timestamp time.Time
+	Value     int64
+}
+
+// HTTPSource is a DataSource that fetches over HTTP,
+// the poller hands it a client to reuse connections.
+type HTTPSource interface {
+	DataSource
+	SetClient(c HTTPClient)
+}
+
+// PatternAnalyzer recognizes pulses of one dimension in the sequence below it.
+// In D1 the sequence is the Ictus of a metric. In D2 and up each Ictus is
+// a pulse of the dimension below: Timestamp and Duration are the pulse's,
+// and IsAccent is whether the pulse starts on an accent (a Trochee, a Dactyl).
+// Detected pulses carry their Pattern (and Name), StartTime, Duration,
+// and the Timestamps of their Children, the caller fills in Dimension and Metric.
+type PatternAnalyzer interface {
+	DetectPatterns(sequence []Mt.Ictus) ([]Mt.PulseEvent, error)
+	PatternName() string // Unique name of the pattern
+	Dimension() int      // Which dimension this analyzer operates on
+}
+
+// ConfigurableAnalyzer is a PatternAnalyzer set up from the config,
+// Configure receives the entry from "pattern_analyzers"
+type ConfigurableAnalyzer interface {
+	PatternAnalyzer
+	Configure(config map[string]interface{}) error
+}
+
 // OutputAdapter can be used to define a place for the data to go,
 // pulse-by-pulse or in batches if supported by the output type.
 type OutputAdapter interface {
@@ -35,3 +86,65 @@ type OutputAdapter interface {
 	Close() error                                         // Close the adapter and release resources
 	Type() string                                         // ID for output
 }
+
+// PulseQuerier is an OutputAdapter that archives pulses and can find them again
+type PulseQuerier interface {
+	Query(q PulseQuery) (*PulsePage, error)
+}
+
+// RollupQuerier is an OutputAdapter that keeps rollups of the pulses it archives,
+// resolution is one of RollupResolutions
+type RollupQuerier interface {
+	Rollups(start, end time.Time, resolution time.Duration) ([]*Rollup, error)
+}
+
+// SQLQuerier is an OutputAdapter that answers read-only SQL over the pulses it archives
+type SQLQuerier interface {
+	QuerySQL(ctx context.Context, query string, maxRows int) (*SQLResult, error)
+}
+
+// SQLResult is the outcome of a QuerySQL
+type SQLResult struct {
+	Columns   []string        `json:"columns"`
+	Rows      [][]interface{} `json:"rows"`
+	Truncated bool            `json:"truncated,omitempty"` // there were more than maxRows rows
+}
+
+// PulseQuery selects archived pulses, zero values match everything
+type PulseQuery struct {
+	Start     time.Time        // inclusive
+	End       time.Time        // exclusive, zero for no end
+	Endpoint  string           // ID of the endpoint the pulse was detected on
+	Metric    string           // any metric of the pulse, a Cascade has two
+	Dimension int              // 0 for any
+	Pattern   *Mt.PulsePattern // nil for any
+	Name      string           // pattern name of a Custom pulse
+	After     []byte           // continue after this key, the Next of the previous page
+	Limit     int              // pulses per page, 0 for all
+}
+
+// PulsePage is a page of pulses in time order
+type PulsePage struct {
+	Pulses []*Mt.PulseEvent
+	Next   []byte // key of the last pulse when there are more, nil on the last page
+}
+
+// Matches tells whether a pulse passes the query's filters, not its time range
+func (q PulseQuery) Matches(p *Mt.PulseEvent) bool {
+	if q.Dimension > 0 && p.Dimension != q.Dimension {
+		return false
+	}
+	if q.Pattern != nil && p.Pattern != *q.Pattern {
+		return false
+	}
+	if q.Name != "" && p.Name != q.Name {
+		return false
+	}
+	if q.Endpoint != "" && p.Endpoint != q.Endpoint {
+		return false
+	}
+	if q.Metric != "" && !slices.Contains(p.Metric, q.Metric) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,91 @@
+package plugin
+
+/*
+
+	custom_pulse is a user-defined pattern:
+
+		"pattern_analyzers": [
+			{ "type": "custom_pulse", "name": "double_accent", "sequence": [true, true, false], "dimension": 1 }
+		]
+
+	In D1 each place of the sequence is one beat of the metric, the endpoint's
+	interval unless "beat" (seconds) is set, so a long accent fills several places.
+	In D2 and up each place is a pulse of the dimension below,
+	accented when that pulse starts on an accent.
+
+*/
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	Mt "github.com/maroda/monteverdi/types"
+)
+
+// Configure sets up a custom_pulse from its "pattern_analyzers" entry
+func (sa *SequenceAnalyzer) Configure(config map[string]interface{}) error {
+	if sa.Pattern != Mt.Custom {
+		return fmt.Errorf("%s is built in and always runs", sa.Name)
+	}
+
+	sa.Name = configString(config, "name")
+	if sa.Name == "" {
+		return errors.New("custom_pulse needs a name")
+	}
+	if _, builtin := Analyzers[sa.Name]; builtin {
+		return fmt.Errorf("custom_pulse name %q is taken by a built-in pattern", sa.Name)
+	}
+
+	sa.Sequence = configBools(config, "sequence")
+	if len(sa.Sequence) < 2 {
+		return fmt.Errorf("custom_pulse %s needs a sequence of at least two places", sa.Name)
+	}
+
+	sa.Dim = 1
+	if d, ok := configNumber(config, "dimension"); ok {
+		sa.Dim = int(d)
+	}
+	if sa.Dim < 1 {
+		return fmt.Errorf("custom_pulse %s has an invalid dimension %d", sa.Name, sa.Dim)
+	}
+
+	if b, ok := configNumber(config, "beat"); ok {
+		if b < 0 {
+			return fmt.Errorf("custom_pulse %s has a negative beat", sa.Name)
+		}
+		sa.Beat = time.Duration(b * float64(time.Second))
+	}
+
+	return nil
+}
+
+// configBools returns a list of booleans, either a []bool from code or a []interface{} from JSON
+func configBools(config map[string]interface{}, key string) []bool {
+	switch v := config[key].(type) {
+	case []bool:
+		return v
+	case []interface{}:
+		list := make([]bool, 0, len(v))
+		for _, b := range v {
+			accent, ok := b.(bool)
+			if !ok {
+				return nil
+			}
+			list = append(list, accent)
+		}
+		return list
+	}
+	return nil
+}
+
+// configNumber returns a number option, a float64 from JSON or an int from code
+func configNumber(config map[string]interface{}, key string) (float64, bool) {
+	switch v := config[key].(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	}
+	return 0, false
+}
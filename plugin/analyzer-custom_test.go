@@ -0,0 +1,106 @@
+package plugin_test
+
+import (
+	"testing"
+	"time"
+
+	Mp "github.com/maroda/monteverdi/plugin"
+	Mt "github.com/maroda/monteverdi/types"
+)
+
+func TestSequenceAnalyzer_Configure(t *testing.T) {
+	custom := func() Mp.ConfigurableAnalyzer {
+		a, _ := Mp.AnalyzerLookup("custom_pulse")
+		return a.(Mp.ConfigurableAnalyzer)
+	}
+
+	t.Run("Reads a JSON entry", func(t *testing.T) {
+		a := custom()
+		err := a.Configure(map[string]interface{}{
+			"name":      "surge",
+			"sequence":  []interface{}{false, true, true},
+			"dimension": float64(2),
+		})
+		assertError(t, err, nil)
+		assertStringContains(t, a.PatternName(), "surge")
+		assertInt(t, a.Dimension(), 2)
+	})
+
+	t.Run("Defaults to D1", func(t *testing.T) {
+		a := custom()
+		err := a.Configure(map[string]interface{}{"name": "flicker", "sequence": []bool{true, false}})
+		assertError(t, err, nil)
+		assertInt(t, a.Dimension(), 1)
+	})
+
+	invalid := []struct {
+		name   string
+		config map[string]interface{}
+	}{
+		{"no name", map[string]interface{}{"sequence": []bool{true, false}}},
+		{"a built-in name", map[string]interface{}{"name": "iamb", "sequence": []bool{false, true}}},
+		{"a short sequence", map[string]interface{}{"name": "blip", "sequence": []bool{true}}},
+		{"a sequence that isn't bools", map[string]interface{}{"name": "blip", "sequence": []interface{}{1, 0}}},
+		{"dimension zero", map[string]interface{}{"name": "blip", "sequence": []bool{true, false}, "dimension": 0}},
+		{"a negative beat", map[string]interface{}{"name": "blip", "sequence": []bool{true, false}, "beat": -1}},
+	}
+	for _, tt := range invalid {
+		t.Run("Rejects "+tt.name, func(t *testing.T) {
+			assertGotError(t, custom().Configure(tt.config))
+		})
+	}
+
+	t.Run("Built-in feet can't be configured", func(t *testing.T) {
+		a := Mp.NewTernaryFootAnalyzer(Mt.Dactyl)
+		assertGotError(t, a.Configure(map[string]interface{}{"name": "surge", "sequence": []bool{true, false}}))
+	})
+}
+
+func TestSequenceAnalyzer_DetectPatterns(t *testing.T) {
+	start := time.Date(2023, 10, 1, 14, 0, 0, 0, time.UTC)
+
+	t.Run("Names each match", func(t *testing.T) {
+		a := &Mp.SequenceAnalyzer{Pattern: Mt.Custom, Name: "double_accent", Sequence: []bool{true, true}, Dim: 1}
+		sequence := makeIctusSequence(start, 5*time.Second, true, true, true, false)
+
+		got, err := a.DetectPatterns(sequence)
+		assertError(t, err, nil)
+		assertInt(t, len(got), 2)
+		for _, p := range got {
+			if p.Pattern != Mt.Custom || p.Name != "double_accent" {
+				t.Errorf("Expected custom pulse double_accent, got %v %q", p.Pattern, p.Name)
+			}
+			assertInt(t, len(p.Children), 0)
+		}
+	})
+
+	t.Run("A long ictus fills several beats", func(t *testing.T) {
+		a := &Mp.SequenceAnalyzer{Pattern: Mt.Custom, Name: "double_accent", Sequence: []bool{true, true}, Dim: 1, Beat: 5 * time.Second}
+
+		// One accent lasting two polls, then a non-accent still open
+		sequence := makeIctusSequence(start, 10*time.Second, true, false)
+
+		got, err := a.DetectPatterns(sequence)
+		assertError(t, err, nil)
+		assertInt(t, len(got), 1)
+		if !got[0].StartTime.Equal(start) || got[0].Duration != 10*time.Second {
+			t.Errorf("Expected the pulse to span the accent, got %v for %v", got[0].StartTime, got[0].Duration)
+		}
+	})
+
+	t.Run("Leaves the open ictus out", func(t *testing.T) {
+		a := &Mp.SequenceAnalyzer{Pattern: Mt.Custom, Name: "double_accent", Sequence: []bool{true, true}, Dim: 1, Beat: 5 * time.Second}
+		got, _ := a.DetectPatterns(makeIctusSequence(start, 10*time.Second, true))
+		assertInt(t, len(got), 0)
+	})
+
+	t.Run("Above D1 the children are the pulses", func(t *testing.T) {
+		a := &Mp.SequenceAnalyzer{Pattern: Mt.Custom, Name: "surge", Sequence: []bool{false, true, true}, Dim: 2}
+		got, _ := a.DetectPatterns(makeIctusSequence(start, 10*time.Second, false, true, true))
+		assertInt(t, len(got), 1)
+		assertInt(t, len(got[0].Children), 3)
+		if !got[0].Children[2].Equal(start.Add(20 * time.Second)) {
+			t.Errorf("Expected the last child at 20s, got %v", got[0].Children[2])
+		}
+	})
+}
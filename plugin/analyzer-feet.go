@@ -0,0 +1,206 @@
+package plugin
+
+/*
+
+	The built-in feet as PatternAnalyzers
+
+	D1, read from the Ictus of a metric:
+		Iamb:       ⚍ non-accent → accent
+		Trochee:    ⚎ accent → non-accent
+
+	D2, read from D1 pulses, accented when the pulse starts on one:
+		Amphibrach: ☵ Iamb → Trochee → Iamb  (non-accent → accent → non-accent)
+		Anapest:    ☳ Iamb → Iamb → Trochee  (non-accent → non-accent → accent)
+		Dactyl:     ☶ Trochee → Iamb → Iamb  (accent → non-accent → non-accent)
+
+*/
+
+import (
+	"time"
+
+	Mt "github.com/maroda/monteverdi/types"
+)
+
+// DefaultPulseConfig starts and ends each D1 foot in the middle of its ictus
+var DefaultPulseConfig = Mt.PulseConfig{
+	IambStartPeriod:    0.5,
+	IambEndPeriod:      0.5,
+	TrocheeStartPeriod: 0.5,
+	TrocheeEndPeriod:   0.5,
+}
+
+// BinaryFootAnalyzer detects an Iamb or a Trochee at each change of accent
+type BinaryFootAnalyzer struct {
+	Pattern Mt.PulsePattern // Iamb or Trochee
+	Config  Mt.PulseConfig  // where in each ictus the foot starts and ends
+}
+
+func NewIambAnalyzer(config Mt.PulseConfig) *BinaryFootAnalyzer {
+	return &BinaryFootAnalyzer{Pattern: Mt.Iamb, Config: config}
+}
+
+func NewTrocheeAnalyzer(config Mt.PulseConfig) *BinaryFootAnalyzer {
+	return &BinaryFootAnalyzer{Pattern: Mt.Trochee, Config: config}
+}
+
+func (bf *BinaryFootAnalyzer) PatternName() string {
+	if bf.Pattern == Mt.Trochee {
+		return "trochee"
+	}
+	return "iamb"
+}
+
+func (bf *BinaryFootAnalyzer) Dimension() int { return 1 }
+
+// DetectPatterns needs an ictus on either side of the change,
+// the last two in the sequence are still open and are left for the next run
+func (bf *BinaryFootAnalyzer) DetectPatterns(sequence []Mt.Ictus) ([]Mt.PulseEvent, error) {
+	var pulses []Mt.PulseEvent
+
+	for i := 1; i < len(sequence)-2; i++ {
+		prev := sequence[i-1]
+		curr := sequence[i]
+		next := sequence[i+1]
+
+		// Iamb rises into the accent, Trochee falls out of it
+		rising := !prev.IsAccent && curr.IsAccent
+		falling := prev.IsAccent && !curr.IsAccent
+		if (bf.Pattern == Mt.Iamb && !rising) || (bf.Pattern == Mt.Trochee && !falling) {
+			continue
+		}
+
+		startPeriod, endPeriod := bf.Config.IambStartPeriod, bf.Config.IambEndPeriod
+		if bf.Pattern == Mt.Trochee {
+			startPeriod, endPeriod = bf.Config.TrocheeStartPeriod, bf.Config.TrocheeEndPeriod
+		}
+
+		firstDur := curr.Timestamp.Sub(prev.Timestamp)
+		secondDur := next.Timestamp.Sub(curr.Timestamp)
+
+		// Configurable START within the first ictus, END within the second
+		patternStart := prev.Timestamp.Add(time.Duration(float64(firstDur) * startPeriod))
+		patternEnd := curr.Timestamp.Add(time.Duration(float64(secondDur) * endPeriod))
+
+		pulses = append(pulses, Mt.PulseEvent{
+			Pattern:   bf.Pattern,
+			StartTime: patternStart,
+			Duration:  patternEnd.Sub(patternStart),
+		})
+	}
+
+	return pulses, nil
+}
+
+// NewTernaryFootAnalyzer returns the D2 analyzer of an Amphibrach, Anapest, or Dactyl
+func NewTernaryFootAnalyzer(pattern Mt.PulsePattern) *SequenceAnalyzer {
+	sa := &SequenceAnalyzer{Pattern: pattern, Dim: 2}
+	switch pattern {
+	case Mt.Amphibrach:
+		sa.Name = "amphibrach"
+		sa.Sequence = []bool{false, true, false}
+	case Mt.Anapest:
+		sa.Name = "anapest"
+		sa.Sequence = []bool{false, false, true}
+	case Mt.Dactyl:
+		sa.Name = "dactyl"
+		sa.Sequence = []bool{true, false, false}
+	}
+	return sa
+}
+
+// SequenceAnalyzer detects a fixed sequence of accents and non-accents,
+// at every place in the sequence where it fits
+type SequenceAnalyzer struct {
+	Pattern  Mt.PulsePattern // a built-in foot, or Custom
+	Name     string          // pattern name
+	Sequence []bool          // accent or not, in order
+	Dim      int             // dimension of the detected pulses
+	Beat     time.Duration   // D1: one place, an ictus fills as many as fit; 0 is one place per ictus
+}
+
+func (sa *SequenceAnalyzer) PatternName() string { return sa.Name }
+
+func (sa *SequenceAnalyzer) Dimension() int { return sa.Dim }
+
+// place is one beat of the sequence being matched
+type place struct {
+	start    time.Time
+	duration time.Duration
+	accent   bool
+}
+
+func (sa *SequenceAnalyzer) DetectPatterns(sequence []Mt.Ictus) ([]Mt.PulseEvent, error) {
+	var pulses []Mt.PulseEvent
+
+	places, owners := sa.places(sequence)
+	n := len(sa.Sequence)
+	for i := 0; n > 0 && i+n <= len(places); i++ {
+		match := true
+		for j, accent := range sa.Sequence {
+			if places[i+j].accent != accent {
+				match = false
+				break
+			}
+		}
+		if !match {
+			continue
+		}
+
+		first := places[i]
+		last := places[i+n-1]
+		pulse := Mt.PulseEvent{
+			Pattern:   sa.Pattern,
+			StartTime: first.start,
+			Duration:  last.start.Add(last.duration).Sub(first.start),
+		}
+		if sa.Pattern == Mt.Custom {
+			pulse.Name = sa.Name
+		}
+
+		// Above D1 the children are the pulses of the places
+		if sa.Dim > 1 {
+			for j := i; j < i+n; j++ {
+				pulse.Children = append(pulse.Children, sequence[owners[j]].Timestamp)
+			}
+		}
+
+		pulses = append(pulses, pulse)
+	}
+
+	return pulses, nil
+}
+
+// places splits the sequence into beats, with the index of the Ictus each came from.
+// With a Beat, a closed ictus fills as many places as its length allows,
+// and the last ictus is left out while it is still open.
+func (sa *SequenceAnalyzer) places(sequence []Mt.Ictus) ([]place, []int) {
+	var places []place
+	var owners []int
+
+	for i, ictus := range sequence {
+		if sa.Beat <= 0 || sa.Dim > 1 {
+			places = append(places, place{start: ictus.Timestamp, duration: ictus.Duration, accent: ictus.IsAccent})
+			owners = append(owners, i)
+			continue
+		}
+		if i == len(sequence)-1 {
+			break
+		}
+
+		length := sequence[i+1].Timestamp.Sub(ictus.Timestamp)
+		beats := int((length + sa.Beat/2) / sa.Beat)
+		if beats < 1 {
+			beats = 1
+		}
+		for b := 0; b < beats; b++ {
+			places = append(places, place{
+				start:    ictus.Timestamp.Add(time.Duration(b) * sa.Beat),
+				duration: sa.Beat,
+				accent:   ictus.IsAccent,
+			})
+			owners = append(owners, i)
+		}
+	}
+
+	return places, owners
+}
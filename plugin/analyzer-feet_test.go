@@ -0,0 +1,104 @@
+package plugin_test
+
+import (
+	"testing"
+	"time"
+
+	Mp "github.com/maroda/monteverdi/plugin"
+	Mt "github.com/maroda/monteverdi/types"
+)
+
+func TestBinaryFootAnalyzer_DetectPatterns(t *testing.T) {
+	start := time.Date(2023, 10, 1, 14, 0, 0, 0, time.UTC)
+	sequence := makeIctusSequence(start, 10*time.Second, false, true, false, true, false)
+
+	t.Run("Detects an Iamb at each rise", func(t *testing.T) {
+		got, err := Mp.NewIambAnalyzer(Mp.DefaultPulseConfig).DetectPatterns(sequence)
+		assertError(t, err, nil)
+
+		// The rise into the last accent is still open
+		assertInt(t, len(got), 1)
+		if got[0].Pattern != Mt.Iamb {
+			t.Errorf("Expected an Iamb, got %v", got[0].Pattern)
+		}
+		if !got[0].StartTime.Equal(start.Add(5*time.Second)) || got[0].Duration != 10*time.Second {
+			t.Errorf("Expected the Iamb to span the middle of both ictus, got %v for %v", got[0].StartTime, got[0].Duration)
+		}
+	})
+
+	t.Run("Detects a Trochee at each fall", func(t *testing.T) {
+		got, err := Mp.NewTrocheeAnalyzer(Mp.DefaultPulseConfig).DetectPatterns(sequence)
+		assertError(t, err, nil)
+		assertInt(t, len(got), 1)
+		if got[0].Pattern != Mt.Trochee {
+			t.Errorf("Expected a Trochee, got %v", got[0].Pattern)
+		}
+	})
+
+	t.Run("Uses the configured periods", func(t *testing.T) {
+		config := Mp.DefaultPulseConfig
+		config.IambStartPeriod = 0
+		config.IambEndPeriod = 1
+		got, _ := Mp.NewIambAnalyzer(config).DetectPatterns(sequence)
+		assertInt(t, len(got), 1)
+		if !got[0].StartTime.Equal(start) || got[0].Duration != 20*time.Second {
+			t.Errorf("Expected the Iamb to span both ictus, got %v for %v", got[0].StartTime, got[0].Duration)
+		}
+	})
+
+	t.Run("Needs more than two ictus", func(t *testing.T) {
+		got, err := Mp.NewIambAnalyzer(Mp.DefaultPulseConfig).DetectPatterns(sequence[:2])
+		assertError(t, err, nil)
+		assertInt(t, len(got), 0)
+	})
+}
+
+func TestTernaryFootAnalyzer_DetectPatterns(t *testing.T) {
+	start := time.Date(2023, 10, 1, 14, 0, 0, 0, time.UTC)
+
+	// D2 analyzers read D1 pulses, accented when the pulse is a Trochee
+	beats := makeIctusSequence(start, 10*time.Second, false, true, false, false, true)
+
+	tests := []struct {
+		pattern Mt.PulsePattern
+		name    string
+		count   int
+		first   time.Duration
+	}{
+		{Mt.Amphibrach, "amphibrach", 1, 0},
+		{Mt.Anapest, "anapest", 1, 20 * time.Second},
+		{Mt.Dactyl, "dactyl", 1, 10 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run("Detects "+tt.name, func(t *testing.T) {
+			a := Mp.NewTernaryFootAnalyzer(tt.pattern)
+			assertInt(t, a.Dimension(), 2)
+			assertStringContains(t, a.PatternName(), tt.name)
+
+			got, err := a.DetectPatterns(beats)
+			assertError(t, err, nil)
+			assertInt(t, len(got), tt.count)
+			if got[0].Pattern != tt.pattern || got[0].Name != "" {
+				t.Errorf("Expected an unnamed %s, got %v %q", tt.name, got[0].Pattern, got[0].Name)
+			}
+			if !got[0].StartTime.Equal(start.Add(tt.first)) {
+				t.Errorf("Expected the %s at %v, got %v", tt.name, start.Add(tt.first), got[0].StartTime)
+			}
+			assertInt(t, len(got[0].Children), 3)
+		})
+	}
+}
+
+// makeIctusSequence spaces one ictus per accent flag every step
+func makeIctusSequence(start time.Time, step time.Duration, accents ...bool) []Mt.Ictus {
+	sequence := make([]Mt.Ictus, len(accents))
+	for i, accent := range accents {
+		sequence[i] = Mt.Ictus{
+			Timestamp: start.Add(time.Duration(i) * step),
+			IsAccent:  accent,
+			Duration:  step,
+		}
+	}
+	return sequence
+}
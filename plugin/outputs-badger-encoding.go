@@ -0,0 +1,297 @@
+package plugin
+
+/*
+
+	Pulse encoding
+
+	Archived pulses are written in an explicit binary encoding, so a change to
+	Mt.PulseEvent doesn't break the archive and other languages can read it.
+	Varints are those of encoding/binary (zig-zag for signed), strings are a
+	uvarint length and UTF-8 bytes, and times are a presence byte (0 for the
+	zero time) followed by a varint of Unix nanoseconds.
+
+		0x00 | version 2
+		dimension  varint
+		pattern    varint
+		endpoint   string
+		name       string
+		metrics    uvarint count, then each string
+		start      time
+		duration   varint nanoseconds
+		parent     time
+		children   uvarint count, then each time
+		endpoints  uvarint count, then each string
+
+	Version 1 had no endpoints, PulseDecode reads both versions.
+
+	A gob stream never starts with 0x00, so PulseDecode reads values from
+	before this encoding as gob. RewritePulses re-encodes them in place.
+
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	Mt "github.com/maroda/monteverdi/types"
+)
+
+const (
+	EncodingVersion = 2 // version of the pulse encoding written
+
+	encodingMarker = 0x00 // first byte of an encoded pulse
+	maxEncodedLen  = 1 << 20
+)
+
+// PulseEncode serializes the pulse event struct for data storage
+func PulseEncode(p *Mt.PulseEvent) ([]byte, error) {
+	if p == nil {
+		return nil, errors.New("no pulse to encode")
+	}
+
+	b := make([]byte, 0, 64)
+	b = append(b, encodingMarker, EncodingVersion)
+	b = binary.AppendVarint(b, int64(p.Dimension))
+	b = binary.AppendVarint(b, int64(p.Pattern))
+	b = appendString(b, p.Endpoint)
+	b = appendString(b, p.Name)
+	b = binary.AppendUvarint(b, uint64(len(p.Metric)))
+	for _, m := range p.Metric {
+		b = appendString(b, m)
+	}
+	b = appendTime(b, p.StartTime)
+	b = binary.AppendVarint(b, int64(p.Duration))
+	b = appendTime(b, p.Parent)
+	b = binary.AppendUvarint(b, uint64(len(p.Children)))
+	for _, c := range p.Children {
+		b = appendTime(b, c)
+	}
+	b = binary.AppendUvarint(b, uint64(len(p.Endpoints)))
+	for _, e := range p.Endpoints {
+		b = appendString(b, e)
+	}
+
+	if len(b) > maxEncodedLen {
+		return nil, fmt.Errorf("encoded pulse is %d bytes, more than %d", len(b), maxEncodedLen)
+	}
+	return b, nil
+}
+
+// PulseDecode deserializes the pulse event data,
+// in the current encoding or the gob of earlier versions
+func PulseDecode(data []byte) (*Mt.PulseEvent, error) {
+	if len(data) == 0 {
+		return nil, errors.New("no pulse data")
+	}
+	if !IsPulseEncoded(data) {
+		return pulseDecodeGob(data)
+	}
+	version := data[1]
+	if version > EncodingVersion || version == 0 {
+		return nil, fmt.Errorf("pulse encoding version %d, newer than %d", data[1], EncodingVersion)
+	}
+
+	d := &pulseDecoder{data: data[2:]}
+	p := &Mt.PulseEvent{
+		Dimension: int(d.varint()),
+		Pattern:   Mt.PulsePattern(d.varint()),
+		Endpoint:  d.string(),
+		Name:      d.string(),
+	}
+	if n := d.count(); n > 0 {
+		p.Metric = make([]string, 0, n)
+		for i := 0; i < n; i++ {
+			p.Metric = append(p.Metric, d.string())
+		}
+	}
+	p.StartTime = d.time()
+	p.Duration = time.Duration(d.varint())
+	p.Parent = d.time()
+	if n := d.count(); n > 0 {
+		p.Children = make([]time.Time, 0, n)
+		for i := 0; i < n; i++ {
+			p.Children = append(p.Children, d.time())
+		}
+	}
+	if version >= 2 {
+		if n := d.count(); n > 0 {
+			p.Endpoints = make([]string, 0, n)
+			for i := 0; i < n; i++ {
+				p.Endpoints = append(p.Endpoints, d.string())
+			}
+		}
+	}
+
+	if d.err == nil && len(d.data) > 0 {
+		d.err = fmt.Errorf("%d bytes after the pulse", len(d.data))
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("pulse decode error: %w", d.err)
+	}
+	return p, nil
+}
+
+// IsPulseEncoded tells whether data is in the current encoding rather than gob
+func IsPulseEncoded(data []byte) bool {
+	return len(data) >= 2 && data[0] == encodingMarker
+}
+
+// RewritePulses re-encodes the pulses still in gob in place, keeping their expiry,
+// and returns how many were rewritten.
+// Pulses that can't be decoded are left as they are and logged.
+func (bo *BadgerOutput) RewritePulses() (int, error) {
+	rewritten, skipped := 0, 0
+	wb := bo.DB.NewWriteBatch()
+	defer wb.Cancel()
+
+	prefix := []byte{KeyVersion, TimeKeys}
+	err := bo.DB.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return fmt.Errorf("item data error: %w", err)
+			}
+			if IsPulseEncoded(val) {
+				continue
+			}
+
+			pulse, err := PulseDecode(val)
+			if err != nil {
+				skipped++
+				slog.Warn("BadgerOutput could not rewrite pulse, leaving it",
+					slog.String("key", fmt.Sprintf("%x", item.Key())),
+					slog.Any("error", err))
+				continue
+			}
+			encoded, err := PulseEncode(pulse)
+			if err != nil {
+				return fmt.Errorf("rewrite encode error: %w", err)
+			}
+
+			e := badger.NewEntry(item.KeyCopy(nil), encoded)
+			e.ExpiresAt = item.ExpiresAt()
+			if err := wb.SetEntry(e); err != nil {
+				return fmt.Errorf("rewrite set error: %w", err)
+			}
+			rewritten++
+		}
+		return nil
+	})
+	if err == nil {
+		err = wb.Flush()
+	}
+	if err != nil {
+		slog.Error("BadgerOutput failed to rewrite pulses", slog.Any("error", err))
+		return rewritten, fmt.Errorf("pulse rewrite error: %w", err)
+	}
+
+	slog.Info("BadgerOutput rewrote pulses",
+		slog.Int("version", EncodingVersion),
+		slog.Int("pulses", rewritten),
+		slog.Int("skipped", skipped))
+	return rewritten, nil
+}
+
+// pulseDecodeGob reads a pulse written before the versioned encoding
+func pulseDecodeGob(data []byte) (*Mt.PulseEvent, error) {
+	var p Mt.PulseEvent
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&p); err != nil {
+		return nil, fmt.Errorf("legacy pulse decode error: %w", err)
+	}
+	return &p, nil
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendTime(b []byte, t time.Time) []byte {
+	if t.IsZero() {
+		return append(b, 0)
+	}
+	return binary.AppendVarint(append(b, 1), t.UnixNano())
+}
+
+// pulseDecoder reads the fields of an encoded pulse,
+// keeping the first error and reading zero values after it
+type pulseDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *pulseDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.err = errors.New("truncated varint")
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *pulseDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.err = errors.New("truncated uvarint")
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+// count reads a length, which can't be more than the bytes left
+func (d *pulseDecoder) count() int {
+	n := d.uvarint()
+	if n > uint64(len(d.data)) {
+		if d.err == nil {
+			d.err = fmt.Errorf("length %d past the end", n)
+		}
+		return 0
+	}
+	return int(n)
+}
+
+func (d *pulseDecoder) string() string {
+	n := d.count()
+	if d.err != nil {
+		return ""
+	}
+	s := string(d.data[:n])
+	d.data = d.data[n:]
+	return s
+}
+
+func (d *pulseDecoder) time() time.Time {
+	if d.err != nil {
+		return time.Time{}
+	}
+	if len(d.data) == 0 {
+		d.err = errors.New("truncated time")
+		return time.Time{}
+	}
+	present := d.data[0]
+	d.data = d.data[1:]
+	if present == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, d.varint())
+}
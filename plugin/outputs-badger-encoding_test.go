@@ -0,0 +1,182 @@
+package plugin_test
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	Mp "github.com/maroda/monteverdi/plugin"
+	Mt "github.com/maroda/monteverdi/types"
+)
+
+func TestPulseEncode(t *testing.T) {
+	start := time.Date(2023, 10, 1, 14, 0, 0, 0, time.UTC)
+	pulse := &Mt.PulseEvent{
+		Dimension: 2,
+		Metric:    []string{"latency", "errors"},
+		Endpoint:  "DB",
+		Endpoints: []string{"DB", "API"},
+		Pattern:   Mt.Custom,
+		Name:      "pyrrhic",
+		Parent:    start.Add(-time.Minute),
+		Children:  []time.Time{start, start.Add(10 * time.Second)},
+		StartTime: start,
+		Duration:  25 * time.Second,
+	}
+
+	// same compares every field, times by instant
+	same := func(t *testing.T, got, want *Mt.PulseEvent) {
+		t.Helper()
+		if got.Dimension != want.Dimension || got.Pattern != want.Pattern || got.Name != want.Name ||
+			got.Endpoint != want.Endpoint || got.Duration != want.Duration ||
+			!got.StartTime.Equal(want.StartTime) || !got.Parent.Equal(want.Parent) ||
+			len(got.Metric) != len(want.Metric) || len(got.Children) != len(want.Children) ||
+			len(got.Endpoints) != len(want.Endpoints) {
+			t.Fatalf("got %+v, want %+v", got, want)
+		}
+		for i := range want.Endpoints {
+			if got.Endpoints[i] != want.Endpoints[i] {
+				t.Errorf("Endpoint %d: got %q, want %q", i, got.Endpoints[i], want.Endpoints[i])
+			}
+		}
+		for i := range want.Metric {
+			if got.Metric[i] != want.Metric[i] {
+				t.Errorf("Metric %d: got %q, want %q", i, got.Metric[i], want.Metric[i])
+			}
+		}
+		for i := range want.Children {
+			if !got.Children[i].Equal(want.Children[i]) {
+				t.Errorf("Child %d: got %v, want %v", i, got.Children[i], want.Children[i])
+			}
+		}
+	}
+
+	t.Run("Round trips every field", func(t *testing.T) {
+		encoded, err := Mp.PulseEncode(pulse)
+		assertError(t, err, nil)
+		if !Mp.IsPulseEncoded(encoded) || encoded[1] != Mp.EncodingVersion {
+			t.Fatalf("Expected a version %d header, got %x", Mp.EncodingVersion, encoded[:2])
+		}
+
+		got, err := Mp.PulseDecode(encoded)
+		assertError(t, err, nil)
+		same(t, got, pulse)
+	})
+
+	t.Run("Keeps zero times and empty fields", func(t *testing.T) {
+		d1 := &Mt.PulseEvent{Dimension: 1, Pattern: Mt.Iamb, StartTime: start}
+		encoded, err := Mp.PulseEncode(d1)
+		assertError(t, err, nil)
+
+		got, err := Mp.PulseDecode(encoded)
+		assertError(t, err, nil)
+		same(t, got, d1)
+		if !got.Parent.IsZero() || got.Metric != nil || got.Children != nil {
+			t.Errorf("Expected no parent, metrics, or children, got %+v", got)
+		}
+	})
+
+	t.Run("Reads version 1 without endpoints", func(t *testing.T) {
+		v1 := *pulse
+		v1.Endpoints = nil
+		encoded, err := Mp.PulseEncode(&v1)
+		assertError(t, err, nil)
+		encoded = encoded[:len(encoded)-1] // no endpoint count
+		encoded[1] = 1
+
+		got, err := Mp.PulseDecode(encoded)
+		assertError(t, err, nil)
+		same(t, got, &v1)
+	})
+
+	t.Run("Reads the legacy gob", func(t *testing.T) {
+		encoded := encodeGob(t, pulse)
+		if Mp.IsPulseEncoded(encoded) {
+			t.Fatal("Expected gob not to look like the current encoding")
+		}
+
+		got, err := Mp.PulseDecode(encoded)
+		assertError(t, err, nil)
+		same(t, got, pulse)
+	})
+
+	t.Run("Errors on broken data", func(t *testing.T) {
+		encoded, err := Mp.PulseEncode(pulse)
+		assertError(t, err, nil)
+
+		newer := bytes.Clone(encoded)
+		newer[1] = Mp.EncodingVersion + 1
+		for name, data := range map[string][]byte{
+			"empty":     nil,
+			"truncated": encoded[:len(encoded)-3],
+			"trailing":  append(bytes.Clone(encoded), 0),
+			"newer":     newer,
+			"not gob":   []byte("craquemattic"),
+		} {
+			if _, err := Mp.PulseDecode(data); err == nil {
+				t.Errorf("Expected an error decoding %s data", name)
+			}
+		}
+
+		_, err = Mp.PulseEncode(nil)
+		assertGotError(t, err)
+	})
+}
+
+func TestBadgerOutput_RewritePulses(t *testing.T) {
+	adapter, closedb := makeTestBadgerOutput(t)
+	defer closedb()
+
+	start := time.Date(2023, 10, 1, 14, 0, 0, 0, time.UTC)
+	current := &Mt.PulseEvent{Dimension: 1, Metric: []string{"latency"}, StartTime: start}
+	legacy := &Mt.PulseEvent{Dimension: 2, Metric: []string{"latency"}, StartTime: start.Add(time.Second)}
+	broken := &Mt.PulseEvent{Dimension: 1, Metric: []string{"broken"}, StartTime: start.Add(2 * time.Second)}
+	expires := uint64(time.Now().Add(time.Hour).Unix())
+
+	assertError(t, adapter.WriteBatch([]*Mt.PulseEvent{current}), nil)
+	assertError(t, adapter.DB.Update(func(txn *badger.Txn) error {
+		e := badger.NewEntry(Mp.PulseKey(legacy), encodeGob(t, legacy))
+		e.ExpiresAt = expires
+		if err := txn.SetEntry(e); err != nil {
+			return err
+		}
+		return txn.Set(Mp.PulseKey(broken), []byte("craquemattic"))
+	}), nil)
+
+	rewritten, err := adapter.RewritePulses()
+	assertError(t, err, nil)
+	assertInt(t, rewritten, 1)
+
+	assertError(t, adapter.DB.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(Mp.PulseKey(legacy))
+		if err != nil {
+			return err
+		}
+		if item.ExpiresAt() != expires {
+			t.Errorf("Expected the expiry to be kept, got %d", item.ExpiresAt())
+		}
+		return item.Value(func(val []byte) error {
+			if !Mp.IsPulseEncoded(val) {
+				t.Error("Expected the pulse in the current encoding")
+			}
+			return nil
+		})
+	}), nil)
+
+	// Once rewritten there is nothing left
+	rewritten, err = adapter.RewritePulses()
+	assertError(t, err, nil)
+	assertInt(t, rewritten, 0)
+}
+
+// Helpers //
+
+// encodeGob encodes a pulse the way BadgerOutput did before the versioned encoding
+func encodeGob(t *testing.T, p *Mt.PulseEvent) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	assertError(t, gob.NewEncoder(&buf).Encode(p), nil)
+	return buf.Bytes()
+}
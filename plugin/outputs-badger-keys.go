@@ -0,0 +1,317 @@
+package plugin
+
+/*
+
+	BadgerDB key schema
+
+	Keys start with the schema version and a keyspace, integers are big-endian.
+	Every pulse is written under three keys holding the same fields in a
+	different order, so each keyspace sorts by time within its lead field:
+
+		time      2 't' | start (8) | dimension | pattern | endpoint (8) | metric (8) | name (8)
+		metric    2 'm' | metric (8) | start (8) | dimension | pattern | endpoint (8) | name (8) [| metrics (8)]
+		pattern   2 'p' | pattern | start (8) | dimension | endpoint (8) | metric (8) | name (8)
+
+	start is StartTime in nanoseconds. endpoint, metric, and name are FNV-64a
+	hashes of the Endpoint, every Metric, and Name of the pulse, so two pulses
+	share a key only when they are the same pulse. A pulse on one metric hashes
+	just that metric. The time key holds the pulse.
+
+	A pulse has a metric key for each of its metrics with the hash of that
+	metric in front, so a Cascade is found by its leader and its follower.
+	When the pulse has more than one metric, the hash of all of them ends
+	the metric key. The metric and pattern keys are empty and point back to
+	the time key with the same fields.
+
+	Version 1 keys (PulseKeyV1) were 14 bytes: start (8) | dimension | the first
+	five bytes of Metric[0]. Pulses on metrics sharing a prefix could overwrite
+	each other, MigrateKeys rewrites them when the database is opened.
+
+*/
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+
+	"github.com/dgraph-io/badger/v4"
+	Mt "github.com/maroda/monteverdi/types"
+)
+
+const (
+	KeyVersion = 2 // first byte of every pulse key
+
+	TimeKeys    byte = 't' // pulses by time
+	MetricKeys  byte = 'm' // index by metric, then time
+	PatternKeys byte = 'p' // index by pattern, then time
+
+	pulseKeyLen   = 2 + 8 + 1 + 1 + 8 + 8 + 8
+	indexKeyLen   = pulseKeyLen + 8 // metric key of a pulse on several metrics
+	pulseKeyLenV1 = 8 + 1 + 5
+)
+
+// SchemaKey holds the KeyVersion of the database once it's migrated
+var SchemaKey = []byte("!schema")
+
+// PulseKeyFields are the fields of a pulse key
+type PulseKeyFields struct {
+	Start     int64  // StartTime in nanoseconds
+	Dimension byte   // Dimension
+	Pattern   byte   // PulsePattern
+	Endpoint  uint64 // hash of Endpoint
+	Metric    uint64 // hash of every Metric
+	Name      uint64 // hash of Name
+	Indexed   uint64 // hash of the metric a metric key is under, when it isn't Metric
+}
+
+// NewPulseKeyFields returns the key fields of a pulse
+func NewPulseKeyFields(p *Mt.PulseEvent) PulseKeyFields {
+	return PulseKeyFields{
+		Start:     p.StartTime.UnixNano(),
+		Dimension: byte(p.Dimension),
+		Pattern:   byte(p.Pattern),
+		Endpoint:  HashKeyField(p.Endpoint),
+		Metric:    HashKeyField(p.Metric...),
+		Name:      HashKeyField(p.Name),
+	}
+}
+
+// Key returns the key of the fields in a keyspace
+func (f PulseKeyFields) Key(space byte) []byte {
+	key := make([]byte, 0, indexKeyLen)
+	key = append(key, KeyVersion, space)
+
+	switch space {
+	case MetricKeys:
+		indexed := f.Metric
+		if f.Indexed != 0 {
+			indexed = f.Indexed
+		}
+		key = binary.BigEndian.AppendUint64(key, indexed)
+		key = binary.BigEndian.AppendUint64(key, uint64(f.Start))
+		key = append(key, f.Dimension, f.Pattern)
+		key = binary.BigEndian.AppendUint64(key, f.Endpoint)
+		key = binary.BigEndian.AppendUint64(key, f.Name)
+		if indexed != f.Metric {
+			key = binary.BigEndian.AppendUint64(key, f.Metric)
+		}
+	case PatternKeys:
+		key = append(key, f.Pattern)
+		key = binary.BigEndian.AppendUint64(key, uint64(f.Start))
+		key = append(key, f.Dimension)
+		key = binary.BigEndian.AppendUint64(key, f.Endpoint)
+		key = binary.BigEndian.AppendUint64(key, f.Metric)
+		key = binary.BigEndian.AppendUint64(key, f.Name)
+	default:
+		key = binary.BigEndian.AppendUint64(key, uint64(f.Start))
+		key = append(key, f.Dimension, f.Pattern)
+		key = binary.BigEndian.AppendUint64(key, f.Endpoint)
+		key = binary.BigEndian.AppendUint64(key, f.Metric)
+		key = binary.BigEndian.AppendUint64(key, f.Name)
+	}
+
+	return key
+}
+
+// ParsePulseKey returns the fields and keyspace of a key,
+// false when it isn't a pulse key of this version
+func ParsePulseKey(key []byte) (PulseKeyFields, byte, bool) {
+	var f PulseKeyFields
+	if len(key) < 2 || key[0] != KeyVersion {
+		return f, 0, false
+	}
+	if len(key) != pulseKeyLen && (len(key) != indexKeyLen || key[1] != MetricKeys) {
+		return f, 0, false
+	}
+
+	u64 := func(i int) uint64 { return binary.BigEndian.Uint64(key[i : i+8]) }
+	space := key[1]
+	switch space {
+	case TimeKeys:
+		f.Start, f.Dimension, f.Pattern = int64(u64(2)), key[10], key[11]
+		f.Endpoint, f.Metric, f.Name = u64(12), u64(20), u64(28)
+	case MetricKeys:
+		f.Metric, f.Start, f.Dimension, f.Pattern = u64(2), int64(u64(10)), key[18], key[19]
+		f.Endpoint, f.Name = u64(20), u64(28)
+		if len(key) == indexKeyLen {
+			f.Indexed, f.Metric = f.Metric, u64(36)
+		}
+	case PatternKeys:
+		f.Pattern, f.Start, f.Dimension = key[2], int64(u64(3)), key[11]
+		f.Endpoint, f.Metric, f.Name = u64(12), u64(20), u64(28)
+	default:
+		return f, 0, false
+	}
+
+	return f, space, true
+}
+
+// PulseKey is the time key of a pulse, which holds it
+func PulseKey(pulse *Mt.PulseEvent) []byte {
+	return NewPulseKeyFields(pulse).Key(TimeKeys)
+}
+
+// PulseKeys are every key a pulse is written under:
+// the time key first, a metric key for each metric, then the pattern key
+func PulseKeys(pulse *Mt.PulseEvent) [][]byte {
+	f := NewPulseKeyFields(pulse)
+	keys := [][]byte{f.Key(TimeKeys)}
+	if len(pulse.Metric) > 1 {
+		for _, m := range pulse.Metric {
+			mf := f
+			mf.Indexed = HashKeyField(m)
+			keys = append(keys, mf.Key(MetricKeys))
+		}
+	} else {
+		keys = append(keys, f.Key(MetricKeys))
+	}
+	return append(keys, f.Key(PatternKeys))
+}
+
+// PulseKeyV1 creates a version 1 composite key
+// timestamp + dimension + first five letters of metric
+func PulseKeyV1(pulse *Mt.PulseEvent) []byte {
+	key := make([]byte, pulseKeyLenV1)
+
+	// Using positive BigEndian integer to convert timestamp
+	// so keys can be sorted chronologically by BadgerDB
+	binary.BigEndian.PutUint64(key[0:8], uint64(pulse.StartTime.UnixNano()))
+
+	// Set Dimension
+	key[8] = byte(pulse.Dimension)
+
+	// Keep metric name at five chars
+	if len(pulse.Metric) > 0 {
+		mBytes := []byte(pulse.Metric[0])
+		n := len(mBytes)
+		if n > 5 {
+			n = 5
+		}
+		copy(key[9:9+n], mBytes[:n])
+	}
+
+	return key
+}
+
+// HashKeyField is the FNV-64a hash of a key field,
+// the values of a field with several are separated by a zero byte
+func HashKeyField(s ...string) uint64 {
+	h := fnv.New64a()
+	for i, v := range s {
+		if i > 0 {
+			h.Write([]byte{0})
+		}
+		h.Write([]byte(v))
+	}
+	return h.Sum64()
+}
+
+// MigrateKeys rewrites the pulses under version 1 keys with the current keys and encoding,
+// then records the KeyVersion so it only runs once.
+// Pulses that can't be decoded are left under their old key and logged.
+func (bo *BadgerOutput) MigrateKeys() (int, error) {
+	version, err := bo.schemaVersion()
+	if err != nil || version == KeyVersion {
+		return 0, err
+	}
+	if version > KeyVersion {
+		return 0, fmt.Errorf("database keys are version %d, newer than %d", version, KeyVersion)
+	}
+
+	migrated, skipped := 0, 0
+	wb := bo.DB.NewWriteBatch()
+	defer wb.Cancel()
+
+	err = bo.DB.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			if len(item.Key()) != pulseKeyLenV1 {
+				continue
+			}
+
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return fmt.Errorf("item data error: %w", err)
+			}
+			pulse, err := PulseDecode(val)
+			if err != nil {
+				skipped++
+				slog.Warn("BadgerOutput could not migrate pulse, leaving it",
+					slog.String("key", fmt.Sprintf("%x", item.Key())),
+					slog.Any("error", err))
+				continue
+			}
+
+			encoded, err := PulseEncode(pulse)
+			if err != nil {
+				return fmt.Errorf("migrate encode error: %w", err)
+			}
+
+			expires := bo.Retention.ExpiresAt(pulse)
+			for i, k := range PulseKeys(pulse) {
+				v := []byte{}
+				if i == 0 {
+					v = encoded
+				}
+				e := badger.NewEntry(k, v)
+				e.ExpiresAt = expires
+				if err := wb.SetEntry(e); err != nil {
+					return fmt.Errorf("migrate set error: %w", err)
+				}
+			}
+			if err := wb.Delete(item.KeyCopy(nil)); err != nil {
+				return fmt.Errorf("migrate delete error: %w", err)
+			}
+			migrated++
+		}
+		return nil
+	})
+	if err == nil {
+		err = wb.Set(SchemaKey, []byte{KeyVersion})
+	}
+	if err == nil {
+		err = wb.Flush()
+	}
+	if err != nil {
+		slog.Error("BadgerOutput failed to migrate keys", slog.Any("error", err))
+		return migrated, fmt.Errorf("key migration error: %w", err)
+	}
+
+	if migrated > 0 || skipped > 0 {
+		slog.Info("BadgerOutput migrated keys",
+			slog.Int("from", int(version)),
+			slog.Int("to", KeyVersion),
+			slog.Int("pulses", migrated),
+			slog.Int("skipped", skipped))
+	}
+	return migrated, nil
+}
+
+// schemaVersion is the KeyVersion the database was last migrated to, 1 before any
+func (bo *BadgerOutput) schemaVersion() (byte, error) {
+	version := byte(1)
+	err := bo.DB.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(SchemaKey)
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			if len(val) == 1 {
+				version = val[0]
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return version, fmt.Errorf("schema version error: %w", err)
+	}
+	return version, nil
+}
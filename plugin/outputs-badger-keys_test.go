@@ -0,0 +1,246 @@
+package plugin_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	Mp "github.com/maroda/monteverdi/plugin"
+	Mt "github.com/maroda/monteverdi/types"
+)
+
+func TestPulseKeys(t *testing.T) {
+	start := time.Date(2023, 10, 1, 14, 0, 0, 0, time.UTC)
+	pulse := &Mt.PulseEvent{
+		Dimension: 1,
+		Pattern:   Mt.Custom,
+		Name:      "pyrrhic",
+		Endpoint:  "prom",
+		Metric:    []string{"go_memstats_alloc_bytes"},
+		StartTime: start,
+	}
+
+	t.Run("Round trips the fields in every keyspace", func(t *testing.T) {
+		want := Mp.NewPulseKeyFields(pulse)
+		for i, key := range Mp.PulseKeys(pulse) {
+			got, space, ok := Mp.ParsePulseKey(key)
+			if !ok {
+				t.Fatalf("Expected key %d to parse", i)
+			}
+			if got != want {
+				t.Errorf("Key %d: got %+v, want %+v", i, got, want)
+			}
+			assertInt(t, int(key[0]), Mp.KeyVersion)
+			if space != []byte{Mp.TimeKeys, Mp.MetricKeys, Mp.PatternKeys}[i] {
+				t.Errorf("Key %d: unexpected keyspace %c", i, space)
+			}
+		}
+	})
+
+	t.Run("Differs for everything that tells pulses apart", func(t *testing.T) {
+		others := []Mt.PulseEvent{*pulse, *pulse, *pulse, *pulse}
+		others[0].Metric = []string{"go_memstats_heap_bytes"}
+		others[1].Endpoint = "node"
+		others[2].Name = "spondee"
+		others[3].Pattern = Mt.Iamb
+		for i := range others {
+			if bytes.Equal(Mp.PulseKey(pulse), Mp.PulseKey(&others[i])) {
+				t.Errorf("Expected a different key for %+v", others[i])
+			}
+		}
+	})
+
+	t.Run("Hashes every metric of a pulse", func(t *testing.T) {
+		leader := *pulse
+		leader.Pattern = Mt.Cascade
+		leader.Metric = []string{"go_memstats_alloc_bytes", "go_goroutines"}
+		other := leader
+		other.Metric = []string{"go_memstats_alloc_bytes", "go_gc_duration_seconds"}
+		if bytes.Equal(Mp.PulseKey(&leader), Mp.PulseKey(&other)) {
+			t.Error("Expected cascades to different followers to have different keys")
+		}
+		if Mp.NewPulseKeyFields(pulse).Metric != Mp.HashKeyField(pulse.Metric[0]) {
+			t.Error("Expected a pulse on one metric to hash just that metric")
+		}
+
+		keys := Mp.PulseKeys(&leader)
+		assertInt(t, len(keys), 4)
+		for i, m := range leader.Metric {
+			f, space, ok := Mp.ParsePulseKey(keys[i+1])
+			if !ok || space != Mp.MetricKeys || f.Indexed != Mp.HashKeyField(m) {
+				t.Errorf("Expected key %d to be the metric key of %s", i+1, m)
+			}
+			if !bytes.Equal(f.Key(Mp.TimeKeys), keys[0]) {
+				t.Errorf("Expected key %d to point to the time key", i+1)
+			}
+		}
+	})
+
+	t.Run("Sorts time keys by time", func(t *testing.T) {
+		later := *pulse
+		later.StartTime = start.Add(time.Nanosecond)
+		later.Metric = []string{"a"}
+		if bytes.Compare(Mp.PulseKey(pulse), Mp.PulseKey(&later)) >= 0 {
+			t.Error("Expected the earlier pulse first")
+		}
+	})
+
+	t.Run("Ignores other keys", func(t *testing.T) {
+		for _, key := range [][]byte{Mp.PulseKeyV1(pulse), Mp.SchemaKey, nil} {
+			if _, _, ok := Mp.ParsePulseKey(key); ok {
+				t.Errorf("Expected %v not to parse", key)
+			}
+		}
+	})
+}
+
+func TestBadgerOutput_KeysDoNotCollide(t *testing.T) {
+	adapter, closedb := makeTestBadgerOutput(t)
+	defer closedb()
+
+	start := time.Date(2023, 10, 1, 14, 0, 0, 0, time.UTC)
+	pulses := []*Mt.PulseEvent{
+		{Dimension: 1, Pattern: Mt.Iamb, Endpoint: "prom", Metric: []string{"go_memstats_alloc_bytes"}, StartTime: start},
+		{Dimension: 1, Pattern: Mt.Iamb, Endpoint: "prom", Metric: []string{"go_memstats_heap_bytes"}, StartTime: start},
+		{Dimension: 1, Pattern: Mt.Iamb, Endpoint: "node", Metric: []string{"go_memstats_heap_bytes"}, StartTime: start},
+		{Dimension: 2, Pattern: Mt.Iamb, Endpoint: "prom", Metric: []string{"go_memstats_heap_bytes"}, StartTime: start.Add(-time.Second)},
+	}
+	assertError(t, adapter.WriteBatch(pulses), nil)
+
+	t.Run("Keeps pulses starting together", func(t *testing.T) {
+		page, err := adapter.Query(Mp.PulseQuery{})
+		assertError(t, err, nil)
+		assertInt(t, len(page.Pulses), 4)
+	})
+
+	t.Run("Scans the metric index", func(t *testing.T) {
+		page, err := adapter.Query(Mp.PulseQuery{Metric: "go_memstats_heap_bytes", Endpoint: "prom"})
+		assertError(t, err, nil)
+		assertInt(t, len(page.Pulses), 2)
+	})
+
+	t.Run("Finds a cascade by each of its metrics", func(t *testing.T) {
+		cascades := []*Mt.PulseEvent{
+			{Dimension: 1, Pattern: Mt.Cascade, Endpoint: "prom", Metric: []string{"latency", "errors"}, StartTime: start},
+			{Dimension: 1, Pattern: Mt.Cascade, Endpoint: "prom", Metric: []string{"latency", "saturation"}, StartTime: start},
+		}
+		assertError(t, adapter.WriteBatch(cascades), nil)
+
+		for metric, want := range map[string]int{"latency": 2, "errors": 1, "saturation": 1} {
+			page, err := adapter.Query(Mp.PulseQuery{Metric: metric})
+			assertError(t, err, nil)
+			assertInt(t, len(page.Pulses), want)
+		}
+	})
+
+	t.Run("Scans the pattern index in time order", func(t *testing.T) {
+		iamb := Mt.Iamb
+		page, err := adapter.Query(Mp.PulseQuery{Pattern: &iamb})
+		assertError(t, err, nil)
+		assertInt(t, len(page.Pulses), 4)
+		assertInt(t, page.Pulses[0].Dimension, 2)
+	})
+}
+
+func TestBadgerOutput_MigrateKeys(t *testing.T) {
+	start := time.Date(2023, 10, 1, 14, 0, 0, 0, time.UTC)
+	legacy := []*Mt.PulseEvent{
+		{Dimension: 1, Pattern: Mt.Iamb, Metric: []string{"latency"}, StartTime: start},
+		{Dimension: 1, Pattern: Mt.Trochee, Metric: []string{"latency"}, StartTime: start.Add(time.Second)},
+		{Dimension: 2, Pattern: Mt.Dactyl, Metric: []string{"errors"}, StartTime: start.Add(2 * time.Second)},
+	}
+
+	// writeV1 writes pulses as the version 1 BadgerOutput did
+	writeV1 := func(t *testing.T, db *badger.DB, pulses []*Mt.PulseEvent) {
+		t.Helper()
+		err := db.Update(func(txn *badger.Txn) error {
+			for _, p := range pulses {
+				if err := txn.Set(Mp.PulseKeyV1(p), encodeGob(t, p)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		assertError(t, err, nil)
+	}
+
+	t.Run("Rewrites version 1 keys", func(t *testing.T) {
+		adapter, closedb := makeTestBadgerOutput(t)
+		defer closedb()
+		writeV1(t, adapter.DB, legacy)
+
+		// A value that can't be decoded is left alone
+		broken := Mp.PulseKeyV1(&Mt.PulseEvent{StartTime: start.Add(time.Minute), Metric: []string{"broken"}})
+		assertError(t, adapter.DB.Update(func(txn *badger.Txn) error {
+			return txn.Set(broken, []byte("craquemattic"))
+		}), nil)
+
+		migrated, err := adapter.MigrateKeys()
+		assertError(t, err, nil)
+		assertInt(t, migrated, 3)
+
+		page, err := adapter.Query(Mp.PulseQuery{Metric: "latency"})
+		assertError(t, err, nil)
+		assertInt(t, len(page.Pulses), 2)
+
+		assertError(t, adapter.DB.View(func(txn *badger.Txn) error {
+			if _, err := txn.Get(Mp.PulseKeyV1(legacy[0])); !errors.Is(err, badger.ErrKeyNotFound) {
+				t.Error("Expected the version 1 key to be deleted")
+			}
+			if _, err := txn.Get(broken); err != nil {
+				t.Error("Expected the undecodable pulse to be kept")
+			}
+			item, err := txn.Get(Mp.PulseKey(legacy[0]))
+			if err != nil {
+				return err
+			}
+			return item.Value(func(val []byte) error {
+				if !Mp.IsPulseEncoded(val) {
+					t.Error("Expected the migrated pulse in the current encoding")
+				}
+				return nil
+			})
+		}), nil)
+	})
+
+	t.Run("Only runs once", func(t *testing.T) {
+		adapter, closedb := makeTestBadgerOutput(t)
+		defer closedb()
+		_, err := adapter.MigrateKeys()
+		assertError(t, err, nil)
+
+		writeV1(t, adapter.DB, legacy)
+		migrated, err := adapter.MigrateKeys()
+		assertError(t, err, nil)
+		assertInt(t, migrated, 0)
+	})
+
+	t.Run("Runs when the database is opened", func(t *testing.T) {
+		path := t.TempDir()
+		db, err := badger.Open(badger.DefaultOptions(path).WithLogger(nil))
+		assertError(t, err, nil)
+		writeV1(t, db, legacy)
+		assertError(t, db.Close(), nil)
+
+		adapter, err := Mp.NewBadgerOutput(path, 1)
+		assertError(t, err, nil)
+		defer adapter.Close()
+
+		page, err := adapter.Query(Mp.PulseQuery{})
+		assertError(t, err, nil)
+		assertInt(t, len(page.Pulses), 3)
+	})
+
+	t.Run("Errors on a newer version", func(t *testing.T) {
+		adapter, closedb := makeTestBadgerOutput(t)
+		defer closedb()
+		assertError(t, adapter.DB.Update(func(txn *badger.Txn) error {
+			return txn.Set(Mp.SchemaKey, []byte{Mp.KeyVersion + 1})
+		}), nil)
+
+		_, err := adapter.MigrateKeys()
+		assertGotError(t, err)
+	})
+}
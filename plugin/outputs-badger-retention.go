@@ -0,0 +1,252 @@
+package plugin
+
+/*
+
+	Retention
+
+	Pulses expire by dimension: WriteBatch sets every key of a pulse to expire
+	its TTL after the pulse started, and Badger stops returning it then.
+	Expired and deleted entries take space until compaction and value log GC
+	reclaim it, which the retention loop runs every Interval. When MaxBytes is
+	set and the database is larger, the loop first deletes the oldest pulses,
+	as many as the database is over by.
+
+	Badger refreshes its size estimate about once a minute,
+	so the cap is approximate and the Interval should be longer than that.
+
+*/
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	Mt "github.com/maroda/monteverdi/types"
+)
+
+const (
+	gcDiscardRatio = 0.5 // rewrite value log files that are at least half garbage
+	maxGCRewrites  = 10  // value log files rewritten in one pass
+)
+
+// Retention is how long the pulse archive keeps pulses and how large it may grow
+type Retention struct {
+	TTL      []time.Duration // by dimension from D1, the last one for every higher dimension, 0 keeps forever
+	MaxBytes int64           // size cap of the database, 0 for none
+	Interval time.Duration   // between retention passes
+}
+
+// RetentionPass is what one retention pass did
+type RetentionPass struct {
+	Trimmed  int           // oldest pulses deleted for MaxBytes
+	Rewrites int           // value log files rewritten by GC
+	Size     int64         // bytes used after the pass, as Badger estimates it
+	Duration time.Duration // how long the pass took
+}
+
+// TTLFor returns how long pulses of the dimension are kept, 0 for forever
+func (r *Retention) TTLFor(dimension int) time.Duration {
+	if r == nil || len(r.TTL) == 0 {
+		return 0
+	}
+	i := dimension - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(r.TTL) {
+		i = len(r.TTL) - 1
+	}
+	return r.TTL[i]
+}
+
+// ExpiresAt is the Unix time the keys of a pulse expire, 0 for never
+func (r *Retention) ExpiresAt(pulse *Mt.PulseEvent) uint64 {
+	ttl := r.TTLFor(pulse.Dimension)
+	if ttl <= 0 {
+		return 0
+	}
+	return uint64(pulse.StartTime.Add(ttl).Unix())
+}
+
+// RunRetention deletes the oldest pulses while the database is over MaxBytes,
+// then runs value log GC until there is nothing left to reclaim
+func (bo *BadgerOutput) RunRetention() (RetentionPass, error) {
+	began := time.Now()
+	var pass RetentionPass
+
+	if r := bo.Retention; r != nil && r.MaxBytes > 0 {
+		if size := bo.size(); size > r.MaxBytes {
+			total, err := bo.countPulses()
+			if err != nil {
+				return pass, err
+			}
+			excess := int(math.Ceil(float64(total) * float64(size-r.MaxBytes) / float64(size)))
+			if pass.Trimmed, err = bo.TrimOldest(excess); err != nil {
+				return pass, err
+			}
+		}
+	}
+
+	for pass.Rewrites < maxGCRewrites {
+		err := bo.DB.RunValueLogGC(gcDiscardRatio)
+		if errors.Is(err, badger.ErrNoRewrite) || errors.Is(err, badger.ErrRejected) || errors.Is(err, badger.ErrGCInMemoryMode) {
+			break
+		}
+		if err != nil {
+			return pass, fmt.Errorf("value log GC error: %w", err)
+		}
+		pass.Rewrites++
+	}
+
+	pass.Size = bo.size()
+	pass.Duration = time.Since(began)
+	return pass, nil
+}
+
+// TrimOldest deletes the n oldest pulses with their index keys,
+// returning how many were deleted
+func (bo *BadgerOutput) TrimOldest(n int) (int, error) {
+	if n <= 0 {
+		return 0, nil
+	}
+
+	wb := bo.DB.NewWriteBatch()
+	defer wb.Cancel()
+
+	trimmed := 0
+	prefix := []byte{KeyVersion, TimeKeys}
+	err := bo.DB.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.ValidForPrefix(prefix) && trimmed < n; it.Next() {
+			f, _, ok := ParsePulseKey(it.Item().Key())
+			if !ok {
+				continue
+			}
+
+			// A pulse has a metric key for each metric, one when it can't be read
+			keys := [][]byte{f.Key(TimeKeys), f.Key(MetricKeys), f.Key(PatternKeys)}
+			err := it.Item().Value(func(val []byte) error {
+				pulse, err := PulseDecode(val)
+				if err == nil {
+					keys = PulseKeys(pulse)
+				}
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("item data error: %w", err)
+			}
+
+			for _, key := range keys {
+				if err := wb.Delete(key); err != nil {
+					return fmt.Errorf("trim delete error: %w", err)
+				}
+			}
+			trimmed++
+		}
+		return nil
+	})
+	if err == nil {
+		err = wb.Flush()
+	}
+	if err != nil {
+		slog.Error("BadgerOutput failed to trim oldest pulses", slog.Any("error", err))
+		return 0, err
+	}
+
+	slog.Info("BadgerOutput trimmed oldest pulses", slog.Int("count", trimmed))
+	return trimmed, nil
+}
+
+// StartRetention runs a retention pass every Interval until Close,
+// report is called with the outcome of each pass when set
+func (bo *BadgerOutput) StartRetention(report func(RetentionPass, error)) {
+	if bo.Retention == nil || bo.Retention.Interval <= 0 {
+		return
+	}
+
+	slog.Info("BadgerOutput retention running",
+		slog.Any("ttl", bo.Retention.TTL),
+		slog.Int64("maxBytes", bo.Retention.MaxBytes),
+		slog.Duration("interval", bo.Retention.Interval))
+
+	bo.every(bo.Retention.Interval, func() {
+		pass, err := bo.RunRetention()
+		if err != nil {
+			slog.Error("BadgerOutput retention pass failed", slog.Any("error", err))
+		}
+		if report != nil {
+			report(pass, err)
+		}
+	})
+}
+
+// every runs pass every interval in the background until Close
+func (bo *BadgerOutput) every(interval time.Duration, pass func()) {
+	if bo.stopChan == nil {
+		bo.stopChan = make(chan struct{})
+	}
+
+	bo.wg.Add(1)
+	go func(stop chan struct{}) {
+		defer bo.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				pass()
+			case <-stop:
+				return
+			}
+		}
+	}(bo.stopChan)
+}
+
+// stopBackground waits for running passes and ends the background loops
+func (bo *BadgerOutput) stopBackground() {
+	if bo.stopChan == nil {
+		return
+	}
+	close(bo.stopChan)
+	bo.wg.Wait()
+	bo.stopChan = nil
+}
+
+// size is what the database uses, as Badger estimates it
+func (bo *BadgerOutput) size() int64 {
+	if bo.Size != nil {
+		return bo.Size()
+	}
+	lsm, vlog := bo.DB.Size()
+	return lsm + vlog
+}
+
+// countPulses counts the time keys
+func (bo *BadgerOutput) countPulses() (int, error) {
+	count := 0
+	prefix := []byte{KeyVersion, TimeKeys}
+	err := bo.DB.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.ValidForPrefix(prefix); it.Next() {
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("count pulses error: %w", err)
+	}
+	return count, nil
+}
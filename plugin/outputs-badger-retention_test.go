@@ -0,0 +1,124 @@
+package plugin_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	Mp "github.com/maroda/monteverdi/plugin"
+	Mt "github.com/maroda/monteverdi/types"
+)
+
+func TestRetention_TTLFor(t *testing.T) {
+	retention := &Mp.Retention{TTL: []time.Duration{72 * time.Hour, 2160 * time.Hour}}
+
+	tests := []struct {
+		name      string
+		retention *Mp.Retention
+		dimension int
+		want      time.Duration
+	}{
+		{"No retention keeps forever", nil, 1, 0},
+		{"No TTL keeps forever", &Mp.Retention{}, 1, 0},
+		{"D1", retention, 1, 72 * time.Hour},
+		{"D2", retention, 2, 2160 * time.Hour},
+		{"Higher dimensions use the last", retention, 4, 2160 * time.Hour},
+		{"Unset dimension is D1", retention, 0, 72 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.retention.TTLFor(tt.dimension); got != tt.want {
+				t.Errorf("TTLFor(%d) = %v, want %v", tt.dimension, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBadgerOutput_Retention(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+
+	t.Run("Expires every key of a pulse by its dimension", func(t *testing.T) {
+		adapter, closedb := makeTestBadgerOutput(t)
+		defer closedb()
+		adapter.Retention = &Mp.Retention{TTL: []time.Duration{time.Hour, 0}}
+
+		live := &Mt.PulseEvent{Dimension: 1, Metric: []string{"latency"}, StartTime: now}
+		pulses := []*Mt.PulseEvent{
+			live,
+			{Dimension: 1, Metric: []string{"latency"}, StartTime: now.Add(-2 * time.Hour)},
+			{Dimension: 2, Metric: []string{"latency"}, StartTime: now.Add(-365 * 24 * time.Hour)},
+		}
+		assertError(t, adapter.WriteBatch(pulses), nil)
+
+		page, err := adapter.Query(Mp.PulseQuery{})
+		assertError(t, err, nil)
+		assertInt(t, len(page.Pulses), 2)
+
+		assertError(t, adapter.DB.View(func(txn *badger.Txn) error {
+			for _, key := range Mp.PulseKeys(live) {
+				item, err := txn.Get(key)
+				if err != nil {
+					return err
+				}
+				if item.ExpiresAt() != uint64(now.Add(time.Hour).Unix()) {
+					t.Errorf("Expected the key to expire an hour after the pulse, got %d", item.ExpiresAt())
+				}
+			}
+			return nil
+		}), nil)
+	})
+
+	t.Run("Trims the oldest pulses over the size cap", func(t *testing.T) {
+		adapter, closedb := makeTestBadgerOutput(t)
+		defer closedb()
+		adapter.Retention = &Mp.Retention{MaxBytes: 1000}
+		adapter.Size = func() int64 { return 2000 }
+
+		var pulses []*Mt.PulseEvent
+		for i := 0; i < 10; i++ {
+			pulses = append(pulses, &Mt.PulseEvent{Dimension: 1, Metric: []string{"latency"}, StartTime: now.Add(time.Duration(i) * time.Second)})
+		}
+		assertError(t, adapter.WriteBatch(pulses), nil)
+
+		pass, err := adapter.RunRetention()
+		assertError(t, err, nil)
+		assertInt(t, pass.Trimmed, 5)
+		assertInt64(t, pass.Size, 2000)
+
+		page, err := adapter.Query(Mp.PulseQuery{Metric: "latency"})
+		assertError(t, err, nil)
+		assertInt(t, len(page.Pulses), 5)
+		if !page.Pulses[0].StartTime.Equal(now.Add(5 * time.Second)) {
+			t.Errorf("Expected the oldest to be trimmed, got %v first", page.Pulses[0].StartTime)
+		}
+	})
+
+	t.Run("Leaves a database under the cap", func(t *testing.T) {
+		adapter, closedb := makeTestBadgerOutput(t)
+		defer closedb()
+		adapter.Retention = &Mp.Retention{MaxBytes: 1000}
+		adapter.Size = func() int64 { return 500 }
+		assertError(t, adapter.WriteBatch([]*Mt.PulseEvent{{Dimension: 1, StartTime: now}}), nil)
+
+		pass, err := adapter.RunRetention()
+		assertError(t, err, nil)
+		assertInt(t, pass.Trimmed, 0)
+	})
+
+	t.Run("Reports passes until closed", func(t *testing.T) {
+		adapter, err := Mp.NewBadgerOutputWithRetention(t.TempDir(), 1, &Mp.Retention{Interval: 10 * time.Millisecond})
+		assertError(t, err, nil)
+
+		passes := make(chan error, 100)
+		adapter.StartRetention(func(pass Mp.RetentionPass, err error) { passes <- err })
+
+		select {
+		case err := <-passes:
+			assertError(t, err, nil)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected a retention pass")
+		}
+		assertError(t, adapter.Close(), nil)
+	})
+}
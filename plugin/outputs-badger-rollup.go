@@ -0,0 +1,370 @@
+package plugin
+
+/*
+
+	Rollups
+
+	Pulses are summarized per minute, hour, and day, so a chart over weeks
+	reads a few hundred summaries instead of decoding every pulse.
+
+		rollup    2 'r' | resolution | bucket start (8)
+		pending   2 'u' | written (8) | sequence (8)
+
+	WriteBatch adds a pending key with a summary per minute of the pulses in
+	the batch that aren't in the database yet, so writing a batch again
+	doesn't count its pulses twice.
+	RunRollups merges the pending summaries into the minute, hour, and day
+	rollups and deletes them, in the background every rollup interval and
+	once more on Close. Rollups lag the pulses by up to that interval.
+
+	Rollups are JSON and don't expire, they keep counting pulses past their
+	TTL, including backfilled pulses that were too old to be kept at all.
+	Those are never written, so they are counted each time they are backfilled.
+
+*/
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	Mt "github.com/maroda/monteverdi/types"
+)
+
+const (
+	RollupKeys        byte = 'r' // rollups by resolution, then time
+	PendingRollupKeys byte = 'u' // summaries not yet rolled up
+
+	rollupChunk = 1000 // pending summaries merged in one transaction
+)
+
+// RollupResolutions are the bucket sizes of rollups, finest first
+var RollupResolutions = []time.Duration{time.Minute, time.Hour, 24 * time.Hour}
+
+// Rollup summarizes the pulses starting in a bucket of time
+type Rollup struct {
+	Start      time.Time               `json:"start"`
+	Resolution time.Duration           `json:"resolution"`
+	Count      int                     `json:"count"`
+	Duration   time.Duration           `json:"duration"`             // total of the pulses
+	Patterns   map[Mt.PulsePattern]int `json:"patterns,omitempty"`   // counts by pattern
+	Names      map[string]int          `json:"names,omitempty"`      // counts of Custom pulses by name
+	Dimensions map[int]int             `json:"dimensions,omitempty"` // counts by dimension
+	Metrics    map[string]int          `json:"metrics,omitempty"`    // counts by each Metric
+	Endpoints  map[string]int          `json:"endpoints,omitempty"`  // counts by endpoint
+}
+
+// NewRollup returns an empty rollup of the bucket holding start
+func NewRollup(start time.Time, resolution time.Duration) *Rollup {
+	return &Rollup{
+		Start:      start.Truncate(resolution).UTC(),
+		Resolution: resolution,
+		Patterns:   make(map[Mt.PulsePattern]int),
+		Names:      make(map[string]int),
+		Dimensions: make(map[int]int),
+		Metrics:    make(map[string]int),
+		Endpoints:  make(map[string]int),
+	}
+}
+
+// Add counts a pulse
+func (r *Rollup) Add(p *Mt.PulseEvent) {
+	r.Count++
+	r.Duration += p.Duration
+	r.Patterns[p.Pattern]++
+	if p.Pattern == Mt.Custom && p.Name != "" {
+		r.Names[p.Name]++
+	}
+	r.Dimensions[p.Dimension]++
+	for _, m := range p.Metric {
+		r.Metrics[m]++
+	}
+	r.Endpoints[p.Endpoint]++
+}
+
+// Merge adds the counts of another rollup
+func (r *Rollup) Merge(o *Rollup) {
+	r.Count += o.Count
+	r.Duration += o.Duration
+	for k, n := range o.Patterns {
+		r.Patterns[k] += n
+	}
+	for k, n := range o.Names {
+		r.Names[k] += n
+	}
+	for k, n := range o.Dimensions {
+		r.Dimensions[k] += n
+	}
+	for k, n := range o.Metrics {
+		r.Metrics[k] += n
+	}
+	for k, n := range o.Endpoints {
+		r.Endpoints[k] += n
+	}
+}
+
+// MeanDuration is the mean duration of the pulses, 0 without any
+func (r *Rollup) MeanDuration() time.Duration {
+	if r.Count == 0 {
+		return 0
+	}
+	return r.Duration / time.Duration(r.Count)
+}
+
+// RollupKey is the key of the rollup of a resolution holding start
+func RollupKey(resolution time.Duration, start time.Time) []byte {
+	key := []byte{KeyVersion, RollupKeys, rollupLevel(resolution)}
+	return binary.BigEndian.AppendUint64(key, uint64(start.Truncate(resolution).UnixNano()))
+}
+
+// RollupResolution is the finest resolution with at most maxBuckets buckets
+// from start to end, the coarsest when none has
+func RollupResolution(start, end time.Time, maxBuckets int) time.Duration {
+	span := end.Sub(start)
+	for _, res := range RollupResolutions {
+		if span <= res*time.Duration(maxBuckets) {
+			return res
+		}
+	}
+	return RollupResolutions[len(RollupResolutions)-1]
+}
+
+// Rollups returns the rollups of a resolution in time order,
+// from the bucket holding start until end, exclusive.
+// Buckets without pulses have no rollup.
+func (bo *BadgerOutput) Rollups(start, end time.Time, resolution time.Duration) ([]*Rollup, error) {
+	level := rollupLevel(resolution)
+	if RollupResolutions[level] != resolution {
+		return nil, fmt.Errorf("no rollups of %s, only minute, hour, and day", resolution)
+	}
+
+	prefix := []byte{KeyVersion, RollupKeys, level}
+	var rollups []*Rollup
+	err := bo.DB.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek(RollupKey(resolution, start)); it.ValidForPrefix(prefix); it.Next() {
+			key := it.Item().Key()
+			if len(key) != len(prefix)+8 {
+				continue
+			}
+			if !end.IsZero() && int64(binary.BigEndian.Uint64(key[len(prefix):])) >= end.UnixNano() {
+				break
+			}
+
+			r := NewRollup(time.Time{}, resolution)
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, r)
+			})
+			if err != nil {
+				return fmt.Errorf("rollup decode error: %w", err)
+			}
+			rollups = append(rollups, r)
+		}
+		return nil
+	})
+
+	return rollups, err
+}
+
+// RunRollups merges the pending summaries into the rollups,
+// returning how many were merged
+func (bo *BadgerOutput) RunRollups() (int, error) {
+	merged := 0
+	for {
+		n, err := bo.rollupChunk()
+		merged += n
+		if err != nil {
+			slog.Error("BadgerOutput failed to roll up pulses", slog.Any("error", err))
+			return merged, err
+		}
+		if n < rollupChunk {
+			break
+		}
+	}
+
+	if merged > 0 {
+		slog.Debug("BadgerOutput rolled up pulses", slog.Int("summaries", merged))
+	}
+	return merged, nil
+}
+
+// StartRollups runs RunRollups every interval until Close
+func (bo *BadgerOutput) StartRollups(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	slog.Info("BadgerOutput rollups running", slog.Duration("interval", interval))
+	bo.every(interval, func() { bo.RunRollups() })
+}
+
+// newPulses returns the pulses whose time key isn't in the database,
+// each once. Pulses past their TTL are never written, so they are always new.
+func (bo *BadgerOutput) newPulses(pulses []*Mt.PulseEvent) ([]*Mt.PulseEvent, error) {
+	var fresh []*Mt.PulseEvent
+	seen := make(map[string]bool, len(pulses))
+	err := bo.DB.View(func(txn *badger.Txn) error {
+		for _, p := range pulses {
+			key := PulseKey(p)
+			if seen[string(key)] {
+				continue
+			}
+			seen[string(key)] = true
+
+			_, err := txn.Get(key)
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				fresh = append(fresh, p)
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("item lookup error: %w", err)
+			}
+		}
+		return nil
+	})
+	return fresh, err
+}
+
+// pendRollups adds the per minute summaries of pulses to a write batch
+func (bo *BadgerOutput) pendRollups(wb *badger.WriteBatch, pulses []*Mt.PulseEvent) error {
+	if len(pulses) == 0 {
+		return nil
+	}
+
+	byMinute := make(map[int64]*Rollup)
+	var summaries []*Rollup
+	for _, p := range pulses {
+		minute := p.StartTime.Truncate(time.Minute).UnixNano()
+		r, ok := byMinute[minute]
+		if !ok {
+			r = NewRollup(p.StartTime, time.Minute)
+			byMinute[minute] = r
+			summaries = append(summaries, r)
+		}
+		r.Add(p)
+	}
+
+	val, err := json.Marshal(summaries)
+	if err != nil {
+		return fmt.Errorf("rollup encode error: %w", err)
+	}
+
+	key := binary.BigEndian.AppendUint64([]byte{KeyVersion, PendingRollupKeys}, uint64(time.Now().UnixNano()))
+	key = binary.BigEndian.AppendUint64(key, bo.rollupSeq.Add(1))
+	return wb.Set(key, val)
+}
+
+// rollupChunk merges up to rollupChunk pending summaries in one transaction,
+// a write of the same rollups at the same time makes it fail and leaves them pending
+func (bo *BadgerOutput) rollupChunk() (int, error) {
+	prefix := []byte{KeyVersion, PendingRollupKeys}
+	n := 0
+
+	err := bo.DB.Update(func(txn *badger.Txn) error {
+		type pending struct {
+			key []byte
+			val []byte
+		}
+		var pendings []pending
+
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		for it.Rewind(); it.ValidForPrefix(prefix) && len(pendings) < rollupChunk; it.Next() {
+			val, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				it.Close()
+				return fmt.Errorf("item data error: %w", err)
+			}
+			pendings = append(pendings, pending{it.Item().KeyCopy(nil), val})
+		}
+		it.Close()
+
+		rollups := make(map[string]*Rollup)
+		for _, p := range pendings {
+			var summaries []*Rollup
+			if err := json.Unmarshal(p.val, &summaries); err != nil {
+				slog.Warn("BadgerOutput could not roll up pulses, dropping them",
+					slog.String("key", fmt.Sprintf("%x", p.key)),
+					slog.Any("error", err))
+			}
+			for _, s := range summaries {
+				for _, res := range RollupResolutions {
+					r, err := bo.loadRollup(txn, rollups, res, s.Start)
+					if err != nil {
+						return err
+					}
+					r.Merge(s)
+				}
+			}
+			if err := txn.Delete(p.key); err != nil {
+				return fmt.Errorf("rollup delete error: %w", err)
+			}
+		}
+
+		for key, r := range rollups {
+			val, err := json.Marshal(r)
+			if err != nil {
+				return fmt.Errorf("rollup encode error: %w", err)
+			}
+			if err := txn.Set([]byte(key), val); err != nil {
+				return fmt.Errorf("rollup set error: %w", err)
+			}
+		}
+
+		n = len(pendings)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// loadRollup returns the rollup holding start from loaded, reading it from the
+// database the first time, or a new one when there is none
+func (bo *BadgerOutput) loadRollup(txn *badger.Txn, loaded map[string]*Rollup, res time.Duration, start time.Time) (*Rollup, error) {
+	key := RollupKey(res, start)
+	if r, ok := loaded[string(key)]; ok {
+		return r, nil
+	}
+
+	r := NewRollup(start, res)
+	item, err := txn.Get(key)
+	switch {
+	case errors.Is(err, badger.ErrKeyNotFound):
+	case err != nil:
+		return nil, fmt.Errorf("rollup read error: %w", err)
+	default:
+		err = item.Value(func(val []byte) error {
+			return json.Unmarshal(val, r)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("rollup decode error: %w", err)
+		}
+	}
+
+	loaded[string(key)] = r
+	return r, nil
+}
+
+// rollupLevel is the index of the resolution in RollupResolutions,
+// the coarsest it is at least as long as
+func rollupLevel(resolution time.Duration) byte {
+	level := 0
+	for i, res := range RollupResolutions {
+		if resolution >= res {
+			level = i
+		}
+	}
+	return byte(level)
+}
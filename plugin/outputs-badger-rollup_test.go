@@ -0,0 +1,173 @@
+package plugin_test
+
+import (
+	"testing"
+	"time"
+
+	Mp "github.com/maroda/monteverdi/plugin"
+	Mt "github.com/maroda/monteverdi/types"
+)
+
+func TestRollupResolution(t *testing.T) {
+	start := time.Date(2023, 10, 1, 14, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		span time.Duration
+		want time.Duration
+	}{
+		{"Minutes for hours", 6 * time.Hour, time.Minute},
+		{"Hours for days", 7 * 24 * time.Hour, time.Hour},
+		{"Days for months", 90 * 24 * time.Hour, 24 * time.Hour},
+		{"Days beyond the buckets", 5 * 365 * 24 * time.Hour, 24 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Mp.RollupResolution(start, start.Add(tt.span), 500); got != tt.want {
+				t.Errorf("RollupResolution(%v) = %v, want %v", tt.span, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBadgerOutput_Rollups(t *testing.T) {
+	start := time.Date(2023, 10, 1, 14, 0, 0, 0, time.UTC)
+	pulse := func(at time.Duration, pattern Mt.PulsePattern, metric string) *Mt.PulseEvent {
+		return &Mt.PulseEvent{
+			Dimension: 1,
+			Pattern:   pattern,
+			Endpoint:  "DB",
+			Metric:    []string{metric},
+			StartTime: start.Add(at),
+			Duration:  10 * time.Second,
+		}
+	}
+
+	t.Run("Summarizes pulses by minute, hour, and day", func(t *testing.T) {
+		adapter, closedb := makeTestBadgerOutput(t)
+		defer closedb()
+
+		pyrrhic := pulse(90*time.Second, Mt.Custom, "errors")
+		pyrrhic.Name = "pyrrhic"
+		pyrrhic.Duration = 40 * time.Second
+		assertError(t, adapter.WriteBatch([]*Mt.PulseEvent{
+			pulse(0, Mt.Iamb, "latency"),
+			pulse(30*time.Second, Mt.Iamb, "latency"),
+			pyrrhic,
+		}), nil)
+		assertError(t, adapter.WriteBatch([]*Mt.PulseEvent{
+			pulse(10*time.Second, Mt.Trochee, "latency"),
+			pulse(2*time.Hour, Mt.Iamb, "latency"),
+		}), nil)
+
+		merged, err := adapter.RunRollups()
+		assertError(t, err, nil)
+		assertInt(t, merged, 2)
+
+		minutes, err := adapter.Rollups(start, start.Add(3*time.Hour), time.Minute)
+		assertError(t, err, nil)
+		assertInt(t, len(minutes), 3)
+		assertInt(t, minutes[0].Count, 3)
+		assertInt(t, minutes[0].Patterns[Mt.Iamb], 2)
+		assertInt(t, minutes[0].Patterns[Mt.Trochee], 1)
+		assertInt(t, minutes[1].Names["pyrrhic"], 1)
+
+		hours, err := adapter.Rollups(start, start.Add(3*time.Hour), time.Hour)
+		assertError(t, err, nil)
+		assertInt(t, len(hours), 2)
+		assertInt(t, hours[0].Count, 4)
+		assertInt(t, hours[0].Metrics["latency"], 3)
+		assertInt(t, hours[0].Endpoints["DB"], 4)
+		if hours[0].MeanDuration() != 17500*time.Millisecond {
+			t.Errorf("Expected a mean of 17.5s, got %v", hours[0].MeanDuration())
+		}
+
+		days, err := adapter.Rollups(start, start.Add(24*time.Hour), 24*time.Hour)
+		assertError(t, err, nil)
+		assertInt(t, len(days), 1)
+		assertInt(t, days[0].Count, 5)
+		assertInt(t, days[0].Dimensions[1], 5)
+		if !days[0].Start.Equal(start.Truncate(24 * time.Hour)) {
+			t.Errorf("Expected the day to start at midnight, got %v", days[0].Start)
+		}
+
+		// Merged summaries are gone
+		merged, err = adapter.RunRollups()
+		assertError(t, err, nil)
+		assertInt(t, merged, 0)
+	})
+
+	t.Run("Stops at the end of the range", func(t *testing.T) {
+		adapter, closedb := makeTestBadgerOutput(t)
+		defer closedb()
+		assertError(t, adapter.WriteBatch([]*Mt.PulseEvent{
+			pulse(0, Mt.Iamb, "latency"),
+			pulse(time.Hour, Mt.Iamb, "latency"),
+		}), nil)
+		_, err := adapter.RunRollups()
+		assertError(t, err, nil)
+
+		hours, err := adapter.Rollups(start.Add(30*time.Minute), start.Add(time.Hour), time.Hour)
+		assertError(t, err, nil)
+		assertInt(t, len(hours), 1)
+	})
+
+	t.Run("Counts a pulse once when it is written again", func(t *testing.T) {
+		adapter, closedb := makeTestBadgerOutput(t)
+		defer closedb()
+
+		batch := []*Mt.PulseEvent{pulse(0, Mt.Iamb, "latency"), pulse(0, Mt.Iamb, "latency")}
+		assertError(t, adapter.WriteBatch(batch), nil)
+		assertError(t, adapter.WriteBatch(batch), nil)
+		assertError(t, adapter.WriteBatch([]*Mt.PulseEvent{batch[0], pulse(time.Second, Mt.Iamb, "latency")}), nil)
+		_, err := adapter.RunRollups()
+		assertError(t, err, nil)
+
+		minutes, err := adapter.Rollups(start, start.Add(time.Hour), time.Minute)
+		assertError(t, err, nil)
+		assertInt(t, len(minutes), 1)
+		assertInt(t, minutes[0].Count, 2)
+	})
+
+	t.Run("Counts pulses past their TTL", func(t *testing.T) {
+		adapter, closedb := makeTestBadgerOutput(t)
+		defer closedb()
+		adapter.Retention = &Mp.Retention{TTL: []time.Duration{time.Hour}}
+
+		assertError(t, adapter.WriteBatch([]*Mt.PulseEvent{pulse(0, Mt.Iamb, "latency")}), nil)
+		_, err := adapter.RunRollups()
+		assertError(t, err, nil)
+
+		page, err := adapter.Query(Mp.PulseQuery{})
+		assertError(t, err, nil)
+		assertInt(t, len(page.Pulses), 0)
+
+		days, err := adapter.Rollups(start, start.Add(time.Hour), 24*time.Hour)
+		assertError(t, err, nil)
+		assertInt(t, len(days), 1)
+	})
+
+	t.Run("Rolls up the rest on close", func(t *testing.T) {
+		path := t.TempDir()
+		adapter, err := Mp.NewBadgerOutput(path, 10)
+		assertError(t, err, nil)
+		assertError(t, adapter.WritePulse(pulse(0, Mt.Iamb, "latency")), nil)
+		assertError(t, adapter.Close(), nil)
+
+		adapter, err = Mp.NewBadgerOutput(path, 10)
+		assertError(t, err, nil)
+		defer adapter.Close()
+
+		minutes, err := adapter.Rollups(start, start.Add(time.Minute), time.Minute)
+		assertError(t, err, nil)
+		assertInt(t, len(minutes), 1)
+	})
+
+	t.Run("Errors on other resolutions", func(t *testing.T) {
+		adapter, closedb := makeTestBadgerOutput(t)
+		defer closedb()
+		_, err := adapter.Rollups(start, start.Add(time.Hour), 5*time.Minute)
+		assertGotError(t, err)
+	})
+}
@@ -3,10 +3,11 @@ package plugin
 import (
 	"bytes"
 	"encoding/binary"
-	"encoding/gob"
+	"errors"
 	"fmt"
 	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dgraph-io/badger/v4"
@@ -19,9 +20,21 @@ type BadgerOutput struct {
 	DB        *badger.DB
 	BatchSize int
 	Buffer    []*Mt.PulseEvent
+	Retention *Retention     // how long pulses are kept, nil keeps them forever
+	Size      func() int64   // bytes the database uses, Badger's estimate when nil, e.g. for testing
+	stopChan  chan struct{}  // stops the background loops
+	wg        sync.WaitGroup // waits for the background loops
+	rollupSeq atomic.Uint64  // tells apart the pending rollups of a batch
+	ReadOnly  bool           // opened with OpenBadgerReadOnly, Close neither flushes nor rolls up
 }
 
 func NewBadgerOutput(path string, batchSize int) (*BadgerOutput, error) {
+	return NewBadgerOutputWithRetention(path, batchSize, nil)
+}
+
+// NewBadgerOutputWithRetention opens the database with pulses expiring by retention,
+// StartRetention runs the rest of it
+func NewBadgerOutputWithRetention(path string, batchSize int, retention *Retention) (*BadgerOutput, error) {
 	opts := badger.DefaultOptions(path).
 		WithCompression(options.ZSTD).
 		WithNumVersionsToKeep(1)
@@ -36,11 +49,47 @@ func NewBadgerOutput(path string, batchSize int) (*BadgerOutput, error) {
 		slog.String("path", path),
 		slog.Int("batchSize", batchSize))
 
-	return &BadgerOutput{
+	bo := &BadgerOutput{
 		DB:        db,
 		BatchSize: batchSize,
 		Buffer:    make([]*Mt.PulseEvent, 0, batchSize),
-	}, nil
+		Retention: retention,
+	}
+
+	// Databases written with older keys are rewritten once
+	if _, err := bo.MigrateKeys(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return bo, nil
+}
+
+// OpenBadgerReadOnly opens the database for reading only, e.g. to export it.
+// Its keys are not migrated, so a database with older keys is an error.
+func OpenBadgerReadOnly(path string) (*BadgerOutput, error) {
+	opts := badger.DefaultOptions(path).
+		WithCompression(options.ZSTD).
+		WithReadOnly(true)
+
+	db, err := badger.Open(opts)
+	if err != nil {
+		slog.Error("BadgerOutput failed to open database", slog.Any("error", err))
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	bo := &BadgerOutput{DB: db, ReadOnly: true}
+	version, err := bo.schemaVersion()
+	if err == nil && version != KeyVersion {
+		err = fmt.Errorf("database keys are version %d, open it for writing once to migrate them to %d", version, KeyVersion)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	slog.Info("BadgerOutput opened read-only", slog.String("path", path))
+	return bo, nil
 }
 
 // WritePulse queues up a batch of pulses,
@@ -58,21 +107,57 @@ func (bo *BadgerOutput) WritePulse(pulse *Mt.PulseEvent) error {
 }
 
 // WriteBatch performs the key/value creation to be stored
-// and actually calls BadgerDB to write the data
+// and actually calls BadgerDB to write the data,
+// along with the summaries for rollups
 func (bo *BadgerOutput) WriteBatch(pulses []*Mt.PulseEvent) error {
+	// Only pulses the database doesn't have yet are summarized,
+	// so a retried batch or a rerun backfill isn't counted twice
+	fresh, err := bo.newPulses(pulses)
+	if err != nil {
+		slog.Error("BadgerOutput failed to look up batch", slog.Any("error", err))
+		return fmt.Errorf("write batch error: %w", err)
+	}
+
 	wb := bo.DB.NewWriteBatch()
 	defer wb.Cancel()
 
+	now := uint64(time.Now().Unix())
 	for _, p := range pulses {
-		k := PulseKey(p)
-		v := PulseEncode(p)
-		if err := wb.Set(k, v); err != nil {
-			slog.Error("BadgerOutput failed to set key in batch",
+		// A backfilled pulse can be past its TTL already
+		expires := bo.Retention.ExpiresAt(p)
+		if expires > 0 && expires <= now {
+			continue
+		}
+		v, err := PulseEncode(p)
+		if err != nil {
+			slog.Error("BadgerOutput failed to encode pulse",
 				slog.Any("error", err),
 				slog.Time("pulseTime", p.StartTime),
-				slog.String("metric", p.Metric[0]))
+				slog.Any("metric", p.Metric))
 			return fmt.Errorf("write batch error: %w", err)
 		}
+
+		// The pulse is under its time key, the index keys are empty
+		for i, k := range PulseKeys(p) {
+			if i > 0 {
+				v = []byte{}
+			}
+			e := badger.NewEntry(k, v)
+			e.ExpiresAt = expires
+			if err := wb.SetEntry(e); err != nil {
+				slog.Error("BadgerOutput failed to set key in batch",
+					slog.Any("error", err),
+					slog.Time("pulseTime", p.StartTime),
+					slog.Any("metric", p.Metric))
+				return fmt.Errorf("write batch error: %w", err)
+			}
+		}
+	}
+
+	// Pulses past their TTL still count in the rollups
+	if err := bo.pendRollups(wb, fresh); err != nil {
+		slog.Error("BadgerOutput failed to summarize batch", slog.Any("error", err))
+		return fmt.Errorf("write batch error: %w", err)
 	}
 
 	if err := wb.Flush(); err != nil {
@@ -107,9 +192,22 @@ func (bo *BadgerOutput) flushLocked() error {
 
 // Close returns a Flush error but still attempts to close
 func (bo *BadgerOutput) Close() error {
+	if bo.ReadOnly {
+		if err := bo.DB.Close(); err != nil {
+			slog.Error("BadgerOutput failed to close database", slog.Any("error", err))
+			return fmt.Errorf("close failed: %v", err)
+		}
+		return nil
+	}
+
+	bo.stopBackground()
+
 	slog.Info("BadgerOutput closing, flushing buffer",
 		slog.Int("bufferSize", len(bo.Buffer)))
 	flushErr := bo.Flush()
+	if _, err := bo.RunRollups(); err != nil {
+		slog.Warn("BadgerOutput left pulses to roll up when next opened", slog.Any("error", err))
+	}
 	closeErr := bo.DB.Close()
 
 	if flushErr != nil {
@@ -128,87 +226,129 @@ func (bo *BadgerOutput) Close() error {
 
 func (bo *BadgerOutput) Type() string { return "BadgerDB" }
 
-// PulseKey creates a composite key
-// timestamp + dimension + first five letters of metric
-func PulseKey(pulse *Mt.PulseEvent) []byte {
-	key := make([]byte, 8+1+5)
-
-	// Using positive BigEndian integer to convert timestamp
-	// so keys can be sorted chronologically by BadgerDB
-	binary.BigEndian.PutUint64(key[0:8], uint64(pulse.StartTime.UnixNano()))
-
-	// Set Dimension
-	key[8] = byte(pulse.Dimension)
+// QueryRange retrieves pulses that start between start and end, exclusive
+func (bo *BadgerOutput) QueryRange(start, end time.Time) (interface{}, error) {
+	var pulses []*Mt.PulseEvent
 
-	// Keep metric name at five chars
-	if len(pulse.Metric) > 0 {
-		mBytes := []byte(pulse.Metric[0])
-		n := len(mBytes)
-		if n > 5 {
-			n = 5
+	page, err := bo.Query(PulseQuery{Start: start, End: end})
+	if page != nil {
+		for _, p := range page.Pulses {
+			if p.StartTime.After(start) {
+				pulses = append(pulses, p)
+			}
 		}
-		copy(key[9:9+n], mBytes[:n])
 	}
 
-	return key
-}
+	slog.Info("BadgerOutput QueryRange successful", slog.Int("count", len(pulses)))
 
-// PulseEncode serializes the pulse event struct for data storage
-func PulseEncode(p *Mt.PulseEvent) []byte {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	enc.Encode(p)
-	return buf.Bytes()
+	return pulses, err
 }
 
-// PulseDecode deserializes the pulse event data
-func PulseDecode(data []byte) (*Mt.PulseEvent, error) {
-	var p Mt.PulseEvent
-	buf := bytes.NewBuffer(data)
-	dec := gob.NewDecoder(buf)
-	err := dec.Decode(&p)
-	return &p, err
-}
+// Query scans the keys of the metric when one is given, else of the pattern,
+// else the time keys, from the start of the range until its end.
+// Keys are filtered on their fields, only pulses that pass are read and decoded.
+// Pulses still in the Buffer are not found.
+func (bo *BadgerOutput) Query(q PulseQuery) (*PulsePage, error) {
+	space, prefix := TimeKeys, []byte{KeyVersion, TimeKeys}
+	switch {
+	case q.Metric != "":
+		space = MetricKeys
+		prefix = binary.BigEndian.AppendUint64([]byte{KeyVersion, MetricKeys}, HashKeyField(q.Metric))
+	case q.Pattern != nil:
+		space = PatternKeys
+		prefix = []byte{KeyVersion, PatternKeys, byte(*q.Pattern)}
+	}
 
-// QueryRange retrieves pulses within a time range
-func (bo *BadgerOutput) QueryRange(start, end time.Time) (interface{}, error) {
-	var pulses []*Mt.PulseEvent
+	var start uint64
+	if !q.Start.IsZero() {
+		start = uint64(q.Start.UnixNano())
+	}
+	seek := binary.BigEndian.AppendUint64(bytes.Clone(prefix), start)
+	if len(q.After) > 0 && bytes.Compare(q.After, seek) > 0 {
+		seek = q.After
+	}
 
-	// db.View() callback
-	// BadgerDB provides a transaction in which to get item.Value()
+	page := &PulsePage{}
 	err := bo.DB.View(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		opts.PrefetchValues = space == TimeKeys
 		it := txn.NewIterator(opts)
 		defer it.Close()
 
-		for it.Rewind(); it.Valid(); it.Next() {
+		var last []byte
+		for it.Seek(seek); it.ValidForPrefix(prefix); it.Next() {
 			item := it.Item()
+			key := item.Key()
+			f, _, ok := ParsePulseKey(key)
+			if !ok || bytes.Equal(key, q.After) {
+				continue
+			}
+			if !q.End.IsZero() && f.Start >= q.End.UnixNano() {
+				break
+			}
+			if !q.matchesKey(f) {
+				continue
+			}
 
-			// item.Value() callback
-			// BadgerDB passes bytes to the anon func
-			err := item.Value(func(val []byte) error {
-				pulse, err := PulseDecode(val)
-				if err != nil {
-					slog.Error("BadgerOutput failed to decode pulse", slog.Any("error", err))
-					return fmt.Errorf("pulse decode error: %w", err)
+			// Index keys point to the time key holding the pulse
+			if space != TimeKeys {
+				held, err := txn.Get(f.Key(TimeKeys))
+				if errors.Is(err, badger.ErrKeyNotFound) {
+					continue
 				}
-
-				// Filter by time range
-				if pulse.StartTime.After(start) && pulse.StartTime.Before(end) {
-					pulses = append(pulses, pulse)
+				if err != nil {
+					return fmt.Errorf("item data error: %w", err)
 				}
+				item = held
+			}
 
-				return nil
+			var pulse *Mt.PulseEvent
+			err := item.Value(func(val []byte) error {
+				var err error
+				pulse, err = PulseDecode(val)
+				return err
 			})
 			if err != nil {
-				slog.Error("BadgerOutput callback failure", slog.Any("error", err))
-				return fmt.Errorf("item data error: %w", err)
+				slog.Error("BadgerOutput failed to decode pulse", slog.Any("error", err))
+				return fmt.Errorf("pulse decode error: %w", err)
+			}
+
+			// Hashes can collide, the pulse has the last word
+			if !q.Matches(pulse) {
+				continue
+			}
+
+			// A full page, and there is at least one more
+			if q.Limit > 0 && len(page.Pulses) == q.Limit {
+				page.Next = last
+				break
 			}
+			page.Pulses = append(page.Pulses, pulse)
+			last = it.Item().KeyCopy(nil)
 		}
 		return nil
 	})
 
-	slog.Info("BadgerOutput QueryRange successful", slog.Int("count", len(pulses)))
+	return page, err
+}
 
-	return pulses, err
+// matchesKey tells whether the fields of a key can be a pulse of the query
+func (q PulseQuery) matchesKey(f PulseKeyFields) bool {
+	if q.Dimension > 0 && int(f.Dimension) != q.Dimension {
+		return false
+	}
+	if q.Pattern != nil && f.Pattern != byte(*q.Pattern) {
+		return false
+	}
+	if q.Endpoint != "" && f.Endpoint != HashKeyField(q.Endpoint) {
+		return false
+	}
+	if q.Metric != "" && f.Metric != HashKeyField(q.Metric) && f.Indexed != HashKeyField(q.Metric) {
+		return false
+	}
+	if q.Name != "" && f.Name != HashKeyField(q.Name) {
+		return false
+	}
+	return true
 }
@@ -37,6 +37,59 @@ func TestNewBadgerOutput(t *testing.T) {
 	})
 }
 
+func TestOpenBadgerReadOnly(t *testing.T) {
+	path := t.TempDir()
+	start := time.Date(2023, 10, 1, 14, 0, 0, 0, time.UTC)
+	writer, err := Mp.NewBadgerOutput(path, 10)
+	assertError(t, err, nil)
+	assertError(t, writer.WriteBatch([]*Mt.PulseEvent{
+		{Dimension: 1, Pattern: Mt.Iamb, StartTime: start, Metric: []string{"latency"}},
+		{Dimension: 1, Pattern: Mt.Trochee, StartTime: start.Add(time.Second), Metric: []string{"latency"}},
+	}), nil)
+	// Closed without rolling up, the summaries stay pending
+	assertError(t, writer.DB.Close(), nil)
+
+	pending := func(t *testing.T, db *badger.DB) int {
+		t.Helper()
+		count := 0
+		assertError(t, db.View(func(txn *badger.Txn) error {
+			it := txn.NewIterator(badger.IteratorOptions{Prefix: []byte{Mp.KeyVersion, Mp.PendingRollupKeys}})
+			defer it.Close()
+			for it.Rewind(); it.Valid(); it.Next() {
+				count++
+			}
+			return nil
+		}), nil)
+		return count
+	}
+
+	reader, err := Mp.OpenBadgerReadOnly(path)
+	assertError(t, err, nil)
+	before := pending(t, reader.DB)
+	if before == 0 {
+		t.Fatal("Expected pending rollups")
+	}
+
+	t.Run("Reads the pulses", func(t *testing.T) {
+		page, err := reader.Query(Mp.PulseQuery{})
+		assertError(t, err, nil)
+		assertInt(t, len(page.Pulses), 2)
+	})
+
+	t.Run("Refuses writes", func(t *testing.T) {
+		assertGotError(t, reader.WriteBatch([]*Mt.PulseEvent{{Dimension: 1, StartTime: start.Add(time.Minute)}}))
+	})
+
+	t.Run("Closes without rolling up", func(t *testing.T) {
+		assertError(t, reader.Close(), nil)
+
+		db, err := badger.Open(badger.DefaultOptions(path).WithLogger(nil))
+		assertError(t, err, nil)
+		defer db.Close()
+		assertInt(t, pending(t, db), before)
+	})
+}
+
 func TestBadgerOutput_WritePulse(t *testing.T) {
 	adapter, closedb := makeTestBadgerOutput(t)
 	defer closedb()
@@ -106,7 +159,7 @@ func TestBadgerOutput_PulseKeyValue(t *testing.T) {
 		Metric:    []string{"NETWORK"},
 	}
 
-	t.Run("Makes a Pulse Key", func(t *testing.T) {
+	t.Run("Makes a version 1 Pulse Key", func(t *testing.T) {
 		key := make([]byte, 8+1+len(pulse.Metric[0]))
 		t.Logf("key: %s", key)
 
@@ -117,14 +170,35 @@ func TestBadgerOutput_PulseKeyValue(t *testing.T) {
 		t.Logf("want: %s", want)
 		t.Logf("mb: %s", mb)
 
-		get := Mp.PulseKey(pulse)
+		get := Mp.PulseKeyV1(pulse)
 		t.Logf("get: %v", get)
 
 		got := get[9:]
 		t.Logf("got: %v", got)
 
 		if !bytes.Equal(want, got) {
-			t.Errorf("PulseKey = %v, want %v", got, want)
+			t.Errorf("PulseKeyV1 = %v, want %v", got, want)
+		}
+	})
+}
+
+func TestBadgerOutput_PulseEncode(t *testing.T) {
+	t.Run("Keeps the name of a custom pulse", func(t *testing.T) {
+		pulse := &Mt.PulseEvent{
+			Dimension: 2,
+			Pattern:   Mt.Custom,
+			Name:      "surge",
+			StartTime: time.Now(),
+			Duration:  30 * time.Second,
+			Metric:    []string{"CPU"},
+		}
+
+		encoded, err := Mp.PulseEncode(pulse)
+		assertError(t, err, nil)
+		got, err := Mp.PulseDecode(encoded)
+		assertError(t, err, nil)
+		if got.Pattern != Mt.Custom || got.Name != "surge" {
+			t.Errorf("Expected custom pulse surge, got %v %q", got.Pattern, got.Name)
 		}
 	})
 }
@@ -209,6 +283,108 @@ func TestBadgerOutput_QueryRange(t *testing.T) {
 	})
 }
 
+func TestBadgerOutput_Query(t *testing.T) {
+	adapter, closedb := makeTestBadgerOutput(t)
+	defer closedb()
+
+	start := time.Date(2023, 10, 1, 14, 0, 0, 0, time.UTC)
+	var pulses []*Mt.PulseEvent
+	for i := 0; i < 12; i++ {
+		p := &Mt.PulseEvent{
+			Dimension: 1,
+			Pattern:   Mt.PulsePattern(i % 2),
+			Metric:    []string{"latency"},
+			Endpoint:  "DB",
+			StartTime: start.Add(time.Duration(i) * time.Second),
+			Duration:  time.Second,
+		}
+		switch {
+		case i%3 == 0:
+			p.Metric = []string{"latens"} // same five-letter key prefix
+		case i%4 == 0:
+			p.Endpoint = "API"
+		}
+		pulses = append(pulses, p)
+	}
+	pulses = append(pulses, &Mt.PulseEvent{Dimension: 2, Pattern: Mt.Dactyl, Metric: []string{"latency"}, Endpoint: "DB", StartTime: start.Add(5500 * time.Millisecond)})
+	assertError(t, adapter.WriteBatch(pulses), nil)
+
+	t.Run("Finds the pulses in the range in order", func(t *testing.T) {
+		page, err := adapter.Query(Mp.PulseQuery{Start: start.Add(2 * time.Second), End: start.Add(6 * time.Second)})
+		assertError(t, err, nil)
+		assertInt(t, len(page.Pulses), 5)
+		for i := 1; i < len(page.Pulses); i++ {
+			if page.Pulses[i].StartTime.Before(page.Pulses[i-1].StartTime) {
+				t.Error("Expected pulses in time order")
+			}
+		}
+		if page.Next != nil {
+			t.Error("Expected no next page")
+		}
+	})
+
+	t.Run("Filters by metric, endpoint, dimension, and pattern", func(t *testing.T) {
+		iamb := Mt.Iamb
+		dactyl := Mt.Dactyl
+		for _, tc := range []struct {
+			name  string
+			query Mp.PulseQuery
+			want  int
+		}{
+			{"metric", Mp.PulseQuery{Metric: "latency"}, 9},
+			{"metric sharing a key prefix", Mp.PulseQuery{Metric: "latens"}, 4},
+			{"endpoint", Mp.PulseQuery{Endpoint: "API"}, 2},
+			{"dimension", Mp.PulseQuery{Dimension: 2}, 1},
+			{"pattern", Mp.PulseQuery{Pattern: &iamb}, 6},
+			{"pattern and dimension", Mp.PulseQuery{Pattern: &dactyl, Dimension: 1}, 0},
+			{"everything", Mp.PulseQuery{Metric: "latency", Endpoint: "DB", Dimension: 1, Pattern: &iamb}, 2},
+		} {
+			page, err := adapter.Query(tc.query)
+			assertError(t, err, nil)
+			if len(page.Pulses) != tc.want {
+				t.Errorf("%s: expected %d pulses, got %d", tc.name, tc.want, len(page.Pulses))
+			}
+		}
+	})
+
+	t.Run("Pages through the range", func(t *testing.T) {
+		var all []*Mt.PulseEvent
+		query := Mp.PulseQuery{Start: start, Limit: 5}
+		for pages := 0; pages < 10; pages++ {
+			page, err := adapter.Query(query)
+			assertError(t, err, nil)
+			all = append(all, page.Pulses...)
+			if page.Next == nil {
+				break
+			}
+			query.After = page.Next
+		}
+		assertInt(t, len(all), len(pulses))
+
+		seen := make(map[time.Time]bool)
+		for _, p := range all {
+			if seen[p.StartTime] {
+				t.Errorf("Expected each pulse once, got %v twice", p.StartTime)
+			}
+			seen[p.StartTime] = true
+		}
+	})
+
+	t.Run("Finds buffered pulses once flushed", func(t *testing.T) {
+		late := &Mt.PulseEvent{Dimension: 1, Metric: []string{"errors"}, StartTime: start.Add(time.Minute)}
+		assertError(t, adapter.WritePulse(late), nil)
+
+		page, err := adapter.Query(Mp.PulseQuery{Metric: "errors"})
+		assertError(t, err, nil)
+		assertInt(t, len(page.Pulses), 0)
+
+		assertError(t, adapter.Flush(), nil)
+		page, err = adapter.Query(Mp.PulseQuery{Metric: "errors"})
+		assertError(t, err, nil)
+		assertInt(t, len(page.Pulses), 1)
+	})
+}
+
 // Helpers //
 
 func makeTestBadgerOutput(t *testing.T) (*Mp.BadgerOutput, func()) {
@@ -0,0 +1,577 @@
+package plugin
+
+/*
+
+	SQLite output
+
+	Archives pulses to an embedded SQLite file, so any SQL tool can read them.
+	The driver is pure Go (modernc.org/sqlite), no cgo needed.
+
+		pulses          one row per pulse, times and durations in Unix nanoseconds
+		pulse_metrics   the metrics of a pulse in order, position 0 is the one it was detected on,
+		                with the endpoint of each when they can differ (a Cascade), else NULL
+		pulse_children  the start times of the children of a pulse in order
+
+	pattern is the name of the pattern (PatternName), or of a Custom pulse,
+	pattern_id is the Mt.PulsePattern. pulse_key is the BadgerDB time key
+	(PulseKey) in hex and is unique, so writing the same pulse twice, from a repeated
+	backfill or a retried batch, keeps the first row like BadgerDB does.
+
+	QuerySQL runs SELECT statements on a second connection that can't write.
+
+*/
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	Mt "github.com/maroda/monteverdi/types"
+	_ "modernc.org/sqlite"
+)
+
+const sqliteChunk = 500 // pulses per query when loading metrics and children
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS pulses (
+	id          INTEGER PRIMARY KEY,
+	endpoint    TEXT    NOT NULL,
+	pattern     TEXT    NOT NULL,
+	pattern_id  INTEGER NOT NULL,
+	dimension   INTEGER NOT NULL,
+	start_ns    INTEGER NOT NULL,
+	duration_ns INTEGER NOT NULL,
+	parent_ns   INTEGER,
+	pulse_key   TEXT
+);
+CREATE INDEX IF NOT EXISTS pulses_start ON pulses (start_ns);
+CREATE INDEX IF NOT EXISTS pulses_pattern ON pulses (pattern, start_ns);
+
+CREATE TABLE IF NOT EXISTS pulse_metrics (
+	pulse_id INTEGER NOT NULL REFERENCES pulses (id) ON DELETE CASCADE,
+	position INTEGER NOT NULL,
+	metric   TEXT    NOT NULL,
+	endpoint TEXT,
+	PRIMARY KEY (pulse_id, position)
+);
+CREATE INDEX IF NOT EXISTS pulse_metrics_metric ON pulse_metrics (metric);
+
+CREATE TABLE IF NOT EXISTS pulse_children (
+	pulse_id INTEGER NOT NULL REFERENCES pulses (id) ON DELETE CASCADE,
+	position INTEGER NOT NULL,
+	start_ns INTEGER NOT NULL,
+	PRIMARY KEY (pulse_id, position)
+);
+`
+
+type SQLiteOutput struct {
+	MU          sync.Mutex
+	DB          *sql.DB // writes
+	RO          *sql.DB // QuerySQL, can't write
+	BatchSize   int
+	Buffer      []*Mt.PulseEvent
+	PatternName func(Mt.PulseEvent) string // names the pattern of a pulse, the Name or pattern_id when nil
+}
+
+func NewSQLiteOutput(path string, batchSize int) (*SQLiteOutput, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		slog.Error("SQLiteOutput failed to open database", slog.Any("error", err))
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	db.SetMaxOpenConns(1) // SQLite has one writer
+
+	if _, err = db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		slog.Error("SQLiteOutput failed to create schema", slog.Any("error", err))
+		return nil, fmt.Errorf("schema error: %w", err)
+	}
+	if err = addPulseKey(db); err != nil {
+		db.Close()
+		slog.Error("SQLiteOutput failed to add pulse keys", slog.Any("error", err))
+		return nil, fmt.Errorf("schema error: %w", err)
+	}
+	if err = addColumn(db, "pulse_metrics", "endpoint", "TEXT"); err != nil {
+		db.Close()
+		slog.Error("SQLiteOutput failed to add metric endpoints", slog.Any("error", err))
+		return nil, fmt.Errorf("schema error: %w", err)
+	}
+
+	ro, err := sql.Open("sqlite", "file:"+path+"?mode=ro&_pragma=query_only(1)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("read only database error: %w", err)
+	}
+
+	slog.Info("SQLiteOutput opened",
+		slog.String("path", path),
+		slog.Int("batchSize", batchSize))
+
+	return &SQLiteOutput{
+		DB:        db,
+		RO:        ro,
+		BatchSize: batchSize,
+		Buffer:    make([]*Mt.PulseEvent, 0, batchSize),
+	}, nil
+}
+
+// addPulseKey adds the pulse_key column to a database created without it,
+// its older rows keep a NULL key, then makes the key unique
+func addPulseKey(db *sql.DB) error {
+	if err := addColumn(db, "pulses", "pulse_key", "TEXT"); err != nil {
+		return err
+	}
+	_, err := db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS pulses_key ON pulses (pulse_key)`)
+	return err
+}
+
+// addColumn adds a column to a table created without it
+func addColumn(db *sql.DB, table, column, decl string) error {
+	var n int
+	err := db.QueryRow(`SELECT count(*) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, decl))
+	return err
+}
+
+// WritePulse queues up a batch of pulses,
+// when batchsize is reached, it calls WriteBatch with the new batch
+func (so *SQLiteOutput) WritePulse(pulse *Mt.PulseEvent) error {
+	so.MU.Lock()
+	defer so.MU.Unlock()
+
+	so.Buffer = append(so.Buffer, pulse)
+	if len(so.Buffer) >= so.BatchSize {
+		return so.flushLocked()
+	}
+	return nil
+}
+
+// WriteBatch inserts the pulses with their metrics and children in one transaction,
+// pulses already in the database are skipped
+func (so *SQLiteOutput) WriteBatch(pulses []*Mt.PulseEvent) error {
+	if len(pulses) == 0 {
+		return nil
+	}
+
+	tx, err := so.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("write batch error: %w", err)
+	}
+	defer tx.Rollback()
+
+	insertPulse, err := tx.Prepare(`INSERT OR IGNORE INTO pulses (endpoint, pattern, pattern_id, dimension, start_ns, duration_ns, parent_ns, pulse_key) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("write batch error: %w", err)
+	}
+	insertMetric, err := tx.Prepare(`INSERT INTO pulse_metrics (pulse_id, position, metric, endpoint) VALUES (?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("write batch error: %w", err)
+	}
+	insertChild, err := tx.Prepare(`INSERT INTO pulse_children (pulse_id, position, start_ns) VALUES (?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("write batch error: %w", err)
+	}
+	setParent, err := tx.Prepare(`UPDATE pulses SET parent_ns = ? WHERE pulse_key = ? AND parent_ns IS NULL`)
+	if err != nil {
+		return fmt.Errorf("write batch error: %w", err)
+	}
+
+	for _, p := range pulses {
+		var parent interface{}
+		if !p.Parent.IsZero() {
+			parent = p.Parent.UnixNano()
+		}
+
+		key := hex.EncodeToString(PulseKey(p))
+		res, err := insertPulse.Exec(p.Endpoint, so.patternName(p), int(p.Pattern), p.Dimension,
+			p.StartTime.UnixNano(), int64(p.Duration), parent, key)
+		if err != nil {
+			slog.Error("SQLiteOutput failed to insert pulse",
+				slog.Any("error", err),
+				slog.Time("pulseTime", p.StartTime),
+				slog.Any("metric", p.Metric))
+			return fmt.Errorf("write batch error: %w", err)
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return fmt.Errorf("write batch error: %w", err)
+		} else if n == 0 {
+			// Already written, a pulse is written again when it gets a Parent
+			if parent != nil {
+				if _, err := setParent.Exec(parent, key); err != nil {
+					return fmt.Errorf("write batch error: %w", err)
+				}
+			}
+			continue
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("write batch error: %w", err)
+		}
+
+		for i, m := range p.Metric {
+			var endpoint interface{}
+			if i < len(p.Endpoints) {
+				endpoint = p.Endpoints[i]
+			}
+			if _, err := insertMetric.Exec(id, i, m, endpoint); err != nil {
+				return fmt.Errorf("write batch error: %w", err)
+			}
+		}
+		for i, c := range p.Children {
+			if _, err := insertChild.Exec(id, i, c.UnixNano()); err != nil {
+				return fmt.Errorf("write batch error: %w", err)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		slog.Error("SQLiteOutput failed to commit batch", slog.Any("error", err))
+		return fmt.Errorf("batch commit error: %w", err)
+	}
+	return nil
+}
+
+// Flush is the public method that blocks,
+// it sends data to WriteBatch and then clears the buffer
+func (so *SQLiteOutput) Flush() error {
+	so.MU.Lock()
+	defer so.MU.Unlock()
+	return so.flushLocked()
+}
+
+// flushLocked mimics Flush without locking, called by WritePulse
+func (so *SQLiteOutput) flushLocked() error {
+	err := so.WriteBatch(so.Buffer)
+	so.Buffer = so.Buffer[:0]
+	return err
+}
+
+// Close returns a Flush error but still attempts to close
+func (so *SQLiteOutput) Close() error {
+	slog.Info("SQLiteOutput closing, flushing buffer",
+		slog.Int("bufferSize", len(so.Buffer)))
+	flushErr := so.Flush()
+	roErr := so.RO.Close()
+	closeErr := so.DB.Close()
+
+	if flushErr != nil {
+		slog.Error("SQLiteOutput failed to flush on close", slog.Any("error", flushErr))
+		return fmt.Errorf("flush failed, close may have failed: %v", flushErr)
+	}
+	if closeErr = errors.Join(closeErr, roErr); closeErr != nil {
+		slog.Error("SQLiteOutput failed to close database", slog.Any("error", closeErr))
+		return fmt.Errorf("close failed: %v", closeErr)
+	}
+
+	slog.Info("SQLiteOutput closed successfully")
+	return nil
+}
+
+func (so *SQLiteOutput) Type() string { return "SQLite" }
+
+// QueryRange retrieves pulses that start between start and end, exclusive
+func (so *SQLiteOutput) QueryRange(start, end time.Time) (interface{}, error) {
+	var pulses []*Mt.PulseEvent
+
+	page, err := so.Query(PulseQuery{Start: start, End: end})
+	if page != nil {
+		for _, p := range page.Pulses {
+			if p.StartTime.After(start) {
+				pulses = append(pulses, p)
+			}
+		}
+	}
+
+	slog.Info("SQLiteOutput QueryRange successful", slog.Int("count", len(pulses)))
+
+	return pulses, err
+}
+
+// Query returns the pulses of the query in time order.
+// The cursor is the start and id of the last pulse of the page.
+// Pulses still in the Buffer are not found.
+func (so *SQLiteOutput) Query(q PulseQuery) (*PulsePage, error) {
+	where := []string{"1 = 1"}
+	var args []interface{}
+	if !q.Start.IsZero() {
+		where = append(where, "p.start_ns >= ?")
+		args = append(args, q.Start.UnixNano())
+	}
+	if !q.End.IsZero() {
+		where = append(where, "p.start_ns < ?")
+		args = append(args, q.End.UnixNano())
+	}
+	if len(q.After) == 16 {
+		where = append(where, "(p.start_ns > ? OR (p.start_ns = ? AND p.id > ?))")
+		after := int64(binary.BigEndian.Uint64(q.After[:8]))
+		args = append(args, after, after, int64(binary.BigEndian.Uint64(q.After[8:])))
+	}
+	if q.Endpoint != "" {
+		where = append(where, "p.endpoint = ?")
+		args = append(args, q.Endpoint)
+	}
+	if q.Dimension > 0 {
+		where = append(where, "p.dimension = ?")
+		args = append(args, q.Dimension)
+	}
+	if q.Pattern != nil {
+		where = append(where, "p.pattern_id = ?")
+		args = append(args, int(*q.Pattern))
+	}
+	if q.Name != "" {
+		where = append(where, "p.pattern = ?")
+		args = append(args, q.Name)
+	}
+	if q.Metric != "" {
+		where = append(where, "EXISTS (SELECT 1 FROM pulse_metrics m WHERE m.pulse_id = p.id AND m.metric = ?)")
+		args = append(args, q.Metric)
+	}
+
+	query := `SELECT p.id, p.endpoint, p.pattern, p.pattern_id, p.dimension, p.start_ns, p.duration_ns, p.parent_ns
+		FROM pulses p WHERE ` + strings.Join(where, " AND ") + ` ORDER BY p.start_ns, p.id`
+	if q.Limit > 0 {
+		query += " LIMIT " + strconv.Itoa(q.Limit+1) // one more tells there is a next page
+	}
+
+	rows, err := so.DB.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("pulse query error: %w", err)
+	}
+	defer rows.Close()
+
+	page := &PulsePage{}
+	var ids []int64
+	byID := make(map[int64]*Mt.PulseEvent)
+	for rows.Next() {
+		var (
+			id, start, duration int64
+			pattern             int
+			name                string
+			parent              sql.NullInt64
+			p                   Mt.PulseEvent
+		)
+		if err := rows.Scan(&id, &p.Endpoint, &name, &pattern, &p.Dimension, &start, &duration, &parent); err != nil {
+			return nil, fmt.Errorf("pulse scan error: %w", err)
+		}
+		if q.Limit > 0 && len(page.Pulses) == q.Limit {
+			last := page.Pulses[len(page.Pulses)-1]
+			page.Next = binary.BigEndian.AppendUint64(nil, uint64(last.StartTime.UnixNano()))
+			page.Next = binary.BigEndian.AppendUint64(page.Next, uint64(ids[len(ids)-1]))
+			break
+		}
+
+		p.Pattern = Mt.PulsePattern(pattern)
+		if p.Pattern == Mt.Custom {
+			p.Name = name
+		}
+		p.StartTime = time.Unix(0, start)
+		p.Duration = time.Duration(duration)
+		if parent.Valid {
+			p.Parent = time.Unix(0, parent.Int64)
+		}
+
+		page.Pulses = append(page.Pulses, &p)
+		ids = append(ids, id)
+		byID[id] = &p
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("pulse query error: %w", err)
+	}
+	rows.Close()
+
+	if err := so.loadDetails(ids, byID); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// QuerySQL runs one SELECT (or WITH) statement on the read only connection,
+// returning at most maxRows rows
+func (so *SQLiteOutput) QuerySQL(ctx context.Context, query string, maxRows int) (*SQLResult, error) {
+	query, tail := splitStatement(strings.TrimSpace(query))
+	if tail != "" {
+		return nil, fmt.Errorf("only one statement is allowed")
+	}
+	lower := strings.ToLower(query)
+	if !strings.HasPrefix(lower, "select") && !strings.HasPrefix(lower, "with") {
+		return nil, fmt.Errorf("only SELECT statements are allowed")
+	}
+
+	rows, err := so.RO.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("sql error: %w", err)
+	}
+	defer rows.Close()
+
+	result := &SQLResult{Rows: [][]interface{}{}}
+	if result.Columns, err = rows.Columns(); err != nil {
+		return nil, fmt.Errorf("sql error: %w", err)
+	}
+
+	for rows.Next() {
+		if len(result.Rows) == maxRows {
+			result.Truncated = true
+			break
+		}
+		values := make([]interface{}, len(result.Columns))
+		scan := make([]interface{}, len(values))
+		for i := range values {
+			scan[i] = &values[i]
+		}
+		if err := rows.Scan(scan...); err != nil {
+			return nil, fmt.Errorf("sql scan error: %w", err)
+		}
+		for i, v := range values {
+			if b, ok := v.([]byte); ok {
+				values[i] = string(b)
+			}
+		}
+		result.Rows = append(result.Rows, values)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("sql error: %w", err)
+	}
+
+	return result, nil
+}
+
+// splitStatement splits the query after its first statement,
+// at a semicolon outside of quotes and comments.
+// The tail, without its comments, is empty when there is one statement.
+func splitStatement(query string) (string, string) {
+	for i := 0; i < len(query); i++ {
+		switch c := query[i]; c {
+		case '\'', '"', '`':
+			// Quotes are escaped by doubling them, which reads as two quoted runs
+			if end := strings.IndexByte(query[i+1:], c); end >= 0 {
+				i += end + 1
+			} else {
+				i = len(query)
+			}
+		case '[':
+			if end := strings.IndexByte(query[i+1:], ']'); end >= 0 {
+				i += end + 1
+			} else {
+				i = len(query)
+			}
+		case '-':
+			if strings.HasPrefix(query[i:], "--") {
+				if end := strings.IndexByte(query[i:], '\n'); end >= 0 {
+					i += end
+				} else {
+					i = len(query)
+				}
+			}
+		case '/':
+			if strings.HasPrefix(query[i:], "/*") {
+				if end := strings.Index(query[i+2:], "*/"); end >= 0 {
+					i += end + 3
+				} else {
+					i = len(query)
+				}
+			}
+		case ';':
+			return query[:i], stripComments(query[i+1:])
+		}
+	}
+	return query, ""
+}
+
+// stripComments removes the comments following a statement
+func stripComments(tail string) string {
+	for {
+		tail = strings.TrimSpace(tail)
+		switch {
+		case strings.HasPrefix(tail, "--"):
+			end := strings.IndexByte(tail, '\n')
+			if end < 0 {
+				return ""
+			}
+			tail = tail[end:]
+		case strings.HasPrefix(tail, "/*"):
+			end := strings.Index(tail, "*/")
+			if end < 0 {
+				return ""
+			}
+			tail = tail[end+2:]
+		default:
+			return tail
+		}
+	}
+}
+
+// loadDetails fills in the metrics and children of the pulses by id,
+// sqliteChunk ids at a time to stay under the limit of bound parameters
+func (so *SQLiteOutput) loadDetails(ids []int64, byID map[int64]*Mt.PulseEvent) error {
+	for len(ids) > sqliteChunk {
+		if err := so.loadDetails(ids[:sqliteChunk], byID); err != nil {
+			return err
+		}
+		ids = ids[sqliteChunk:]
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	in := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+
+	rows, err := so.DB.Query(`SELECT pulse_id, metric, endpoint FROM pulse_metrics WHERE pulse_id IN (`+in+`) ORDER BY pulse_id, position`, args...)
+	if err != nil {
+		return fmt.Errorf("metric query error: %w", err)
+	}
+	for rows.Next() {
+		var id int64
+		var metric string
+		var endpoint sql.NullString
+		if err := rows.Scan(&id, &metric, &endpoint); err != nil {
+			rows.Close()
+			return fmt.Errorf("metric scan error: %w", err)
+		}
+		p := byID[id]
+		p.Metric = append(p.Metric, metric)
+		if endpoint.Valid {
+			p.Endpoints = append(p.Endpoints, endpoint.String)
+		}
+	}
+	rows.Close()
+
+	rows, err = so.DB.Query(`SELECT pulse_id, start_ns FROM pulse_children WHERE pulse_id IN (`+in+`) ORDER BY pulse_id, position`, args...)
+	if err != nil {
+		return fmt.Errorf("children query error: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, start int64
+		if err := rows.Scan(&id, &start); err != nil {
+			return fmt.Errorf("children scan error: %w", err)
+		}
+		byID[id].Children = append(byID[id].Children, time.Unix(0, start))
+	}
+	return rows.Err()
+}
+
+// patternName is the pattern column of a pulse
+func (so *SQLiteOutput) patternName(p *Mt.PulseEvent) string {
+	switch {
+	case so.PatternName != nil:
+		return so.PatternName(*p)
+	case p.Pattern == Mt.Custom && p.Name != "":
+		return p.Name
+	}
+	return strconv.Itoa(int(p.Pattern))
+}
@@ -0,0 +1,366 @@
+package plugin_test
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	Mp "github.com/maroda/monteverdi/plugin"
+	Mt "github.com/maroda/monteverdi/types"
+)
+
+func TestNewSQLiteOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pulses.db")
+
+	adapter, err := Mp.NewSQLiteOutput(path, 10)
+	assertError(t, err, nil)
+	assertInt(t, adapter.BatchSize, 10)
+	if adapter.Type() != "SQLite" {
+		t.Errorf("Expected type SQLite, got %q", adapter.Type())
+	}
+	assertError(t, adapter.Close(), nil)
+
+	// Opening again keeps the schema
+	adapter, err = Mp.NewSQLiteOutput(path, 10)
+	assertError(t, err, nil)
+	assertError(t, adapter.Close(), nil)
+
+	_, err = Mp.NewSQLiteOutput(filepath.Join(t.TempDir(), "missing", "pulses.db"), 10)
+	assertGotError(t, err)
+
+	t.Run("Adds pulse keys to an older database", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "old.db")
+		db, err := sql.Open("sqlite", path)
+		assertError(t, err, nil)
+		_, err = db.Exec(`CREATE TABLE pulses (id INTEGER PRIMARY KEY, endpoint TEXT NOT NULL, pattern TEXT NOT NULL,
+			pattern_id INTEGER NOT NULL, dimension INTEGER NOT NULL, start_ns INTEGER NOT NULL, duration_ns INTEGER NOT NULL, parent_ns INTEGER)`)
+		assertError(t, err, nil)
+		assertError(t, db.Close(), nil)
+
+		adapter, err := Mp.NewSQLiteOutput(path, 10)
+		assertError(t, err, nil)
+		defer adapter.Close()
+		pulse := &Mt.PulseEvent{Dimension: 1, StartTime: time.Now()}
+		assertError(t, adapter.WriteBatch([]*Mt.PulseEvent{pulse, pulse}), nil)
+		page, err := adapter.Query(Mp.PulseQuery{})
+		assertError(t, err, nil)
+		assertInt(t, len(page.Pulses), 1)
+	})
+}
+
+func TestSQLiteOutput_WritePulse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pulses.db")
+	adapter, err := Mp.NewSQLiteOutput(path, 3)
+	assertError(t, err, nil)
+
+	start := time.Date(2023, 10, 1, 14, 0, 0, 0, time.UTC)
+	count := func() int {
+		t.Helper()
+		page, err := adapter.Query(Mp.PulseQuery{})
+		assertError(t, err, nil)
+		return len(page.Pulses)
+	}
+
+	t.Run("Writes when the batch is full", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			assertError(t, adapter.WritePulse(&Mt.PulseEvent{Dimension: 1, StartTime: start.Add(time.Duration(i) * time.Second)}), nil)
+		}
+		assertInt(t, count(), 0)
+		assertInt(t, len(adapter.Buffer), 2)
+
+		assertError(t, adapter.WritePulse(&Mt.PulseEvent{Dimension: 1, StartTime: start.Add(2 * time.Second)}), nil)
+		assertInt(t, count(), 3)
+		assertInt(t, len(adapter.Buffer), 0)
+	})
+
+	t.Run("Skips pulses it already has", func(t *testing.T) {
+		again := []*Mt.PulseEvent{
+			{Dimension: 1, StartTime: start.Add(time.Second)},
+			{Dimension: 1, StartTime: start.Add(time.Second), Metric: []string{"latency"}},
+		}
+		assertError(t, adapter.WriteBatch(again), nil)
+		assertError(t, adapter.WriteBatch(again), nil)
+		assertInt(t, count(), 4)
+
+		result, err := adapter.QuerySQL(context.Background(), "SELECT count(*) FROM pulse_metrics", 1)
+		assertError(t, err, nil)
+		assertInt64(t, result.Rows[0][0].(int64), 1)
+	})
+
+	t.Run("Keeps cascades to different followers", func(t *testing.T) {
+		cascades := []*Mt.PulseEvent{
+			{Dimension: 1, Pattern: Mt.Cascade, StartTime: start.Add(2 * time.Second), Metric: []string{"latency", "errors"}, Endpoints: []string{"DB", "API"}},
+			{Dimension: 1, Pattern: Mt.Cascade, StartTime: start.Add(2 * time.Second), Metric: []string{"latency", "saturation"}, Endpoints: []string{"DB", "DB"}},
+		}
+		assertError(t, adapter.WriteBatch(cascades), nil)
+		assertInt(t, count(), 6)
+
+		cascade := Mt.Cascade
+		page, err := adapter.Query(Mp.PulseQuery{Pattern: &cascade})
+		assertError(t, err, nil)
+		assertInt(t, len(page.Pulses), 2)
+		for i, p := range page.Pulses {
+			if len(p.Endpoints) != 2 || p.Endpoints[1] != cascades[i].Endpoints[1] {
+				t.Errorf("Expected the endpoint of each metric, got %v", p.Endpoints)
+			}
+		}
+
+		// Either metric finds the cascade
+		page, err = adapter.Query(Mp.PulseQuery{Metric: "errors"})
+		assertError(t, err, nil)
+		assertInt(t, len(page.Pulses), 1)
+	})
+
+	t.Run("Sets the Parent of a pulse written again", func(t *testing.T) {
+		child := &Mt.PulseEvent{Dimension: 1, StartTime: start.Add(time.Second), Metric: []string{"latency"}}
+		child.Parent = start.Add(time.Second)
+		assertError(t, adapter.WriteBatch([]*Mt.PulseEvent{child}), nil)
+		assertInt(t, count(), 6)
+
+		result, err := adapter.QuerySQL(context.Background(), "SELECT count(*) FROM pulses WHERE parent_ns IS NOT NULL", 1)
+		assertError(t, err, nil)
+		assertInt64(t, result.Rows[0][0].(int64), 1)
+	})
+
+	t.Run("Writes the buffer on Close", func(t *testing.T) {
+		assertError(t, adapter.WritePulse(&Mt.PulseEvent{Dimension: 1, StartTime: start.Add(3 * time.Second)}), nil)
+		assertError(t, adapter.Close(), nil)
+
+		adapter, err = Mp.NewSQLiteOutput(path, 3)
+		assertError(t, err, nil)
+		defer adapter.Close()
+		assertInt(t, count(), 7)
+	})
+}
+
+func TestSQLiteOutput_Query(t *testing.T) {
+	adapter := makeTestSQLiteOutput(t)
+	adapter.PatternName = func(p Mt.PulseEvent) string {
+		if p.Pattern == Mt.Custom {
+			return p.Name
+		}
+		return "pattern" + string(rune('0'+p.Pattern))
+	}
+
+	start := time.Date(2023, 10, 1, 14, 0, 0, 0, time.UTC)
+	consort := &Mt.PulseEvent{
+		Dimension: 2,
+		Endpoint:  "DB",
+		Metric:    []string{"latency", "errors"},
+		Pattern:   Mt.Custom,
+		Name:      "pyrrhic",
+		Parent:    start.Add(-time.Minute),
+		Children:  []time.Time{start, start.Add(10 * time.Second)},
+		StartTime: start,
+		Duration:  25 * time.Second,
+	}
+	pulses := []*Mt.PulseEvent{consort}
+	for i := 1; i <= 10; i++ {
+		endpoint := "DB"
+		if i%2 == 0 {
+			endpoint = "API"
+		}
+		pulses = append(pulses, &Mt.PulseEvent{
+			Dimension: 1,
+			Endpoint:  endpoint,
+			Metric:    []string{"latency"},
+			Pattern:   Mt.Iamb,
+			StartTime: start.Add(time.Duration(i) * time.Second),
+			Duration:  5 * time.Second,
+		})
+	}
+	assertError(t, adapter.WriteBatch(pulses), nil)
+
+	t.Run("Round trips every field", func(t *testing.T) {
+		page, err := adapter.Query(Mp.PulseQuery{Dimension: 2})
+		assertError(t, err, nil)
+		assertInt(t, len(page.Pulses), 1)
+
+		got := page.Pulses[0]
+		if got.Endpoint != consort.Endpoint || got.Pattern != consort.Pattern || got.Name != consort.Name ||
+			got.Duration != consort.Duration || !got.StartTime.Equal(consort.StartTime) ||
+			!got.Parent.Equal(consort.Parent) {
+			t.Fatalf("got %+v, want %+v", got, consort)
+		}
+		if len(got.Metric) != 2 || got.Metric[1] != "errors" {
+			t.Errorf("Expected the metrics in order, got %v", got.Metric)
+		}
+		if len(got.Children) != 2 || !got.Children[1].Equal(consort.Children[1]) {
+			t.Errorf("Expected the children in order, got %v", got.Children)
+		}
+	})
+
+	t.Run("Filters", func(t *testing.T) {
+		iamb := Mt.Iamb
+		for name, tc := range map[string]struct {
+			q    Mp.PulseQuery
+			want int
+		}{
+			"endpoint":      {Mp.PulseQuery{Endpoint: "API"}, 5},
+			"metric":        {Mp.PulseQuery{Metric: "latency"}, 11},
+			"pattern":       {Mp.PulseQuery{Pattern: &iamb}, 10},
+			"name":          {Mp.PulseQuery{Name: "pyrrhic"}, 1},
+			"range":         {Mp.PulseQuery{Start: start.Add(time.Second), End: start.Add(4 * time.Second)}, 3},
+			"second metric": {Mp.PulseQuery{Metric: "errors"}, 1},
+			"no metric":     {Mp.PulseQuery{Metric: "saturation"}, 0},
+		} {
+			t.Run(name, func(t *testing.T) {
+				page, err := adapter.Query(tc.q)
+				assertError(t, err, nil)
+				assertInt(t, len(page.Pulses), tc.want)
+			})
+		}
+	})
+
+	t.Run("Pages in time order", func(t *testing.T) {
+		q := Mp.PulseQuery{Limit: 4}
+		var got []*Mt.PulseEvent
+		pages := 0
+		for {
+			page, err := adapter.Query(q)
+			assertError(t, err, nil)
+			got = append(got, page.Pulses...)
+			pages++
+			if page.Next == nil {
+				break
+			}
+			q.After = page.Next
+		}
+		assertInt(t, pages, 3)
+		assertInt(t, len(got), 11)
+		for i := 1; i < len(got); i++ {
+			if !got[i].StartTime.After(got[i-1].StartTime) {
+				t.Fatalf("Pulse %d at %v is not after %v", i, got[i].StartTime, got[i-1].StartTime)
+			}
+		}
+	})
+
+	t.Run("Loads the metrics of a long range", func(t *testing.T) {
+		many := make([]*Mt.PulseEvent, 0, 1200)
+		for i := 0; i < 1200; i++ {
+			many = append(many, &Mt.PulseEvent{Dimension: 1, Endpoint: "Web", Metric: []string{"rps"}, StartTime: start.Add(time.Hour + time.Duration(i)*time.Second)})
+		}
+		assertError(t, adapter.WriteBatch(many), nil)
+
+		page, err := adapter.Query(Mp.PulseQuery{Endpoint: "Web"})
+		assertError(t, err, nil)
+		assertInt(t, len(page.Pulses), 1200)
+		for _, p := range page.Pulses {
+			if len(p.Metric) != 1 {
+				t.Fatalf("Expected the metric of every pulse, got %+v", p)
+			}
+		}
+	})
+
+	t.Run("QueryRange excludes the start", func(t *testing.T) {
+		result, err := adapter.QueryRange(start, start.Add(3*time.Second))
+		assertError(t, err, nil)
+		assertInt(t, len(result.([]*Mt.PulseEvent)), 2)
+	})
+}
+
+func TestSQLiteOutput_QuerySQL(t *testing.T) {
+	adapter := makeTestSQLiteOutput(t)
+	adapter.PatternName = func(p Mt.PulseEvent) string { return "amphibrach" }
+
+	start := time.Date(2023, 10, 1, 14, 0, 0, 0, time.UTC)
+	var pulses []*Mt.PulseEvent
+	for i := 0; i < 6; i++ {
+		endpoint := "DB"
+		if i%3 == 0 {
+			endpoint = "API"
+		}
+		pulses = append(pulses, &Mt.PulseEvent{
+			Dimension: 1,
+			Endpoint:  endpoint,
+			Metric:    []string{"latency"},
+			Pattern:   Mt.Amphibrach,
+			StartTime: start.Add(time.Duration(i) * 30 * time.Minute),
+			Duration:  5 * time.Second,
+		})
+	}
+	assertError(t, adapter.WriteBatch(pulses), nil)
+	ctx := context.Background()
+
+	t.Run("Counts per endpoint per hour", func(t *testing.T) {
+		result, err := adapter.QuerySQL(ctx, `
+			SELECT endpoint, strftime('%Y-%m-%dT%H:00', start_ns / 1000000000, 'unixepoch') AS hour, count(*) AS pulses
+			FROM pulses WHERE pattern = 'amphibrach'
+			GROUP BY endpoint, hour ORDER BY endpoint, hour;`, 100)
+		assertError(t, err, nil)
+		assertInt(t, len(result.Columns), 3)
+		assertInt(t, len(result.Rows), 5)
+		if result.Rows[0][0] != "API" || result.Rows[0][1] != "2023-10-01T14:00" || result.Rows[0][2] != int64(1) {
+			t.Errorf("Expected API 14:00 1, got %v", result.Rows[0])
+		}
+		if result.Truncated {
+			t.Error("Expected all rows")
+		}
+	})
+
+	t.Run("Joins the metrics", func(t *testing.T) {
+		result, err := adapter.QuerySQL(ctx, `WITH m AS (SELECT metric FROM pulse_metrics) SELECT metric, count(*) FROM m GROUP BY metric`, 100)
+		assertError(t, err, nil)
+		assertInt(t, len(result.Rows), 1)
+	})
+
+	t.Run("Truncates at maxRows", func(t *testing.T) {
+		result, err := adapter.QuerySQL(ctx, "SELECT * FROM pulses", 4)
+		assertError(t, err, nil)
+		assertInt(t, len(result.Rows), 4)
+		if !result.Truncated {
+			t.Error("Expected the result to be truncated")
+		}
+	})
+
+	t.Run("Allows semicolons in literals and comments", func(t *testing.T) {
+		for _, q := range []string{
+			"SELECT * FROM pulses WHERE endpoint = 'a;b'",
+			"SELECT count(*) AS \"a;b\" FROM pulses WHERE endpoint = 'it''s;'",
+			"SELECT 1 /* one; */ -- done;\n",
+			"SELECT 1; -- trailing comment",
+		} {
+			if _, err := adapter.QuerySQL(ctx, q, 100); err != nil {
+				t.Errorf("Expected no error for %q, got %v", q, err)
+			}
+		}
+	})
+
+	t.Run("Rejects anything but one SELECT", func(t *testing.T) {
+		for _, q := range []string{
+			"DELETE FROM pulses",
+			"DROP TABLE pulses",
+			"SELECT 1; DELETE FROM pulses",
+			"SELECT 'a;b'; SELECT 2",
+			"SELECT 1 /* ; */; SELECT 2",
+			"PRAGMA query_only = 0",
+			"SELECT * FROM nowhere",
+		} {
+			if _, err := adapter.QuerySQL(ctx, q, 100); err == nil {
+				t.Errorf("Expected an error for %q", q)
+			}
+		}
+
+		// WITH can also lead to a write, the connection refuses it
+		_, err := adapter.QuerySQL(ctx, "WITH old AS (SELECT id FROM pulses) DELETE FROM pulses WHERE id IN old", 100)
+		assertGotError(t, err)
+
+		result, err := adapter.QuerySQL(ctx, "SELECT count(*) FROM pulses", 1)
+		assertError(t, err, nil)
+		if result.Rows[0][0] != int64(6) {
+			t.Errorf("Expected the pulses kept, got %v", result.Rows[0][0])
+		}
+	})
+}
+
+// Helpers //
+
+func makeTestSQLiteOutput(t *testing.T) *Mp.SQLiteOutput {
+	t.Helper()
+	adapter, err := Mp.NewSQLiteOutput(filepath.Join(t.TempDir(), "pulses.db"), 5)
+	assertError(t, err, nil)
+	t.Cleanup(func() { adapter.Close() })
+	return adapter
+}
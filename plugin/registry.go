@@ -1,12 +1,19 @@
 package plugin
 
-import "fmt"
+import (
+	"fmt"
+
+	Mt "github.com/maroda/monteverdi/types"
+)
 
 // Transformers is a global map of MetricTransformer plugins.
 var Transformers = map[string]func() MetricTransformer{
 	"calc_rate": func() MetricTransformer {
 		return &CalcRatePlugin{}
 	},
+	"histogram_quantile": func() MetricTransformer {
+		return &HistogramQuantilePlugin{Quantile: 0.95, Scale: 1}
+	},
 }
 
 func TransformerLookup(name string) (MetricTransformer, error) {
@@ -16,3 +23,55 @@ func TransformerLookup(name string) (MetricTransformer, error) {
 	}
 	return factory(), nil
 }
+
+// Sources is a global map of DataSource plugins.
+var Sources = map[string]func() DataSource{
+	"kv": func() DataSource {
+		return &KVSource{}
+	},
+	"json": func() DataSource {
+		return &JSONSource{}
+	},
+	"promql": func() DataSource {
+		return &PromQLSource{}
+	},
+}
+
+func SourceLookup(name string) (DataSource, error) {
+	factory, ok := Sources[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown source: %s", name)
+	}
+	return factory(), nil
+}
+
+// Analyzers is a global map of PatternAnalyzer plugins.
+// The feet are built in and always run, custom_pulse is set up from the config.
+var Analyzers = map[string]func() PatternAnalyzer{
+	"iamb": func() PatternAnalyzer {
+		return NewIambAnalyzer(DefaultPulseConfig)
+	},
+	"trochee": func() PatternAnalyzer {
+		return NewTrocheeAnalyzer(DefaultPulseConfig)
+	},
+	"amphibrach": func() PatternAnalyzer {
+		return NewTernaryFootAnalyzer(Mt.Amphibrach)
+	},
+	"anapest": func() PatternAnalyzer {
+		return NewTernaryFootAnalyzer(Mt.Anapest)
+	},
+	"dactyl": func() PatternAnalyzer {
+		return NewTernaryFootAnalyzer(Mt.Dactyl)
+	},
+	"custom_pulse": func() PatternAnalyzer {
+		return &SequenceAnalyzer{Pattern: Mt.Custom}
+	},
+}
+
+func AnalyzerLookup(name string) (PatternAnalyzer, error) {
+	factory, ok := Analyzers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown pattern analyzer: %s", name)
+	}
+	return factory(), nil
+}
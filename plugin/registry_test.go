@@ -15,9 +15,54 @@ func TestTransformerLookup(t *testing.T) {
 		assertStringContains(t, got.Type(), want)
 	})
 
+	t.Run("Returns histogram quantile transformer", func(t *testing.T) {
+		got, err := Mp.TransformerLookup("histogram_quantile")
+		assertError(t, err, nil)
+		assertStringContains(t, got.Type(), "histogram_quantile")
+	})
+
 	t.Run("Returns error if transformers don't exist", func(t *testing.T) {
 		unknown := "craquemattic"
 		_, err := Mp.TransformerLookup(unknown)
 		assertGotError(t, err)
 	})
 }
+
+func TestSourceLookup(t *testing.T) {
+	t.Run("Returns built-in sources", func(t *testing.T) {
+		for _, name := range []string{"kv", "json", "promql"} {
+			got, err := Mp.SourceLookup(name)
+			assertError(t, err, nil)
+			assertStringContains(t, got.ID(), name)
+		}
+	})
+
+	t.Run("Returns error if sources don't exist", func(t *testing.T) {
+		_, err := Mp.SourceLookup("craquemattic")
+		assertGotError(t, err)
+	})
+}
+
+func TestAnalyzerLookup(t *testing.T) {
+	t.Run("Returns the built-in feet", func(t *testing.T) {
+		for _, name := range []string{"iamb", "trochee", "amphibrach", "anapest", "dactyl"} {
+			got, err := Mp.AnalyzerLookup(name)
+			assertError(t, err, nil)
+			assertStringContains(t, got.PatternName(), name)
+		}
+	})
+
+	t.Run("Returns a new custom_pulse each time", func(t *testing.T) {
+		first, err := Mp.AnalyzerLookup("custom_pulse")
+		assertError(t, err, nil)
+		second, _ := Mp.AnalyzerLookup("custom_pulse")
+		if first == second {
+			t.Error("Expected separate custom_pulse analyzers")
+		}
+	})
+
+	t.Run("Returns error if analyzers don't exist", func(t *testing.T) {
+		_, err := Mp.AnalyzerLookup("craquemattic")
+		assertGotError(t, err)
+	})
+}
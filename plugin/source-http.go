@@ -0,0 +1,68 @@
+package plugin
+
+/*
+	HTTP helpers shared by the built-in sources
+
+	The server replaces the client with its own shared client
+	through HTTPSource, this default only covers standalone use.
+*/
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// HTTPClient is implemented to enable testing, it is satisfied by *http.Client
+type HTTPClient interface {
+	Get(string) (*http.Response, error)
+}
+
+var defaultHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// FetchBody returns the body of a GET for url
+func FetchBody(c HTTPClient, url string) ([]byte, error) {
+	if c == nil {
+		c = defaultHTTPClient
+	}
+
+	resp, err := c.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("fetch error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read body: %w", err)
+	}
+
+	return body, nil
+}
+
+// configString returns a string option from a source configuration
+func configString(config map[string]interface{}, key string) string {
+	if v, ok := config[key].(string); ok {
+		return v
+	}
+	return ""
+}
+
+// configStrings returns a list option from a source configuration,
+// either a []string from code or a []interface{} from JSON.
+func configStrings(config map[string]interface{}, key string) []string {
+	switch v := config[key].(type) {
+	case []string:
+		return v
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, s := range v {
+			if str, ok := s.(string); ok {
+				list = append(list, str)
+			}
+		}
+		return list
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package plugin
+
+/*
+	JSONSource
+
+	Reads a JSON API, each metric key is the dotted path
+	to a number inside the response, e.g. "bitcoin.usd" for:
+
+		{"bitcoin":{"usd":111580}}
+
+	This is what an empty delimiter used to mean.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+type JSONSource struct {
+	URL     string
+	Metrics []string // JSON paths to extract
+	Client  HTTPClient
+}
+
+// Configure reads "url" and "metrics"
+func (s *JSONSource) Configure(config map[string]interface{}) error {
+	s.URL = configString(config, "url")
+	s.Metrics = configStrings(config, "metrics")
+
+	if s.URL == "" {
+		return errors.New("json source needs a url")
+	}
+	return nil
+}
+
+// Poll fetches the document once and extracts every metric path from it.
+// Paths that cannot be found are logged and left out.
+func (s *JSONSource) Poll() (map[string]int64, error) {
+	body, err := FetchBody(s.Client, s.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	var data interface{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, fmt.Errorf("error unmarshalling json: %w", err)
+	}
+
+	values := make(map[string]int64, len(s.Metrics))
+	for _, m := range s.Metrics {
+		v, err := ExtractValue(data, m)
+		if err != nil {
+			slog.Error("Could not extract metric", slog.String("metric", m), slog.Any("error", err))
+			continue
+		}
+		values[m] = v
+	}
+
+	return values, nil
+}
+
+func (s *JSONSource) SetClient(c HTTPClient) { s.Client = c }
+func (s *JSONSource) ID() string             { return "json" }
@@ -0,0 +1,42 @@
+package plugin_test
+
+import (
+	"testing"
+
+	Mp "github.com/maroda/monteverdi/plugin"
+)
+
+func TestJSONSource(t *testing.T) {
+	mockWWW := makeSourceServer(`{"bitcoin":{"usd":111580},"ethereum":{"usd":3955.02},"name":"coins"}`)
+	defer mockWWW.Close()
+
+	t.Run("Extracts every metric path", func(t *testing.T) {
+		src := &Mp.JSONSource{}
+		err := src.Configure(map[string]interface{}{
+			"url":     mockWWW.URL,
+			"metrics": []string{"bitcoin.usd", "ethereum.usd", "name", "dogecoin.usd"},
+		})
+		assertError(t, err, nil)
+
+		got, err := src.Poll()
+		assertError(t, err, nil)
+		assertInt(t, len(got), 2)
+		assertInt64(t, got["bitcoin.usd"], 111580)
+		assertInt64(t, got["ethereum.usd"], 3955)
+	})
+
+	t.Run("Errors without url", func(t *testing.T) {
+		src := &Mp.JSONSource{}
+		assertGotError(t, src.Configure(map[string]interface{}{}))
+	})
+
+	t.Run("Errors on invalid JSON", func(t *testing.T) {
+		badWWW := makeSourceServer(`{"bitcoin":`)
+		defer badWWW.Close()
+
+		src := &Mp.JSONSource{URL: badWWW.URL, Metrics: []string{"bitcoin.usd"}}
+		_, err := src.Poll()
+		assertGotError(t, err)
+		assertStringContains(t, src.ID(), "json")
+	})
+}
@@ -0,0 +1,129 @@
+package plugin
+
+/*
+	KVSource
+
+	The original Monteverdi poller: one "key<delim>value" per line,
+	e.g. Prometheus without labels (" ") or an env file ("=").
+
+	Whitespace and comments are ignored, values are parsed
+	as floats (for exponential notation) and truncated to int64.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+type KVSource struct {
+	URL     string
+	Delim   string
+	Metrics []string // only these keys are returned when set
+	Client  HTTPClient
+}
+
+// Configure reads "url", "delim" and "metrics"
+func (s *KVSource) Configure(config map[string]interface{}) error {
+	s.URL = configString(config, "url")
+	s.Delim = configString(config, "delim")
+	s.Metrics = configStrings(config, "metrics")
+
+	if s.URL == "" {
+		return errors.New("kv source needs a url")
+	}
+	if s.Delim == "" {
+		return errors.New("kv source needs a delimiter")
+	}
+	return nil
+}
+
+// Poll fetches the endpoint and returns every numeric value found
+func (s *KVSource) Poll() (map[string]int64, error) {
+	body, err := FetchBody(s.Client, s.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	kv, err := ParseKV(bytes.NewReader(body), s.Delim)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.values(kv), nil
+}
+
+// values converts the raw KV to int64, limited to the configured metrics
+func (s *KVSource) values(kv map[string]string) map[string]int64 {
+	keys := s.Metrics
+	if len(keys) == 0 {
+		for k := range kv {
+			keys = append(keys, k)
+		}
+	}
+
+	values := make(map[string]int64, len(keys))
+	for _, k := range keys {
+		v, ok := kv[k]
+		if !ok {
+			continue
+		}
+		// make floats (e.g. exponential notation) become big integers
+		floatVal, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			slog.Error("invalid syntax in metric", slog.String("metric", k), slog.Any("Error", err))
+			continue
+		}
+		values[k] = int64(floatVal)
+	}
+
+	return values
+}
+
+// ParseKV extracts all key/values from the reader, split on the delimiter /d/
+func ParseKV(reader io.Reader, d string) (map[string]string, error) {
+	envMap := make(map[string]string)
+	scanner := bufio.NewScanner(reader)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		// ignore whitespace and comments
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// Split on the delimiter /d/
+		parts := strings.SplitN(line, d, 2)
+		if len(parts) != 2 {
+			slog.Error("WARNING: Invalid line", slog.String("line", line))
+			continue
+		}
+
+		// Extract Key, Clean up Value, Add to Map
+		key := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+		// Remove quotes
+		value = strings.Trim(value, `"'`)
+		// Take care of any trailing quotes and comments
+		if pos := strings.IndexAny(value, `"'#`); pos != -1 {
+			value = value[:pos]
+		}
+		envMap[key] = value
+	}
+
+	if err := scanner.Err(); err != nil {
+		slog.Error("Problem scanning input", slog.Any("Error", err))
+		return nil, fmt.Errorf("scanning error: %w", err)
+	}
+
+	return envMap, nil
+}
+
+func (s *KVSource) SetClient(c HTTPClient) { s.Client = c }
+func (s *KVSource) ID() string             { return "kv" }
@@ -0,0 +1,89 @@
+package plugin_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	Mp "github.com/maroda/monteverdi/plugin"
+)
+
+func makeSourceServer(body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	}))
+}
+
+func TestParseKV(t *testing.T) {
+	input := `# comment
+CPU1=100
+CPU2 = "200" # trailing comment
+not a pair
+`
+	got, err := Mp.ParseKV(strings.NewReader(input), "=")
+	assertError(t, err, nil)
+	assertInt(t, len(got), 2)
+	assertStringContains(t, got["CPU2"], "200")
+}
+
+func TestKVSource(t *testing.T) {
+	mockWWW := makeSourceServer("CPU1=100\nCPU2=2.5e3\nCPU3=notanumber\nCPU4=4\n")
+	defer mockWWW.Close()
+
+	t.Run("Returns configured metrics as int64", func(t *testing.T) {
+		src := &Mp.KVSource{}
+		err := src.Configure(map[string]interface{}{
+			"url":     mockWWW.URL,
+			"delim":   "=",
+			"metrics": []string{"CPU1", "CPU2", "CPU3", "MISSING"},
+		})
+		assertError(t, err, nil)
+
+		got, err := src.Poll()
+		assertError(t, err, nil)
+		assertInt(t, len(got), 2)
+		assertInt64(t, got["CPU1"], 100)
+		assertInt64(t, got["CPU2"], 2500)
+	})
+
+	t.Run("Returns every numeric key without metrics", func(t *testing.T) {
+		src := &Mp.KVSource{URL: mockWWW.URL, Delim: "="}
+		got, err := src.Poll()
+		assertError(t, err, nil)
+		assertInt(t, len(got), 3)
+	})
+
+	t.Run("Reads metrics from a JSON config list", func(t *testing.T) {
+		src := &Mp.KVSource{}
+		err := src.Configure(map[string]interface{}{
+			"url":     mockWWW.URL,
+			"delim":   "=",
+			"metrics": []interface{}{"CPU4"},
+		})
+		assertError(t, err, nil)
+		got, _ := src.Poll()
+		assertInt64(t, got["CPU4"], 4)
+	})
+
+	t.Run("Errors without url or delim", func(t *testing.T) {
+		src := &Mp.KVSource{}
+		assertGotError(t, src.Configure(map[string]interface{}{"delim": "="}))
+		assertGotError(t, src.Configure(map[string]interface{}{"url": mockWWW.URL}))
+	})
+
+	t.Run("Errors on fetch failure", func(t *testing.T) {
+		src := &Mp.KVSource{URL: "http://unreachable-craquemattic:2345/metrics", Delim: "="}
+		_, err := src.Poll()
+		assertGotError(t, err)
+	})
+
+	t.Run("Uses the client it is given", func(t *testing.T) {
+		src := &Mp.KVSource{URL: mockWWW.URL, Delim: "="}
+		src.SetClient(http.DefaultClient)
+		_, err := src.Poll()
+		assertError(t, err, nil)
+		assertStringContains(t, src.ID(), "kv")
+	})
+}
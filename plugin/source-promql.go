@@ -0,0 +1,355 @@
+package plugin
+
+/*
+	PromQLSource
+
+	Polls a Prometheus-compatible HTTP API (Prometheus, Thanos, VictoriaMetrics)
+	with one instant query per metric, so recording rules and aggregations
+	can be used like any other metric:
+
+		GET <url>/api/v1/query?query=sum(rate(http_requests_total{code=~"5.."}[5m]))
+
+	A query must resolve to one number: a scalar, a single-series vector,
+	the last point of a single-series matrix, or a numeric string.
+	Queries returning nothing are left out until they match again.
+
+	PollRange runs the same queries over /api/v1/query_range to backfill.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type PromQLSource struct {
+	URL     string            // base URL of the API, e.g. http://prometheus:9090
+	Metrics []string          // metric keys to query
+	Queries map[string]string // PromQL expression by metric key, defaults to the key
+	Client  HTTPClient
+}
+
+// PromQLResponse is the envelope of every Prometheus API response
+type PromQLResponse struct {
+	Status    string     `json:"status"` // "success" or "error"
+	Data      PromQLData `json:"data"`
+	ErrorType string     `json:"errorType,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	Warnings  []string   `json:"warnings,omitempty"`
+}
+
+// PromQLData holds the raw result, its shape depends on ResultType
+type PromQLData struct {
+	ResultType string          `json:"resultType"` // scalar, vector, matrix or string
+	Result     json.RawMessage `json:"result"`
+}
+
+// promQLSeries is one element of a vector or matrix result
+type promQLSeries struct {
+	Metric map[string]string `json:"metric"`
+	Value  []interface{}     `json:"value"`  // vector: [ts, "v"]
+	Values [][]interface{}   `json:"values"` // matrix: [[ts, "v"], ...]
+}
+
+// ErrPromQLNoData is returned for queries that match nothing
+var ErrPromQLNoData = errors.New("query returned no data")
+
+// Configure reads "url", "metrics", and "queries" (metric key → PromQL),
+// a metric's own "query" in "metric_config" takes precedence
+func (s *PromQLSource) Configure(config map[string]interface{}) error {
+	s.URL = strings.TrimRight(configString(config, "url"), "/")
+	s.Metrics = configStrings(config, "metrics")
+	s.Queries = make(map[string]string)
+
+	switch q := config["queries"].(type) {
+	case map[string]string:
+		for k, v := range q {
+			s.Queries[k] = v
+		}
+	case map[string]interface{}:
+		for k, v := range q {
+			if str, ok := v.(string); ok {
+				s.Queries[k] = str
+			}
+		}
+	}
+
+	if mc, ok := config["metric_config"].(map[string]interface{}); ok {
+		for k, v := range mc {
+			m, _ := v.(map[string]interface{})
+			if query := configString(m, "query"); query != "" {
+				s.Queries[k] = query
+			}
+		}
+	}
+
+	if s.URL == "" {
+		return errors.New("promql source needs a url")
+	}
+	return nil
+}
+
+// Poll runs the query of every metric. Failing queries are logged and left out,
+// an error is only returned when every query failed.
+func (s *PromQLSource) Poll() (map[string]int64, error) {
+	values := make(map[string]int64, len(s.Metrics))
+
+	var firstErr error
+	failed := 0
+	for _, m := range s.Metrics {
+		query := s.Queries[m]
+		if query == "" {
+			query = m
+		}
+
+		v, err := s.Query(query)
+		if errors.Is(err, ErrPromQLNoData) {
+			slog.Debug("PromQL query returned no data", slog.String("metric", m), slog.String("query", query))
+			continue
+		}
+		if err != nil {
+			slog.Error("PromQL query failed",
+				slog.String("metric", m),
+				slog.String("query", query),
+				slog.Any("error", err))
+			if firstErr == nil {
+				firstErr = err
+			}
+			failed++
+			continue
+		}
+
+		if math.IsNaN(v) {
+			continue
+		}
+		values[m] = floatToInt64(v)
+	}
+
+	if failed > 0 && failed == len(s.Metrics) {
+		return nil, fmt.Errorf("all queries failed: %w", firstErr)
+	}
+	return values, nil
+}
+
+// Query runs one instant query and returns its single value
+func (s *PromQLSource) Query(query string) (float64, error) {
+	c := s.Client
+	if c == nil {
+		c = defaultHTTPClient
+	}
+
+	resp, err := c.Get(s.URL + "/api/v1/query?query=" + url.QueryEscape(query))
+	if err != nil {
+		return 0, fmt.Errorf("fetch error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Error payloads come with 400, 422 and 503, anything else is not the API
+	var pr PromQLResponse
+	if err := json.NewDecoder(resp.Body).Decode(&pr); err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return 0, fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+		return 0, fmt.Errorf("error decoding response: %w", err)
+	}
+
+	return ParsePromQLResponse(&pr)
+}
+
+// PollRange runs the query of every metric from start to end every step.
+// Like Poll, failing queries are logged and left out,
+// an error is only returned when every query failed.
+func (s *PromQLSource) PollRange(start, end time.Time, step time.Duration) (map[string][]Sample, error) {
+	if step <= 0 {
+		return nil, errors.New("range step must be positive")
+	}
+
+	history := make(map[string][]Sample, len(s.Metrics))
+
+	var firstErr error
+	failed := 0
+	for _, m := range s.Metrics {
+		query := s.Queries[m]
+		if query == "" {
+			query = m
+		}
+
+		samples, err := s.QueryRange(query, start, end, step)
+		if err != nil && !errors.Is(err, ErrPromQLNoData) {
+			slog.Error("PromQL range query failed",
+				slog.String("metric", m),
+				slog.String("query", query),
+				slog.Any("error", err))
+			if firstErr == nil {
+				firstErr = err
+			}
+			failed++
+			continue
+		}
+		if len(samples) > 0 {
+			history[m] = samples
+		}
+	}
+
+	if failed > 0 && failed == len(s.Metrics) {
+		return nil, fmt.Errorf("all queries failed: %w", firstErr)
+	}
+	return history, nil
+}
+
+// QueryRange runs one range query and returns the points of its single series
+func (s *PromQLSource) QueryRange(query string, start, end time.Time, step time.Duration) ([]Sample, error) {
+	c := s.Client
+	if c == nil {
+		c = defaultHTTPClient
+	}
+
+	params := url.Values{}
+	params.Set("query", query)
+	params.Set("start", strconv.FormatInt(start.Unix(), 10))
+	params.Set("end", strconv.FormatInt(end.Unix(), 10))
+	params.Set("step", strconv.FormatFloat(step.Seconds(), 'f', -1, 64))
+
+	resp, err := c.Get(s.URL + "/api/v1/query_range?" + params.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("fetch error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var pr PromQLResponse
+	if err := json.NewDecoder(resp.Body).Decode(&pr); err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+		return nil, fmt.Errorf("error decoding response: %w", err)
+	}
+
+	return ParsePromQLRange(&pr)
+}
+
+// ParsePromQLRange returns the points of a single-series matrix result
+func ParsePromQLRange(pr *PromQLResponse) ([]Sample, error) {
+	if pr.Status != "success" {
+		return nil, fmt.Errorf("query error (%s): %s", pr.ErrorType, pr.Error)
+	}
+	if pr.Data.ResultType != "matrix" {
+		return nil, fmt.Errorf("unexpected result type for a range query: %q", pr.Data.ResultType)
+	}
+
+	var series []promQLSeries
+	if err := json.Unmarshal(pr.Data.Result, &series); err != nil {
+		return nil, fmt.Errorf("invalid matrix result: %w", err)
+	}
+	if len(series) == 0 {
+		return nil, ErrPromQLNoData
+	}
+	if len(series) > 1 {
+		return nil, fmt.Errorf("query returned %d series, aggregate it to one", len(series))
+	}
+
+	samples := make([]Sample, 0, len(series[0].Values))
+	for _, point := range series[0].Values {
+		v, err := promQLPointValue(point)
+		if err != nil {
+			return nil, err
+		}
+		if math.IsNaN(v) {
+			continue
+		}
+		ts, ok := point[0].(float64)
+		if !ok {
+			return nil, fmt.Errorf("invalid sample timestamp: %v", point[0])
+		}
+		samples = append(samples, Sample{
+			Timestamp: time.Unix(0, int64(ts*float64(time.Second))),
+			Value:     floatToInt64(v),
+		})
+	}
+
+	return samples, nil
+}
+
+// ParsePromQLResponse returns the single value held by an instant query result
+func ParsePromQLResponse(pr *PromQLResponse) (float64, error) {
+	if pr.Status != "success" {
+		return 0, fmt.Errorf("query error (%s): %s", pr.ErrorType, pr.Error)
+	}
+	for _, w := range pr.Warnings {
+		slog.Warn("PromQL warning", slog.String("warning", w))
+	}
+
+	switch pr.Data.ResultType {
+	case "scalar", "string":
+		var point []interface{}
+		if err := json.Unmarshal(pr.Data.Result, &point); err != nil {
+			return 0, fmt.Errorf("invalid %s result: %w", pr.Data.ResultType, err)
+		}
+		return promQLPointValue(point)
+
+	case "vector":
+		var series []promQLSeries
+		if err := json.Unmarshal(pr.Data.Result, &series); err != nil {
+			return 0, fmt.Errorf("invalid vector result: %w", err)
+		}
+		if len(series) == 0 {
+			return 0, ErrPromQLNoData
+		}
+		if len(series) > 1 {
+			return 0, fmt.Errorf("query returned %d series, aggregate it to one", len(series))
+		}
+		return promQLPointValue(series[0].Value)
+
+	case "matrix":
+		var series []promQLSeries
+		if err := json.Unmarshal(pr.Data.Result, &series); err != nil {
+			return 0, fmt.Errorf("invalid matrix result: %w", err)
+		}
+		if len(series) == 0 || len(series[0].Values) == 0 {
+			return 0, ErrPromQLNoData
+		}
+		if len(series) > 1 {
+			return 0, fmt.Errorf("query returned %d series, aggregate it to one", len(series))
+		}
+		points := series[0].Values
+		return promQLPointValue(points[len(points)-1])
+	}
+
+	return 0, fmt.Errorf("unknown result type: %q", pr.Data.ResultType)
+}
+
+// promQLPointValue reads the value of a [timestamp, "value"] pair
+func promQLPointValue(point []interface{}) (float64, error) {
+	if len(point) != 2 {
+		return 0, fmt.Errorf("invalid sample: %v", point)
+	}
+	str, ok := point[1].(string)
+	if !ok {
+		return 0, fmt.Errorf("invalid sample value: %v", point[1])
+	}
+	v, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return 0, fmt.Errorf("non-numeric sample value: %q", str)
+	}
+	return v, nil
+}
+
+// floatToInt64 truncates, clamping infinities
+func floatToInt64(v float64) int64 {
+	switch {
+	case v >= math.MaxInt64:
+		return math.MaxInt64
+	case v <= math.MinInt64:
+		return math.MinInt64
+	}
+	return int64(v)
+}
+
+func (s *PromQLSource) SetClient(c HTTPClient) { s.Client = c }
+func (s *PromQLSource) ID() string             { return "promql" }
@@ -0,0 +1,224 @@
+package plugin_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	Mp "github.com/maroda/monteverdi/plugin"
+)
+
+// makePromAPI answers /api/v1/query with a canned response per query
+func makePromAPI(responses map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/query" {
+			http.NotFound(w, r)
+			return
+		}
+		body, ok := responses[r.URL.Query().Get("query")]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"status":"error","errorType":"bad_data","error":"parse error: unexpected end of input"}`)
+			return
+		}
+		fmt.Fprint(w, body)
+	}))
+}
+
+var promAPIResponses = map[string]string{
+	`scalar(up)`:         `{"status":"success","data":{"resultType":"scalar","result":[1700000000.123,"3"]}}`,
+	`sum(up)`:            `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1700000000,"42.7"]}]}}`,
+	`up`:                 `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"job":"a"},"value":[1,"1"]},{"metric":{"job":"b"},"value":[1,"1"]}]}}`,
+	`absent_metric`:      `{"status":"success","data":{"resultType":"vector","result":[]}}`,
+	`up{job="a"}[5m]`:    `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"job":"a"},"values":[[1,"10"],[2,"20"]]}]}}`,
+	`"77"`:               `{"status":"success","data":{"resultType":"string","result":[1,"77"]}}`,
+	`"label"`:            `{"status":"success","data":{"resultType":"string","result":[1,"label"]}}`,
+	`nan_metric`:         `{"status":"success","data":{"resultType":"scalar","result":[1,"NaN"]}}`,
+	`inf_metric`:         `{"status":"success","data":{"resultType":"scalar","result":[1,"+Inf"]}}`,
+	`warned`:             `{"status":"success","warnings":["partial response"],"data":{"resultType":"scalar","result":[1,"5"]}}`,
+	`timeout`:            `{"status":"error","errorType":"timeout","error":"query timed out in expression evaluation"}`,
+	`histogram_metric`:   `{"status":"success","data":{"resultType":"histogram","result":[]}}`,
+	`not_json`:           `<html>proxy error</html>`,
+	`matrix_empty[5m]`:   `{"status":"success","data":{"resultType":"matrix","result":[]}}`,
+	`vector_bad_payload`: `{"status":"success","data":{"resultType":"vector","result":{"oops":1}}}`,
+}
+
+func TestPromQLSource_Query(t *testing.T) {
+	mockAPI := makePromAPI(promAPIResponses)
+	defer mockAPI.Close()
+
+	src := &Mp.PromQLSource{URL: mockAPI.URL}
+
+	valid := []struct {
+		query string
+		want  float64
+	}{
+		{`scalar(up)`, 3},
+		{`sum(up)`, 42.7},
+		{`up{job="a"}[5m]`, 20}, // last point of the matrix
+		{`"77"`, 77},
+		{`warned`, 5},
+	}
+	for _, tt := range valid {
+		t.Run(tt.query, func(t *testing.T) {
+			got, err := src.Query(tt.query)
+			assertError(t, err, nil)
+			if got != tt.want {
+				t.Errorf("got %f, want %f", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("Returns ErrPromQLNoData for empty results", func(t *testing.T) {
+		_, err := src.Query(`absent_metric`)
+		assertError(t, err, Mp.ErrPromQLNoData)
+		_, err = src.Query(`matrix_empty[5m]`)
+		assertError(t, err, Mp.ErrPromQLNoData)
+	})
+
+	invalid := []string{
+		`up`,                 // more than one series
+		`"label"`,            // non-numeric string
+		`timeout`,            // API error payload with 200
+		`syntax error(`,      // API error payload with 400
+		`histogram_metric`,   // unknown result type
+		`not_json`,           // not the API
+		`vector_bad_payload`, // malformed result
+	}
+	for _, q := range invalid {
+		t.Run("Errors on "+q, func(t *testing.T) {
+			_, err := src.Query(q)
+			assertGotError(t, err)
+		})
+	}
+
+	t.Run("Includes the API error in the message", func(t *testing.T) {
+		_, err := src.Query(`timeout`)
+		assertStringContains(t, err.Error(), "query timed out")
+	})
+}
+
+func TestPromQLSource(t *testing.T) {
+	mockAPI := makePromAPI(promAPIResponses)
+	defer mockAPI.Close()
+
+	t.Run("Polls the query of every metric", func(t *testing.T) {
+		src := &Mp.PromQLSource{}
+		err := src.Configure(map[string]interface{}{
+			"url":     mockAPI.URL + "/",
+			"metrics": []string{"requests", "scalar(up)", "absent_metric", "nan_metric", "inf_metric", "broken"},
+			"queries": map[string]interface{}{
+				"requests": "sum(up)",
+				"broken":   "timeout",
+			},
+		})
+		assertError(t, err, nil)
+
+		got, err := src.Poll()
+		assertError(t, err, nil)
+		assertInt(t, len(got), 3)
+		assertInt64(t, got["requests"], 42)
+		assertInt64(t, got["scalar(up)"], 3)
+		if got["inf_metric"] <= 0 {
+			t.Errorf("Expected +Inf to clamp to a large value, got %d", got["inf_metric"])
+		}
+	})
+
+	t.Run("Prefers the query in the metric config", func(t *testing.T) {
+		src := &Mp.PromQLSource{}
+		err := src.Configure(map[string]interface{}{
+			"url":     mockAPI.URL,
+			"metrics": []string{"requests"},
+			"queries": map[string]interface{}{"requests": "timeout"},
+			"metric_config": map[string]interface{}{
+				"requests": map[string]interface{}{"type": "gauge", "query": "sum(up)"},
+			},
+		})
+		assertError(t, err, nil)
+
+		got, err := src.Poll()
+		assertError(t, err, nil)
+		assertInt64(t, got["requests"], 42)
+	})
+
+	t.Run("Errors when every query fails", func(t *testing.T) {
+		src := &Mp.PromQLSource{URL: mockAPI.URL, Metrics: []string{"timeout"}}
+		_, err := src.Poll()
+		assertGotError(t, err)
+	})
+
+	t.Run("Errors on unreachable API", func(t *testing.T) {
+		src := &Mp.PromQLSource{URL: "http://unreachable-craquemattic:9090", Metrics: []string{"up"}}
+		_, err := src.Poll()
+		assertGotError(t, err)
+	})
+
+	t.Run("Errors without url", func(t *testing.T) {
+		src := &Mp.PromQLSource{}
+		assertGotError(t, src.Configure(map[string]interface{}{}))
+		assertStringContains(t, src.ID(), "promql")
+	})
+}
+
+func TestPromQLSource_PollRange(t *testing.T) {
+	mockAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.URL.Path != "/api/v1/query_range" || q.Get("start") != "1700000000" || q.Get("step") != "15" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"status":"error","errorType":"bad_data","error":"bad range"}`)
+			return
+		}
+		switch q.Get("query") {
+		case "sum(up)":
+			fmt.Fprint(w, `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{},"values":[[1700000000,"1"],[1700000015.5,"NaN"],[1700000030,"3.9"]]}]}}`)
+		case "up":
+			fmt.Fprint(w, `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"job":"a"},"values":[]},{"metric":{"job":"b"},"values":[]}]}}`)
+		case "absent_metric":
+			fmt.Fprint(w, `{"status":"success","data":{"resultType":"matrix","result":[]}}`)
+		default:
+			fmt.Fprint(w, `{"status":"success","data":{"resultType":"vector","result":[]}}`)
+		}
+	}))
+	defer mockAPI.Close()
+
+	start := time.Unix(1700000000, 0)
+	end := start.Add(time.Minute)
+
+	t.Run("Returns the points of every metric", func(t *testing.T) {
+		src := &Mp.PromQLSource{
+			URL:     mockAPI.URL,
+			Metrics: []string{"requests", "up", "absent_metric"},
+			Queries: map[string]string{"requests": "sum(up)"},
+		}
+		got, err := src.PollRange(start, end, 15*time.Second)
+		assertError(t, err, nil)
+		assertInt(t, len(got), 1)
+
+		points := got["requests"]
+		assertInt(t, len(points), 2) // NaN is left out
+		assertInt64(t, points[1].Value, 3)
+		if !points[1].Timestamp.Equal(start.Add(30 * time.Second)) {
+			t.Errorf("got %v, want %v", points[1].Timestamp, start.Add(30*time.Second))
+		}
+	})
+
+	t.Run("Errors on a non-matrix result", func(t *testing.T) {
+		src := &Mp.PromQLSource{URL: mockAPI.URL}
+		_, err := src.QueryRange("vector_metric", start, end, 15*time.Second)
+		assertGotError(t, err)
+	})
+
+	t.Run("Errors when every query fails", func(t *testing.T) {
+		src := &Mp.PromQLSource{URL: mockAPI.URL, Metrics: []string{"up"}}
+		_, err := src.PollRange(start, end, 15*time.Second)
+		assertGotError(t, err)
+	})
+
+	t.Run("Errors on a bad step", func(t *testing.T) {
+		src := &Mp.PromQLSource{URL: mockAPI.URL, Metrics: []string{"up"}}
+		_, err := src.PollRange(start, end, 0)
+		assertGotError(t, err)
+	})
+}
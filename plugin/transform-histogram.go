@@ -0,0 +1,202 @@
+package plugin
+
+/*
+	HistogramQuantile
+
+	Returns a quantile (e.g. p95) interpolated from histogram buckets,
+	the same way PromQL's histogram_quantile() does.
+
+	A histogram arrives as many cumulative series, one per upper bound:
+
+		http_request_duration_seconds_bucket{le="0.1"} 240
+		http_request_duration_seconds_bucket{le="0.5"} 310
+		http_request_duration_seconds_bucket{le="+Inf"} 320
+
+	The poller hands every bucket of one poll to SetBuckets before
+	calling Transform, and the Transform result is checked against Max.
+	Summaries already expose their quantiles, these are passed with SetSummary.
+
+	With BucketRate the quantile is computed from the bucket increase
+	since the previous poll, instead of everything since process start.
+*/
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// Bucket is one cumulative histogram bucket
+type Bucket struct {
+	UpperBound float64 // the "le" label
+	Count      float64 // observations less than or equal to UpperBound
+}
+
+type HistogramQuantilePlugin struct {
+	Quantile    float64             // 0.5 for p50, 0.95 for p95, 0.99 for p99
+	BucketRate  bool                // use the bucket increase over the last poll interval
+	Scale       float64             // multiplier applied before truncating to int64, e.g. 1000 for s → ms
+	Buckets     map[string][]Bucket // buckets from the current poll by metric
+	PrevBuckets map[string][]Bucket // buckets from the previous poll by metric
+	Summary     map[string]float64  // summary quantile from the current poll by metric
+}
+
+// NewHistogramQuantile returns a transformer for quantile q,
+// a Scale of 0 is taken as 1.
+func NewHistogramQuantile(q float64, rate bool, scale float64) (*HistogramQuantilePlugin, error) {
+	if q < 0 || q > 1 || math.IsNaN(q) {
+		return nil, fmt.Errorf("quantile must be between 0 and 1, got %f", q)
+	}
+	if scale == 0 {
+		scale = 1
+	}
+
+	return &HistogramQuantilePlugin{
+		Quantile:    q,
+		BucketRate:  rate,
+		Scale:       scale,
+		Buckets:     make(map[string][]Bucket),
+		PrevBuckets: make(map[string][]Bucket),
+		Summary:     make(map[string]float64),
+	}, nil
+}
+
+// SetBuckets records the histogram buckets of metric for the next Transform
+func (p *HistogramQuantilePlugin) SetBuckets(metric string, buckets []Bucket) {
+	if p.Buckets == nil {
+		p.Buckets = make(map[string][]Bucket)
+	}
+	p.Buckets[metric] = buckets
+}
+
+// SetSummary records the summary quantile of metric for the next Transform
+func (p *HistogramQuantilePlugin) SetSummary(metric string, value float64) {
+	if p.Summary == nil {
+		p.Summary = make(map[string]float64)
+	}
+	p.Summary[metric] = value
+}
+
+// Transform is the main wrapper for the interface.
+// The current value is not used, the quantile comes from the recorded buckets.
+func (p *HistogramQuantilePlugin) Transform(metric string, current int64, historical []int64, timestamp time.Time) (int64, error) {
+	if v, ok := p.Summary[metric]; ok {
+		delete(p.Summary, metric)
+		return p.scaled(v), nil
+	}
+
+	buckets, ok := p.Buckets[metric]
+	if !ok {
+		return 0, fmt.Errorf("no buckets recorded for %s", metric)
+	}
+	delete(p.Buckets, metric)
+
+	if p.BucketRate {
+		if p.PrevBuckets == nil {
+			p.PrevBuckets = make(map[string][]Bucket)
+		}
+		prev, seen := p.PrevBuckets[metric]
+		p.PrevBuckets[metric] = buckets
+
+		// No interval yet, first time reading
+		if !seen {
+			return 0, nil
+		}
+		buckets = BucketIncrease(buckets, prev)
+	}
+
+	q := HistogramQuantile(p.Quantile, buckets)
+	if math.IsNaN(q) {
+		return 0, nil
+	}
+
+	return p.scaled(q), nil
+}
+
+func (p *HistogramQuantilePlugin) scaled(v float64) int64 {
+	scale := p.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	return int64(v * scale)
+}
+
+// BucketIncrease returns the per-bucket increase from prev to curr.
+// Any decreasing bucket means the counters were reset, so curr is returned as is.
+func BucketIncrease(curr, prev []Bucket) []Bucket {
+	before := make(map[float64]float64, len(prev))
+	for _, b := range prev {
+		before[b.UpperBound] = b.Count
+	}
+
+	increase := make([]Bucket, 0, len(curr))
+	for _, b := range curr {
+		delta := b.Count - before[b.UpperBound]
+		if delta < 0 {
+			return curr
+		}
+		increase = append(increase, Bucket{UpperBound: b.UpperBound, Count: delta})
+	}
+
+	return increase
+}
+
+// HistogramQuantile interpolates quantile q from cumulative buckets.
+// It returns NaN without observations or without a +Inf bucket.
+// A rank landing in the +Inf bucket returns the highest finite upper bound.
+func HistogramQuantile(q float64, buckets []Bucket) float64 {
+	if len(buckets) == 0 {
+		return math.NaN()
+	}
+
+	sorted := make([]Bucket, len(buckets))
+	copy(sorted, buckets)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].UpperBound < sorted[j].UpperBound })
+
+	last := sorted[len(sorted)-1]
+	if !math.IsInf(last.UpperBound, 1) {
+		return math.NaN()
+	}
+
+	// Scrapes are not atomic, keep the counts monotonic
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i].Count < sorted[i-1].Count {
+			sorted[i].Count = sorted[i-1].Count
+		}
+	}
+
+	total := sorted[len(sorted)-1].Count
+	if total == 0 {
+		return math.NaN()
+	}
+
+	rank := q * total
+	b := sort.Search(len(sorted)-1, func(i int) bool { return sorted[i].Count >= rank })
+
+	if b == len(sorted)-1 {
+		if len(sorted) < 2 {
+			return math.NaN()
+		}
+		return sorted[len(sorted)-2].UpperBound
+	}
+	if b == 0 && sorted[0].UpperBound <= 0 {
+		return sorted[0].UpperBound
+	}
+
+	start, end := 0.0, sorted[b].UpperBound
+	count := sorted[b].Count
+	if b > 0 {
+		start = sorted[b-1].UpperBound
+		count -= sorted[b-1].Count
+		rank -= sorted[b-1].Count
+	}
+	if count == 0 {
+		return end
+	}
+
+	return start + (end-start)*(rank/count)
+}
+
+func (p *HistogramQuantilePlugin) HysteresisReq() int { return 0 }
+func (p *HistogramQuantilePlugin) Type() string       { return "histogram_quantile" }
@@ -0,0 +1,134 @@
+package plugin_test
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	Mp "github.com/maroda/monteverdi/plugin"
+)
+
+// 100 observations: 50 under 0.1s, 40 more under 0.5s, 8 more under 1s
+var latencyBuckets = []Mp.Bucket{
+	{UpperBound: 1, Count: 98},
+	{UpperBound: 0.1, Count: 50},
+	{UpperBound: math.Inf(1), Count: 100},
+	{UpperBound: 0.5, Count: 90},
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	tests := []struct {
+		name string
+		q    float64
+		want float64
+	}{
+		{"p50 is the first bucket bound", 0.5, 0.1},
+		{"p25 interpolates from zero", 0.25, 0.05},
+		{"p70 interpolates inside a bucket", 0.7, 0.3},
+		{"p99 lands in +Inf and returns the highest bound", 0.99, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Mp.HistogramQuantile(tt.q, latencyBuckets)
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("got %f, want %f", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("NaN without a +Inf bucket", func(t *testing.T) {
+		got := Mp.HistogramQuantile(0.5, []Mp.Bucket{{UpperBound: 1, Count: 10}})
+		if !math.IsNaN(got) {
+			t.Errorf("Expected NaN, got %f", got)
+		}
+	})
+
+	t.Run("NaN without observations", func(t *testing.T) {
+		got := Mp.HistogramQuantile(0.5, []Mp.Bucket{{UpperBound: 1}, {UpperBound: math.Inf(1)}})
+		if !math.IsNaN(got) {
+			t.Errorf("Expected NaN, got %f", got)
+		}
+		if !math.IsNaN(Mp.HistogramQuantile(0.5, nil)) {
+			t.Errorf("Expected NaN for no buckets")
+		}
+	})
+}
+
+func TestBucketIncrease(t *testing.T) {
+	prev := []Mp.Bucket{{UpperBound: 1, Count: 10}, {UpperBound: math.Inf(1), Count: 12}}
+
+	t.Run("Returns the per-bucket increase", func(t *testing.T) {
+		curr := []Mp.Bucket{{UpperBound: 1, Count: 15}, {UpperBound: math.Inf(1), Count: 20}}
+		got := Mp.BucketIncrease(curr, prev)
+		assertInt64(t, int64(got[0].Count), 5)
+		assertInt64(t, int64(got[1].Count), 8)
+	})
+
+	t.Run("Handles counter reset", func(t *testing.T) {
+		curr := []Mp.Bucket{{UpperBound: 1, Count: 2}, {UpperBound: math.Inf(1), Count: 3}}
+		got := Mp.BucketIncrease(curr, prev)
+		assertInt64(t, int64(got[1].Count), 3)
+	})
+}
+
+func TestHistogramQuantilePlugin(t *testing.T) {
+	metric := "latency"
+	now := time.Now()
+
+	t.Run("Errors on invalid quantile", func(t *testing.T) {
+		_, err := Mp.NewHistogramQuantile(1.5, false, 1)
+		assertGotError(t, err)
+	})
+
+	t.Run("Returns the scaled quantile", func(t *testing.T) {
+		p, err := Mp.NewHistogramQuantile(0.7, false, 1000)
+		assertError(t, err, nil)
+		p.SetBuckets(metric, latencyBuckets)
+		got, err := p.Transform(metric, 100, nil, now)
+		assertError(t, err, nil)
+		assertInt64(t, got, 300)
+	})
+
+	t.Run("Errors without buckets", func(t *testing.T) {
+		p, _ := Mp.NewHistogramQuantile(0.5, false, 1)
+		_, err := p.Transform(metric, 0, nil, now)
+		assertGotError(t, err)
+	})
+
+	t.Run("Returns summary quantiles as they are", func(t *testing.T) {
+		p, _ := Mp.NewHistogramQuantile(0.99, false, 1000)
+		p.SetSummary(metric, 0.25)
+		got, err := p.Transform(metric, 0, nil, now)
+		assertError(t, err, nil)
+		assertInt64(t, got, 250)
+	})
+
+	t.Run("Bucket rate uses the last interval only", func(t *testing.T) {
+		p, _ := Mp.NewHistogramQuantile(0.5, true, 1000)
+
+		// First reading has no interval
+		p.SetBuckets(metric, latencyBuckets)
+		got, err := p.Transform(metric, 100, nil, now)
+		assertError(t, err, nil)
+		assertInt64(t, got, 0)
+
+		// Everything new landed between 0.5s and 1s
+		next := []Mp.Bucket{
+			{UpperBound: 0.1, Count: 50},
+			{UpperBound: 0.5, Count: 90},
+			{UpperBound: 1, Count: 108},
+			{UpperBound: math.Inf(1), Count: 110},
+		}
+		p.SetBuckets(metric, next)
+		got, err = p.Transform(metric, 110, nil, now.Add(15*time.Second))
+		assertError(t, err, nil)
+		assertInt64(t, got, 750)
+	})
+
+	t.Run("Interface values", func(t *testing.T) {
+		p := Mp.HistogramQuantilePlugin{}
+		assertInt(t, p.HysteresisReq(), 0)
+		assertStringContains(t, p.Type(), "histogram_quantile")
+	})
+}
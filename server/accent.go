@@ -16,8 +16,9 @@ A Dimension is a layer of the PulseTree hierarchy.
 An IctusSequence is in Dimension 1.
 A PulseSequence is in Dimension 2.
 A Consort is in D2: at least three pulses from a PulseSequence , i.e. a group of Groups.
+A Period is in D3 and up: three Consorts (or Periods) in a row, a group of Consorts.
 There are no Consort Patterns, they are all Pulse Patterns.
-Pulse Events are produced by both Groups and Consorts.
+Pulse Events are produced by Groups, Consorts, and Periods.
 The TemporalGrouper is the heart of the algorithm that groups things together.
 
 */
@@ -25,17 +26,24 @@ The TemporalGrouper is the heart of the algorithm that groups things together.
 import (
 	"fmt"
 	"log/slog"
+	"slices"
 	"sort"
 	"time"
 
+	Mp "github.com/maroda/monteverdi/plugin"
 	Mt "github.com/maroda/monteverdi/types"
 )
 
 // NewAccent builds the metadata for the accent
 // There is no boolean, the existence of an Accent is always true
 func NewAccent(i int, s string) *Mt.Accent {
+	return NewAccentAt(i, s, time.Now())
+}
+
+// NewAccentAt builds the metadata for an accent at time t
+func NewAccentAt(i int, s string, t time.Time) *Mt.Accent {
 	return &Mt.Accent{
-		Timestamp: time.Now().UnixNano(),
+		Timestamp: t.UnixNano(),
 		Intensity: i,
 		SourceID:  s,
 	}
@@ -48,6 +56,7 @@ type IctusSequence struct {
 	StartTime               time.Time
 	EndTime                 time.Time
 	LastProcessedEventCount int
+	LastCustom              map[string]time.Time // start of the last pulse of each user-defined D1 pattern
 }
 
 // PulseEvents is an alias on []Mt.PulseEvent to be used with a method.
@@ -97,56 +106,22 @@ func (is *IctusSequence) DetectPulsesWithConfig(config Mt.PulseConfig) []Mt.Puls
 		return pulses
 	}
 
-	for i := 1; i < len(is.Events)-2; i++ {
-		prev := is.Events[i-1]
-		curr := is.Events[i]
-		next := is.Events[i+1]
-
-		// Iamb pattern: non-accent → accent transition
-		if !prev.IsAccent && curr.IsAccent {
-			slog.Debug("IAMB_DETECTED",
+	// The built-in D1 feet, in the order they happen
+	for _, analyzer := range []Mp.PatternAnalyzer{Mp.NewIambAnalyzer(config), Mp.NewTrocheeAnalyzer(config)} {
+		feet, _ := analyzer.DetectPatterns(is.Events)
+		for _, foot := range feet {
+			slog.Debug("D1_FOOT_DETECTED",
 				slog.String("metric", is.Metric),
-				slog.String("transition", fmt.Sprintf("%v->%v", prev.IsAccent, curr.IsAccent)))
-
-			nonAccentDur := curr.Timestamp.Sub(prev.Timestamp)
-			accentDur := next.Timestamp.Sub(curr.Timestamp)
-
-			// Configurable START within the non-accent period
-			patternStart := prev.Timestamp.Add(time.Duration(float64(nonAccentDur) * config.IambStartPeriod))
-
-			// Configurable END within the non-accent period
-			patternEnd := curr.Timestamp.Add(time.Duration(float64(accentDur) * config.IambEndPeriod))
-
-			pulses = append(pulses, Mt.PulseEvent{
-				Dimension: 1,
-				Pattern:   Mt.Iamb,
-				StartTime: patternStart,
-				Duration:  patternEnd.Sub(patternStart),
-				Metric:    []string{is.Metric},
-			})
-		}
-
-		// Trochee pattern: accent → non-accent transition
-		if prev.IsAccent && !curr.IsAccent {
-			slog.Debug("TROCHEE_DETECTED",
-				slog.String("metric", is.Metric),
-				slog.String("transition", fmt.Sprintf("%v->%v", prev.IsAccent, curr.IsAccent)))
-
-			accentDur := curr.Timestamp.Sub(prev.Timestamp)
-			nonAccentDur := next.Timestamp.Sub(curr.Timestamp)
-
-			patternStart := prev.Timestamp.Add(time.Duration(float64(accentDur) * config.TrocheeStartPeriod))
-			patternEnd := curr.Timestamp.Add(time.Duration(float64(nonAccentDur) * config.TrocheeEndPeriod))
+				slog.String("pattern", analyzer.PatternName()))
 
-			pulses = append(pulses, Mt.PulseEvent{
-				Dimension: 1,
-				Pattern:   Mt.Trochee,
-				StartTime: patternStart,
-				Duration:  patternEnd.Sub(patternStart),
-				Metric:    []string{is.Metric},
-			})
+			foot.Dimension = 1
+			foot.Metric = []string{is.Metric}
+			pulses = append(pulses, foot)
 		}
 	}
+	sort.SliceStable(pulses, func(i, j int) bool {
+		return pulses[i].StartTime.Before(pulses[j].StartTime)
+	})
 
 	// Track we've processed this sequence
 	is.LastProcessedEventCount = lastProcessedCount
@@ -184,24 +159,31 @@ func (ps *PulseSequence) DetectConsortPulses(detectedKeys map[string]bool) []Mt.
 	// Track what we've already detected to prevent duplicates
 	detected := make(map[string]bool)
 
-	for i := 0; i < len(ps.Events)-2; i++ {
-		first := ps.Events[i]
-		second := ps.Events[i+1]
-		third := ps.Events[i+2]
+	// Each event's place in the sequence, by its start time
+	index := make(map[int64]int, len(ps.Events))
+	for i, e := range ps.Events {
+		index[e.StartTime.UnixNano()] = i
+	}
+
+	beats := PulseBeats(ps.Events)
+	for _, analyzer := range consortAnalyzers {
+		feet, _ := analyzer.DetectPatterns(beats)
+		for _, foot := range feet {
+			first := ps.Events[index[foot.Children[0].UnixNano()]]
+			second := ps.Events[index[foot.Children[1].UnixNano()]]
+			third := ps.Events[index[foot.Children[2].UnixNano()]]
 
-		// Detect Amphibrach: Iamb → Trochee → Iamb
-		// (non-accent→accent) → (accent→non-accent) → (non-accent→accent)
-		if first.Pattern == Mt.Iamb && second.Pattern == Mt.Trochee && third.Pattern == Mt.Iamb {
 			key := fmt.Sprintf("%d_%d_%d",
 				first.StartTime.UnixNano(),
 				second.StartTime.UnixNano(),
 				third.StartTime.UnixNano())
 
-			slog.Debug("AMPHIBRACH_DETECTED",
+			slog.Debug("CONSORT_DETECTED",
+				slog.String("pattern", analyzer.PatternName()),
 				slog.String("key", key),
 				slog.Bool("already_detected", detected[key]))
 
-			if detectedKeys[key] {
+			if detectedKeys[key] || detected[key] {
 				continue
 			}
 			detected[key] = true
@@ -209,35 +191,101 @@ func (ps *PulseSequence) DetectConsortPulses(detectedKeys map[string]bool) []Mt.
 			slog.Debug("PULSE_TIMESTAMPS",
 				slog.String("first_time", first.StartTime.Format("15:04:05.000")),
 				slog.String("second_time", second.StartTime.Format("15:04:05.000")),
-				slog.String("third_time", third.StartTime.Format("15:04:05.000")),
-				slog.String("now", time.Now().Format("15:04:05.000")))
-
-			newD2Pulse := Mt.PulseEvent{
-				Dimension: 2,
-				Pattern:   Mt.Amphibrach,
-				StartTime: first.StartTime,
-				Duration:  third.StartTime.Add(third.Duration).Sub(first.StartTime),
-				Metric:    first.Metric,
-				Children:  []time.Time{first.StartTime, second.StartTime, third.StartTime},
-			}
+				slog.String("third_time", third.StartTime.Format("15:04:05.000")))
+
+			// The sequence is endpoint-wide, so the three pulses can be on different metrics:
+			// an Anapest or Dactyl needs two in a row that a single metric can't make
+			foot.Dimension = 2
+			foot.Metric = pulseMetrics(first, second, third)
+			foot.Endpoint = first.Endpoint
 
 			// Update this pulse as the parent for its Children
-			first.Parent = newD2Pulse.StartTime
-			second.Parent = newD2Pulse.StartTime
-			third.Parent = newD2Pulse.StartTime
+			for _, child := range foot.Children {
+				ps.Events[index[child.UnixNano()]].Parent = foot.StartTime
+			}
 
 			// Add the pulse to the consort
-			consort = append(consort, newD2Pulse)
+			consort = append(consort, foot)
+
+			slog.Debug("NEW CONSORT PATTERN", slog.Any("event", foot))
+		}
+	}
+
+	// In the order they happen
+	sort.SliceStable(consort, func(i, j int) bool {
+		return consort[i].StartTime.Before(consort[j].StartTime)
+	})
 
-			slog.Debug("NEW CONSORT PATTERN", slog.Any("event", newD2Pulse))
+	return consort
+}
+
+// consortAnalyzers are the built-in D2 feet, each made of three D1 pulses
+var consortAnalyzers = []Mp.PatternAnalyzer{
+	Mp.NewTernaryFootAnalyzer(Mt.Amphibrach), // (non-accent→accent) → (accent→non-accent) → (non-accent→accent)
+	Mp.NewTernaryFootAnalyzer(Mt.Anapest),    // (non-accent→accent) → (non-accent→accent) → (accent→non-accent)
+	Mp.NewTernaryFootAnalyzer(Mt.Dactyl),     // (accent→non-accent) → (non-accent→accent) → (non-accent→accent)
+}
+
+// PulseBeats turns pulses into the sequence a PatternAnalyzer reads
+// in the dimension above them: each pulse is one place,
+// accented when the pulse starts on an accent
+func PulseBeats(pulses []Mt.PulseEvent) []Mt.Ictus {
+	beats := make([]Mt.Ictus, len(pulses))
+	for i, p := range pulses {
+		beats[i] = Mt.Ictus{
+			IsAccent:  p.Pattern.StartsOnAccent(),
+			Timestamp: p.StartTime,
+			Duration:  p.Duration,
+		}
+	}
+	return beats
+}
+
+// DetectPeriodPulses takes D2 or higher pulses in a PulseSequence
+// and joins every three in a row into a Period one dimension up.
+// Which feet make up the Period is kept in its PulseTree.
+func (ps *PulseSequence) DetectPeriodPulses() []Mt.PulseEvent {
+	var periods []Mt.PulseEvent
+	if ps == nil {
+		return periods
+	}
+
+	for i := 0; i+2 < len(ps.Events); i += 3 {
+		first := ps.Events[i]
+		second := ps.Events[i+1]
+		third := ps.Events[i+2]
+
+		period := Mt.PulseEvent{
+			Dimension: first.Dimension + 1,
+			Pattern:   Mt.Period,
+			StartTime: first.StartTime,
+			Duration:  third.StartTime.Add(third.Duration).Sub(first.StartTime),
+			Metric:    pulseMetrics(first, second, third),
+			Endpoint:  first.Endpoint,
+			Children:  []time.Time{first.StartTime, second.StartTime, third.StartTime},
 		}
 
-		// Detect Anapest: Iamb → Iamb → Trochee
+		slog.Debug("PERIOD_DETECTED",
+			slog.Int("dimension", period.Dimension),
+			slog.String("feet", fmt.Sprintf("%v->%v->%v", first.Pattern, second.Pattern, third.Pattern)))
 
-		// Detect Dactyl: Trochee → Iamb → Iamb
+		periods = append(periods, period)
 	}
 
-	return consort
+	return periods
+}
+
+// pulseMetrics are the metrics of the pulses in the order they first appear
+func pulseMetrics(pulses ...Mt.PulseEvent) []string {
+	var metrics []string
+	for _, p := range pulses {
+		for _, m := range p.Metric {
+			if !slices.Contains(metrics, m) {
+				metrics = append(metrics, m)
+			}
+		}
+	}
+	return metrics
 }
 
 // TemporalGrouper is a window for collecting pulses in time
@@ -246,16 +294,28 @@ func (ps *PulseSequence) DetectConsortPulses(detectedKeys map[string]bool) []Mt.
 type TemporalGrouper struct {
 	WindowSize    time.Duration
 	Buffer        []Mt.PulseEvent
-	Groups        []*Mt.PulseTree
+	Groups        []*Mt.PulseTree // D2 and higher, each with the trees of its constituents
 	PulseSequence *PulseSequence
+	Sequences     map[int]*PulseSequence  // D2 and higher pulses waiting to form a Period
+	MaxDimension  int                     // highest dimension detected, 2 when zero
+	Analyzers     []Mp.PatternAnalyzer    // user-defined patterns of D2 and up
+	History       map[int][]Mt.PulseEvent // recent pulses by dimension, read by the Analyzers
+	LastCustom    map[string]time.Time    // start of the last pulse of each user-defined pattern
 	PendingPulses []Mt.PulseEvent
 	DetectedKeys  map[string]bool
+	Clock         Clock // wall clock when nil
+
+	detected []Mt.PulseEvent // pulses AddPulse returns
 }
 
 // AddPulse performs data routing for the pulse depending on its attributes.
 // Pulses are grouped into the minimum number to perform pattern recognition: 3
 // This group is processed in real time, results written to the endpoint's grouper.
-func (tg *TemporalGrouper) AddPulse(pulse Mt.PulseEvent) {
+// It returns the pulses detected from this one (consorts, Periods, and user-defined
+// patterns), and the buffered pulses they made children, which now have a Parent.
+func (tg *TemporalGrouper) AddPulse(pulse Mt.PulseEvent) []Mt.PulseEvent {
+	tg.detected = nil
+
 	// Add to current buffer
 	tg.Buffer = append(tg.Buffer, pulse)
 
@@ -266,8 +326,12 @@ func (tg *TemporalGrouper) AddPulse(pulse Mt.PulseEvent) {
 		}
 	}
 
-	// Only add D1 pulses to the sequence for D2 pattern detection
-	if pulse.Dimension == 1 {
+	// User-defined patterns can be made of any pulse
+	tg.detectCustom(pulse)
+
+	// Only add D1 pulses to the sequence for D2 pattern detection,
+	// built-in feet are only made of built-in feet
+	if pulse.Dimension == 1 && pulse.Pattern != Mt.Custom {
 		tg.PulseSequence.Events = append(tg.PulseSequence.Events, pulse)
 		tg.PulseSequence.EndTime = pulse.StartTime
 
@@ -294,7 +358,7 @@ func (tg *TemporalGrouper) AddPulse(pulse Mt.PulseEvent) {
 
 			consortPulses := tempSeq.DetectConsortPulses(tg.DetectedKeys)
 			for _, consortPulse := range consortPulses {
-				tg.PendingPulses = append(tg.PendingPulses, consortPulse)
+				tg.adopt(consortPulse)
 				slog.Debug("Adding consort")
 			}
 
@@ -313,19 +377,25 @@ func (tg *TemporalGrouper) AddPulse(pulse Mt.PulseEvent) {
 			tg.PulseSequence.Events = []Mt.PulseEvent{} // Clear the sequence
 			slog.Debug("SEQUENCE_AFTER_WINDOW", slog.Any("events", tg.PulseSequence.Events))
 		}
+	} else {
+		tg.sequencePeriod(pulse)
 	}
 
-	// Process any queued D2 pulses
+	// Process any queued D2 and higher pulses,
+	// each of which can complete a Period in the next dimension
 	for len(tg.PendingPulses) > 0 {
 		pending := tg.PendingPulses[0]
 		tg.PendingPulses = tg.PendingPulses[1:]
 		tg.Buffer = append(tg.Buffer, pending)
 
-		// LOG: When amphibrach is processed from pending
-		if pending.Dimension == 2 {
-			slog.Debug("AMPHIBRACH_PENDING_PROCESSED",
-				slog.Float64("age_seconds", time.Since(pending.StartTime).Seconds()))
-		}
+		// LOG: When a consort is processed from pending
+		slog.Debug("CONSORT_PENDING_PROCESSED",
+			slog.Int("dimension", pending.Dimension),
+			slog.Int("pattern", int(pending.Pattern)),
+			slog.Float64("age_seconds", clockNow(tg.Clock).Sub(pending.StartTime).Seconds()))
+
+		tg.detectCustom(pending)
+		tg.sequencePeriod(pending)
 	}
 
 	// Remove pulses outside the window
@@ -333,24 +403,82 @@ func (tg *TemporalGrouper) AddPulse(pulse Mt.PulseEvent) {
 	// and the following is a memory management window
 	// This number directly affects how long pulses can be displayed
 	removalWindow := 600 * time.Second
-	limiter := time.Now().Add(-removalWindow)
+	limiter := clockNow(tg.Clock).Add(-removalWindow)
 
 	tg.TrimBuffer(limiter)
 
-	// LOG: After trimming
-	amphibrachCountAfter := 0
-	for _, p := range tg.Buffer {
-		if p.Dimension == 2 {
-			amphibrachCountAfter++
-		}
+	detected := tg.detected
+	tg.detected = nil
+	return detected
+}
+
+// sequencePeriod adds a D2 or higher pulse to the sequence of its dimension.
+// Every three make a Period one dimension up, until MaxDimension.
+func (tg *TemporalGrouper) sequencePeriod(pulse Mt.PulseEvent) {
+	if pulse.Dimension < 2 || pulse.Dimension >= tg.maxDimension() || pulse.Pattern == Mt.Custom {
+		return
+	}
+
+	if tg.Sequences == nil {
+		tg.Sequences = make(map[int]*PulseSequence)
+	}
+	ps := tg.Sequences[pulse.Dimension]
+	if ps == nil {
+		ps = &PulseSequence{}
+		tg.Sequences[pulse.Dimension] = ps
+	}
+	ps.Events = append(ps.Events, pulse)
+	ps.EndTime = pulse.StartTime
+
+	if len(ps.Events) < 3 {
+		return
+	}
+
+	sort.Slice(ps.Events, func(i, j int) bool {
+		return ps.Events[i].StartTime.Before(ps.Events[j].StartTime)
+	})
+	for _, period := range ps.DetectPeriodPulses() {
+		tg.adopt(period)
+	}
+	ps.Events = []Mt.PulseEvent{}
+}
+
+// maxDimension is the highest dimension the grouper detects
+func (tg *TemporalGrouper) maxDimension() int {
+	if tg.MaxDimension < 2 {
+		return 2
 	}
+	return tg.MaxDimension
+}
 
-	// Check if buffer has minimum pulses to form a group
-	if len(tg.Buffer) >= 3 {
-		// group := tg.createGroup()
-		// tg.Groups = append(tg.Groups, group)
-		tg.createGroupsByDimension()
+// adopt links a newly detected pulse to its constituents,
+// grows its PulseTree, and queues it for the buffer and the output
+func (tg *TemporalGrouper) adopt(parent Mt.PulseEvent) {
+	children := tg.linkChildren(parent)
+	if group := tg.CreateGroupForPulses(children, parent.Dimension); group != nil {
+		tg.Groups = append(tg.Groups, group)
 	}
+	tg.PendingPulses = append(tg.PendingPulses, parent)
+	tg.detected = append(tg.detected, parent)
+}
+
+// linkChildren sets the Parent of the buffered pulses
+// that make up a higher dimension pulse, and returns them.
+// A pulse keeps the first Parent it is given.
+func (tg *TemporalGrouper) linkChildren(parent Mt.PulseEvent) []Mt.PulseEvent {
+	var children []Mt.PulseEvent
+	for _, child := range parent.Children {
+		for i := range tg.Buffer {
+			if tg.Buffer[i].Dimension == parent.Dimension-1 && tg.Buffer[i].StartTime.Equal(child) {
+				if tg.Buffer[i].Parent.IsZero() {
+					tg.Buffer[i].Parent = parent.StartTime
+					tg.detected = append(tg.detected, tg.Buffer[i])
+				}
+				children = append(children, tg.Buffer[i])
+			}
+		}
+	}
+	return children
 }
 
 func (tg *TemporalGrouper) ProcessPendingPulses() {
@@ -364,24 +492,9 @@ func (tg *TemporalGrouper) ProcessPendingPulses() {
 	}
 }
 
-func (tg *TemporalGrouper) createGroupsByDimension() {
-	// Group pulses by dimension
-	dimensionMap := make(map[int][]Mt.PulseEvent)
-	for _, pulse := range tg.Buffer {
-		dimensionMap[pulse.Dimension] = append(dimensionMap[pulse.Dimension], pulse)
-	}
-
-	// Create a group for each dimension that has enough pulses
-	for dimension, pulses := range dimensionMap {
-		if len(pulses) >= 3 {
-			group := tg.CreateGroupForPulses(pulses, dimension)
-			if group != nil {
-				tg.Groups = append(tg.Groups, group)
-			}
-		}
-	}
-}
-
+// CreateGroupForPulses builds the PulseTree for a pulse of the given dimension
+// from its constituent pulses. Constituents that are consorts or periods
+// bring their own trees as Children, D1 constituents become leaves.
 func (tg *TemporalGrouper) CreateGroupForPulses(pulses []Mt.PulseEvent, dimension int) *Mt.PulseTree {
 	if len(pulses) == 0 {
 		return nil
@@ -392,13 +505,40 @@ func (tg *TemporalGrouper) CreateGroupForPulses(pulses []Mt.PulseEvent, dimensio
 		patterns[i] = p.Pattern
 	}
 
+	children := make([]*Mt.PulseTree, len(pulses))
+	for i, p := range pulses {
+		children[i] = tg.findGroup(p)
+	}
+
+	last := pulses[len(pulses)-1]
 	return &Mt.PulseTree{
 		Dimension: dimension,
 		Pulses:    patterns,
+		OGEvents:  pulses,
 		StartTime: pulses[0].StartTime,
-		Duration:  pulses[len(pulses)-1].StartTime.Sub(pulses[0].StartTime),
+		Duration:  last.StartTime.Add(last.Duration).Sub(pulses[0].StartTime),
+		Frequency: 1,
+		Children:  children,
+	}
+}
+
+// findGroup returns the PulseTree grown for a pulse,
+// or a leaf for a pulse that has none
+func (tg *TemporalGrouper) findGroup(pulse Mt.PulseEvent) *Mt.PulseTree {
+	for i := len(tg.Groups) - 1; i >= 0; i-- {
+		g := tg.Groups[i]
+		if g.Dimension == pulse.Dimension && g.StartTime.Equal(pulse.StartTime) {
+			return g
+		}
+	}
+
+	return &Mt.PulseTree{
+		Dimension: pulse.Dimension,
+		Pulses:    []Mt.PulsePattern{pulse.Pattern},
+		OGEvents:  []Mt.PulseEvent{pulse},
+		StartTime: pulse.StartTime,
+		Duration:  pulse.Duration,
 		Frequency: 1,
-		Children:  nil,
 	}
 }
 
@@ -456,4 +596,28 @@ func (tg *TemporalGrouper) TrimBuffer(limit time.Time) {
 			tg.PulseSequence.Events = tg.PulseSequence.Events[:0]
 		}
 	}
+
+	// Forget pulses the user-defined patterns can no longer read
+	for d, history := range tg.History {
+		kept := 0
+		for _, pulse := range history {
+			if pulse.StartTime.After(limit) {
+				history[kept] = pulse
+				kept++
+			}
+		}
+		tg.History[d] = history[:kept]
+	}
+
+	// Drop higher dimension pulses that can no longer form a Period
+	for _, ps := range tg.Sequences {
+		kept := 0
+		for _, pulse := range ps.Events {
+			if pulse.StartTime.After(limit) {
+				ps.Events[kept] = pulse
+				kept++
+			}
+		}
+		ps.Events = ps.Events[:kept]
+	}
 }
@@ -3,6 +3,7 @@ package monteverdi_test
 import (
 	"fmt"
 	"reflect"
+	"slices"
 	"testing"
 	"time"
 
@@ -420,6 +421,296 @@ func TestTemporalGrouper_HierarchyDetection(t *testing.T) {
 	})
 }
 
+func TestTemporalGrouper_TernaryFeet(t *testing.T) {
+	now := time.Now()
+	testMetric := "CPU1"
+
+	feet := []struct {
+		name     string
+		pattern  Mt.PulsePattern
+		sequence []Mt.PulsePattern
+	}{
+		{"Amphibrach", Mt.Amphibrach, []Mt.PulsePattern{Mt.Iamb, Mt.Trochee, Mt.Iamb}},
+		{"Anapest", Mt.Anapest, []Mt.PulsePattern{Mt.Iamb, Mt.Iamb, Mt.Trochee}},
+		{"Dactyl", Mt.Dactyl, []Mt.PulsePattern{Mt.Trochee, Mt.Iamb, Mt.Iamb}},
+	}
+
+	for _, foot := range feet {
+		t.Run("Detects "+foot.name, func(t *testing.T) {
+			tg := &Ms.TemporalGrouper{
+				WindowSize: 60 * time.Second,
+				Buffer:     make([]Mt.PulseEvent, 0),
+				Groups:     make([]*Mt.PulseTree, 0),
+			}
+
+			for i, pattern := range foot.sequence {
+				tg.AddPulse(Mt.PulseEvent{
+					Dimension: 1,
+					Pattern:   pattern,
+					StartTime: now.Add(time.Duration(i*5) * time.Second),
+					Duration:  4 * time.Second,
+					Metric:    []string{testMetric},
+				})
+			}
+
+			var d2 []Mt.PulseEvent
+			for _, pulse := range tg.Buffer {
+				if pulse.Dimension == 2 {
+					d2 = append(d2, pulse)
+				}
+			}
+			if len(d2) != 1 {
+				t.Fatalf("Expected 1 D2 pulse, got %d", len(d2))
+			}
+			if d2[0].Pattern != foot.pattern {
+				t.Errorf("Expected %v, got %v", foot.pattern, d2[0].Pattern)
+			}
+			assertInt(t, len(d2[0].Children), 3)
+			if d2[0].Duration != 14*time.Second {
+				t.Errorf("Expected a duration of 14s, got %v", d2[0].Duration)
+			}
+
+			// Every D1 pulse points back to the consort
+			for _, pulse := range tg.Buffer {
+				if pulse.Dimension == 1 && !pulse.Parent.Equal(d2[0].StartTime) {
+					t.Errorf("Expected parent %v, got %v", d2[0].StartTime, pulse.Parent)
+				}
+			}
+
+			buffered := Ms.PulseEvents(tg.Buffer)
+			children := buffered.FindChildren(d2[0].StartTime)
+			assertInt(t, len(children), 3)
+		})
+	}
+
+	t.Run("Ignores triplets that are not a foot", func(t *testing.T) {
+		for _, sequence := range [][]Mt.PulsePattern{
+			{Mt.Trochee, Mt.Iamb, Mt.Trochee},
+			{Mt.Iamb, Mt.Iamb, Mt.Iamb},
+			{Mt.Trochee, Mt.Trochee, Mt.Iamb},
+		} {
+			ps := &Ms.PulseSequence{Metric: testMetric}
+			for i, pattern := range sequence {
+				ps.Events = append(ps.Events, Mt.PulseEvent{
+					Dimension: 1,
+					Pattern:   pattern,
+					StartTime: now.Add(time.Duration(i) * time.Second),
+				})
+			}
+			consorts := ps.DetectConsortPulses(map[string]bool{})
+			if len(consorts) != 0 {
+				t.Errorf("Expected no consort for %v, got %v", sequence, consorts[0].Pattern)
+			}
+		}
+	})
+
+	t.Run("Finds every foot in a longer sequence", func(t *testing.T) {
+		// Iamb Iamb Trochee Iamb Iamb: anapest, then amphibrach, then dactyl
+		ps := &Ms.PulseSequence{Metric: testMetric}
+		for i, pattern := range []Mt.PulsePattern{Mt.Iamb, Mt.Iamb, Mt.Trochee, Mt.Iamb, Mt.Iamb} {
+			ps.Events = append(ps.Events, Mt.PulseEvent{
+				Dimension: 1,
+				Pattern:   pattern,
+				StartTime: now.Add(time.Duration(i) * time.Second),
+			})
+		}
+
+		consorts := ps.DetectConsortPulses(map[string]bool{})
+		assertInt(t, len(consorts), 3)
+		want := []Mt.PulsePattern{Mt.Anapest, Mt.Amphibrach, Mt.Dactyl}
+		for i, c := range consorts {
+			if c.Pattern != want[i] {
+				t.Errorf("Expected %v at %d, got %v", want[i], i, c.Pattern)
+			}
+		}
+	})
+}
+
+func TestQNet_IngestMetricTernaryFeet(t *testing.T) {
+	start := time.Date(2023, 10, 1, 14, 0, 0, 0, time.UTC)
+	qn := Ms.NewQNet(*Ms.NewEndpointsFromConfig([]Ms.ConfigFile{{
+		ID:       "DB",
+		URL:      "http://localhost:8090/db",
+		Delim:    "=",
+		Interval: 5,
+		Metrics: map[string]Ms.MetricConfig{
+			"latency": {Type: "gauge", Max: 100},
+			"errors":  {Type: "gauge", Max: 100},
+		},
+	}}))
+	clock := Ms.NewManualClock(start)
+	qn.SetClock(clock)
+
+	// One metric alternates Iamb and Trochee, two out of step make two in a row:
+	// Iamb Iamb Trochee Trochee Iamb Iamb ...
+	for i := 0; i < 24; i++ {
+		var latency, errors int64
+		if (i/2)%2 == 1 {
+			latency = 150
+		}
+		if ((i+1)/2)%2 == 1 {
+			errors = 150
+		}
+		qn.IngestMetric(0, "latency", latency, clock.Now())
+		qn.IngestMetric(0, "errors", errors, clock.Now())
+		clock.Advance(5 * time.Second)
+	}
+
+	found := make(map[Mt.PulsePattern]Mt.PulseEvent)
+	for _, p := range qn.Network[0].Pulses.Buffer {
+		if p.Dimension == 2 {
+			found[p.Pattern] = p
+		}
+	}
+
+	for _, pattern := range []Mt.PulsePattern{Mt.Anapest, Mt.Dactyl} {
+		foot, ok := found[pattern]
+		if !ok {
+			t.Fatalf("Expected a %v, got %v", pattern, found)
+		}
+		// Every metric making up the foot is kept
+		if len(foot.Metric) != 2 || !slices.Contains(foot.Metric, "latency") || !slices.Contains(foot.Metric, "errors") {
+			t.Errorf("Expected the %v on both metrics, got %v", pattern, foot.Metric)
+		}
+	}
+}
+
+func TestTemporalGrouper_Periods(t *testing.T) {
+	now := time.Now()
+	testMetric := "CPU1"
+
+	// Each Iamb→Trochee→Iamb triplet is an Amphibrach,
+	// the Trochee between triplets starts no foot
+	addFeet := func(tg *Ms.TemporalGrouper, feet int) {
+		patterns := []Mt.PulsePattern{Mt.Iamb, Mt.Trochee, Mt.Iamb}
+		for i := 0; i < feet*3; i++ {
+			tg.AddPulse(Mt.PulseEvent{
+				Dimension: 1,
+				Pattern:   patterns[i%3],
+				StartTime: now.Add(time.Duration(i*2) * time.Second),
+				Duration:  time.Second,
+				Metric:    []string{testMetric},
+			})
+		}
+	}
+
+	countDimension := func(tg *Ms.TemporalGrouper, d int) int {
+		count := 0
+		for _, pulse := range tg.Buffer {
+			if pulse.Dimension == d {
+				count++
+			}
+		}
+		return count
+	}
+
+	t.Run("Stops at D2 by default", func(t *testing.T) {
+		tg := &Ms.TemporalGrouper{}
+		addFeet(tg, 3)
+		assertInt(t, countDimension(tg, 2), 3)
+		assertInt(t, countDimension(tg, 3), 0)
+	})
+
+	t.Run("Three consorts make a D3 Period", func(t *testing.T) {
+		tg := &Ms.TemporalGrouper{MaxDimension: 3}
+		addFeet(tg, 3)
+		assertInt(t, countDimension(tg, 2), 3)
+		assertInt(t, countDimension(tg, 3), 1)
+
+		var period Mt.PulseEvent
+		for _, pulse := range tg.Buffer {
+			if pulse.Dimension == 3 {
+				period = pulse
+			}
+		}
+		if period.Pattern != Mt.Period {
+			t.Errorf("Expected a Period, got %v", period.Pattern)
+		}
+		assertInt(t, len(period.Children), 3)
+		if !period.StartTime.Equal(now) {
+			t.Errorf("Expected the Period to start with its first foot")
+		}
+		if period.Duration != 17*time.Second {
+			t.Errorf("Expected a duration of 17s, got %v", period.Duration)
+		}
+
+		// The consorts point back to the Period
+		for _, pulse := range tg.Buffer {
+			if pulse.Dimension == 2 && !pulse.Parent.Equal(period.StartTime) {
+				t.Errorf("Expected consort parent %v, got %v", period.StartTime, pulse.Parent)
+			}
+		}
+	})
+
+	t.Run("PulseTree holds the hierarchy", func(t *testing.T) {
+		tg := &Ms.TemporalGrouper{MaxDimension: 3}
+		addFeet(tg, 3)
+
+		var top *Mt.PulseTree
+		for _, g := range tg.Groups {
+			if g.Dimension == 3 {
+				top = g
+			}
+		}
+		if top == nil {
+			t.Fatal("Expected a D3 PulseTree")
+		}
+
+		assertInt(t, len(top.Children), 3)
+		for _, consort := range top.Children {
+			assertInt(t, consort.Dimension, 2)
+			assertInt(t, len(consort.Children), 3)
+			want := []Mt.PulsePattern{Mt.Iamb, Mt.Trochee, Mt.Iamb}
+			for i, leaf := range consort.Children {
+				assertInt(t, leaf.Dimension, 1)
+				if leaf.Pulses[0] != want[i] {
+					t.Errorf("Expected leaf %v, got %v", want[i], leaf.Pulses[0])
+				}
+				assertInt(t, len(leaf.Children), 0)
+			}
+		}
+		for _, p := range top.Pulses {
+			if p != Mt.Amphibrach {
+				t.Errorf("Expected the Period to be made of Amphibrachs, got %v", p)
+			}
+		}
+	})
+
+	t.Run("Periods build up to MaxDimension", func(t *testing.T) {
+		tg := &Ms.TemporalGrouper{MaxDimension: 4}
+		addFeet(tg, 9)
+		assertInt(t, countDimension(tg, 2), 9)
+		assertInt(t, countDimension(tg, 3), 3)
+		assertInt(t, countDimension(tg, 4), 1)
+		assertInt(t, countDimension(tg, 5), 0)
+
+		var top *Mt.PulseTree
+		for _, g := range tg.Groups {
+			if g.Dimension == 4 {
+				top = g
+			}
+		}
+		if top == nil {
+			t.Fatal("Expected a D4 PulseTree")
+		}
+		assertInt(t, top.Children[0].Dimension, 3)
+		assertInt(t, top.Children[0].Children[0].Dimension, 2)
+		assertInt(t, top.Children[0].Children[0].Children[0].Dimension, 1)
+	})
+
+	t.Run("Detects a Period from any three feet", func(t *testing.T) {
+		ps := &Ms.PulseSequence{Events: []Mt.PulseEvent{
+			{Dimension: 2, Pattern: Mt.Anapest, StartTime: now},
+			{Dimension: 2, Pattern: Mt.Dactyl, StartTime: now.Add(time.Second)},
+			{Dimension: 2, Pattern: Mt.Amphibrach, StartTime: now.Add(2 * time.Second)},
+			{Dimension: 2, Pattern: Mt.Dactyl, StartTime: now.Add(3 * time.Second)},
+		}}
+		periods := ps.DetectPeriodPulses()
+		assertInt(t, len(periods), 1)
+		assertInt(t, periods[0].Dimension, 3)
+	})
+}
+
 func TestTemporalGrouper_TrimBuffer(t *testing.T) {
 	t.Run("Removes all pulses when none are after limit", func(t *testing.T) {
 		tg := &Ms.TemporalGrouper{
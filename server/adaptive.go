@@ -0,0 +1,253 @@
+package monteverdi
+
+/*
+
+	Adaptive thresholds
+
+	Instead of a hand-tuned max, the accent threshold is learned
+	from the metric's own recent history:
+
+		"metrics": {
+			"latency_ms": { "adaptive": { "method": "stddev", "k": 3, "window": 120 } },
+			"queue":      { "adaptive": { "method": "percentile", "percentile": 99 } },
+			"rps":        { "adaptive": { "method": "ewma", "alpha": 0.05, "below": true } }
+		}
+
+	stddev:     accent above mean + k·σ of the window
+	percentile: accent above the percentile of the window
+	ewma:       accent above the exponentially weighted mean + k·σ
+
+	With "below" the accent is under mean - k·σ, or under the percentile.
+	No value is an accent until the warmup has been observed.
+	The threshold is learned from the values before the one being checked,
+	so a spike is compared to what came before it.
+
+*/
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Adaptive methods
+const (
+	AdaptiveStdDev     = "stddev"
+	AdaptivePercentile = "percentile"
+	AdaptiveEWMA       = "ewma"
+)
+
+// AdaptiveConfig configures a learned threshold for a metric
+type AdaptiveConfig struct {
+	Method     string  `json:"method"`               // stddev, percentile, or ewma
+	Window     int     `json:"window,omitempty"`     // values of history, default 60
+	Warmup     int     `json:"warmup,omitempty"`     // values observed before any accent, default the window
+	K          float64 `json:"k,omitempty"`          // stddev and ewma: deviations from the mean, default 3
+	Percentile float64 `json:"percentile,omitempty"` // percentile: default 95, or 5 when below
+	Alpha      float64 `json:"alpha,omitempty"`      // ewma: smoothing, default 2/(window+1)
+	Below      bool    `json:"below,omitempty"`      // accent low values instead of high ones
+}
+
+// Adaptive learns a Threshold from a rolling history of values
+type Adaptive struct {
+	Config  AdaptiveConfig `json:"config"`
+	Seen    int            `json:"seen"`  // values observed
+	Ready   bool           `json:"ready"` // warmup is over
+	History *CycBuffer     `json:"-"`     // the window of values
+	Mean    float64        `json:"-"`     // ewma: running mean
+	Var     float64        `json:"-"`     // ewma: running variance
+	current *Threshold     // learned from the values seen so far
+}
+
+// NewAdaptive validates the config and fills in its defaults
+func NewAdaptive(ac AdaptiveConfig) (*Adaptive, error) {
+	switch ac.Method {
+	case AdaptiveStdDev, AdaptivePercentile, AdaptiveEWMA:
+	default:
+		return nil, fmt.Errorf("unknown adaptive method: %q", ac.Method)
+	}
+
+	if ac.Window == 0 {
+		ac.Window = 60
+	}
+	if ac.Window < 2 {
+		return nil, fmt.Errorf("adaptive window of %d is too small", ac.Window)
+	}
+	if ac.Warmup == 0 {
+		ac.Warmup = ac.Window
+	}
+	if ac.Warmup < 2 {
+		return nil, fmt.Errorf("adaptive warmup of %d is too small", ac.Warmup)
+	}
+	if ac.K == 0 {
+		ac.K = 3
+	}
+	if ac.K < 0 {
+		return nil, errors.New("adaptive k cannot be negative")
+	}
+	if ac.Percentile == 0 {
+		ac.Percentile = 95
+		if ac.Below {
+			ac.Percentile = 5
+		}
+	}
+	if ac.Percentile <= 0 || ac.Percentile >= 100 {
+		return nil, fmt.Errorf("adaptive percentile %v is not between 0 and 100", ac.Percentile)
+	}
+	if ac.Alpha == 0 {
+		ac.Alpha = 2 / float64(ac.Window+1)
+	}
+	if ac.Alpha < 0 || ac.Alpha > 1 {
+		return nil, fmt.Errorf("adaptive alpha %v is not between 0 and 1", ac.Alpha)
+	}
+
+	return &Adaptive{
+		Config:  ac,
+		History: NewCycBuffer(ac.Window),
+		current: &Threshold{Mode: ThresholdWarmup},
+	}, nil
+}
+
+// Clone returns a new Adaptive with the same config and no history,
+// for series matched under the same metric key
+func (a *Adaptive) Clone() *Adaptive {
+	return &Adaptive{
+		Config:  a.Config,
+		History: NewCycBuffer(a.Config.Window),
+		current: &Threshold{Mode: ThresholdWarmup},
+	}
+}
+
+// Threshold is the threshold learned so far
+func (a *Adaptive) Threshold() *Threshold {
+	return a.current
+}
+
+// AdaptiveState is what an Adaptive has learned, for snapshots
+type AdaptiveState struct {
+	Seen    int        `json:"seen"`
+	Ready   bool       `json:"ready"`
+	History *CycBuffer `json:"history"`
+	Mean    float64    `json:"mean"`
+	Var     float64    `json:"var"`
+	Current *Threshold `json:"current"`
+}
+
+// State returns what has been learned so far
+func (a *Adaptive) State() AdaptiveState {
+	return AdaptiveState{
+		Seen:    a.Seen,
+		Ready:   a.Ready,
+		History: a.History,
+		Mean:    a.Mean,
+		Var:     a.Var,
+		Current: a.current,
+	}
+}
+
+// Restore picks up learning where the state left off,
+// unless its history is for a different window
+func (a *Adaptive) Restore(s AdaptiveState) {
+	if s.History == nil || s.History.MaxSize != a.Config.Window || s.Current == nil {
+		return
+	}
+	a.Seen = s.Seen
+	a.Ready = s.Ready
+	a.History = s.History
+	a.Mean = s.Mean
+	a.Var = s.Var
+	a.current = s.Current
+}
+
+// Observe adds a value to the history and learns the next threshold
+func (a *Adaptive) Observe(v int64) {
+	x := float64(v)
+	if a.Seen == 0 {
+		a.Mean = x
+	} else {
+		// Incremental exponentially weighted mean and variance
+		diff := x - a.Mean
+		incr := a.Config.Alpha * diff
+		a.Mean += incr
+		a.Var = (1 - a.Config.Alpha) * (a.Var + diff*incr)
+	}
+
+	a.History.Add(v)
+	a.Seen++
+
+	if a.Seen < a.Config.Warmup {
+		return
+	}
+	a.Ready = true
+
+	var learned float64
+	switch a.Config.Method {
+	case AdaptiveStdDev:
+		mean, sd := MeanStdDev(a.History.Recent())
+		learned = a.offset(mean, sd)
+	case AdaptivePercentile:
+		learned = Percentile(a.History.Recent(), a.Config.Percentile)
+	case AdaptiveEWMA:
+		learned = a.offset(a.Mean, math.Sqrt(a.Var))
+	}
+
+	// Strictly beyond what was learned, so a flat metric is never an accent
+	th := &Threshold{Mode: ThresholdAbove}
+	if a.Config.Below {
+		th.Mode = ThresholdBelow
+		th.Enter = int64(math.Ceil(learned)) - 1
+	} else {
+		th.Enter = int64(math.Floor(learned)) + 1
+	}
+	th.Exit = th.Enter
+	a.current = th
+}
+
+// offset is k standard deviations past the mean, in the accent's direction
+func (a *Adaptive) offset(mean, sd float64) float64 {
+	if a.Config.Below {
+		return mean - a.Config.K*sd
+	}
+	return mean + a.Config.K*sd
+}
+
+// MeanStdDev returns the mean and population standard deviation
+func MeanStdDev(values []int64) (float64, float64) {
+	if len(values) == 0 {
+		return 0, 0
+	}
+
+	var sum float64
+	for _, v := range values {
+		sum += float64(v)
+	}
+	mean := sum / float64(len(values))
+
+	var sq float64
+	for _, v := range values {
+		d := float64(v) - mean
+		sq += d * d
+	}
+
+	return mean, math.Sqrt(sq / float64(len(values)))
+}
+
+// Percentile returns the p-th percentile (0-100) of the values,
+// interpolating between the closest ranks
+func Percentile(values []int64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	sorted := make([]float64, len(values))
+	for i, v := range values {
+		sorted[i] = float64(v)
+	}
+	sort.Float64s(sorted)
+
+	rank := p / 100 * float64(len(sorted)-1)
+	lo := int(math.Floor(rank))
+	hi := int(math.Ceil(rank))
+	return sorted[lo] + (sorted[hi]-sorted[lo])*(rank-float64(lo))
+}
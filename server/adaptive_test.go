@@ -0,0 +1,155 @@
+package monteverdi_test
+
+import (
+	"math"
+	"testing"
+
+	Ms "github.com/maroda/monteverdi/server"
+)
+
+func TestNewAdaptive(t *testing.T) {
+	t.Run("Fills in defaults", func(t *testing.T) {
+		a, err := Ms.NewAdaptive(Ms.AdaptiveConfig{Method: Ms.AdaptiveStdDev})
+		assertError(t, err, nil)
+		assertInt(t, a.Config.Window, 60)
+		assertInt(t, a.Config.Warmup, 60)
+		if a.Config.K != 3 || a.Config.Percentile != 95 {
+			t.Errorf("Expected k 3 and percentile 95, got %+v", a.Config)
+		}
+		if a.Threshold().Mode != Ms.ThresholdWarmup {
+			t.Errorf("Expected to start in warmup, got %s", a.Threshold().Mode)
+		}
+	})
+
+	t.Run("Below defaults to the 5th percentile", func(t *testing.T) {
+		a, err := Ms.NewAdaptive(Ms.AdaptiveConfig{Method: Ms.AdaptivePercentile, Below: true})
+		assertError(t, err, nil)
+		if a.Config.Percentile != 5 {
+			t.Errorf("Expected percentile 5, got %v", a.Config.Percentile)
+		}
+	})
+
+	invalid := []Ms.AdaptiveConfig{
+		{Method: "median"},
+		{Method: Ms.AdaptiveStdDev, Window: 1},
+		{Method: Ms.AdaptiveStdDev, Warmup: 1},
+		{Method: Ms.AdaptiveStdDev, K: -1},
+		{Method: Ms.AdaptivePercentile, Percentile: 100},
+		{Method: Ms.AdaptiveEWMA, Alpha: 1.5},
+	}
+	for _, ac := range invalid {
+		t.Run("Rejects "+ac.Method, func(t *testing.T) {
+			_, err := Ms.NewAdaptive(ac)
+			assertGotError(t, err)
+		})
+	}
+
+	t.Run("Cannot be combined with a static threshold", func(t *testing.T) {
+		_, err := Ms.NewThreshold(Ms.MetricConfig{Adaptive: &Ms.AdaptiveConfig{Method: Ms.AdaptiveEWMA}, Band: []int64{1, 2}})
+		assertGotError(t, err)
+	})
+}
+
+func TestAdaptive_Observe(t *testing.T) {
+	// A steady metric between 95 and 105
+	steady := func(i int) int64 { return 100 + int64(i%3-1)*5 }
+
+	t.Run("Learns mean plus k sigma after the warmup", func(t *testing.T) {
+		a, _ := Ms.NewAdaptive(Ms.AdaptiveConfig{Method: Ms.AdaptiveStdDev, Window: 30, Warmup: 10, K: 2})
+		for i := 0; i < 9; i++ {
+			a.Observe(steady(i))
+			if a.Ready || a.Threshold().IsAccent(1000, false) {
+				t.Fatal("Expected no accent during warmup")
+			}
+		}
+		for i := 9; i < 30; i++ {
+			a.Observe(steady(i))
+		}
+
+		mean, sd := Ms.MeanStdDev(a.History.Recent())
+		want := int64(math.Floor(mean+2*sd)) + 1
+		if !a.Ready || a.Threshold().Enter != want {
+			t.Errorf("Expected a learned threshold of %d, got %+v", want, a.Threshold())
+		}
+		if a.Threshold().IsAccent(105, false) || !a.Threshold().IsAccent(120, false) {
+			t.Error("Expected a spike to be an accent and the steady range not")
+		}
+	})
+
+	t.Run("A flat metric is never an accent", func(t *testing.T) {
+		for _, method := range []string{Ms.AdaptiveStdDev, Ms.AdaptivePercentile, Ms.AdaptiveEWMA} {
+			a, _ := Ms.NewAdaptive(Ms.AdaptiveConfig{Method: method, Window: 10})
+			for i := 0; i < 20; i++ {
+				a.Observe(50)
+			}
+			if a.Threshold().IsAccent(50, false) {
+				t.Errorf("%s: flat value is an accent with %+v", method, a.Threshold())
+			}
+		}
+	})
+
+	t.Run("Percentile follows the window", func(t *testing.T) {
+		a, _ := Ms.NewAdaptive(Ms.AdaptiveConfig{Method: Ms.AdaptivePercentile, Window: 101, Percentile: 90})
+		for i := 0; i <= 100; i++ {
+			a.Observe(int64(i))
+		}
+		assertInt64(t, a.Threshold().Enter, 91)
+	})
+
+	t.Run("EWMA below accents drops", func(t *testing.T) {
+		a, _ := Ms.NewAdaptive(Ms.AdaptiveConfig{Method: Ms.AdaptiveEWMA, Window: 20, Below: true})
+		for i := 0; i < 40; i++ {
+			a.Observe(steady(i))
+		}
+		th := a.Threshold()
+		if th.Mode != Ms.ThresholdBelow || th.IsAccent(95, false) || !th.IsAccent(20, false) {
+			t.Errorf("Expected a drop to be an accent, got %+v", th)
+		}
+	})
+}
+
+func TestPercentile(t *testing.T) {
+	values := []int64{40, 10, 30, 20}
+	if got := Ms.Percentile(values, 50); got != 25 {
+		t.Errorf("Expected 25, got %v", got)
+	}
+	if got := Ms.Percentile(values, 100-1e-9); math.Round(got) != 40 {
+		t.Errorf("Expected 40, got %v", got)
+	}
+	if got := Ms.Percentile(nil, 50); got != 0 {
+		t.Errorf("Expected 0, got %v", got)
+	}
+}
+
+func TestQNet_FindAccentAdaptive(t *testing.T) {
+	eps := Ms.NewEndpointsFromConfig([]Ms.ConfigFile{{
+		ID:    "LEARN",
+		URL:   "http://localhost:8090/metrics",
+		Delim: "=",
+		Metrics: map[string]Ms.MetricConfig{
+			"LATENCY": {Type: "gauge", Adaptive: &Ms.AdaptiveConfig{Method: Ms.AdaptiveStdDev, Window: 20}},
+		},
+	}})
+	qn := Ms.NewQNet(*eps)
+	ep := qn.Network[0]
+
+	for i := 0; i < 20; i++ {
+		qn.IngestMetric(0, "LATENCY", 100+int64(i%2), ep.Now())
+		if ep.InAccent("LATENCY") {
+			t.Fatalf("Expected no accent while learning, at %d", i)
+		}
+	}
+
+	t.Run("A spike after the warmup is an accent", func(t *testing.T) {
+		qn.IngestMetric(0, "LATENCY", 500, ep.Now())
+		if !ep.InAccent("LATENCY") {
+			t.Errorf("Expected an accent, threshold %+v", ep.Threshold("LATENCY"))
+		}
+	})
+
+	t.Run("The spike raises the learned threshold", func(t *testing.T) {
+		if ep.Threshold("LATENCY").Enter <= 102 {
+			t.Errorf("Expected a higher threshold, got %+v", ep.Threshold("LATENCY"))
+		}
+	})
+}
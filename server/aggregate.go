@@ -0,0 +1,129 @@
+package monteverdi
+
+/*
+
+	Label aggregation
+
+	A selector can match one series per pod, status code or route.
+	An Aggregation reduces those series before they reach the Endpoint,
+	either to a single gauge or to one gauge per group of labels:
+
+		"metrics": {
+			"http_requests_total": { "aggregate": "sum", "by": ["code"], "max": 100 }
+		}
+
+	This mirrors PromQL's `sum by (code) (http_requests_total)`,
+	so that a pod restart with a new label value does not need a config change.
+
+*/
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Aggregation operators
+const (
+	AggSum   = "sum"
+	AggMax   = "max"
+	AggMin   = "min"
+	AggAvg   = "avg"
+	AggCount = "count"
+)
+
+// Aggregation reduces many series into one per label group
+type Aggregation struct {
+	Op      string   // one of sum, max, min, avg, count
+	By      []string // keep only these labels in the group
+	Without []string // drop these labels from the group
+}
+
+// NewAggregation validates the configured operator and grouping
+func NewAggregation(op string, by, without []string) (*Aggregation, error) {
+	switch op {
+	case AggSum, AggMax, AggMin, AggAvg, AggCount:
+	default:
+		return nil, fmt.Errorf("unknown aggregation: %q", op)
+	}
+
+	if len(by) > 0 && len(without) > 0 {
+		return nil, errors.New("aggregation cannot use both by and without")
+	}
+
+	return &Aggregation{Op: op, By: by, Without: without}, nil
+}
+
+// GroupLabels returns the labels that identify the group for a series
+func (a *Aggregation) GroupLabels(labels map[string]string) map[string]string {
+	group := make(map[string]string)
+
+	switch {
+	case len(a.By) > 0:
+		for _, l := range a.By {
+			if v, ok := labels[l]; ok && v != "" {
+				group[l] = v
+			}
+		}
+	case len(a.Without) > 0:
+		for l, v := range labels {
+			group[l] = v
+		}
+		for _, l := range a.Without {
+			delete(group, l)
+		}
+	}
+
+	return group
+}
+
+// Apply aggregates the samples, returning values by metric ID.
+// The ID is the config key, with the group labels when grouping:
+//
+//	http_requests_total{code="500"}
+//
+// NaN samples are left out, they would poison every operator.
+func (a *Aggregation) Apply(key string, samples []PromSample) map[string]float64 {
+	type acc struct {
+		value float64
+		count int
+	}
+	groups := make(map[string]*acc)
+
+	for _, s := range samples {
+		if math.IsNaN(s.Value) {
+			continue
+		}
+
+		id := PromSeriesID(key, a.GroupLabels(s.Labels))
+		g, ok := groups[id]
+		if !ok {
+			groups[id] = &acc{value: s.Value, count: 1}
+			continue
+		}
+
+		g.count++
+		switch a.Op {
+		case AggSum, AggAvg:
+			g.value += s.Value
+		case AggMax:
+			g.value = math.Max(g.value, s.Value)
+		case AggMin:
+			g.value = math.Min(g.value, s.Value)
+		}
+	}
+
+	result := make(map[string]float64, len(groups))
+	for id, g := range groups {
+		switch a.Op {
+		case AggAvg:
+			result[id] = g.value / float64(g.count)
+		case AggCount:
+			result[id] = float64(g.count)
+		default:
+			result[id] = g.value
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,140 @@
+package monteverdi_test
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	Ms "github.com/maroda/monteverdi/server"
+)
+
+const aggBody = `# TYPE http_requests_total counter
+http_requests_total{pod="api-1",code="200"} 100
+http_requests_total{pod="api-2",code="200"} 50
+http_requests_total{pod="api-1",code="500"} 4
+http_requests_total{pod="api-2",code="500"} 8
+http_requests_total{pod="api-3",code="500"} NaN
+`
+
+func TestNewAggregation(t *testing.T) {
+	t.Run("Accepts known operators", func(t *testing.T) {
+		for _, op := range []string{"sum", "max", "min", "avg", "count"} {
+			_, err := Ms.NewAggregation(op, nil, nil)
+			assertError(t, err, nil)
+		}
+	})
+
+	t.Run("Errors on unknown operator", func(t *testing.T) {
+		_, err := Ms.NewAggregation("median", nil, nil)
+		assertGotError(t, err)
+	})
+
+	t.Run("Errors on both by and without", func(t *testing.T) {
+		_, err := Ms.NewAggregation("sum", []string{"code"}, []string{"pod"})
+		assertGotError(t, err)
+	})
+}
+
+func TestAggregation_Apply(t *testing.T) {
+	samples := []Ms.PromSample{
+		{Name: "m", Labels: map[string]string{"pod": "a", "code": "200"}, Value: 10},
+		{Name: "m", Labels: map[string]string{"pod": "b", "code": "200"}, Value: 30},
+		{Name: "m", Labels: map[string]string{"pod": "a", "code": "500"}, Value: 2},
+		{Name: "m", Labels: map[string]string{"pod": "b", "code": "500"}, Value: math.NaN()},
+	}
+
+	tests := []struct {
+		name    string
+		op      string
+		by      []string
+		without []string
+		want    map[string]float64
+	}{
+		{"sum all", "sum", nil, nil, map[string]float64{"m": 42}},
+		{"max all", "max", nil, nil, map[string]float64{"m": 30}},
+		{"min all", "min", nil, nil, map[string]float64{"m": 2}},
+		{"avg all", "avg", nil, nil, map[string]float64{"m": 14}},
+		{"count all", "count", nil, nil, map[string]float64{"m": 3}},
+		{"sum by code", "sum", []string{"code"}, nil, map[string]float64{
+			`m{code="200"}`: 40,
+			`m{code="500"}`: 2,
+		}},
+		{"max without pod", "max", nil, []string{"pod"}, map[string]float64{
+			`m{code="200"}`: 30,
+			`m{code="500"}`: 2,
+		}},
+		{"count by missing label", "count", []string{"zone"}, nil, map[string]float64{"m": 3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agg, err := Ms.NewAggregation(tt.op, tt.by, tt.without)
+			assertError(t, err, nil)
+
+			got := agg.Apply("m", samples)
+			assertInt(t, len(got), len(tt.want))
+			for id, want := range tt.want {
+				if got[id] != want {
+					t.Errorf("%s: got %f, want %f", id, got[id], want)
+				}
+			}
+		})
+	}
+}
+
+func TestQNet_PollPrometheusAggregate(t *testing.T) {
+	mockWWW := makeMockWebServBody(0*time.Millisecond, aggBody)
+	defer mockWWW.Close()
+
+	config := []Ms.ConfigFile{{
+		ID:       "AGG",
+		URL:      mockWWW.URL,
+		Format:   "prometheus",
+		Interval: 1,
+		Metrics: map[string]Ms.MetricConfig{
+			"requests": {
+				Type:      "gauge",
+				Max:       100,
+				Selector:  "http_requests_total",
+				Aggregate: "sum",
+				By:        []string{"code"},
+			},
+			"http_requests_total": {Type: "gauge", Max: 10, Aggregate: "count"},
+			"bad_agg":             {Type: "gauge", Max: 10, Aggregate: "median"},
+		},
+	}}
+	eps := Ms.NewEndpointsFromConfig(config)
+	qn := Ms.NewQNet(*eps)
+	qn.PollEndpoint(0)
+	ep := qn.Network[0]
+
+	t.Run("Groups become metrics", func(t *testing.T) {
+		assertInt64(t, ep.Mdata[`requests{code="200"}`], 150)
+		assertInt64(t, ep.Mdata[`requests{code="500"}`], 12)
+		assertInt64(t, ep.Maxval[`requests{code="500"}`], 100)
+		assertString(t, ep.Series[`requests{code="200"}`], "requests")
+	})
+
+	t.Run("Ungrouped aggregation keeps the config key", func(t *testing.T) {
+		assertInt64(t, ep.Mdata["http_requests_total"], 4)
+	})
+
+	t.Run("Invalid aggregation is ignored", func(t *testing.T) {
+		if _, ok := ep.Aggregations["bad_agg"]; ok {
+			t.Errorf("Invalid aggregation should not be configured")
+		}
+	})
+
+	t.Run("Individual series are not recorded", func(t *testing.T) {
+		if _, ok := ep.Mdata[`http_requests_total{code="200",pod="api-1"}`]; ok {
+			t.Errorf("Aggregated series should not be recorded on their own")
+		}
+	})
+
+	t.Run("Repeat polls do not add rows", func(t *testing.T) {
+		rows := len(ep.Metric)
+		qn.PollEndpoint(0)
+		assertInt(t, len(ep.Metric), rows)
+		assertInt(t, rows, 4)
+	})
+}
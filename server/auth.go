@@ -0,0 +1,327 @@
+package monteverdi
+
+/*
+
+	Endpoint Authentication
+
+	Each Endpoint with an "auth" stanza gets its own http.Client:
+
+		"auth": {
+			"bearer_token_file": "/var/run/secrets/token",
+			"headers": {"X-Scope-OrgID": "ops"},
+			"cert_file": "/etc/monteverdi/client.crt",
+			"key_file": "/etc/monteverdi/client.key",
+			"ca_file": "/etc/monteverdi/ca.crt"
+		}
+
+	Tokens and passwords from files and env vars are read on every request,
+	so a rotated token is picked up without a reload.
+	Endpoints without auth share sharedHTTPClient,
+	endpoints with invalid auth are not polled at all.
+
+*/
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// RedactedSecret replaces secrets in a config that is read back
+const RedactedSecret = "REDACTED"
+
+// AuthConfig holds the credentials and TLS settings for an endpoint
+type AuthConfig struct {
+	Username           string            `json:"username,omitempty"`             // basic auth
+	Password           string            `json:"password,omitempty"`             // basic auth, literal
+	PasswordFile       string            `json:"password_file,omitempty"`        // basic auth, read from a file
+	PasswordEnv        string            `json:"password_env,omitempty"`         // basic auth, read from an env var
+	BearerTokenFile    string            `json:"bearer_token_file,omitempty"`    // Authorization: Bearer, read from a file
+	BearerTokenEnv     string            `json:"bearer_token_env,omitempty"`     // Authorization: Bearer, read from an env var
+	Headers            map[string]string `json:"headers,omitempty"`              // static headers sent with every request
+	CertFile           string            `json:"cert_file,omitempty"`            // mTLS client certificate
+	KeyFile            string            `json:"key_file,omitempty"`             // mTLS client key
+	CAFile             string            `json:"ca_file,omitempty"`              // CA bundle to verify the server
+	InsecureSkipVerify bool              `json:"insecure_skip_verify,omitempty"` // do not verify the server certificate
+}
+
+// Validate checks the settings fit together
+func (a *AuthConfig) Validate() error {
+	passwords := 0
+	for _, p := range []string{a.Password, a.PasswordFile, a.PasswordEnv} {
+		if p != "" {
+			passwords++
+		}
+	}
+	if passwords > 1 {
+		return errors.New("only one of password, password_file, and password_env can be set")
+	}
+	if passwords > 0 && a.Username == "" {
+		return errors.New("basic auth needs a username")
+	}
+	if a.BearerTokenFile != "" && a.BearerTokenEnv != "" {
+		return errors.New("only one of bearer_token_file and bearer_token_env can be set")
+	}
+	if a.Username != "" && (a.BearerTokenFile != "" || a.BearerTokenEnv != "") {
+		return errors.New("basic auth and a bearer token cannot both be set")
+	}
+	if (a.CertFile == "") != (a.KeyFile == "") {
+		return errors.New("cert_file and key_file must be set together")
+	}
+	return nil
+}
+
+// TLSConfig returns the client TLS settings, nil when there are none
+func (a *AuthConfig) TLSConfig() (*tls.Config, error) {
+	if a.CertFile == "" && a.CAFile == "" && !a.InsecureSkipVerify {
+		return nil, nil
+	}
+
+	tc := &tls.Config{InsecureSkipVerify: a.InsecureSkipVerify}
+
+	if a.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(a.CertFile, a.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %w", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+
+	if a.CAFile != "" {
+		pem, err := os.ReadFile(a.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", a.CAFile)
+		}
+		tc.RootCAs = pool
+	}
+
+	return tc, nil
+}
+
+// Redacted returns a copy safe to show, without passwords or header values
+func (a *AuthConfig) Redacted() *AuthConfig {
+	if a == nil {
+		return nil
+	}
+	r := *a
+	if r.Password != "" {
+		r.Password = RedactedSecret
+	}
+	if len(a.Headers) > 0 {
+		r.Headers = make(map[string]string, len(a.Headers))
+		for k := range a.Headers {
+			r.Headers[k] = RedactedSecret
+		}
+	}
+	return &r
+}
+
+// Unredact puts back the secrets of prev that were redacted in a,
+// so a config read from GET /conf can be posted back unchanged.
+// Secrets are only kept for the same TLS settings,
+// anything else must send them again.
+// It returns true when anything was restored.
+func (a *AuthConfig) Unredact(prev *AuthConfig) (bool, error) {
+	if !a.isRedacted() {
+		return false, nil
+	}
+	if prev == nil {
+		return false, errors.New("no previous secret to keep, it must be sent again")
+	}
+	if a.CertFile != prev.CertFile || a.KeyFile != prev.KeyFile ||
+		a.CAFile != prev.CAFile || a.InsecureSkipVerify != prev.InsecureSkipVerify {
+		return false, errors.New("TLS settings changed, secrets must be sent again")
+	}
+
+	if a.Password == RedactedSecret {
+		if prev.Password == "" {
+			return false, errors.New("no previous password to keep, it must be sent again")
+		}
+		a.Password = prev.Password
+	}
+	for k, v := range a.Headers {
+		if v != RedactedSecret {
+			continue
+		}
+		pv, ok := prev.Headers[k]
+		if !ok {
+			return false, fmt.Errorf("no previous value of header %s to keep, it must be sent again", k)
+		}
+		a.Headers[k] = pv
+	}
+	return true, nil
+}
+
+// isRedacted is true when any secret is RedactedSecret
+func (a *AuthConfig) isRedacted() bool {
+	if a == nil {
+		return false
+	}
+	if a.Password == RedactedSecret {
+		return true
+	}
+	for _, v := range a.Headers {
+		if v == RedactedSecret {
+			return true
+		}
+	}
+	return false
+}
+
+// RedactConfig returns a copy of the config with every AuthConfig redacted
+func RedactConfig(cf []ConfigFile) []ConfigFile {
+	redacted := make([]ConfigFile, len(cf))
+	for i, c := range cf {
+		c.Auth = c.Auth.Redacted()
+		redacted[i] = c
+	}
+	return redacted
+}
+
+// UnredactConfig restores secrets redacted by RedactConfig
+// from the previous config, matching endpoints by ID.
+// An endpoint whose URL or TLS settings changed does not get them back,
+// so credentials are never sent to a host they were not configured for.
+// It returns true when anything was restored.
+func UnredactConfig(cf, prev []ConfigFile) (bool, error) {
+	byID := make(map[string]ConfigFile, len(prev))
+	for _, c := range prev {
+		byID[c.ID] = c
+	}
+	restored := false
+	for i := range cf {
+		if !cf[i].Auth.isRedacted() {
+			continue
+		}
+		old, ok := byID[cf[i].ID]
+		if ok && old.URL != cf[i].URL {
+			return false, fmt.Errorf("endpoint %s: url changed, secrets must be sent again", cf[i].ID)
+		}
+		kept, err := cf[i].Auth.Unredact(old.Auth)
+		if err != nil {
+			return false, fmt.Errorf("endpoint %s: %w", cf[i].ID, err)
+		}
+		if kept {
+			restored = true
+		}
+	}
+	return restored, nil
+}
+
+// NewHTTPClient returns the client for an endpoint's auth settings,
+// the shared client when there are none
+func NewHTTPClient(a *AuthConfig) (HTTPClient, error) {
+	if a == nil {
+		return sharedHTTPClient, nil
+	}
+	if err := a.Validate(); err != nil {
+		return nil, err
+	}
+
+	tc, err := a.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	// Fail on load rather than every poll
+	if _, err := a.password(); err != nil {
+		return nil, err
+	}
+	if _, err := a.bearerToken(); err != nil {
+		return nil, err
+	}
+
+	return &http.Client{
+		Timeout: webTimeout,
+		Transport: &authTransport{
+			auth: a,
+			next: &http.Transport{
+				TLSClientConfig:     tc,
+				MaxIdleConns:        10,
+				MaxIdleConnsPerHost: 2,
+				IdleConnTimeout:     30 * time.Second,
+			},
+		},
+	}, nil
+}
+
+// refusedClient fails every request of an endpoint with invalid auth,
+// so it is never polled without its credentials or TLS settings
+type refusedClient struct {
+	err error
+}
+
+func (rc refusedClient) Get(string) (*http.Response, error) {
+	return nil, rc.err
+}
+
+// authTransport adds the endpoint's credentials to every request
+type authTransport struct {
+	auth *AuthConfig
+	next http.RoundTripper
+}
+
+func (at *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the caller's request
+	req = req.Clone(req.Context())
+
+	for k, v := range at.auth.Headers {
+		req.Header.Set(k, v)
+	}
+
+	if at.auth.Username != "" {
+		password, err := at.auth.password()
+		if err != nil {
+			return nil, err
+		}
+		req.SetBasicAuth(at.auth.Username, password)
+	}
+
+	token, err := at.auth.bearerToken()
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return at.next.RoundTrip(req)
+}
+
+// password returns the basic auth password from wherever it is configured
+func (a *AuthConfig) password() (string, error) {
+	return readSecret(a.Password, a.PasswordFile, a.PasswordEnv)
+}
+
+// bearerToken returns the token, empty when none is configured
+func (a *AuthConfig) bearerToken() (string, error) {
+	return readSecret("", a.BearerTokenFile, a.BearerTokenEnv)
+}
+
+// readSecret returns the literal, or the trimmed contents of the file or env var
+func readSecret(literal, file, env string) (string, error) {
+	switch {
+	case file != "":
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("could not read secret file: %w", err)
+		}
+		return strings.TrimSpace(string(b)), nil
+	case env != "":
+		v := strings.TrimSpace(os.Getenv(env))
+		if v == "" {
+			return "", fmt.Errorf("env var %s is not set", env)
+		}
+		return v, nil
+	}
+	return literal, nil
+}
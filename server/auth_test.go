@@ -0,0 +1,332 @@
+package monteverdi_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	Ms "github.com/maroda/monteverdi/server"
+)
+
+func TestAuthConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name  string
+		auth  Ms.AuthConfig
+		fails bool
+	}{
+		{"Basic auth", Ms.AuthConfig{Username: "ops", PasswordEnv: "PASS"}, false},
+		{"Bearer token", Ms.AuthConfig{BearerTokenFile: "/token"}, false},
+		{"Client certificate", Ms.AuthConfig{CertFile: "c.crt", KeyFile: "c.key"}, false},
+		{"Two passwords", Ms.AuthConfig{Username: "ops", Password: "a", PasswordFile: "/b"}, true},
+		{"Password without username", Ms.AuthConfig{Password: "a"}, true},
+		{"Two tokens", Ms.AuthConfig{BearerTokenFile: "/token", BearerTokenEnv: "TOKEN"}, true},
+		{"Basic and bearer", Ms.AuthConfig{Username: "ops", Password: "a", BearerTokenEnv: "TOKEN"}, true},
+		{"Cert without key", Ms.AuthConfig{CertFile: "c.crt"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.auth.Validate()
+			if tt.fails {
+				assertGotError(t, err)
+			} else {
+				assertError(t, err, nil)
+			}
+		})
+	}
+}
+
+func TestNewHTTPClient(t *testing.T) {
+	// Echo the credentials the exporter receives
+	var got http.Header
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("CPU1=99\n"))
+	}))
+	defer mockServer.Close()
+
+	t.Run("Nil auth is the shared client", func(t *testing.T) {
+		c, err := Ms.NewHTTPClient(nil)
+		assertError(t, err, nil)
+		if c == nil {
+			t.Fatal("Expected a client")
+		}
+	})
+
+	t.Run("Reads a rotated bearer token from its file", func(t *testing.T) {
+		tokenFile := filepath.Join(t.TempDir(), "token")
+		os.WriteFile(tokenFile, []byte("alef\n"), 0600)
+
+		c, err := Ms.NewHTTPClient(&Ms.AuthConfig{BearerTokenFile: tokenFile})
+		assertError(t, err, nil)
+
+		_, _, err = Ms.SingleFetchWithClient(mockServer.URL, c)
+		assertError(t, err, nil)
+		assertString(t, got.Get("Authorization"), "Bearer alef")
+
+		os.WriteFile(tokenFile, []byte("bet"), 0600)
+		_, _, err = Ms.SingleFetchWithClient(mockServer.URL, c)
+		assertError(t, err, nil)
+		assertString(t, got.Get("Authorization"), "Bearer bet")
+	})
+
+	t.Run("Reads a bearer token from an env var", func(t *testing.T) {
+		t.Setenv("MONTEVERDI_TEST_TOKEN", "gimel")
+		c, err := Ms.NewHTTPClient(&Ms.AuthConfig{BearerTokenEnv: "MONTEVERDI_TEST_TOKEN"})
+		assertError(t, err, nil)
+
+		_, _, err = Ms.SingleFetchWithClient(mockServer.URL, c)
+		assertError(t, err, nil)
+		assertString(t, got.Get("Authorization"), "Bearer gimel")
+	})
+
+	t.Run("Sends basic auth and headers", func(t *testing.T) {
+		t.Setenv("MONTEVERDI_TEST_PASSWORD", "dalet")
+		c, err := Ms.NewHTTPClient(&Ms.AuthConfig{
+			Username:    "ops",
+			PasswordEnv: "MONTEVERDI_TEST_PASSWORD",
+			Headers:     map[string]string{"X-Scope-OrgID": "tenant1"},
+		})
+		assertError(t, err, nil)
+
+		_, _, err = Ms.SingleFetchWithClient(mockServer.URL, c)
+		assertError(t, err, nil)
+		r := &http.Request{Header: got}
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "ops" || pass != "dalet" {
+			t.Errorf("Expected basic auth ops:dalet, got %s:%s", user, pass)
+		}
+		assertString(t, got.Get("X-Scope-OrgID"), "tenant1")
+	})
+
+	t.Run("Errors on a missing secret", func(t *testing.T) {
+		_, err := Ms.NewHTTPClient(&Ms.AuthConfig{BearerTokenEnv: "MONTEVERDI_TEST_UNSET"})
+		assertGotError(t, err)
+
+		_, err = Ms.NewHTTPClient(&Ms.AuthConfig{BearerTokenFile: filepath.Join(t.TempDir(), "nope")})
+		assertGotError(t, err)
+	})
+}
+
+func TestNewHTTPClient_TLS(t *testing.T) {
+	// The exporter requires a client certificate
+	mockServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("CPU1=99\n"))
+	}))
+	mockServer.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	mockServer.StartTLS()
+	defer mockServer.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.crt")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: mockServer.Certificate().Raw}), 0600)
+	certFile, keyFile := makeClientCert(t, dir)
+
+	t.Run("Presents the client certificate", func(t *testing.T) {
+		c, err := Ms.NewHTTPClient(&Ms.AuthConfig{CertFile: certFile, KeyFile: keyFile, CAFile: caFile})
+		assertError(t, err, nil)
+
+		code, body, err := Ms.SingleFetchWithClient(mockServer.URL, c)
+		assertError(t, err, nil)
+		assertStatus(t, code, http.StatusOK)
+		assertString(t, string(body), "CPU1=99\n")
+	})
+
+	t.Run("Skips verification when asked", func(t *testing.T) {
+		c, err := Ms.NewHTTPClient(&Ms.AuthConfig{CertFile: certFile, KeyFile: keyFile, InsecureSkipVerify: true})
+		assertError(t, err, nil)
+
+		code, _, err := Ms.SingleFetchWithClient(mockServer.URL, c)
+		assertError(t, err, nil)
+		assertStatus(t, code, http.StatusOK)
+	})
+
+	t.Run("Fails without the CA", func(t *testing.T) {
+		c, err := Ms.NewHTTPClient(&Ms.AuthConfig{CertFile: certFile, KeyFile: keyFile})
+		assertError(t, err, nil)
+
+		_, _, err = Ms.SingleFetchWithClient(mockServer.URL, c)
+		assertGotError(t, err)
+	})
+
+	t.Run("Errors on unreadable files", func(t *testing.T) {
+		_, err := Ms.NewHTTPClient(&Ms.AuthConfig{CertFile: caFile, KeyFile: caFile})
+		assertGotError(t, err)
+
+		_, err = Ms.NewHTTPClient(&Ms.AuthConfig{CAFile: certFile + ".missing"})
+		assertGotError(t, err)
+	})
+}
+
+func TestRedactConfig(t *testing.T) {
+	config := []Ms.ConfigFile{
+		{ID: "SECURE", Auth: &Ms.AuthConfig{
+			Username: "ops",
+			Password: "hunter2",
+			Headers:  map[string]string{"X-Api-Key": "abc123"},
+		}},
+		{ID: "OPEN"},
+	}
+
+	redacted := Ms.RedactConfig(config)
+
+	t.Run("Hides passwords and header values", func(t *testing.T) {
+		assertString(t, redacted[0].Auth.Password, Ms.RedactedSecret)
+		assertString(t, redacted[0].Auth.Headers["X-Api-Key"], Ms.RedactedSecret)
+		assertString(t, redacted[0].Auth.Username, "ops")
+		if redacted[1].Auth != nil {
+			t.Error("Expected no auth on an open endpoint")
+		}
+	})
+
+	t.Run("Leaves the original alone", func(t *testing.T) {
+		assertString(t, config[0].Auth.Password, "hunter2")
+		assertString(t, config[0].Auth.Headers["X-Api-Key"], "abc123")
+	})
+
+	t.Run("Refuses to restore secrets for a new url", func(t *testing.T) {
+		moved := Ms.RedactConfig(config)
+		moved[0].URL = "https://elsewhere.example.com/metrics"
+		_, err := Ms.UnredactConfig(moved, config)
+		assertGotError(t, err)
+		assertString(t, moved[0].Auth.Password, Ms.RedactedSecret)
+	})
+
+	t.Run("Refuses to restore secrets for new TLS settings", func(t *testing.T) {
+		insecure := Ms.RedactConfig(config)
+		insecure[0].Auth.InsecureSkipVerify = true
+		_, err := Ms.UnredactConfig(insecure, config)
+		assertGotError(t, err)
+	})
+
+	t.Run("Refuses a redacted secret it never had", func(t *testing.T) {
+		unknown := Ms.RedactConfig(config)
+		unknown[0].Auth.Headers["X-New"] = Ms.RedactedSecret
+		_, err := Ms.UnredactConfig(unknown, config)
+		assertGotError(t, err)
+
+		_, err = Ms.UnredactConfig(Ms.RedactConfig(config), nil)
+		assertGotError(t, err)
+	})
+
+	t.Run("Restores redacted secrets by endpoint", func(t *testing.T) {
+		redacted[0].Auth.Headers["X-Other"] = "new"
+		restored, err := Ms.UnredactConfig(redacted, config)
+		assertError(t, err, nil)
+		if !restored {
+			t.Error("Expected secrets to be restored")
+		}
+		assertString(t, redacted[0].Auth.Password, "hunter2")
+		assertString(t, redacted[0].Auth.Headers["X-Api-Key"], "abc123")
+		assertString(t, redacted[0].Auth.Headers["X-Other"], "new")
+	})
+}
+
+func TestQNet_PollEndpointAuth(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer vav" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("CPU1 99\n"))
+	}))
+	defer mockServer.Close()
+
+	t.Setenv("MONTEVERDI_TEST_TOKEN", "vav")
+
+	for _, format := range []string{"kv", "prometheus"} {
+		t.Run("Polls "+format+" with the endpoint's token", func(t *testing.T) {
+			eps := Ms.NewEndpointsFromConfig([]Ms.ConfigFile{{
+				ID:      "SECURE",
+				URL:     mockServer.URL,
+				Delim:   " ",
+				Format:  format,
+				Metrics: map[string]Ms.MetricConfig{"CPU1": {Type: "gauge", Max: 100}},
+				Auth:    &Ms.AuthConfig{BearerTokenEnv: "MONTEVERDI_TEST_TOKEN"},
+			}})
+			qn := Ms.NewQNet(*eps)
+			qn.PollEndpoint(0)
+			assertInt64(t, qn.Network[0].Mdata["CPU1"], 99)
+		})
+	}
+
+	t.Run("Is refused without it", func(t *testing.T) {
+		eps := Ms.NewEndpointsFromConfig([]Ms.ConfigFile{{
+			ID:      "OPEN",
+			URL:     mockServer.URL,
+			Delim:   " ",
+			Metrics: map[string]Ms.MetricConfig{"CPU1": {Type: "gauge", Max: 100}},
+		}})
+		qn := Ms.NewQNet(*eps)
+		qn.PollEndpoint(0)
+		assertInt64(t, qn.Network[0].Mdata["CPU1"], 0)
+	})
+
+	t.Run("Is not polled with invalid auth", func(t *testing.T) {
+		var hits atomic.Int32
+		openServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits.Add(1)
+			w.Write([]byte("CPU1 99\n"))
+		}))
+		defer openServer.Close()
+
+		for _, format := range []string{"kv", "prometheus"} {
+			eps := Ms.NewEndpointsFromConfig([]Ms.ConfigFile{{
+				ID:      "BROKEN",
+				URL:     openServer.URL,
+				Delim:   " ",
+				Format:  format,
+				Metrics: map[string]Ms.MetricConfig{"CPU1": {Type: "gauge", Max: 100}},
+				Auth:    &Ms.AuthConfig{BearerTokenEnv: "MONTEVERDI_TEST_TOKEN_UNSET"},
+			}})
+			qn := Ms.NewQNet(*eps)
+			qn.PollEndpoint(0)
+			assertInt64(t, qn.Network[0].Mdata["CPU1"], 0)
+		}
+		if n := hits.Load(); n != 0 {
+			t.Errorf("Expected no requests without the configured auth, got %d", n)
+		}
+	})
+}
+
+// makeClientCert writes a self-signed client certificate and key to dir
+func makeClientCert(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assertError(t, err, nil)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "monteverdi"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assertError(t, err, nil)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assertError(t, err, nil)
+
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
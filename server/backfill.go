@@ -0,0 +1,289 @@
+package monteverdi
+
+/*
+
+	Backfill
+
+	Replays history through the same pipeline as live polling:
+	IngestMetric → FindAccent → RecordIctus → PulseDetect.
+
+	The Endpoint's Clock is set to each sample's timestamp as it is replayed,
+	so ictus, accents and pulses carry the time the sample was taken,
+	and the resulting pulses go to the QNet's OutputAdapter as they would live.
+
+	History comes from a RangeSource (e.g. promql's query_range),
+	or from a file in the Prometheus text format with timestamps:
+
+		node_load1{instance="web-1"} 7.2 1700000000000
+		node_load1{instance="web-1"} 9.8 1700000015000
+
+	A backfill should run on its own QNet, not on one being polled live.
+
+*/
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	Mp "github.com/maroda/monteverdi/plugin"
+	Mt "github.com/maroda/monteverdi/types"
+)
+
+// BackfillSample is one timestamped value to replay for a metric
+type BackfillSample struct {
+	Metric    string
+	Timestamp time.Time
+	Value     int64
+}
+
+// BackfillReport summarises a replay
+type BackfillReport struct {
+	Endpoint string                  // ID of the Endpoint replayed
+	Samples  int                     // samples replayed
+	Skipped  int                     // samples without a metric or timestamp
+	Pulses   map[Mt.PulsePattern]int // pulses sent to the output by pattern
+	Start    time.Time               // timestamp of the first sample
+	End      time.Time               // timestamp of the last sample
+}
+
+// Backfill replays the samples for Endpoint ni in time order.
+// Samples for metrics that are not on the Endpoint are skipped.
+func (q *QNet) Backfill(ni int, samples []BackfillSample) *BackfillReport {
+	ep := q.Network[ni]
+	report := &BackfillReport{Endpoint: ep.ID, Pulses: make(map[Mt.PulsePattern]int)}
+	if len(samples) == 0 {
+		return report
+	}
+
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].Timestamp.Before(samples[j].Timestamp)
+	})
+	report.Start = samples[0].Timestamp
+	report.End = samples[len(samples)-1].Timestamp
+
+	// Drive the engine from the samples' own time
+	clock := NewManualClock(report.Start)
+	ep.MU.Lock()
+	prevClock, prevPulseClock := ep.Clock, ep.Pulses.Clock
+	ep.Clock, ep.Pulses.Clock = clock, clock
+	ep.MU.Unlock()
+	prevCascadeClock := q.swapCascadeClock(clock)
+
+	// Count pulses on their way to the output
+	prevOutput := q.Output
+	q.Output = &pulseCounter{next: prevOutput, counts: report.Pulses}
+
+	defer func() {
+		q.Output = prevOutput
+		ep.MU.Lock()
+		ep.Clock, ep.Pulses.Clock = prevClock, prevPulseClock
+		ep.MU.Unlock()
+		q.swapCascadeClock(prevCascadeClock)
+	}()
+
+	for _, s := range samples {
+		ep.MU.RLock()
+		_, known := ep.Layer[s.Metric]
+		ep.MU.RUnlock()
+		if !known {
+			report.Skipped++
+			continue
+		}
+
+		clock.Set(s.Timestamp)
+		q.IngestMetric(ni, s.Metric, s.Value, s.Timestamp)
+		report.Samples++
+	}
+
+	if prevOutput != nil {
+		if err := prevOutput.Flush(); err != nil {
+			slog.Error("Output adapter flush failed", slog.String("endpoint", ep.ID), slog.Any("error", err))
+		}
+	}
+
+	slog.Info("Backfill complete",
+		slog.String("endpoint", ep.ID),
+		slog.Int("samples", report.Samples),
+		slog.Int("skipped", report.Skipped),
+		slog.Time("start", report.Start),
+		slog.Time("end", report.End))
+
+	return report
+}
+
+// swapCascadeClock sets the clock of the CascadeDetector, if there is one,
+// and returns the one it had
+func (q *QNet) swapCascadeClock(c Clock) Clock {
+	if q.Cascade == nil {
+		return nil
+	}
+	q.Cascade.MU.Lock()
+	defer q.Cascade.MU.Unlock()
+	prev := q.Cascade.Clock
+	q.Cascade.Clock = c
+	return prev
+}
+
+// BackfillRange replays the Endpoint's metrics from start to end,
+// read through its DataSource, which must be a RangeSource.
+// A zero step uses the Endpoint's polling interval.
+func (q *QNet) BackfillRange(ni int, start, end time.Time, step time.Duration) (*BackfillReport, error) {
+	ep := q.Network[ni]
+
+	if ep.Source == nil {
+		return nil, fmt.Errorf("endpoint %s has no data source", ep.ID)
+	}
+	src, ok := ep.Source.(Mp.RangeSource)
+	if !ok {
+		return nil, fmt.Errorf("source %s of endpoint %s cannot query a range", ep.Source.ID(), ep.ID)
+	}
+	if !end.After(start) {
+		return nil, errors.New("backfill end must be after start")
+	}
+	if step == 0 {
+		step = ep.Interval
+	}
+
+	history, err := src.PollRange(start, end, step)
+	if err != nil {
+		return nil, fmt.Errorf("range poll failed: %w", err)
+	}
+
+	var samples []BackfillSample
+	for metric, points := range history {
+		for _, p := range points {
+			samples = append(samples, BackfillSample{Metric: metric, Timestamp: p.Timestamp, Value: p.Value})
+		}
+	}
+
+	return q.Backfill(ni, samples), nil
+}
+
+// BackfillExposition replays the timestamped samples of a Prometheus text file.
+// Prometheus endpoints match series with their selectors and aggregations,
+// per timestamp, others match on the metric key. Samples without a timestamp are skipped.
+func (q *QNet) BackfillExposition(ni int, expo *PromExposition) *BackfillReport {
+	ep := q.Network[ni]
+
+	var samples []BackfillSample
+	skipped := 0
+
+	for _, s := range expo.Samples {
+		if s.Timestamp == 0 {
+			skipped++
+		}
+	}
+
+	if ep.Format != "prometheus" {
+		for _, s := range expo.Samples {
+			if s.Timestamp == 0 {
+				continue
+			}
+			mdata, ok := PromValueToInt64(s.Value)
+			if !ok {
+				continue
+			}
+			samples = append(samples, BackfillSample{Metric: s.SeriesID(), Timestamp: time.UnixMilli(s.Timestamp), Value: mdata})
+		}
+
+		report := q.Backfill(ni, samples)
+		report.Skipped += skipped
+		return report
+	}
+
+	for key, sel := range ep.Selectors {
+		if _, ok := ep.Transformers[key].(*Mp.HistogramQuantilePlugin); ok {
+			slog.Warn("Histogram quantiles are not backfilled", slog.String("metric", key))
+			continue
+		}
+
+		// Group by timestamp, an aggregation applies to one instant
+		instants := make(map[int64][]PromSample)
+		for _, s := range expo.Samples {
+			if s.Timestamp != 0 && sel.Matches(&s) {
+				instants[s.Timestamp] = append(instants[s.Timestamp], s)
+			}
+		}
+
+		agg := ep.Aggregations[key]
+		for ms, matched := range instants {
+			ts := time.UnixMilli(ms)
+
+			values := make(map[string]float64)
+			if agg != nil {
+				values = agg.Apply(key, matched)
+			} else {
+				for _, s := range matched {
+					values[s.SeriesID()] = s.Value
+				}
+			}
+
+			for id, v := range values {
+				mdata, ok := PromValueToInt64(v)
+				if !ok {
+					continue
+				}
+				ep.MU.Lock()
+				ep.RegisterSeries(id, key)
+				ep.MU.Unlock()
+
+				samples = append(samples, BackfillSample{Metric: id, Timestamp: ts, Value: mdata})
+			}
+		}
+	}
+
+	report := q.Backfill(ni, samples)
+	report.Skipped += skipped
+	return report
+}
+
+// pulseCounter is an OutputAdapter counting pulses by pattern
+// before passing them on to the configured output, if any
+type pulseCounter struct {
+	next   Mp.OutputAdapter
+	counts map[Mt.PulsePattern]int
+}
+
+func (pc *pulseCounter) WritePulse(pulse *Mt.PulseEvent) error {
+	pc.counts[pulse.Pattern]++
+	if pc.next == nil {
+		return nil
+	}
+	return pc.next.WritePulse(pulse)
+}
+
+func (pc *pulseCounter) WriteBatch(pulses []*Mt.PulseEvent) error {
+	for _, p := range pulses {
+		pc.counts[p.Pattern]++
+	}
+	if pc.next == nil {
+		return nil
+	}
+	return pc.next.WriteBatch(pulses)
+}
+
+func (pc *pulseCounter) QueryRange(start, end time.Time) (interface{}, error) {
+	if pc.next == nil {
+		return nil, errors.New("no output configured")
+	}
+	return pc.next.QueryRange(start, end)
+}
+
+func (pc *pulseCounter) Flush() error {
+	if pc.next == nil {
+		return nil
+	}
+	return pc.next.Flush()
+}
+
+func (pc *pulseCounter) Close() error {
+	if pc.next == nil {
+		return nil
+	}
+	return pc.next.Close()
+}
+
+func (pc *pulseCounter) Type() string { return "PulseCounter" }
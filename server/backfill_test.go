@@ -0,0 +1,264 @@
+package monteverdi_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	Ms "github.com/maroda/monteverdi/server"
+	Mt "github.com/maroda/monteverdi/types"
+)
+
+// An outage two years ago: CPU1 crosses its max of 100 every other minute
+var outageStart = time.Date(2023, 10, 1, 14, 0, 0, 0, time.UTC)
+
+func makeOutageSamples(metric string, n int) []Ms.BackfillSample {
+	samples := make([]Ms.BackfillSample, 0, n)
+	for i := n - 1; i >= 0; i-- { // out of order on purpose
+		value := int64(20)
+		if (i/2)%2 == 1 {
+			value = 150
+		}
+		samples = append(samples, Ms.BackfillSample{
+			Metric:    metric,
+			Timestamp: outageStart.Add(time.Duration(i) * 30 * time.Second),
+			Value:     value,
+		})
+	}
+	return samples
+}
+
+func makeBackfillQNet(t *testing.T, cf Ms.ConfigFile) (*Ms.QNet, *FailingBadgerOutput) {
+	t.Helper()
+	eps := Ms.NewEndpointsFromConfig([]Ms.ConfigFile{cf})
+	qn := Ms.NewQNet(*eps)
+	output := &FailingBadgerOutput{}
+	qn.Output = output
+	return qn, output
+}
+
+func TestQNet_Backfill(t *testing.T) {
+	qn, output := makeBackfillQNet(t, Ms.ConfigFile{
+		ID:    "HIST",
+		URL:   "http://localhost:8090/metrics",
+		Delim: "=",
+		Metrics: map[string]Ms.MetricConfig{
+			"CPU1": {Type: "gauge", Max: 100},
+		},
+	})
+
+	samples := append(makeOutageSamples("CPU1", 48), Ms.BackfillSample{
+		Metric: "UNKNOWN", Timestamp: outageStart, Value: 1,
+	})
+	report := qn.Backfill(0, samples)
+	ep := qn.Network[0]
+
+	t.Run("Reports the replay", func(t *testing.T) {
+		assertInt(t, report.Samples, 48)
+		assertInt(t, report.Skipped, 1)
+		assertString(t, report.Endpoint, "HIST")
+		if !report.Start.Equal(outageStart) {
+			t.Errorf("Expected start %v, got %v", outageStart, report.Start)
+		}
+	})
+
+	t.Run("Ictus carry the sample timestamps", func(t *testing.T) {
+		seq := ep.Sequence["CPU1"]
+		if seq == nil || len(seq.Events) == 0 {
+			t.Fatal("Expected an ictus sequence")
+		}
+		for _, ictus := range seq.Events {
+			if ictus.Timestamp.Year() != 2023 {
+				t.Errorf("Expected a 2023 ictus, got %v", ictus.Timestamp)
+			}
+		}
+	})
+
+	t.Run("Pulses from the past reach the output", func(t *testing.T) {
+		if len(output.Pulses) == 0 {
+			t.Fatal("Expected backfilled pulses in the output")
+		}
+		total := 0
+		for _, n := range report.Pulses {
+			total += n
+		}
+		assertInt(t, total, len(output.Pulses))
+		for _, p := range output.Pulses {
+			if p.StartTime.Before(outageStart) || p.StartTime.After(outageStart.Add(24*time.Minute)) {
+				t.Errorf("Pulse outside of the outage: %v", p.StartTime)
+			}
+		}
+		if report.Pulses[Mt.Iamb] == 0 || report.Pulses[Mt.Trochee] == 0 {
+			t.Errorf("Expected iambs and trochees, got %v", report.Pulses)
+		}
+	})
+
+	t.Run("Pulses stay in the grouper window of their own time", func(t *testing.T) {
+		if len(ep.Pulses.Buffer) == 0 {
+			t.Errorf("Expected backfilled pulses to stay in the buffer")
+		}
+	})
+
+	t.Run("Clock and output are restored", func(t *testing.T) {
+		if ep.Clock != nil || ep.Pulses.Clock != nil {
+			t.Errorf("Expected the wall clock after a backfill")
+		}
+		if qn.Output != output {
+			t.Errorf("Expected the output adapter to be restored")
+		}
+	})
+
+	t.Run("Nothing to replay", func(t *testing.T) {
+		report := qn.Backfill(0, nil)
+		assertInt(t, report.Samples, 0)
+	})
+}
+
+func TestQNet_BackfillCascades(t *testing.T) {
+	qn, _ := makeBackfillQNet(t, Ms.ConfigFile{
+		ID:    "HIST",
+		URL:   "http://localhost:8090/metrics",
+		Delim: "=",
+		Metrics: map[string]Ms.MetricConfig{
+			"CPU1": {Type: "gauge", Max: 100},
+			"CPU2": {Type: "gauge", Max: 100},
+		},
+	})
+	qn.Cascade = Ms.NewCascadeDetector(10 * time.Second)
+
+	qn.Backfill(0, append(makeOutageSamples("CPU1", 48), makeOutageSamples("CPU2", 48)...))
+
+	t.Run("Cascades stay in the window of their own time", func(t *testing.T) {
+		if len(qn.Cascade.Cascades()) == 0 {
+			t.Error("Expected backfilled cascades to stay in the buffer")
+		}
+	})
+
+	t.Run("Cascade clock is restored", func(t *testing.T) {
+		if qn.Cascade.Clock != nil {
+			t.Error("Expected the wall clock after a backfill")
+		}
+	})
+}
+
+func TestQNet_BackfillExposition(t *testing.T) {
+	var b strings.Builder
+	for i := 0; i < 48; i++ {
+		ts := outageStart.Add(time.Duration(i) * 30 * time.Second).UnixMilli()
+		load := 2
+		if (i/2)%2 == 1 {
+			load = 9
+		}
+		fmt.Fprintf(&b, "node_load1{instance=\"web-1\"} %d %d\n", load, ts)
+		fmt.Fprintf(&b, "node_load1{instance=\"web-2\"} %d %d\n", load, ts)
+	}
+	b.WriteString("node_load1{instance=\"web-3\"} 1\n") // no timestamp
+
+	expo, err := Ms.ParsePromExposition(strings.NewReader(b.String()))
+	assertError(t, err, nil)
+
+	t.Run("Prometheus endpoints aggregate per timestamp", func(t *testing.T) {
+		qn, output := makeBackfillQNet(t, Ms.ConfigFile{
+			ID:     "PROM",
+			Format: "prometheus",
+			Metrics: map[string]Ms.MetricConfig{
+				"node_load1": {Type: "gauge", Max: 15, Aggregate: "sum"},
+			},
+		})
+		report := qn.BackfillExposition(0, expo)
+		assertInt(t, report.Samples, 48)
+		assertInt(t, report.Skipped, 1)
+		assertInt64(t, qn.Network[0].Mdata["node_load1"], 18) // last instant: 9 + 9
+		if len(output.Pulses) == 0 {
+			t.Errorf("Expected backfilled pulses in the output")
+		}
+	})
+
+	t.Run("Prometheus endpoints register each series", func(t *testing.T) {
+		qn, _ := makeBackfillQNet(t, Ms.ConfigFile{
+			ID:     "PROM",
+			Format: "prometheus",
+			Metrics: map[string]Ms.MetricConfig{
+				"node_load1": {Type: "gauge", Max: 5},
+			},
+		})
+		report := qn.BackfillExposition(0, expo)
+		assertInt(t, report.Samples, 96)
+		assertString(t, qn.Network[0].Series[`node_load1{instance="web-2"}`], "node_load1")
+	})
+
+	t.Run("KV endpoints match the metric key", func(t *testing.T) {
+		qn, _ := makeBackfillQNet(t, Ms.ConfigFile{
+			ID:    "KV",
+			URL:   "http://localhost:8090/metrics",
+			Delim: " ",
+			Metrics: map[string]Ms.MetricConfig{
+				"node_load1": {Type: "gauge", Max: 5},
+			},
+		})
+		report := qn.BackfillExposition(0, expo)
+		assertInt(t, report.Samples, 0)
+		assertInt(t, report.Skipped, 97)
+	})
+}
+
+func TestQNet_BackfillRange(t *testing.T) {
+	mockAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/query_range" || r.URL.Query().Get("step") != "30" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"status":"error","errorType":"bad_data","error":"bad request"}`)
+			return
+		}
+		points := make([]string, 0, 48)
+		for i := 0; i < 48; i++ {
+			value := 20
+			if (i/2)%2 == 1 {
+				value = 150
+			}
+			points = append(points, fmt.Sprintf(`[%d,"%d"]`, outageStart.Unix()+int64(i*30), value))
+		}
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{},"values":[%s]}]}}`,
+			strings.Join(points, ","))
+	}))
+	defer mockAPI.Close()
+
+	qn, output := makeBackfillQNet(t, Ms.ConfigFile{
+		ID:       "THANOS",
+		URL:      mockAPI.URL,
+		Source:   "promql",
+		Interval: 30,
+		Metrics: map[string]Ms.MetricConfig{
+			"errors": {Type: "gauge", Max: 100, Query: "sum(rate(errors_total[1m]))"},
+		},
+	})
+
+	t.Run("Replays the range through the pipeline", func(t *testing.T) {
+		report, err := qn.BackfillRange(0, outageStart, outageStart.Add(24*time.Minute), 0)
+		assertError(t, err, nil)
+		assertInt(t, report.Samples, 48)
+		if len(output.Pulses) == 0 {
+			t.Errorf("Expected backfilled pulses in the output")
+		}
+	})
+
+	t.Run("Errors on an inverted range", func(t *testing.T) {
+		_, err := qn.BackfillRange(0, outageStart, outageStart.Add(-time.Minute), 0)
+		assertGotError(t, err)
+	})
+
+	t.Run("Errors when the source cannot query a range", func(t *testing.T) {
+		kv, _ := makeBackfillQNet(t, Ms.ConfigFile{
+			ID:    "KV",
+			URL:   "http://localhost:8090/metrics",
+			Delim: "=",
+			Metrics: map[string]Ms.MetricConfig{
+				"CPU1": {Type: "gauge", Max: 100},
+			},
+		})
+		_, err := kv.BackfillRange(0, outageStart, outageStart.Add(time.Minute), 0)
+		assertGotError(t, err)
+	})
+}
@@ -0,0 +1,173 @@
+package monteverdi
+
+/*
+
+	Cascades
+
+	Each Endpoint's TemporalGrouper only sees its own pulses.
+	The CascadeDetector lives on the QNet and sees the pulses
+	of every metric on every endpoint, so it can tell when one
+	metric's pulse is followed by the same pulse on another:
+
+		DB latency  ⚍ ─┐
+		                ├─ within the tolerance: a Cascade
+		API errors   ⚍ ─┘
+
+	A Cascade is one dimension above the pulses it links,
+	its Metric lists the leader first and the follower second,
+	and its Children are their start times. The linked pulses
+	keep their own Parent, which belongs to their endpoint's hierarchy.
+	Cascades go to the Output like any other pulse, under the leader's endpoint,
+	with the endpoint of each metric in Endpoints.
+
+	MONTEVERDI_CASCADE_TOLERANCE_SECONDS sets the tolerance, 0 turns it off.
+
+*/
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	Mt "github.com/maroda/monteverdi/types"
+)
+
+// CascadePulse is a Cascade, its Endpoints are those of its metrics in the same order
+type CascadePulse struct {
+	Mt.PulseEvent
+}
+
+// cascadeSource is a recent pulse and where it came from
+type cascadeSource struct {
+	endpoint string
+	pulse    Mt.PulseEvent
+}
+
+// CascadeDetector correlates pulses across metrics and endpoints
+type CascadeDetector struct {
+	MU        sync.Mutex
+	Tolerance time.Duration  // how far apart two pulses can start and still cascade
+	Buffer    []CascadePulse // detected cascades
+	Clock     Clock          // wall clock when nil
+	recent    []cascadeSource
+}
+
+// NewCascadeDetector returns a detector for pulses up to tolerance apart,
+// nil when the tolerance is not positive
+func NewCascadeDetector(tolerance time.Duration) *CascadeDetector {
+	if tolerance <= 0 {
+		return nil
+	}
+	return &CascadeDetector{Tolerance: tolerance}
+}
+
+// AddPulse checks a pulse from an endpoint against the recent pulses
+// of every other metric and returns the cascades it completes
+func (cd *CascadeDetector) AddPulse(endpoint string, pulse Mt.PulseEvent) []CascadePulse {
+	if cd == nil || len(pulse.Metric) == 0 {
+		return nil
+	}
+
+	cd.MU.Lock()
+	defer cd.MU.Unlock()
+
+	var found []CascadePulse
+	for _, r := range cd.recent {
+		sameMetric := r.endpoint == endpoint && r.pulse.Metric[0] == pulse.Metric[0]
+		if sameMetric {
+			if r.pulse.StartTime.Equal(pulse.StartTime) {
+				return nil // already seen
+			}
+			continue
+		}
+		if r.pulse.Pattern != pulse.Pattern || r.pulse.Dimension != pulse.Dimension {
+			continue
+		}
+
+		gap := pulse.StartTime.Sub(r.pulse.StartTime)
+		if gap < 0 {
+			gap = -gap
+		}
+		if gap > cd.Tolerance {
+			continue
+		}
+
+		// Pulses can arrive out of order across endpoints,
+		// whichever started first leads
+		leader, follower := r, cascadeSource{endpoint: endpoint, pulse: pulse}
+		if pulse.StartTime.Before(r.pulse.StartTime) {
+			leader, follower = follower, leader
+		}
+		found = append(found, newCascade(leader, follower))
+	}
+
+	cd.recent = append(cd.recent, cascadeSource{endpoint: endpoint, pulse: pulse})
+	cd.Buffer = append(cd.Buffer, found...)
+
+	for _, c := range found {
+		slog.Debug("CASCADE_DETECTED",
+			slog.Any("metrics", c.Metric),
+			slog.Any("endpoints", c.Endpoints),
+			slog.Int("pattern", int(pulse.Pattern)))
+	}
+
+	cd.trim(pulse.StartTime)
+	return found
+}
+
+// newCascade links a leader pulse to its follower
+func newCascade(leader, follower cascadeSource) CascadePulse {
+	end := follower.pulse.StartTime.Add(follower.pulse.Duration)
+	if leaderEnd := leader.pulse.StartTime.Add(leader.pulse.Duration); leaderEnd.After(end) {
+		end = leaderEnd
+	}
+
+	return CascadePulse{
+		PulseEvent: Mt.PulseEvent{
+			Dimension: leader.pulse.Dimension + 1,
+			Pattern:   Mt.Cascade,
+			Endpoint:  leader.endpoint,
+			StartTime: leader.pulse.StartTime,
+			Duration:  end.Sub(leader.pulse.StartTime),
+			Metric:    []string{leader.pulse.Metric[0], follower.pulse.Metric[0]},
+			Children:  []time.Time{leader.pulse.StartTime, follower.pulse.StartTime},
+			Endpoints: []string{leader.endpoint, follower.endpoint},
+		},
+	}
+}
+
+// trim forgets pulses too old to cascade with one starting at latest,
+// and cascades outside the same window the TemporalGrouper keeps
+func (cd *CascadeDetector) trim(latest time.Time) {
+	kept := 0
+	for _, r := range cd.recent {
+		if latest.Sub(r.pulse.StartTime) <= cd.Tolerance {
+			cd.recent[kept] = r
+			kept++
+		}
+	}
+	cd.recent = cd.recent[:kept]
+
+	limit := clockNow(cd.Clock).Add(-600 * time.Second)
+	kept = 0
+	for _, c := range cd.Buffer {
+		if c.StartTime.After(limit) {
+			cd.Buffer[kept] = c
+			kept++
+		}
+	}
+	cd.Buffer = cd.Buffer[:kept]
+}
+
+// Cascades returns a copy of the detected cascades
+func (cd *CascadeDetector) Cascades() []CascadePulse {
+	if cd == nil {
+		return nil
+	}
+	cd.MU.Lock()
+	defer cd.MU.Unlock()
+
+	cascades := make([]CascadePulse, len(cd.Buffer))
+	copy(cascades, cd.Buffer)
+	return cascades
+}
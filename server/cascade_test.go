@@ -0,0 +1,156 @@
+package monteverdi_test
+
+import (
+	"testing"
+	"time"
+
+	Ms "github.com/maroda/monteverdi/server"
+	Mt "github.com/maroda/monteverdi/types"
+)
+
+func TestCascadeDetector_AddPulse(t *testing.T) {
+	now := time.Now()
+	iamb := func(metric string, at time.Duration) Mt.PulseEvent {
+		return Mt.PulseEvent{
+			Dimension: 1,
+			Pattern:   Mt.Iamb,
+			StartTime: now.Add(at),
+			Duration:  4 * time.Second,
+			Metric:    []string{metric},
+		}
+	}
+
+	t.Run("Links the same pulse on two metrics", func(t *testing.T) {
+		cd := Ms.NewCascadeDetector(5 * time.Second)
+		cd.AddPulse("DB", iamb("latency", 0))
+		found := cd.AddPulse("API", iamb("errors", 3*time.Second))
+
+		assertInt(t, len(found), 1)
+		c := found[0]
+		if c.Pattern != Mt.Cascade {
+			t.Errorf("Expected a Cascade, got %v", c.Pattern)
+		}
+		assertInt(t, c.Dimension, 2)
+		assertString(t, c.Metric[0], "latency")
+		assertString(t, c.Metric[1], "errors")
+		assertString(t, c.Endpoints[0], "DB")
+		assertString(t, c.Endpoints[1], "API")
+		if !c.StartTime.Equal(now) || c.Duration != 7*time.Second {
+			t.Errorf("Expected the cascade to span both pulses, got %v for %v", c.StartTime, c.Duration)
+		}
+		assertInt(t, len(c.Children), 2)
+		assertInt(t, len(cd.Cascades()), 1)
+	})
+
+	t.Run("The earlier pulse leads when they arrive out of order", func(t *testing.T) {
+		cd := Ms.NewCascadeDetector(5 * time.Second)
+		cd.AddPulse("API", iamb("errors", 3*time.Second))
+		found := cd.AddPulse("DB", iamb("latency", 0))
+
+		assertInt(t, len(found), 1)
+		assertString(t, found[0].Metric[0], "latency")
+		assertString(t, found[0].Endpoints[0], "DB")
+	})
+
+	t.Run("Ignores pulses outside the tolerance", func(t *testing.T) {
+		cd := Ms.NewCascadeDetector(5 * time.Second)
+		cd.AddPulse("DB", iamb("latency", 0))
+		found := cd.AddPulse("API", iamb("errors", 6*time.Second))
+		assertInt(t, len(found), 0)
+	})
+
+	t.Run("Ignores different patterns", func(t *testing.T) {
+		cd := Ms.NewCascadeDetector(5 * time.Second)
+		cd.AddPulse("DB", iamb("latency", 0))
+		trochee := iamb("errors", time.Second)
+		trochee.Pattern = Mt.Trochee
+		assertInt(t, len(cd.AddPulse("API", trochee)), 0)
+	})
+
+	t.Run("Ignores the same metric and repeated pulses", func(t *testing.T) {
+		cd := Ms.NewCascadeDetector(5 * time.Second)
+		cd.AddPulse("DB", iamb("latency", 0))
+		assertInt(t, len(cd.AddPulse("DB", iamb("latency", 2*time.Second))), 0)
+
+		cd.AddPulse("API", iamb("errors", 3*time.Second))
+		assertInt(t, len(cd.AddPulse("API", iamb("errors", 3*time.Second))), 0)
+		assertInt(t, len(cd.Cascades()), 2)
+	})
+
+	t.Run("Links the same metric name on different endpoints", func(t *testing.T) {
+		cd := Ms.NewCascadeDetector(5 * time.Second)
+		cd.AddPulse("WEB1", iamb("cpu", 0))
+		assertInt(t, len(cd.AddPulse("WEB2", iamb("cpu", time.Second))), 1)
+	})
+
+	t.Run("Is off without a tolerance", func(t *testing.T) {
+		cd := Ms.NewCascadeDetector(0)
+		if cd != nil {
+			t.Fatal("Expected no detector")
+		}
+		assertInt(t, len(cd.AddPulse("DB", iamb("latency", 0))), 0)
+		assertInt(t, len(cd.Cascades()), 0)
+	})
+}
+
+func TestQNet_Cascade(t *testing.T) {
+	start := time.Date(2023, 10, 1, 14, 0, 0, 0, time.UTC)
+	eps := Ms.NewEndpointsFromConfig([]Ms.ConfigFile{
+		{
+			ID:      "DB",
+			URL:     "http://localhost:8090/db",
+			Delim:   "=",
+			Metrics: map[string]Ms.MetricConfig{"latency": {Type: "gauge", Max: 100}},
+		},
+		{
+			ID:      "API",
+			URL:     "http://localhost:8090/api",
+			Delim:   "=",
+			Metrics: map[string]Ms.MetricConfig{"errors": {Type: "gauge", Max: 10}},
+		},
+	})
+	qn := Ms.NewQNet(*eps)
+	clock := Ms.NewManualClock(start)
+	qn.SetClock(clock)
+	output := &FailingBadgerOutput{}
+	qn.Output = output
+
+	// API errors follow DB latency one poll later
+	latency := make([]int64, 48)
+	errors := make([]int64, 48)
+	for i := range latency {
+		if (i/2)%2 == 1 {
+			latency[i] = 150
+		}
+		if i > 0 && ((i-1)/2)%2 == 1 {
+			errors[i] = 20
+		}
+	}
+	for i := range latency {
+		qn.IngestMetric(0, "latency", latency[i], clock.Now())
+		qn.IngestMetric(1, "errors", errors[i], clock.Now())
+		clock.Advance(5 * time.Second)
+	}
+
+	cascades := qn.Cascade.Cascades()
+	if len(cascades) == 0 {
+		t.Fatal("Expected cascades between DB latency and API errors")
+	}
+	for _, c := range cascades {
+		assertString(t, c.Metric[0], "latency")
+		assertString(t, c.Metric[1], "errors")
+		assertString(t, c.Endpoints[1], "API")
+	}
+
+	// Every cascade is written to the output with the other pulses
+	written := 0
+	for _, p := range output.Pulses {
+		if p.Pattern == Mt.Cascade {
+			assertString(t, p.Endpoint, "DB")
+			written++
+		}
+	}
+	if written != len(cascades) {
+		t.Errorf("Expected %d cascades written to the output, got %d", len(cascades), written)
+	}
+}
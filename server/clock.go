@@ -0,0 +1,77 @@
+package monteverdi
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the engine what time it is.
+// Live polling uses the wall clock, a backfill sets
+// the clock to each sample's timestamp as it is replayed,
+// and tests and offline analysis can run hours of ictus
+// through pulse detection in milliseconds with a ManualClock.
+type Clock interface {
+	Now() time.Time
+}
+
+// RealClock is the wall clock
+type RealClock struct{}
+
+func (RealClock) Now() time.Time { return time.Now() }
+
+// ManualClock only moves when it is told to
+type ManualClock struct {
+	mu sync.RWMutex
+	t  time.Time
+}
+
+// NewManualClock returns a clock stopped at t
+func NewManualClock(t time.Time) *ManualClock {
+	return &ManualClock{t: t}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.t
+}
+
+// Set moves the clock to t
+func (c *ManualClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = t
+}
+
+// Advance moves the clock forward by d
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// clockNow is time.Now() unless a Clock is injected
+func clockNow(c Clock) time.Time {
+	if c == nil {
+		return time.Now()
+	}
+	return c.Now()
+}
+
+// SimClock runs Speed times faster than the wall clock from Start,
+// e.g. a Speed of 60 plays an hour of pulses in a minute
+type SimClock struct {
+	Start time.Time // simulated time when the clock was made
+	Speed float64   // simulated seconds per wall second
+	wall  time.Time // wall time when the clock was made
+}
+
+// NewSimClock returns a clock starting at t, running at speed
+func NewSimClock(t time.Time, speed float64) *SimClock {
+	return &SimClock{Start: t, Speed: speed, wall: time.Now()}
+}
+
+func (c *SimClock) Now() time.Time {
+	elapsed := time.Since(c.wall)
+	return c.Start.Add(time.Duration(float64(elapsed) * c.Speed))
+}
@@ -0,0 +1,146 @@
+package monteverdi_test
+
+import (
+	"testing"
+	"time"
+
+	Ms "github.com/maroda/monteverdi/server"
+)
+
+func TestManualClock(t *testing.T) {
+	start := time.Date(2023, 10, 1, 14, 0, 0, 0, time.UTC)
+	clock := Ms.NewManualClock(start)
+
+	t.Run("Stays where it is set", func(t *testing.T) {
+		if !clock.Now().Equal(start) {
+			t.Errorf("got %v, want %v", clock.Now(), start)
+		}
+	})
+
+	t.Run("Advances and sets", func(t *testing.T) {
+		clock.Advance(time.Minute)
+		if !clock.Now().Equal(start.Add(time.Minute)) {
+			t.Errorf("got %v, want %v", clock.Now(), start.Add(time.Minute))
+		}
+		clock.Set(start)
+		if !clock.Now().Equal(start) {
+			t.Errorf("got %v, want %v", clock.Now(), start)
+		}
+	})
+
+	t.Run("Drives RecordIctus", func(t *testing.T) {
+		ep := &Ms.Endpoint{Sequence: make(map[string]*Ms.IctusSequence), Clock: clock}
+		ep.RecordIctus("CPU1", true, 100)
+		clock.Advance(30 * time.Second)
+		ep.RecordIctus("CPU1", true, 100)
+
+		ictus := ep.Sequence["CPU1"].Events[0]
+		if !ictus.Timestamp.Equal(start) {
+			t.Errorf("got %v, want %v", ictus.Timestamp, start)
+		}
+		if ictus.Duration != 30*time.Second {
+			t.Errorf("got %v, want 30s", ictus.Duration)
+		}
+	})
+
+	t.Run("RealClock is the wall clock", func(t *testing.T) {
+		if time.Since(Ms.RealClock{}.Now()) > time.Second {
+			t.Errorf("RealClock is not now")
+		}
+	})
+}
+
+func TestSimClock(t *testing.T) {
+	start := time.Date(2023, 10, 1, 14, 0, 0, 0, time.UTC)
+
+	t.Run("Runs faster than the wall clock", func(t *testing.T) {
+		clock := Ms.NewSimClock(start, 3600)
+		time.Sleep(10 * time.Millisecond)
+		if elapsed := clock.Now().Sub(start); elapsed < 36*time.Second {
+			t.Errorf("Expected at least 36s of simulated time, got %v", elapsed)
+		}
+	})
+
+	t.Run("Stands still at speed zero", func(t *testing.T) {
+		clock := Ms.NewSimClock(start, 0)
+		time.Sleep(time.Millisecond)
+		if !clock.Now().Equal(start) {
+			t.Errorf("got %v, want %v", clock.Now(), start)
+		}
+	})
+}
+
+func TestQNet_SetClock(t *testing.T) {
+	start := time.Date(2023, 10, 1, 14, 0, 0, 0, time.UTC)
+	eps := Ms.NewEndpointsFromConfig([]Ms.ConfigFile{{
+		ID:    "SIM",
+		URL:   "http://localhost:8090/metrics",
+		Delim: "=",
+		Metrics: map[string]Ms.MetricConfig{
+			"CPU1": {Type: "gauge", Max: 100},
+		},
+	}})
+	qn := Ms.NewQNet(*eps)
+	output := &FailingBadgerOutput{}
+	qn.Output = output
+
+	clock := Ms.NewManualClock(start)
+	qn.SetClock(clock)
+	ep := qn.Network[0]
+
+	t.Run("Reaches every Endpoint and TemporalGrouper", func(t *testing.T) {
+		if qn.Clock != clock || ep.Clock != clock || ep.Pulses.Clock != clock {
+			t.Fatal("Expected the clock on the QNet, Endpoint, and TemporalGrouper")
+		}
+		if !qn.Now().Equal(start) || !ep.Now().Equal(start) {
+			t.Errorf("Expected %v, got %v and %v", start, qn.Now(), ep.Now())
+		}
+	})
+
+	// Four hours of 15s polls, crossing the max every minute
+	wall := time.Now()
+	polls := 4 * 60 * 4
+	for i := 0; i < polls; i++ {
+		value := int64(20)
+		if (i/2)%2 == 1 {
+			value = 150
+		}
+		qn.IngestMetric(0, "CPU1", value, clock.Now())
+		clock.Advance(15 * time.Second)
+	}
+	elapsed := time.Since(wall)
+
+	t.Run("Runs hours of ictus faster than real time", func(t *testing.T) {
+		if elapsed > 10*time.Second {
+			t.Errorf("Expected a quick run, took %v", elapsed)
+		}
+		if len(output.Pulses) == 0 {
+			t.Fatal("Expected pulses to reach the output")
+		}
+		last := output.Pulses[len(output.Pulses)-1]
+		if last.StartTime.Sub(start) < 3*time.Hour {
+			t.Errorf("Expected pulses late in the simulated run, got %v", last.StartTime)
+		}
+	})
+
+	t.Run("Trims the buffer by simulated time", func(t *testing.T) {
+		// By the wall clock every pulse from 2023 would be gone
+		if len(ep.Pulses.Buffer) == 0 {
+			t.Fatal("Expected recent simulated pulses in the buffer")
+		}
+		// Trimmed at the last pulse, a few polls before the end
+		limit := clock.Now().Add(-15 * time.Minute)
+		for _, pulse := range ep.Pulses.Buffer {
+			if pulse.StartTime.Before(limit) {
+				t.Errorf("Expected pulses before %v to be trimmed, found %v", limit, pulse.StartTime)
+			}
+		}
+	})
+
+	t.Run("Places viz points by simulated time", func(t *testing.T) {
+		points := ep.GetPulseVizData("CPU1", nil)
+		if len(points) == 0 {
+			t.Fatal("Expected viz points for recent simulated pulses")
+		}
+	})
+}
@@ -9,17 +9,37 @@ import (
 
 // ConfigFile contains the options to configure Endpoints
 type ConfigFile struct {
-	ID       string                  `json:"id"`       // Unique string ID
-	URL      string                  `json:"url"`      // Endpoint URL (no auth yet)
-	Delim    string                  `json:"delim"`    // Stats delimiter (eg: "=")
-	Interval int                     `json:"interval"` // Seconds to repeat poll
-	Metrics  map[string]MetricConfig `json:"metrics"`  // Value to trigger an accent
+	ID       string                   `json:"id"`                          // Unique string ID
+	URL      string                   `json:"url"`                         // Endpoint URL
+	Delim    string                   `json:"delim"`                       // Stats delimiter (eg: "=")
+	Format   string                   `json:"format,omitempty"`            // "prometheus" for the exposition parser, KV by default
+	Source   string                   `json:"source,omitempty"`            // DataSource plugin, e.g. "kv" or "json" (default by delim)
+	Config   map[string]interface{}   `json:"config,omitempty"`            // DataSource plugin options
+	Interval int                      `json:"interval"`                    // Seconds to repeat poll
+	Metrics  map[string]MetricConfig  `json:"metrics"`                     // Value to trigger an accent
+	Auth     *AuthConfig              `json:"auth,omitempty"`              // Credentials and TLS for the URL
+	Patterns []map[string]interface{} `json:"pattern_analyzers,omitempty"` // User-defined PatternAnalyzers
+	Periods  *PeriodConfig            `json:"periods,omitempty"`           // D1 period ratios for every metric
 }
 
 type MetricConfig struct {
-	Type        string `json:"type"`        // "gauge" or "counter" currently supported
-	Transformer string `json:"transformer"` // optional plugin, e.g. "calc_rate"
-	Max         int64  `json:"max"`         // trigger at Max for this metric
+	Type        string          `json:"type"`                  // "gauge" or "counter" currently supported
+	Transformer string          `json:"transformer"`           // optional plugin, e.g. "calc_rate"
+	Max         int64           `json:"max"`                   // trigger at Max for this metric
+	Selector    string          `json:"selector,omitempty"`    // prometheus series selector, defaults to the metric key
+	Aggregate   string          `json:"aggregate,omitempty"`   // reduce matched series: sum, max, min, avg, count
+	By          []string        `json:"by,omitempty"`          // aggregate keeping only these labels
+	Without     []string        `json:"without,omitempty"`     // aggregate dropping these labels
+	Quantile    *float64        `json:"quantile,omitempty"`    // histogram_quantile: 0.5, 0.95 (default), 0.99
+	BucketRate  bool            `json:"bucket_rate,omitempty"` // histogram_quantile: use buckets from the last poll interval only
+	Scale       float64         `json:"scale,omitempty"`       // histogram_quantile: multiplier, e.g. 1000 for seconds to ms
+	Query       string          `json:"query,omitempty"`       // promql source: instant query, defaults to the metric key
+	Min         *int64          `json:"min,omitempty"`         // accent at or below Min instead of at Max
+	Band        []int64         `json:"band,omitempty"`        // accent from [low, high]
+	Enter       *int64          `json:"enter,omitempty"`       // accent from Enter...
+	Exit        *int64          `json:"exit,omitempty"`        // ...until the value passes Exit, with max, min, or enter
+	Adaptive    *AdaptiveConfig `json:"adaptive,omitempty"`    // learn the threshold from the metric's history
+	Periods     *PeriodConfig   `json:"periods,omitempty"`     // D1 period ratios, overriding the endpoint's
 }
 
 // FileSystem is for operating with local configs and/or data.
@@ -55,7 +75,17 @@ func LoadConfigFileNameWithFS(filename string, fs FileSystem) ([]ConfigFile, err
 	}
 
 	// if validation passes, we're good to load the config
-	return LoadConfigWithFS(file, fs)
+	config, err := LoadConfigWithFS(file, fs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Bad period ratios fail here rather than fall back to the defaults
+	if err = ValidatePeriods(config); err != nil {
+		slog.Error("Invalid periods", slog.Any("Error", err))
+		return nil, err
+	}
+	return config, nil
 }
 
 // ValidateLoadWithFS returns an error on issue
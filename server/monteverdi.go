@@ -1,9 +1,11 @@
 package monteverdi
 
 import (
+	"bytes"
 	"fmt"
 	"log/slog"
-	"strconv"
+	"math"
+	"strings"
 	"sync"
 	"time"
 
@@ -19,6 +21,8 @@ type QNet struct {
 	MU      sync.RWMutex
 	Network Endpoints        // slice of *Endpoint
 	Output  Mp.OutputAdapter // Output interface
+	Clock   Clock            // time source for the network, wall clock when nil
+	Cascade *CascadeDetector // pulses correlated across metrics, off when nil
 }
 
 // NewQNet creates a new Quality Network
@@ -32,11 +36,44 @@ type QNet struct {
 // for example step through the Endpoints slice
 // and fire off a goroutine for each Endpoint
 func NewQNet(ep Endpoints) *QNet {
+	tolerance := FillEnvVarInt("MONTEVERDI_CASCADE_TOLERANCE_SECONDS", 10)
 	return &QNet{
 		Network: ep,
+		Cascade: NewCascadeDetector(time.Duration(tolerance) * time.Second),
 	}
 }
 
+// SetClock gives the QNet and every Endpoint and TemporalGrouper
+// on it the same Clock, e.g. a ManualClock or SimClock to run
+// the engine faster than real time
+func (q *QNet) SetClock(c Clock) {
+	q.MU.Lock()
+	q.Clock = c
+	if q.Cascade != nil {
+		q.Cascade.MU.Lock()
+		q.Cascade.Clock = c
+		q.Cascade.MU.Unlock()
+	}
+	q.MU.Unlock()
+
+	for _, ep := range q.Network {
+		ep.MU.Lock()
+		ep.Clock = c
+		if ep.Pulses != nil {
+			ep.Pulses.Clock = c
+		}
+		ep.MU.Unlock()
+	}
+}
+
+// Now is the time on the QNet's Clock
+func (q *QNet) Now() time.Time {
+	if q == nil {
+		return time.Now()
+	}
+	return clockNow(q.Clock)
+}
+
 // Endpoint is what the app uses to
 // check the URL for whatever comes back
 // and then use each metric listed in the map to grab data
@@ -55,6 +92,8 @@ type Endpoint struct {
 	ID           string                          // string describing the endpoint source
 	URL          string                          // URL endpoint for the service
 	Delim        string                          // delimiter for KV, empty for blobs
+	Format       string                          // "prometheus" to parse the exposition format
+	Source       Mp.DataSource                   // plugin polling the metrics, nil for the default by Delim
 	Interval     time.Duration                   // interval to poll for metrics
 	Metric       map[int]string                  // map of all metric keys to be retrieved
 	Mdata        map[string]int64                // map of all metric data by metric key
@@ -65,6 +104,20 @@ type Endpoint struct {
 	Layer        map[string]*Mt.Timeseries       // map of rolling timeseries by metric key
 	Sequence     map[string]*IctusSequence       // map of total timeseries for pattern matching
 	Pulses       *TemporalGrouper                // accent groups arranged by pattern in time
+	Selectors    map[string]*PromSelector        // map of prometheus series selectors by metric key
+	Series       map[string]string               // map of matched series IDs to their metric key
+	SeriesSeen   map[string]int                  // map of matched series IDs to the poll they were last seen in
+	SeriesTTL    int                             // polls a series is kept without being seen, 0 keeps them
+	Polls        int                             // prometheus polls so far
+	Aggregations map[string]*Aggregation         // map of series aggregations by metric key
+	Clock        Clock                           // time source for ictus and accents, wall clock when nil
+	Client       HTTPClient                      // client with the endpoint's auth, the shared client when nil
+	Thresholds   map[string]*Threshold           // map of accent thresholds by metric, Maxval when missing
+	Adaptive     map[string]*Adaptive            // map of learned thresholds by metric, these take precedence
+	Periods      map[string]Mt.PulseConfig       // map of D1 period ratios by metric, the default when missing
+	Config       ConfigFile                      // the config this endpoint was built from
+
+	polled map[string]bool // series ingested in the current poll
 }
 
 type Endpoints []*Endpoint
@@ -78,6 +131,10 @@ func NewEndpointsFromConfig(cf []ConfigFile) *Endpoints {
 
 	// Pulse lifecycle window (1 hour for full ring progression)
 	pulseWindow := FillEnvVarInt("MONTEVERDI_PULSE_WINDOW_SECONDS", 3600)
+	pulseDimensions := FillEnvVarInt("MONTEVERDI_PULSE_DIMENSIONS", 3)
+
+	// Matched series that stop being exposed are dropped after this many polls
+	seriesTTL := FillEnvVarInt("MONTEVERDI_SERIES_EXPIRE_POLLS", 10)
 
 	// cf is a ConfigFile (JSON) of Endpoints
 	// in the format: ID, URL, MWithMax
@@ -96,12 +153,21 @@ func NewEndpointsFromConfig(cf []ConfigFile) *Endpoints {
 		accent := make(map[string]*Mt.Accent)                 // The accent metadata
 		metsdb := make(map[string]*Mt.Timeseries)             // Timeseries tracking accents
 		ictseq := make(map[string]*IctusSequence)             // Running change Sequence
+		selectors := make(map[string]*PromSelector)           // Prometheus series selectors
+		aggregations := make(map[string]*Aggregation)         // Series aggregations
+		thresholds := make(map[string]*Threshold)             // Accent thresholds
+		adaptive := make(map[string]*Adaptive)                // Learned accent thresholds
+		periods := make(map[string]Mt.PulseConfig)            // D1 period ratios
 		pulses := &TemporalGrouper{
-			WindowSize: time.Duration(pulseWindow) * time.Second, // This is a display config
-			Buffer:     make([]Mt.PulseEvent, 0),
-			Groups:     make([]*Mt.PulseTree, 0),
+			WindowSize:   time.Duration(pulseWindow) * time.Second, // This is a display config
+			Buffer:       make([]Mt.PulseEvent, 0),
+			Groups:       make([]*Mt.PulseTree, 0),
+			MaxDimension: pulseDimensions, // Periods are detected from D3 up to here
 		} // Group patterns in time
 
+		// Period ratios for the endpoint, each metric can override them
+		base := endpointPeriods(c)
+
 		// This locates the desired metrics from the on-disk config
 		j := 0
 		for k, mc := range c.Metrics {
@@ -112,6 +178,20 @@ func NewEndpointsFromConfig(cf []ConfigFile) *Endpoints {
 				MaxSize: tsdbWindow,
 				Current: 0,
 			}
+			if th := metricThreshold(k, mc); th != nil { // min, band, and hysteresis
+				thresholds[k] = th
+			}
+			if mc.Adaptive != nil { // learned threshold
+				if a, err := NewAdaptive(*mc.Adaptive); err != nil {
+					slog.Error("Invalid adaptive threshold, metric will use its static threshold",
+						slog.String("metric", k),
+						slog.Any("error", err))
+				} else {
+					adaptive[k] = a
+				}
+			}
+			periods[k] = metricPeriods(k, mc, base) // D1 period ratios
+
 			if mc.Transformer != "" { // initialize transformer plugin if configured
 				switch mc.Transformer {
 				case "calc_rate":
@@ -120,24 +200,116 @@ func NewEndpointsFromConfig(cf []ConfigFile) *Endpoints {
 						PrevTime: make(map[string]time.Time),
 					}
 				case "json_key":
-					transformers[k] = &Mp.JSONKeyPlugin{MetricKey: k}
+					// The json source extracts the key itself
+					if sourceName(c.Source, c.Delim) != "json" {
+						transformers[k] = &Mp.JSONKeyPlugin{MetricKey: k}
+					}
+				case "histogram_quantile":
+					quantile := 0.95
+					if mc.Quantile != nil {
+						quantile = *mc.Quantile
+					}
+					hq, err := Mp.NewHistogramQuantile(quantile, mc.BucketRate, mc.Scale)
+					if err != nil {
+						slog.Error("Invalid histogram quantile, metric will not be transformed",
+							slog.String("metric", k),
+							slog.Any("error", err))
+					} else {
+						transformers[k] = hq
+					}
+				}
+			}
+			if c.Format == "prometheus" { // the selector defaults to the metric key itself
+				sel := mc.Selector
+				if sel == "" {
+					sel = k
+				}
+				ps, err := ParsePromSelector(sel)
+				if err != nil {
+					slog.Error("Invalid series selector, metric will not match",
+						slog.String("metric", k),
+						slog.String("selector", sel),
+						slog.Any("error", err))
+				} else {
+					selectors[k] = ps
+				}
+				if mc.Aggregate != "" {
+					agg, err := NewAggregation(mc.Aggregate, mc.By, mc.Without)
+					if err != nil {
+						slog.Error("Invalid aggregation, series will not be aggregated",
+							slog.String("metric", k),
+							slog.Any("error", err))
+					} else {
+						aggregations[k] = agg
+					}
 				}
 			}
 
 			j++
 		}
 
+		// Each endpoint with auth settings gets its own client,
+		// invalid auth refuses every request instead of sending none
+		client, err := NewHTTPClient(c.Auth)
+		if err != nil {
+			slog.Error("Invalid auth, endpoint will not be polled",
+				slog.String("endpoint", c.ID),
+				slog.Any("error", err))
+			client = refusedClient{err: fmt.Errorf("endpoint %s has invalid auth: %w", c.ID, err)}
+		}
+
+		// Prometheus is parsed here, everything else comes from a DataSource plugin
+		var source Mp.DataSource
+		if c.Format != "prometheus" {
+			keys := make([]string, 0, len(metric))
+			for i := 0; i < len(metric); i++ {
+				keys = append(keys, metric[i])
+			}
+			options := make(map[string]interface{}, len(c.Config)+1)
+			for k, v := range c.Config {
+				options[k] = v
+			}
+			options["metric_config"] = metricOptions(c.Metrics)
+
+			src, err := NewDataSource(c.Source, c.URL, c.Delim, keys, options)
+			if err != nil {
+				slog.Error("Invalid data source",
+					slog.String("endpoint", c.ID),
+					slog.String("source", c.Source),
+					slog.Any("error", err))
+			} else {
+				source = src
+				if hs, ok := source.(Mp.HTTPSource); ok {
+					hs.SetClient(client)
+				}
+			}
+		}
+
 		// Set polling interval, 15s is the default
 		interval := time.Duration(c.Interval) * time.Second
 		if interval == 0 {
 			interval = 15 * time.Second
 		}
 
+		// User-defined patterns, a D1 place is one poll by default
+		for _, pc := range c.Patterns {
+			analyzer, err := NewPatternAnalyzer(pc, interval)
+			if err != nil {
+				slog.Error("Invalid pattern analyzer, skipping it",
+					slog.String("endpoint", c.ID),
+					slog.Any("error", err))
+				continue
+			}
+			pulses.Analyzers = append(pulses.Analyzers, analyzer)
+		}
+
 		// Assign data we know, initialize data we don't
 		NewEP := Endpoint{
 			ID:           c.ID,
 			URL:          c.URL,
 			Delim:        c.Delim,
+			Format:       c.Format,
+			Source:       source,
 			Metric:       metric,
 			Mdata:        mdata,
 			Interval:     interval,
@@ -148,12 +320,59 @@ func NewEndpointsFromConfig(cf []ConfigFile) *Endpoints {
 			Layer:        metsdb,
 			Sequence:     ictseq,
 			Pulses:       pulses,
+			Selectors:    selectors,
+			Series:       make(map[string]string),
+			SeriesSeen:   make(map[string]int),
+			SeriesTTL:    seriesTTL,
+			Aggregations: aggregations,
+			Client:       client,
+			Thresholds:   thresholds,
+			Adaptive:     adaptive,
+			Periods:      periods,
+			Config:       c,
 		}
 		endpoints = append(endpoints, &NewEP)
 	}
 	return &endpoints
 }
 
+// metricThreshold returns the metric's configured threshold,
+// nil when it accents at its max
+func metricThreshold(k string, mc MetricConfig) *Threshold {
+	th, err := NewThreshold(mc)
+	if err != nil {
+		slog.Error("Invalid threshold, metric will accent at its max",
+			slog.String("metric", k),
+			slog.Any("error", err))
+		return nil
+	}
+	return th
+}
+
+// endpointPeriods returns the endpoint's period ratios, the default when invalid
+func endpointPeriods(c ConfigFile) Mt.PulseConfig {
+	base, err := c.Periods.Apply(Mp.DefaultPulseConfig)
+	if err != nil {
+		slog.Error("Invalid periods, endpoint will use the default",
+			slog.String("endpoint", c.ID),
+			slog.Any("error", err))
+		return Mp.DefaultPulseConfig
+	}
+	return base
+}
+
+// metricPeriods returns the metric's period ratios, the endpoint's when invalid
+func metricPeriods(k string, mc MetricConfig, base Mt.PulseConfig) Mt.PulseConfig {
+	pc, err := mc.Periods.Apply(base)
+	if err != nil {
+		slog.Error("Invalid periods, metric will use the endpoint's",
+			slog.String("metric", k),
+			slog.Any("error", err))
+		return base
+	}
+	return pc
+}
+
 // AddSecondWithCheck tallies each second as a counter
 // then adds a rune to the slice indexed by second
 func (ep *Endpoint) AddSecondWithCheck(m string, isAccent bool) {
@@ -162,7 +381,38 @@ func (ep *Endpoint) AddSecondWithCheck(m string, isAccent bool) {
 
 	// translate this val into a rune for display
 	// ep.Layer[m].Runes[ep.Layer[m].Current] = ep.ValToRuneWithCheck(ep.Mdata[m], isAccent)
-	ep.Layer[m].Runes[ep.Layer[m].Current] = ep.ValToRuneWithCheckMax(ep.Mdata[m], ep.Maxval[m], isAccent)
+	val, max := ep.Threshold(m).Depth(ep.Mdata[m])
+	ep.Layer[m].Runes[ep.Layer[m].Current] = ep.ValToRuneWithCheckMax(val, max, isAccent)
+}
+
+// Threshold returns the metric's accent threshold,
+// at or above its Maxval when none is configured
+func (ep *Endpoint) Threshold(m string) *Threshold {
+	if a, ok := ep.Adaptive[m]; ok {
+		return a.Threshold()
+	}
+	if th, ok := ep.Thresholds[m]; ok {
+		return th
+	}
+	return &Threshold{Mode: ThresholdAbove, Enter: ep.Maxval[m], Exit: ep.Maxval[m]}
+}
+
+// WasAccent tells whether the metric's last recorded ictus is an accent
+func (ep *Endpoint) WasAccent(m string) bool {
+	seq := ep.Sequence[m]
+	if seq == nil || len(seq.Events) == 0 {
+		return false
+	}
+	return seq.Events[len(seq.Events)-1].IsAccent
+}
+
+// InAccent tells whether the metric's current value is an accent:
+// its last recorded state, or its threshold before the first poll
+func (ep *Endpoint) InAccent(m string) bool {
+	if seq := ep.Sequence[m]; seq != nil && len(seq.Events) > 0 {
+		return ep.WasAccent(m)
+	}
+	return ep.Threshold(m).IsAccent(ep.Mdata[m], false)
 }
 
 func (ep *Endpoint) ValToRuneWithCheckMax(val, max int64, isAccent bool) rune {
@@ -192,8 +442,35 @@ func (ep *Endpoint) ValToRuneWithCheckMax(val, max int64, isAccent bool) rune {
 	}
 }
 
+// Metrics lists the Endpoint's metrics in display order.
+// Matched series are added while polling, so readers outside
+// the poller use this instead of ranging over ep.Metric.
+func (ep *Endpoint) Metrics() []string {
+	ep.MU.RLock()
+	defer ep.MU.RUnlock()
+
+	metrics := make([]string, len(ep.Metric))
+	for i := range metrics {
+		metrics[i] = ep.Metric[i]
+	}
+	return metrics
+}
+
+// Value returns the metric's last value and accent
+func (ep *Endpoint) Value(m string) (int64, *Mt.Accent) {
+	ep.MU.RLock()
+	defer ep.MU.RUnlock()
+	return ep.Mdata[m], ep.Accent[m]
+}
+
 // GetDisplay provides the string of runes for drawing using the metric name
 func (ep *Endpoint) GetDisplay(m string) []rune {
+	ep.MU.RLock()
+	defer ep.MU.RUnlock()
+
+	if ep.Layer[m] == nil {
+		return nil
+	}
 	display := make([]rune, ep.Layer[m].MaxSize)
 	for i := 0; i < ep.Layer[m].MaxSize; i++ {
 		// Start from oldest and go to newest (left to right)
@@ -204,11 +481,16 @@ func (ep *Endpoint) GetDisplay(m string) []rune {
 	return display
 }
 
+// Now is the time on the Endpoint's Clock
+func (ep *Endpoint) Now() time.Time {
+	return clockNow(ep.Clock)
+}
+
 // RecordIctus takes the metric, accent state, and metric data (pointer)
 // and records either an ongoing duration if an existing state is continuing,
 // or it creates a new start for a new state.
 func (ep *Endpoint) RecordIctus(m string, isAccent bool, d int64) {
-	now := time.Now()
+	now := ep.Now()
 
 	// Initialize the sequence map if it doesn't exist for this metric
 	if ep.Sequence[m] == nil {
@@ -261,7 +543,7 @@ func (ep *Endpoint) GetPulseVizData(m string, fp *Mt.PulsePattern) []Mt.PulseViz
 	// giving display priority to the Trochee
 	// (configured in ChooseBetterPoint)
 	pointMap := make(map[int]Mt.PulseVizPoint)
-	now := time.Now()
+	now := ep.Now()
 
 	// Track processed pulses to avoid duplicates
 	seenPulses := make(map[string]bool)
@@ -386,6 +668,14 @@ func (ep *Endpoint) CalcAccentStateForPos(pulse Mt.PulseEvent, pos, startPos, en
 		firstThird := startPos + ((endPos - startPos) / 3)
 		secondThird := startPos + (2 * (endPos - startPos) / 3)
 		return pos >= firstThird && pos < secondThird
+	case Mt.Anapest:
+		// non-accent → non-accent → accent: last third true
+		secondThird := startPos + (2 * (endPos - startPos) / 3)
+		return pos >= secondThird
+	case Mt.Dactyl:
+		// accent → non-accent → non-accent: first third true
+		firstThird := startPos + ((endPos - startPos) / 3)
+		return pos < firstThird
 	}
 	return false
 }
@@ -404,8 +694,9 @@ func (q *QNet) FindAccent(m string, i int) *Mt.Accent {
 	// The metric data
 	md := q.Network[i].Mdata[m]
 
-	// The metric max
-	mx := q.Network[i].Maxval[m]
+	// The metric threshold, which can depend on the last state
+	th := q.Network[i].Threshold(m)
+	wasAccent := q.Network[i].WasAccent(m)
 
 	// init values
 	intensity := 1
@@ -413,9 +704,9 @@ func (q *QNet) FindAccent(m string, i int) *Mt.Accent {
 	isAccent := false
 
 	// if the accent exists, fill in a bunch of metadata
-	if md >= mx {
+	if th.IsAccent(md, wasAccent) {
 		q.Network[i].Accent = make(map[string]*Mt.Accent)
-		q.Network[i].Accent[m] = NewAccent(intensity, m)
+		q.Network[i].Accent[m] = NewAccentAt(intensity, m, q.Network[i].Now())
 		a = q.Network[i].Accent[m]
 		isAccent = true
 	}
@@ -429,6 +720,11 @@ func (q *QNet) FindAccent(m string, i int) *Mt.Accent {
 	// recorded Ictus duration in the sequence
 	q.Network[i].RecordIctus(m, isAccent, md)
 
+	// Learn from this value for the next one
+	if adaptive, ok := q.Network[i].Adaptive[m]; ok {
+		adaptive.Observe(md)
+	}
+
 	// Run pulse detection on the updated sequence
 	q.PulseDetect(m, i)
 
@@ -482,23 +778,32 @@ func (q *QNet) PulseDetect(m string, i int) {
 
 		// Detect new pulses and add to the temporal grouper
 		// Tuning period ratios in /config/ is important for pulse detection
-		config := NewPulseConfig(0.5, 0.5, 0.5, 0.5)
-		pulses := ictusSeq.DetectPulsesWithConfig(*config)
+		pulses := ictusSeq.DetectPulsesWithConfig(q.Network[i].PulseConfig(m))
+		pulses = append(pulses, seq.DetectCustom(q.Network[i].Pulses.Analyzers)...)
 
 		for _, pulse := range pulses {
 			// Add the pulse itself
-			q.Network[i].Pulses.AddPulse(pulse)
+			pulse.Endpoint = q.Network[i].ID
+			detected := q.Network[i].Pulses.AddPulse(pulse)
+
+			// Look for the same pulse on other metrics
+			cascades := q.Cascade.AddPulse(q.Network[i].ID, pulse)
 
 			slog.Debug("ADD PULSE", slog.Any("pattern", pulse.Pattern), slog.String("metric", m), slog.String("duration", pulse.Duration.String()))
 
 			// If configured, use the Output Adapter Plugin
 			// The output type depends on the value of MONTEVERDI_OUTPUT
-			if q.Output != nil {
-				if err := q.Output.WritePulse(&pulse); err != nil {
-					slog.Error("Output adapter write failed",
-						slog.String("metric", m),
-						slog.String("error", err.Error()))
-				}
+			q.writePulse(m, &pulse)
+
+			// Higher dimensions found by the grouper,
+			// and their children again now that they have a Parent
+			for j := range detected {
+				q.writePulse(m, &detected[j])
+			}
+
+			// Cascades are pulses too
+			for _, c := range cascades {
+				q.writePulse(m, &c.PulseEvent)
 			}
 		}
 
@@ -507,6 +812,18 @@ func (q *QNet) PulseDetect(m string, i int) {
 	}
 }
 
+// writePulse sends the pulse to the Output Adapter, if one is configured
+func (q *QNet) writePulse(m string, pulse *Mt.PulseEvent) {
+	if q.Output == nil {
+		return
+	}
+	if err := q.Output.WritePulse(pulse); err != nil {
+		slog.Error("Output adapter write failed",
+			slog.String("metric", m),
+			slog.String("error", err.Error()))
+	}
+}
+
 func Max(a, b int) int {
 	if a > b {
 		return a
@@ -514,142 +831,489 @@ func Max(a, b int) int {
 	return b
 }
 
-// PollEndpoint takes the Network index and fetches the metric
+// PollEndpoint takes the Network index and fetches the metrics from its DataSource
 func (q *QNet) PollEndpoint(ni int) {
-	var mname string
-	var mdata, tdata int64
-	var dataSink bool
-	delimiter := q.Network[ni].Delim
-
-	// When Delimiter is set to /""/ the entire fetch is the data
-	if delimiter == "" {
-		slog.Debug("Empty delimiter configured, using Transformer")
-		slog.Debug("JSON poll started",
-			slog.String("endpoint", q.Network[ni].ID),
-			slog.Time("time", time.Now()))
-
-		// To keep the atomicity of the metric name with its transformer key,
-		// load the body early and operate on that with the transformer.
-		code, metricsBlob, err := SingleFetch(q.Network[ni].URL)
+	ep := q.Network[ni]
+
+	// Prometheus exposition is parsed with labels instead of split on Delim
+	if ep.Format == "prometheus" {
+		q.PollPrometheus(ni)
+		return
+	}
+
+	// Endpoints not built from a config get the default source for their Delim
+	source := ep.Source
+	if source == nil {
+		src, err := ep.DefaultSource()
 		if err != nil {
-			slog.Error("Problem fetching body",
-				slog.String("url", q.Network[ni].URL),
-				slog.Int("code", code),
-				slog.Any("error", err))
+			slog.Error("No data source for endpoint", slog.String("endpoint", ep.ID), slog.Any("Error", err))
+			return
 		}
-		slog.Debug("Fetch result",
-			slog.Int("status_code", code),
-			slog.Int("body_length", len(metricsBlob)),
-			slog.String("body", string(metricsBlob)))
-
-		// The metric key name in the configuration is the search term for the Transformer.
-		// Step through each of them, using the metricsBlob body, and locate their values.
-		for _, mname = range q.Network[ni].Metric {
-			// Get the transformer
-			mt := q.Network[ni].Transformers[mname]
+		source = src
+	}
 
-			slog.Debug("Adding metric", slog.String("metric", mname), slog.Any("transformer", mt))
+	slog.Debug("Poll started",
+		slog.String("endpoint", ep.ID),
+		slog.String("source", source.ID()),
+		slog.Time("time", ep.Now()))
 
-			// Currently only JSON has a plugin, but others could be supported
-			switch mt.Type() {
-			case "json_key":
-				// Boolean used to register non-accents for display when set to false
-				dataSink = true
+	polled, err := source.Poll()
+	if err != nil {
+		slog.Error("Could not poll metric",
+			slog.String("endpoint", ep.ID),
+			slog.String("source", source.ID()),
+			slog.Any("Error", err))
+		return
+	}
 
-				// Send the JSON as a string to match the interface args
-				tdata, err = mt.Transform(string(metricsBlob), 0, []int64{0}, time.Now())
-				if err != nil {
-					slog.Error("Transformer error", slog.String("metric", mname), slog.String("error", err.Error()))
-					// No accent to display because the metric is null
-					dataSink = false
-				}
+	// For each metric in the configuration, record, transform, and find the accent state
+	now := ep.Now()
+	for _, mname := range ep.Metric {
+		if mdata, ok := polled[mname]; ok {
+			q.IngestMetric(ni, mname, mdata, now)
+		}
+	}
+}
 
-				// Lock and record data
-				q.Network[ni].MU.Lock()
+// DefaultSource returns the built-in source matching the Endpoint's Delim
+func (ep *Endpoint) DefaultSource() (Mp.DataSource, error) {
+	keys := make([]string, 0, len(ep.Metric))
+	for _, m := range ep.Metric {
+		keys = append(keys, m)
+	}
+	src, err := NewDataSource("", ep.URL, ep.Delim, keys, nil)
+	if err != nil {
+		return nil, err
+	}
+	if hs, ok := src.(Mp.HTTPSource); ok {
+		hs.SetClient(ep.HTTPClient())
+	}
+	return src, nil
+}
 
-				if dataSink {
-					q.Network[ni].ValueToHysteresis(mname, tdata)
-					q.Network[ni].Mdata[mname] = tdata
-				}
+// HTTPClient returns the client with the Endpoint's auth, or the shared client
+func (ep *Endpoint) HTTPClient() HTTPClient {
+	if ep.Client == nil {
+		return sharedHTTPClient
+	}
+	return ep.Client
+}
 
-				// Unlock and find the accent state
-				q.Network[ni].MU.Unlock()
-				q.FindAccent(mname, ni)
+// IngestMetric records one polled value for the metric:
+// it is written to hysteresis, passed through any Transformer,
+// stored in Mdata, and then checked for an accent.
+func (q *QNet) IngestMetric(ni int, mname string, mdata int64, ts time.Time) {
+	// Lock endpoint for the entire op
+	q.Network[ni].MU.Lock()
+
+	// Record data to the hysteresis buffer
+	// This comes before the Transformer so that it can be part of the calculation
+	q.Network[ni].ValueToHysteresis(mname, mdata)
+
+	// If a Transformer plugin is detected, use it
+	transformers := q.Network[ni].Transformers
+
+	// dataSink is false when there is nothing to record,
+	// placing a non-accent instead
+	dataSink := true
+
+	if transformers != nil {
+		mt := transformers[mname] // e.g.: Mp.CalcRatePlugin
+		if mt != nil {
+			tdata, err := mt.Transform(mname, mdata, q.Network[ni].GetHysteresis(mname, mt.HysteresisReq()), ts)
+			if err != nil {
+				// Keep going, log the error, do not write any data
+				slog.Error("Error transforming metric", slog.Any("Error", err))
+				dataSink = false
+			} else {
+				// No check for dataSink here, we know it's true
+				mdata = tdata
 			}
 		}
 	}
 
-	// Any other Delimiter is valid as a K/V pair
-	// pollSource is a map of KV extracted from the remote side
-	pollSource, err := MetricKV(delimiter, q.Network[ni].URL)
+	// Record data to Endpoint
+	if dataSink {
+		q.Network[ni].Mdata[mname] = mdata // Populate the map in the struct
+	}
+
+	// Unlock and find the accent state
+	q.Network[ni].MU.Unlock()
+	q.FindAccent(mname, ni)
+}
+
+// PollPrometheus fetches a Prometheus exposition and feeds
+// every series matched by a configured selector into FindAccent
+// as its own metric, keyed by its canonical series ID.
+// Metrics configured with an aggregation are reduced to their groups first.
+func (q *QNet) PollPrometheus(ni int) {
+	ep := q.Network[ni]
+
+	code, body, err := SingleFetchWithClient(ep.URL, ep.HTTPClient())
 	if err != nil {
-		slog.Error("Could not poll metric", slog.Any("Error", err))
-	}
-
-	// For each metric in the configuration:
-	for _, mname = range q.Network[ni].Metric {
-		// ... search through the polled data for its match
-		for k, v := range pollSource {
-			if k == mname {
-				// We've found the key! now grab from the poll
-				// make floats (e.g. exponential notation) become big integers
-				if floatVal, err := strconv.ParseFloat(v, 64); err != nil {
-					slog.Error("invalid syntax in metric", slog.Any("Error", err))
-					continue
-				} else {
-					mdata = int64(floatVal) // Convert float to int64
-				}
+		slog.Error("Could not poll metric", slog.Int("code", code), slog.Any("Error", err))
+		return
+	}
 
-				// Lock endpoint for the entire op
-				q.Network[ni].MU.Lock()
-
-				// Record data to the hysteresis buffer
-				// This comes before the Transformer so that it can be part of the calculation
-				q.Network[ni].ValueToHysteresis(mname, mdata)
-
-				// If a Transformer plugin is detected, use it
-				transformers := q.Network[ni].Transformers
-
-				// Reset dataSink for placing non-accents
-				dataSink = true
-
-				if transformers != nil {
-					mt := transformers[mname] // e.g.: Mp.CalcRatePlugin
-					if mt != nil {
-						tdata, err = mt.Transform(mname, mdata, q.Network[ni].GetHysteresis(mname, mt.HysteresisReq()), time.Now())
-						if err != nil {
-							// Keep going, log the error, do not write any data
-							slog.Error("Error transforming metric", slog.Any("Error", err))
-							dataSink = false
-						} else {
-							// No check for dataSink here, we know it's true
-							mdata = tdata
-						}
-					}
-				}
+	expo, err := ParsePromExposition(bytes.NewReader(body))
+	if err != nil {
+		slog.Error("Could not parse exposition", slog.String("endpoint", ep.ID), slog.Any("Error", err))
+		return
+	}
+
+	ep.MU.Lock()
+	ep.Polls++
+	ep.polled = make(map[string]bool)
+	ep.MU.Unlock()
+
+	now := ep.Now()
+	for key, sel := range ep.Selectors {
+		// Histograms and summaries are read as a whole
+		if hq, ok := ep.Transformers[key].(*Mp.HistogramQuantilePlugin); ok {
+			q.IngestQuantile(ni, key, sel, hq, expo, now)
+			continue
+		}
+
+		var matched []PromSample
+		for _, sample := range expo.Samples {
+			if sel.Matches(&sample) {
+				matched = append(matched, sample)
+			}
+		}
 
-				// Record data to Endpoint
-				if dataSink {
-					q.Network[ni].Mdata[mname] = mdata // Populate the map in the struct
+		// Aggregated groups become metrics instead of the series
+		if agg, ok := ep.Aggregations[key]; ok {
+			for id, value := range agg.Apply(key, matched) {
+				mdata, _ := PromValueToInt64(value)
+				ep.MU.Lock()
+				fresh := ep.SeeSeries(id, key)
+				ep.MU.Unlock()
+
+				if fresh {
+					q.IngestMetric(ni, id, mdata, now)
 				}
+			}
+			continue
+		}
+
+		for _, sample := range matched {
+			mdata, ok := PromValueToInt64(sample.Value)
+			if !ok {
+				slog.Debug("Skipping NaN sample", slog.String("series", sample.SeriesID()))
+				continue
+			}
+
+			// Each matched series becomes a metric of its own
+			id := sample.SeriesID()
+			ep.MU.Lock()
+			fresh := ep.SeeSeries(id, key)
+			ep.MU.Unlock()
+			if !fresh {
+				continue // already ingested by an overlapping selector
+			}
+
+			// Exposed timestamps are more accurate for transformers like calc_rate
+			ts := now
+			if sample.Timestamp != 0 {
+				ts = time.UnixMilli(sample.Timestamp)
+			}
+
+			q.IngestMetric(ni, id, mdata, ts)
+		}
+	}
+
+	ep.MU.Lock()
+	ep.ExpireSeries()
+	ep.MU.Unlock()
+}
+
+// IngestQuantile collects the _bucket series of the histogram selected for /key/,
+// or the matching quantile series of a summary, into one metric per label set
+// (without "le" or "quantile") and passes them through the quantile transformer.
+// With an aggregation, buckets of the same group and bound are summed.
+// Summary quantiles cannot be aggregated, they are always read per series.
+func (q *QNet) IngestQuantile(ni int, key string, sel *PromSelector, hq *Mp.HistogramQuantilePlugin, expo *PromExposition, ts time.Time) {
+	ep := q.Network[ni]
+	agg := ep.Aggregations[key]
+
+	buckets := make(map[string]map[float64]float64)
+	summary := make(map[string]float64)
+
+	for _, sample := range expo.Samples {
+		if math.IsNaN(sample.Value) {
+			continue
+		}
+
+		// The selector names the histogram, not its parts
+		base := PromSample{Name: sample.Name, Labels: make(map[string]string)}
+		for l, v := range sample.Labels {
+			if l != "le" && l != "quantile" {
+				base.Labels[l] = v
+			}
+		}
+
+		le, isBucket := sample.Labels["le"]
+		quantile, isSummary := sample.Labels["quantile"]
+
+		switch {
+		case isBucket && strings.HasSuffix(sample.Name, "_bucket"):
+			base.Name = strings.TrimSuffix(sample.Name, "_bucket")
+			if !sel.Matches(&base) {
+				continue
+			}
+			bound, err := ParsePromValue(le)
+			if err != nil {
+				slog.Debug("Skipping bucket with invalid bound", slog.String("series", sample.SeriesID()))
+				continue
+			}
 
-				// Unlock and find the accent state
-				q.Network[ni].MU.Unlock()
-				q.FindAccent(mname, ni)
+			id := base.SeriesID()
+			if agg != nil {
+				id = PromSeriesID(key, agg.GroupLabels(base.Labels))
+			}
+			if buckets[id] == nil {
+				buckets[id] = make(map[float64]float64)
+			}
+			buckets[id][bound] += sample.Value
 
-				// Go to the top after we've processed this metric
-				break
+		case isSummary:
+			if !sel.Matches(&base) {
+				continue
 			}
+			qv, err := ParsePromValue(quantile)
+			if err != nil || qv != hq.Quantile {
+				continue
+			}
+			summary[base.SeriesID()] = sample.Value
+		}
+	}
+
+	for id, bounds := range buckets {
+		var total float64
+		bl := make([]Mp.Bucket, 0, len(bounds))
+		for bound, count := range bounds {
+			bl = append(bl, Mp.Bucket{UpperBound: bound, Count: count})
+			if math.IsInf(bound, 1) {
+				total = count
+			}
+		}
+		mdata, _ := PromValueToInt64(total)
+
+		ep.MU.Lock()
+		fresh := ep.SeeSeries(id, key)
+		if fresh {
+			hq.SetBuckets(id, bl)
+		}
+		ep.MU.Unlock()
+
+		if fresh {
+			q.IngestMetric(ni, id, mdata, ts)
+		}
+	}
+
+	for id, value := range summary {
+		mdata, _ := PromValueToInt64(value)
+
+		ep.MU.Lock()
+		fresh := ep.SeeSeries(id, key)
+		if fresh {
+			hq.SetSummary(id, value)
+		}
+		ep.MU.Unlock()
+
+		if fresh {
+			q.IngestMetric(ni, id, mdata, ts)
 		}
 	}
 }
 
+// RegisterSeries adds a series matched by the selector of config /key/
+// as a metric on the Endpoint, inheriting the config's max and transformer.
+// The first series to match a selector takes over the selector's own display slot.
+// NB: Caller must hold ep.MU.Lock()
+func (ep *Endpoint) RegisterSeries(id, key string) {
+	if ep.Series == nil {
+		ep.Series = make(map[string]string)
+	}
+	if _, ok := ep.Series[id]; ok {
+		return
+	}
+	ep.Series[id] = key
+	if ep.SeriesSeen == nil {
+		ep.SeriesSeen = make(map[string]int)
+	}
+	ep.SeriesSeen[id] = ep.Polls
+
+	// Already on display, i.e. matched under its own config key
+	if _, ok := ep.Layer[id]; ok {
+		return
+	}
+
+	ep.Maxval[id] = ep.Maxval[key]
+	if th, ok := ep.Thresholds[key]; ok {
+		if ep.Thresholds == nil {
+			ep.Thresholds = make(map[string]*Threshold)
+		}
+		ep.Thresholds[id] = th
+	}
+	if a, ok := ep.Adaptive[key]; ok {
+		ep.Adaptive[id] = a.Clone() // each series learns its own history
+	}
+	if mt, ok := ep.Transformers[key]; ok {
+		ep.Transformers[id] = mt // transformers keep state by metric name
+	}
+	if pc, ok := ep.Periods[key]; ok {
+		ep.Periods[id] = pc
+	}
+
+	// When the config key is not itself a series, its slot is a placeholder
+	if _, ok := ep.Series[key]; !ok {
+		for idx, m := range ep.Metric {
+			if m == key {
+				ep.Metric[idx] = id
+				ep.Layer[id] = ep.Layer[key]
+				delete(ep.Layer, key)
+				return
+			}
+		}
+	}
+
+	tsdbWindow := FillEnvVarInt("MONTEVERDI_TUI_TSDB_VISUAL_WINDOW", 80)
+	ep.Metric[len(ep.Metric)] = id
+	ep.Layer[id] = &Mt.Timeseries{
+		Runes:   make([]rune, tsdbWindow),
+		MaxSize: tsdbWindow,
+		Current: 0,
+	}
+}
+
+// SeeSeries registers a series matched in the current poll and marks it seen.
+// It returns false when the series was already ingested in this poll,
+// i.e. when the selectors of two config keys overlap.
+// NB: Caller must hold ep.MU.Lock()
+func (ep *Endpoint) SeeSeries(id, key string) bool {
+	if ep.polled == nil {
+		ep.polled = make(map[string]bool)
+	}
+	if ep.polled[id] {
+		return false
+	}
+	ep.polled[id] = true
+
+	ep.RegisterSeries(id, key)
+	ep.SeriesSeen[id] = ep.Polls
+	return true
+}
+
+// ExpireSeries removes the series that have not been seen for SeriesTTL polls.
+// Series matched under their own config key are kept, as configured metrics.
+// NB: Caller must hold ep.MU.Lock()
+func (ep *Endpoint) ExpireSeries() {
+	if ep.SeriesTTL <= 0 {
+		return
+	}
+	for id, seen := range ep.SeriesSeen {
+		if ep.Polls-seen < ep.SeriesTTL {
+			continue
+		}
+		if _, ok := ep.Selectors[id]; ok {
+			continue
+		}
+		slog.Debug("Expiring series",
+			slog.String("endpoint", ep.ID),
+			slog.String("series", id),
+			slog.Int("polls", ep.Polls-seen))
+		ep.removeSeries(id)
+	}
+}
+
+// removeSeries deletes a series and its state from the Endpoint.
+// The last series of a config key gives its display slot back to the key.
+// NB: Caller must hold ep.MU.Lock()
+func (ep *Endpoint) removeSeries(id string) {
+	key := ep.Series[id]
+	delete(ep.Series, id)
+	delete(ep.SeriesSeen, id)
+	delete(ep.Mdata, id)
+	delete(ep.Maxval, id)
+	delete(ep.Thresholds, id)
+	delete(ep.Adaptive, id)
+	delete(ep.Transformers, id)
+	delete(ep.Periods, id)
+	delete(ep.Hysteresis, id)
+	delete(ep.Accent, id)
+	delete(ep.Sequence, id)
+	delete(ep.Layer, id)
+
+	// The key gets its placeholder back when none of its series are left
+	placeholder := true
+	for _, k := range ep.Series {
+		if k == key {
+			placeholder = false
+		}
+	}
+	for _, m := range ep.Metric {
+		if m == key {
+			placeholder = false
+		}
+	}
+
+	metric := make(map[int]string, len(ep.Metric))
+	for i := 0; i < len(ep.Metric); i++ {
+		m := ep.Metric[i]
+		if m == id {
+			if !placeholder {
+				continue
+			}
+			m = key
+			tsdbWindow := FillEnvVarInt("MONTEVERDI_TUI_TSDB_VISUAL_WINDOW", 80)
+			ep.Layer[key] = &Mt.Timeseries{
+				Runes:   make([]rune, tsdbWindow),
+				MaxSize: tsdbWindow,
+				Current: 0,
+			}
+		}
+		metric[len(metric)] = m
+	}
+	ep.Metric = metric
+}
+
 // CycBuffer is a cyclic buffer for hysteresis,
 // where MaxSize number of Mdata values are kept.
 type CycBuffer struct {
 	Values  []int64
 	MaxSize int
 	Index   int
+	Count   int // values written, up to MaxSize
+}
+
+// NewCycBuffer returns an empty buffer holding size values
+func NewCycBuffer(size int) *CycBuffer {
+	return &CycBuffer{
+		Values:  make([]int64, size),
+		MaxSize: size,
+	}
+}
+
+// Add writes the value over the oldest one
+func (cb *CycBuffer) Add(value int64) {
+	cb.Values[cb.Index] = value
+
+	// Index always points to the next empty slot
+	cb.Index = (cb.Index + 1) % cb.MaxSize
+	if cb.Count < cb.MaxSize {
+		cb.Count++
+	}
+}
+
+// Recent returns the values written so far, newest first
+func (cb *CycBuffer) Recent() []int64 {
+	result := make([]int64, 0, cb.Count)
+	for i := 0; i < cb.Count; i++ {
+		idx := (cb.Index - 1 - i + cb.MaxSize) % cb.MaxSize
+		result = append(result, cb.Values[idx])
+	}
+	return result
 }
 
 // ValueToHysteresis records metric data to a cyclical buffer
@@ -662,21 +1326,13 @@ func (ep *Endpoint) ValueToHysteresis(metric string, value int64) {
 	}
 
 	// Initialize the buffer if it doesn't exist, Index will be 0
+	// Limit on this buffer is 20
 	if ep.Hysteresis[metric] == nil {
-		ep.Hysteresis[metric] = &CycBuffer{
-			Values:  make([]int64, 20), // Initialize at 20 values
-			MaxSize: 20,                // Limit on this buffer is 20
-		}
+		ep.Hysteresis[metric] = NewCycBuffer(20)
 	}
 
-	// Get the buffer
-	buffer := ep.Hysteresis[metric]
-
 	// Assign the metric value to the buffer
-	buffer.Values[buffer.Index] = value
-
-	// Index always points to the next empty slot
-	buffer.Index = (buffer.Index + 1) % buffer.MaxSize
+	ep.Hysteresis[metric].Add(value)
 }
 
 // GetHysteresis retrieves a depth of metrics to use for calculations
@@ -688,10 +1344,14 @@ func (ep *Endpoint) GetHysteresis(metric string, depth int) []int64 {
 		return []int64{}
 	}
 
-	// Clamp depth to the max buffer size
+	// Clamp depth to the max buffer size,
+	// a negative depth means not applicable (e.g. json_key)
 	if depth > buffer.MaxSize {
 		depth = buffer.MaxSize
 	}
+	if depth < 0 {
+		depth = 0
+	}
 
 	// Slice size equals the requested depth
 	result := make([]int64, 0, depth)
@@ -705,6 +705,38 @@ func TestEndpoint_GetPulseVizData(t *testing.T) {
 
 	})
 
+	t.Run("Anapest calculation", func(t *testing.T) {
+		ep := &Ms.Endpoint{}
+		pulse := Mt.PulseEvent{Pattern: Mt.Anapest}
+		startPos, firstPt, secondPt, endPos := 10, 20, 30, 40
+
+		if ep.CalcAccentStateForPos(pulse, firstPt-1, startPos, endPos) {
+			t.Errorf("Expected NO Accent in the first third")
+		}
+		if ep.CalcAccentStateForPos(pulse, (firstPt+secondPt)/2, startPos, endPos) {
+			t.Errorf("Expected NO Accent in the second third")
+		}
+		if !ep.CalcAccentStateForPos(pulse, secondPt+1, startPos, endPos) {
+			t.Errorf("Expected Accent in the last third")
+		}
+	})
+
+	t.Run("Dactyl calculation", func(t *testing.T) {
+		ep := &Ms.Endpoint{}
+		pulse := Mt.PulseEvent{Pattern: Mt.Dactyl}
+		startPos, firstPt, secondPt, endPos := 10, 20, 30, 40
+
+		if !ep.CalcAccentStateForPos(pulse, firstPt-1, startPos, endPos) {
+			t.Errorf("Expected Accent in the first third")
+		}
+		if ep.CalcAccentStateForPos(pulse, (firstPt+secondPt)/2, startPos, endPos) {
+			t.Errorf("Expected NO Accent in the second third")
+		}
+		if ep.CalcAccentStateForPos(pulse, secondPt+1, startPos, endPos) {
+			t.Errorf("Expected NO Accent in the last third")
+		}
+	})
+
 	t.Run("Calculation returns false for no result", func(t *testing.T) {
 		ep := &Ms.Endpoint{}
 		pulse := Mt.PulseEvent{Pattern: 9}
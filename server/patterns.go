@@ -0,0 +1,175 @@
+package monteverdi
+
+/*
+
+	User-defined patterns
+
+	Each endpoint can add PatternAnalyzers to the built-in feet:
+
+		"pattern_analyzers": [
+			{ "type": "custom_pulse", "name": "double_accent", "sequence": [true, true, false], "dimension": 1 },
+			{ "type": "custom_pulse", "name": "surge", "sequence": [false, true, true, true], "dimension": 2 }
+		]
+
+	D1 analyzers read the metric's IctusSequence in PulseDetect,
+	D2 and up read the recent pulses of the dimension below in the TemporalGrouper.
+	Their pulses are Custom, carry the analyzer's name, and go everywhere
+	the built-in pulses go, but never make up a built-in foot or Period.
+
+*/
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	Mp "github.com/maroda/monteverdi/plugin"
+	Mt "github.com/maroda/monteverdi/types"
+)
+
+// customHistory is how many recent pulses of each dimension the Analyzers read
+const customHistory = 32
+
+// NewPatternAnalyzer sets up an analyzer from a "pattern_analyzers" entry.
+// beat is the default length of one D1 place, the endpoint's interval.
+func NewPatternAnalyzer(config map[string]interface{}, beat time.Duration) (Mp.PatternAnalyzer, error) {
+	name, _ := config["type"].(string)
+	analyzer, err := Mp.AnalyzerLookup(name)
+	if err != nil {
+		return nil, err
+	}
+
+	ca, ok := analyzer.(Mp.ConfigurableAnalyzer)
+	if !ok {
+		return nil, fmt.Errorf("pattern analyzer %s takes no configuration", name)
+	}
+
+	options := make(map[string]interface{}, len(config)+1)
+	for k, v := range config {
+		options[k] = v
+	}
+	if _, ok := options["beat"]; !ok {
+		options["beat"] = beat.Seconds()
+	}
+
+	if err := ca.Configure(options); err != nil {
+		return nil, fmt.Errorf("could not configure pattern analyzer %s: %w", name, err)
+	}
+	return ca, nil
+}
+
+// DetectCustom runs the D1 analyzers on the whole sequence,
+// returning only pulses that start after the last one each has found
+func (is *IctusSequence) DetectCustom(analyzers []Mp.PatternAnalyzer) []Mt.PulseEvent {
+	var pulses []Mt.PulseEvent
+
+	for _, a := range analyzers {
+		if a.Dimension() != 1 {
+			continue
+		}
+
+		found, err := a.DetectPatterns(is.Events)
+		if err != nil {
+			slog.Error("Pattern analyzer failed",
+				slog.String("pattern", a.PatternName()),
+				slog.String("metric", is.Metric),
+				slog.Any("error", err))
+			continue
+		}
+
+		if is.LastCustom == nil {
+			is.LastCustom = make(map[string]time.Time)
+		}
+		for _, p := range found {
+			if !p.StartTime.After(is.LastCustom[a.PatternName()]) {
+				continue
+			}
+			is.LastCustom[a.PatternName()] = p.StartTime
+
+			p.Dimension = 1
+			p.Metric = []string{is.Metric}
+			pulses = append(pulses, p)
+		}
+	}
+
+	return pulses
+}
+
+// detectCustom adds a pulse to the history of its dimension
+// and runs the analyzers of the dimension above it
+func (tg *TemporalGrouper) detectCustom(pulse Mt.PulseEvent) {
+	if len(tg.Analyzers) == 0 {
+		return
+	}
+
+	if tg.History == nil {
+		tg.History = make(map[int][]Mt.PulseEvent)
+	}
+	if tg.LastCustom == nil {
+		tg.LastCustom = make(map[string]time.Time)
+	}
+
+	// Pending consorts can start before the last D1 pulse
+	history := append(tg.History[pulse.Dimension], pulse)
+	sort.SliceStable(history, func(i, j int) bool {
+		return history[i].StartTime.Before(history[j].StartTime)
+	})
+	if len(history) > customHistory {
+		history = history[len(history)-customHistory:]
+	}
+	tg.History[pulse.Dimension] = history
+
+	for _, a := range tg.Analyzers {
+		if a.Dimension() != pulse.Dimension+1 {
+			continue
+		}
+
+		found, err := a.DetectPatterns(tg.beats(history))
+		if err != nil {
+			slog.Error("Pattern analyzer failed",
+				slog.String("pattern", a.PatternName()),
+				slog.Any("error", err))
+			continue
+		}
+
+		for _, p := range found {
+			if !p.StartTime.After(tg.LastCustom[a.PatternName()]) {
+				continue
+			}
+			tg.LastCustom[a.PatternName()] = p.StartTime
+
+			p.Dimension = pulse.Dimension + 1
+			for _, h := range history {
+				if len(p.Children) > 0 && h.StartTime.Equal(p.Children[0]) {
+					p.Metric = h.Metric
+					p.Endpoint = h.Endpoint
+					break
+				}
+			}
+
+			slog.Debug("CUSTOM_PATTERN_DETECTED",
+				slog.String("pattern", a.PatternName()),
+				slog.Int("dimension", p.Dimension))
+
+			tg.adopt(p)
+		}
+	}
+}
+
+// beats is PulseBeats with the accents of user-defined patterns,
+// which start on an accent when their sequence does
+func (tg *TemporalGrouper) beats(pulses []Mt.PulseEvent) []Mt.Ictus {
+	beats := PulseBeats(pulses)
+	for i, p := range pulses {
+		if p.Pattern != Mt.Custom {
+			continue
+		}
+		for _, a := range tg.Analyzers {
+			if sa, ok := a.(*Mp.SequenceAnalyzer); ok && sa.Name == p.Name && len(sa.Sequence) > 0 {
+				beats[i].IsAccent = sa.Sequence[0]
+			}
+		}
+	}
+	return beats
+}
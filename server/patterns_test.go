@@ -0,0 +1,130 @@
+package monteverdi_test
+
+import (
+	"testing"
+	"time"
+
+	Mp "github.com/maroda/monteverdi/plugin"
+	Ms "github.com/maroda/monteverdi/server"
+	Mt "github.com/maroda/monteverdi/types"
+)
+
+func TestNewPatternAnalyzer(t *testing.T) {
+	t.Run("Defaults the beat to the interval", func(t *testing.T) {
+		got, err := Ms.NewPatternAnalyzer(map[string]interface{}{
+			"type":     "custom_pulse",
+			"name":     "double_accent",
+			"sequence": []interface{}{true, true},
+		}, 15*time.Second)
+		assertError(t, err, nil)
+
+		sa := got.(*Mp.SequenceAnalyzer)
+		if sa.Beat != 15*time.Second {
+			t.Errorf("Expected a 15s beat, got %v", sa.Beat)
+		}
+	})
+
+	t.Run("Keeps a configured beat", func(t *testing.T) {
+		got, err := Ms.NewPatternAnalyzer(map[string]interface{}{
+			"type":     "custom_pulse",
+			"name":     "double_accent",
+			"sequence": []interface{}{true, true},
+			"beat":     float64(5),
+		}, 15*time.Second)
+		assertError(t, err, nil)
+		if got.(*Mp.SequenceAnalyzer).Beat != 5*time.Second {
+			t.Errorf("Expected a 5s beat, got %v", got.(*Mp.SequenceAnalyzer).Beat)
+		}
+	})
+
+	t.Run("Rejects unknown and built-in types", func(t *testing.T) {
+		_, err := Ms.NewPatternAnalyzer(map[string]interface{}{"type": "craquemattic"}, time.Second)
+		assertGotError(t, err)
+		_, err = Ms.NewPatternAnalyzer(map[string]interface{}{"type": "iamb"}, time.Second)
+		assertGotError(t, err)
+	})
+
+	t.Run("Skips invalid entries in the config", func(t *testing.T) {
+		eps := Ms.NewEndpointsFromConfig([]Ms.ConfigFile{makePatternConfig(
+			map[string]interface{}{"type": "custom_pulse", "sequence": []interface{}{true}},
+		)})
+		assertInt(t, len((*eps)[0].Pulses.Analyzers), 0)
+	})
+}
+
+func TestQNet_CustomPatterns(t *testing.T) {
+	start := time.Date(2023, 10, 1, 14, 0, 0, 0, time.UTC)
+	eps := Ms.NewEndpointsFromConfig([]Ms.ConfigFile{makePatternConfig(
+		map[string]interface{}{"type": "custom_pulse", "name": "double_accent", "sequence": []interface{}{true, true}},
+		map[string]interface{}{"type": "custom_pulse", "name": "rise", "sequence": []interface{}{false, true}, "dimension": float64(2)},
+	)})
+	assertInt(t, len((*eps)[0].Pulses.Analyzers), 2)
+
+	qn := Ms.NewQNet(*eps)
+	clock := Ms.NewManualClock(start)
+	qn.SetClock(clock)
+
+	// Each accent lasts two polls, two beats of the double_accent
+	for i := 0; i < 48; i++ {
+		var value int64
+		if (i/2)%2 == 1 {
+			value = 150
+		}
+		qn.IngestMetric(0, "latency", value, clock.Now())
+		clock.Advance(5 * time.Second)
+	}
+
+	counts := make(map[string]int)
+	for _, p := range qn.Network[0].Pulses.Buffer {
+		if p.Pattern != Mt.Custom {
+			continue
+		}
+		counts[p.Name]++
+		assertString(t, p.Metric[0], "latency")
+		switch p.Name {
+		case "double_accent":
+			assertInt(t, p.Dimension, 1)
+		case "rise":
+			assertInt(t, p.Dimension, 2)
+			assertInt(t, len(p.Children), 2)
+		}
+	}
+
+	if counts["double_accent"] == 0 || counts["rise"] == 0 {
+		t.Fatalf("Expected both custom patterns, got %v", counts)
+	}
+
+	t.Run("Each pulse is detected once", func(t *testing.T) {
+		seen := make(map[string]bool)
+		for _, p := range qn.Network[0].Pulses.Buffer {
+			if p.Pattern != Mt.Custom {
+				continue
+			}
+			key := p.Name + p.StartTime.String()
+			if seen[key] {
+				t.Errorf("Duplicate %s at %v", p.Name, p.StartTime)
+			}
+			seen[key] = true
+		}
+	})
+
+	t.Run("Built-in feet still form around custom pulses", func(t *testing.T) {
+		for _, p := range qn.Network[0].Pulses.Buffer {
+			if p.Pattern == Mt.Amphibrach {
+				return
+			}
+		}
+		t.Error("Expected the built-in Amphibrachs to keep forming")
+	})
+}
+
+func makePatternConfig(patterns ...map[string]interface{}) Ms.ConfigFile {
+	return Ms.ConfigFile{
+		ID:       "DB",
+		URL:      "http://localhost:8090/db",
+		Delim:    "=",
+		Interval: 5,
+		Metrics:  map[string]Ms.MetricConfig{"latency": {Type: "gauge", Max: 100}},
+		Patterns: patterns,
+	}
+}
@@ -0,0 +1,137 @@
+package monteverdi
+
+/*
+
+	D1 period ratios
+
+	An Iamb or Trochee spans two ictus, the ratios set where
+	in the first one it starts and where in the second one it ends:
+
+		0.0 = start of the ictus, 0.5 = middle (default), 1.0 = end
+
+	They can be set for an endpoint and overridden per metric:
+
+		"periods": { "iamb_start": 0.25, "trochee_end": 0.75 },
+		"metrics": {
+			"cpu": { "max": 90, "periods": { "iamb_start": 0.0 } }
+		}
+
+	Missing ratios are inherited, metric from endpoint, endpoint from the default.
+
+*/
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	Mp "github.com/maroda/monteverdi/plugin"
+	Mt "github.com/maroda/monteverdi/types"
+)
+
+// PeriodConfig is a set of D1 period ratios, each optional
+type PeriodConfig struct {
+	IambStart    *float64 `json:"iamb_start,omitempty"`    // within the non-accent before an Iamb's accent
+	IambEnd      *float64 `json:"iamb_end,omitempty"`      // within the Iamb's accent
+	TrocheeStart *float64 `json:"trochee_start,omitempty"` // within the accent before a Trochee's non-accent
+	TrocheeEnd   *float64 `json:"trochee_end,omitempty"`   // within the Trochee's non-accent
+}
+
+// Apply returns base with the configured ratios,
+// or an error when any of them is outside 0.0–1.0
+func (pc *PeriodConfig) Apply(base Mt.PulseConfig) (Mt.PulseConfig, error) {
+	if pc == nil {
+		return base, nil
+	}
+
+	ratios := []struct {
+		name  string
+		value *float64
+		dest  *float64
+	}{
+		{"iamb_start", pc.IambStart, &base.IambStartPeriod},
+		{"iamb_end", pc.IambEnd, &base.IambEndPeriod},
+		{"trochee_start", pc.TrocheeStart, &base.TrocheeStartPeriod},
+		{"trochee_end", pc.TrocheeEnd, &base.TrocheeEndPeriod},
+	}
+	for _, r := range ratios {
+		if r.value == nil {
+			continue
+		}
+		if *r.value < 0 || *r.value > 1 {
+			return base, fmt.Errorf("period %s must be from 0.0 to 1.0, got %v", r.name, *r.value)
+		}
+		*r.dest = *r.value
+	}
+
+	return base, nil
+}
+
+// ValidatePeriods checks every period ratio in the config
+func ValidatePeriods(cf []ConfigFile) error {
+	for _, c := range cf {
+		base, err := c.Periods.Apply(Mp.DefaultPulseConfig)
+		if err != nil {
+			return fmt.Errorf("endpoint %s: %w", c.ID, err)
+		}
+		for k, mc := range c.Metrics {
+			if _, err := mc.Periods.Apply(base); err != nil {
+				return fmt.Errorf("endpoint %s metric %s: %w", c.ID, k, err)
+			}
+		}
+	}
+	return nil
+}
+
+// PulseConfig returns the metric's period ratios, the default when none are configured
+func (ep *Endpoint) PulseConfig(m string) Mt.PulseConfig {
+	if pc, ok := ep.Periods[m]; ok {
+		return pc
+	}
+	return Mp.DefaultPulseConfig
+}
+
+// PeriodPreview is a recent D1 pulse with its span under the current
+// and the proposed period ratios
+type PeriodPreview struct {
+	Pattern  string    `json:"pattern"`  // iamb or trochee
+	Start    time.Time `json:"start"`    // with the current ratios
+	End      time.Time `json:"end"`      //
+	NewStart time.Time `json:"newStart"` // with the proposed ratios
+	NewEnd   time.Time `json:"newEnd"`   //
+}
+
+// PreviewPeriods runs D1 detection over the metric's recent ictus
+// with both the current and the proposed ratios, neither is recorded.
+// The ratios only move a pulse, so both runs find the same pulses in the same order.
+func (ep *Endpoint) PreviewPeriods(m string, proposed Mt.PulseConfig) []PeriodPreview {
+	seq := ep.Sequence[m]
+	if seq == nil {
+		return nil
+	}
+	current := ep.PulseConfig(m)
+
+	var previews []PeriodPreview
+	feet := []func(Mt.PulseConfig) *Mp.BinaryFootAnalyzer{Mp.NewIambAnalyzer, Mp.NewTrocheeAnalyzer}
+	for _, foot := range feet {
+		before, _ := foot(current).DetectPatterns(seq.Events)
+		after, _ := foot(proposed).DetectPatterns(seq.Events)
+		for i := range before {
+			if i >= len(after) {
+				break
+			}
+			previews = append(previews, PeriodPreview{
+				Pattern:  foot(current).PatternName(),
+				Start:    before[i].StartTime,
+				End:      before[i].StartTime.Add(before[i].Duration),
+				NewStart: after[i].StartTime,
+				NewEnd:   after[i].StartTime.Add(after[i].Duration),
+			})
+		}
+	}
+
+	sort.Slice(previews, func(i, j int) bool {
+		return previews[i].Start.Before(previews[j].Start)
+	})
+	return previews
+}
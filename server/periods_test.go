@@ -0,0 +1,206 @@
+package monteverdi_test
+
+import (
+	"testing"
+	"time"
+
+	Mp "github.com/maroda/monteverdi/plugin"
+	Ms "github.com/maroda/monteverdi/server"
+	Mt "github.com/maroda/monteverdi/types"
+)
+
+func TestPeriodConfig_Apply(t *testing.T) {
+	ratio := func(f float64) *float64 { return &f }
+
+	t.Run("Keeps the base without ratios", func(t *testing.T) {
+		var pc *Ms.PeriodConfig
+		got, err := pc.Apply(Mp.DefaultPulseConfig)
+		assertError(t, err, nil)
+		if got != Mp.DefaultPulseConfig {
+			t.Errorf("Expected the default, got %+v", got)
+		}
+	})
+
+	t.Run("Overrides only the configured ratios", func(t *testing.T) {
+		pc := &Ms.PeriodConfig{IambStart: ratio(0), TrocheeEnd: ratio(1)}
+		got, err := pc.Apply(Mp.DefaultPulseConfig)
+		assertError(t, err, nil)
+		want := Mt.PulseConfig{IambStartPeriod: 0, IambEndPeriod: 0.5, TrocheeStartPeriod: 0.5, TrocheeEndPeriod: 1}
+		if got != want {
+			t.Errorf("Expected %+v, got %+v", want, got)
+		}
+	})
+
+	t.Run("Rejects ratios outside 0.0 to 1.0", func(t *testing.T) {
+		for _, pc := range []*Ms.PeriodConfig{
+			{IambStart: ratio(-0.1)},
+			{IambEnd: ratio(1.5)},
+			{TrocheeStart: ratio(2)},
+			{TrocheeEnd: ratio(-1)},
+		} {
+			_, err := pc.Apply(Mp.DefaultPulseConfig)
+			assertGotError(t, err)
+		}
+	})
+}
+
+func TestValidatePeriods(t *testing.T) {
+	ratio := func(f float64) *float64 { return &f }
+
+	t.Run("Accepts valid endpoint and metric ratios", func(t *testing.T) {
+		err := Ms.ValidatePeriods([]Ms.ConfigFile{{
+			ID:      "DB",
+			Periods: &Ms.PeriodConfig{IambStart: ratio(0.25)},
+			Metrics: map[string]Ms.MetricConfig{"latency": {Periods: &Ms.PeriodConfig{IambEnd: ratio(0.75)}}},
+		}})
+		assertError(t, err, nil)
+	})
+
+	t.Run("Names the metric with an invalid ratio", func(t *testing.T) {
+		err := Ms.ValidatePeriods([]Ms.ConfigFile{{
+			ID:      "DB",
+			Metrics: map[string]Ms.MetricConfig{"latency": {Periods: &Ms.PeriodConfig{IambEnd: ratio(7)}}},
+		}})
+		assertGotError(t, err)
+		assertStringContains(t, err.Error(), "latency")
+	})
+
+	t.Run("Fails loading a config file with an invalid ratio", func(t *testing.T) {
+		configFile, delConfig := createTempFile(t, `[{
+  "id": "DB",
+  "url": "http://localhost:8090/db",
+  "delim": "=",
+  "periods": {"trochee_start": 1.5},
+  "metrics": {"latency": {"type": "gauge", "max": 100}}
+}]`)
+		defer delConfig()
+
+		_, err := Ms.LoadConfigFileName(configFile.Name())
+		assertGotError(t, err)
+		assertStringContains(t, err.Error(), "endpoint DB")
+	})
+}
+
+func TestNewEndpointsFromConfig_Periods(t *testing.T) {
+	ratio := func(f float64) *float64 { return &f }
+
+	eps := Ms.NewEndpointsFromConfig([]Ms.ConfigFile{
+		{
+			ID:      "DB",
+			URL:     "http://localhost:8090/db",
+			Delim:   "=",
+			Periods: &Ms.PeriodConfig{IambStart: ratio(0.25), TrocheeEnd: ratio(0.75)},
+			Metrics: map[string]Ms.MetricConfig{
+				"latency":     {Type: "gauge", Max: 100, Periods: &Ms.PeriodConfig{IambStart: ratio(0)}},
+				"connections": {Type: "gauge", Max: 100},
+				"locks":       {Type: "gauge", Max: 100, Periods: &Ms.PeriodConfig{IambEnd: ratio(3)}},
+			},
+		},
+		{
+			ID:      "API",
+			URL:     "http://localhost:8090/api",
+			Delim:   "=",
+			Periods: &Ms.PeriodConfig{IambStart: ratio(-1)},
+			Metrics: map[string]Ms.MetricConfig{"errors": {Type: "gauge", Max: 10}},
+		},
+	})
+	db, api := (*eps)[0], (*eps)[1]
+
+	t.Run("Metric ratios override the endpoint's", func(t *testing.T) {
+		got := db.PulseConfig("latency")
+		if got.IambStartPeriod != 0 || got.TrocheeEndPeriod != 0.75 || got.IambEndPeriod != 0.5 {
+			t.Errorf("Expected the metric's iamb_start over the endpoint's, got %+v", got)
+		}
+	})
+
+	t.Run("Metrics inherit the endpoint's", func(t *testing.T) {
+		got := db.PulseConfig("connections")
+		if got.IambStartPeriod != 0.25 || got.TrocheeEndPeriod != 0.75 {
+			t.Errorf("Expected the endpoint's ratios, got %+v", got)
+		}
+	})
+
+	t.Run("Invalid metric ratios fall back to the endpoint's", func(t *testing.T) {
+		if got := db.PulseConfig("locks"); got != db.PulseConfig("connections") {
+			t.Errorf("Expected the endpoint's ratios, got %+v", got)
+		}
+	})
+
+	t.Run("Invalid endpoint ratios fall back to the default", func(t *testing.T) {
+		if got := api.PulseConfig("errors"); got != Mp.DefaultPulseConfig {
+			t.Errorf("Expected the default ratios, got %+v", got)
+		}
+	})
+
+	t.Run("Unknown metrics use the default", func(t *testing.T) {
+		if got := db.PulseConfig("craquemattic"); got != Mp.DefaultPulseConfig {
+			t.Errorf("Expected the default ratios, got %+v", got)
+		}
+	})
+}
+
+func TestQNet_PulseDetectPeriods(t *testing.T) {
+	ratio := func(f float64) *float64 { return &f }
+	start := time.Date(2023, 10, 1, 14, 0, 0, 0, time.UTC)
+
+	eps := Ms.NewEndpointsFromConfig([]Ms.ConfigFile{{
+		ID:      "DB",
+		URL:     "http://localhost:8090/db",
+		Delim:   "=",
+		Periods: &Ms.PeriodConfig{IambStart: ratio(0), IambEnd: ratio(1)},
+		Metrics: map[string]Ms.MetricConfig{"latency": {Type: "gauge", Max: 100}},
+	}})
+	qn := Ms.NewQNet(*eps)
+	clock := Ms.NewManualClock(start)
+	qn.SetClock(clock)
+
+	for i := 0; i < 12; i++ {
+		var value int64
+		if i%2 == 1 {
+			value = 150
+		}
+		qn.IngestMetric(0, "latency", value, clock.Now())
+		clock.Advance(5 * time.Second)
+	}
+
+	ep := qn.Network[0]
+	iambs := 0
+	for _, p := range ep.Pulses.Buffer {
+		if p.Pattern != Mt.Iamb {
+			continue
+		}
+		iambs++
+
+		// Each Iamb spans the whole non-accent and the whole accent
+		if p.Duration != 10*time.Second || p.StartTime.Sub(start)%(10*time.Second) != 0 {
+			t.Errorf("Expected the Iamb to span both ictus, got %v for %v", p.StartTime.Sub(start), p.Duration)
+		}
+	}
+	if iambs == 0 {
+		t.Fatal("Expected Iambs")
+	}
+
+	t.Run("Previews proposed ratios without recording them", func(t *testing.T) {
+		before := len(ep.Pulses.Buffer)
+		proposed := Mp.DefaultPulseConfig
+		previews := ep.PreviewPeriods("latency", proposed)
+		if len(previews) == 0 {
+			t.Fatal("Expected previews")
+		}
+		for _, p := range previews {
+			if p.Pattern == "iamb" && p.NewStart.Sub(p.Start) != 2500*time.Millisecond {
+				t.Errorf("Expected the Iamb to start 2.5s later, got %v", p.NewStart.Sub(p.Start))
+			}
+			if p.Pattern == "iamb" && p.End.Sub(p.NewEnd) != 2500*time.Millisecond {
+				t.Errorf("Expected the Iamb to end 2.5s earlier, got %v", p.End.Sub(p.NewEnd))
+			}
+		}
+		for i := 1; i < len(previews); i++ {
+			if previews[i].Start.Before(previews[i-1].Start) {
+				t.Error("Expected previews in order")
+			}
+		}
+		assertInt(t, len(ep.Pulses.Buffer), before)
+		assertInt(t, len(ep.PreviewPeriods("craquemattic", proposed)), 0)
+	})
+}
@@ -78,6 +78,70 @@ func TestQNet_PulseDetectWriteBadgerDB(t *testing.T) {
 			t.Errorf("Expected to get PulseEvent but got %v", get)
 		}
 		assertStringContains(t, got[0].Metric[0], testMetric)
+		assertString(t, got[0].Endpoint, qn.Network[0].ID)
+	})
+}
+
+func TestQNet_GrouperPulsesWriteBadgerDB(t *testing.T) {
+	start := time.Date(2023, 10, 1, 14, 0, 0, 0, time.UTC)
+	eps := Ms.NewEndpointsFromConfig([]Ms.ConfigFile{makePatternConfig(
+		map[string]interface{}{"type": "custom_pulse", "name": "rise", "sequence": []interface{}{false, true}, "dimension": float64(2)},
+	)})
+	qn := Ms.NewQNet(*eps)
+	clock := Ms.NewManualClock(start)
+	qn.SetClock(clock)
+
+	output, err := Mp.NewBadgerOutput(t.TempDir(), 1)
+	assertError(t, err, nil)
+	defer output.Close()
+	qn.Output = output
+
+	for i := 0; i < 48; i++ {
+		var value int64
+		if (i/2)%2 == 1 {
+			value = 150
+		}
+		qn.IngestMetric(0, "latency", value, clock.Now())
+		clock.Advance(5 * time.Second)
+	}
+
+	t.Run("Finds a D2 custom pulse by name", func(t *testing.T) {
+		page, err := output.Query(Mp.PulseQuery{Name: "rise"})
+		assertError(t, err, nil)
+		if len(page.Pulses) == 0 {
+			t.Fatal("Expected the rise pulses in the archive")
+		}
+		for _, p := range page.Pulses {
+			assertInt(t, p.Dimension, 2)
+			assertInt(t, len(p.Children), 2)
+			assertString(t, p.Metric[0], "latency")
+		}
+	})
+
+	t.Run("Children are written with their Parent", func(t *testing.T) {
+		page, err := output.Query(Mp.PulseQuery{Dimension: 2})
+		assertError(t, err, nil)
+		parents := make(map[time.Time]bool)
+		for _, p := range page.Pulses {
+			if p.Pattern != Mt.Custom {
+				parents[p.StartTime] = true
+			}
+		}
+		if len(parents) == 0 {
+			t.Fatal("Expected consorts in the archive")
+		}
+
+		page, err = output.Query(Mp.PulseQuery{Dimension: 1})
+		assertError(t, err, nil)
+		linked := 0
+		for _, p := range page.Pulses {
+			if parents[p.Parent] {
+				linked++
+			}
+		}
+		if linked == 0 {
+			t.Error("Expected D1 pulses with the consort as Parent")
+		}
 	})
 }
 
@@ -4,7 +4,6 @@ import (
 	"testing"
 	"time"
 
-	Mp "github.com/maroda/monteverdi/plugin"
 	Ms "github.com/maroda/monteverdi/server"
 	Mt "github.com/maroda/monteverdi/types"
 )
@@ -34,8 +33,7 @@ func TestQNet_PollEndpoint_JSONKeyPlugin(t *testing.T) {
 			Buffer:     make([]Mt.PulseEvent, 0),
 			Groups:     make([]*Mt.PulseTree, 0),
 		},
-		Hysteresis:   make(map[string]*Ms.CycBuffer),
-		Transformers: map[string]Mp.MetricTransformer{testMetric: &Mp.JSONKeyPlugin{testMetric}},
+		Hysteresis: make(map[string]*Ms.CycBuffer),
 	}
 	eps := Ms.Endpoints{ep}
 	qn := Ms.NewQNet(eps)
@@ -77,10 +75,11 @@ func TestNewEndpointsFromConfig_JSONKeyPlugin(t *testing.T) {
 
 	eps := Ms.NewEndpointsFromConfig(loadConfig)
 
-	t.Run("Transformer is returned", func(t *testing.T) {
+	t.Run("Transformer is left to the json source", func(t *testing.T) {
 		ep := (*eps)[0]
-		if ep.Transformers["bitcoin.usd"] == nil {
-			t.Error("No Transformer returned for metric")
+		if ep.Transformers["bitcoin.usd"] != nil {
+			t.Error("Expected the json source to extract the key without a Transformer")
 		}
+		assertString(t, ep.Source.ID(), "json")
 	})
 }
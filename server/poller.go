@@ -1,14 +1,15 @@
 package monteverdi
 
 import (
-	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
-	"strings"
 	"time"
+
+	Mp "github.com/maroda/monteverdi/plugin"
 )
 
 const (
@@ -79,40 +80,70 @@ func MetricKV(d, url string) (map[string]string, error) {
 
 // ParseMetricKV pairs with MetricKV to extract all configured metrics from an endpoint
 func ParseMetricKV(reader io.Reader, d string) (map[string]string, error) {
-	envMap := make(map[string]string)
-	scanner := bufio.NewScanner(reader)
-
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
+	return Mp.ParseKV(reader, d)
+}
 
-		// ignore whitespace and comments
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
-		}
+// NewDataSource returns the named DataSource configured for an endpoint.
+// Without a name it is "json" for an empty delimiter and "kv" otherwise.
+// HTTP sources are given the shared client.
+func NewDataSource(name, url, delim string, metrics []string, config map[string]interface{}) (Mp.DataSource, error) {
+	name = sourceName(name, delim)
+	src, err := Mp.SourceLookup(name)
+	if err != nil {
+		return nil, err
+	}
 
-		// Split on the delimiter /d/
-		parts := strings.SplitN(line, d, 2)
-		if len(parts) != 2 {
-			slog.Error("WARNING: Invalid line", slog.String("line", line))
-			continue
-		}
+	// Endpoint settings take precedence over the free-form config
+	options := make(map[string]interface{}, len(config)+3)
+	for k, v := range config {
+		options[k] = v
+	}
+	if url != "" {
+		options["url"] = url
+	}
+	if delim != "" {
+		options["delim"] = delim
+	}
+	options["metrics"] = metrics
 
-		// Extract Key, Clean up Value, Add to Map
-		key := strings.TrimSpace(parts[0])
-		value := strings.TrimSpace(parts[1])
-		// Remove quotes
-		value = strings.Trim(value, `"'`)
-		// Take care of any trailing quotes and comments
-		if pos := strings.IndexAny(value, `"'#`); pos != -1 {
-			value = value[:pos]
-		}
-		envMap[key] = value
+	if err := src.Configure(options); err != nil {
+		return nil, fmt.Errorf("could not configure source %s: %w", name, err)
+	}
+	if hs, ok := src.(Mp.HTTPSource); ok {
+		hs.SetClient(sharedHTTPClient)
 	}
 
-	if err := scanner.Err(); err != nil {
-		slog.Error("Problem scanning input", slog.Any("Error", err))
-		return nil, fmt.Errorf("scanning error: %w", err)
+	return src, nil
+}
+
+// sourceName is the DataSource an endpoint uses, "json" for an empty delimiter and "kv" otherwise
+func sourceName(name, delim string) string {
+	if name != "" {
+		return name
+	}
+	if delim == "" {
+		return "json"
 	}
+	return "kv"
+}
 
-	return envMap, nil
+// metricOptions is each metric's config as a source sees it,
+// so a source can read its own per-metric settings
+func metricOptions(metrics map[string]MetricConfig) map[string]interface{} {
+	options := make(map[string]interface{}, len(metrics))
+	for k, mc := range metrics {
+		var m map[string]interface{}
+		b, err := json.Marshal(mc)
+		if err == nil {
+			err = json.Unmarshal(b, &m)
+		}
+		if err != nil {
+			slog.Error("Could not pass metric config to its source",
+				slog.String("metric", k),
+				slog.Any("error", err))
+			continue
+		}
+		options[k] = m
+	}
+	return options
 }
@@ -13,6 +13,7 @@ import (
 	"testing"
 	"time"
 
+	Mp "github.com/maroda/monteverdi/plugin"
 	Ms "github.com/maroda/monteverdi/server"
 )
 
@@ -229,6 +230,137 @@ func (fr *FailingReader) Read(p []byte) (n int, err error) {
 	return toCopy, nil
 }
 
+// MockSource is a DataSource returning fixed values
+type MockSource struct {
+	Values map[string]int64
+	Config map[string]interface{}
+}
+
+func (m *MockSource) Poll() (map[string]int64, error) { return m.Values, nil }
+func (m *MockSource) ID() string                      { return "mock" }
+func (m *MockSource) Configure(config map[string]interface{}) error {
+	m.Config = config
+	if _, ok := config["region"]; !ok {
+		return errors.New("mock source needs a region")
+	}
+	return nil
+}
+
+func TestNewDataSource(t *testing.T) {
+	t.Run("Defaults to kv with a delimiter", func(t *testing.T) {
+		src, err := Ms.NewDataSource("", "http://localhost:8090/metrics", " ", []string{"CPU1"}, nil)
+		assertError(t, err, nil)
+		assertString(t, src.ID(), "kv")
+	})
+
+	t.Run("Defaults to json without a delimiter", func(t *testing.T) {
+		src, err := Ms.NewDataSource("", "http://localhost:8090/api", "", []string{"bitcoin.usd"}, nil)
+		assertError(t, err, nil)
+		assertString(t, src.ID(), "json")
+	})
+
+	t.Run("Errors on unknown source", func(t *testing.T) {
+		_, err := Ms.NewDataSource("craquemattic", "http://localhost:8090", "=", nil, nil)
+		assertGotError(t, err)
+	})
+
+	t.Run("Errors on invalid configuration", func(t *testing.T) {
+		_, err := Ms.NewDataSource("kv", "", "=", nil, nil)
+		assertGotError(t, err)
+	})
+}
+
+func TestQNet_PollEndpointSource(t *testing.T) {
+	mock := &MockSource{Values: map[string]int64{"cpu_utilization": 90, "other": 1}}
+	Mp.Sources["mock"] = func() Mp.DataSource { return mock }
+	defer delete(Mp.Sources, "mock")
+
+	config := []Ms.ConfigFile{{
+		ID:     "MOCK",
+		Source: "mock",
+		Config: map[string]interface{}{"region": "us-west-2"},
+		Metrics: map[string]Ms.MetricConfig{
+			"cpu_utilization": {Type: "gauge", Max: 80},
+		},
+	}}
+	eps := Ms.NewEndpointsFromConfig(config)
+	qn := Ms.NewQNet(*eps)
+	qn.PollEndpoint(0)
+	ep := qn.Network[0]
+
+	t.Run("Source receives its config and metrics", func(t *testing.T) {
+		assertString(t, mock.Config["region"].(string), "us-west-2")
+		assertInt(t, len(mock.Config["metrics"].([]string)), 1)
+	})
+
+	t.Run("Only configured metrics are recorded", func(t *testing.T) {
+		assertInt64(t, ep.Mdata["cpu_utilization"], 90)
+		if _, ok := ep.Mdata["other"]; ok {
+			t.Errorf("Unconfigured metric should not be recorded")
+		}
+		if seq := ep.Sequence["cpu_utilization"]; seq == nil || !seq.Events[0].IsAccent {
+			t.Errorf("Expected an accent for cpu_utilization")
+		}
+	})
+
+	t.Run("Invalid source config is not used", func(t *testing.T) {
+		config[0].Config = nil
+		eps := Ms.NewEndpointsFromConfig(config)
+		if (*eps)[0].Source != nil {
+			t.Errorf("Expected no source for an invalid config")
+		}
+		qn := Ms.NewQNet(*eps)
+		qn.PollEndpoint(0)
+		if len(qn.Network[0].Mdata) != 0 {
+			t.Errorf("Expected no data without a source")
+		}
+	})
+}
+
+func TestQNet_PollEndpointPromQL(t *testing.T) {
+	mockAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("query") {
+		case `sum(rate(http_requests_total{code=~"5.."}[5m]))`:
+			fmt.Fprint(w, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1700000000,"12.5"]}]}}`)
+		case "job:up:count":
+			fmt.Fprint(w, `{"status":"success","data":{"resultType":"scalar","result":[1700000000,"3"]}}`)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"status":"error","errorType":"bad_data","error":"unknown"}`)
+		}
+	}))
+	defer mockAPI.Close()
+
+	config := []Ms.ConfigFile{{
+		ID:     "THANOS",
+		URL:    mockAPI.URL,
+		Source: "promql",
+		Metrics: map[string]Ms.MetricConfig{
+			"errors_5xx":   {Type: "gauge", Max: 10, Query: `sum(rate(http_requests_total{code=~"5.."}[5m]))`},
+			"job:up:count": {Type: "gauge", Max: 5},
+		},
+	}}
+	eps := Ms.NewEndpointsFromConfig(config)
+	qn := Ms.NewQNet(*eps)
+	qn.PollEndpoint(0)
+	ep := qn.Network[0]
+
+	t.Run("Query results become metric values", func(t *testing.T) {
+		assertString(t, ep.Source.ID(), "promql")
+		assertInt64(t, ep.Mdata["errors_5xx"], 12)
+		assertInt64(t, ep.Mdata["job:up:count"], 3)
+	})
+
+	t.Run("Accents are found from query results", func(t *testing.T) {
+		if seq := ep.Sequence["errors_5xx"]; seq == nil || !seq.Events[0].IsAccent {
+			t.Errorf("Expected an accent for errors_5xx")
+		}
+		if seq := ep.Sequence["job:up:count"]; seq == nil || seq.Events[0].IsAccent {
+			t.Errorf("Expected a non-accent for job:up:count")
+		}
+	})
+}
+
 // Mock responder for external API calls with configurable body content
 func makeMockWebServBody(delay time.Duration, body string) *httptest.Server {
 	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
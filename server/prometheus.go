@@ -0,0 +1,498 @@
+package monteverdi
+
+/*
+
+	Prometheus text exposition format
+
+	A Prometheus endpoint serves one series per line:
+
+		# HELP http_requests_total The total number of HTTP requests.
+		# TYPE http_requests_total counter
+		http_requests_total{code="200",method="GET"} 1027 1395066363000
+
+	The Delim based KV parser can only ever see the whole label set as part
+	of the key, so here the line is parsed properly into a name, labels,
+	value and optional timestamp. Series are selected from the exposition
+	with the same selector syntax used by PromQL:
+
+		http_requests_total{code=~"5..",method!="OPTIONS"}
+
+*/
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PromSample is a single series line from an exposition
+type PromSample struct {
+	Name      string            // metric name
+	Labels    map[string]string // label set, empty when the series has none
+	Value     float64           // sample value, may be NaN or ±Inf
+	Timestamp int64             // milliseconds since epoch, 0 when not exposed
+}
+
+// PromExposition is the parsed result of one scrape
+type PromExposition struct {
+	Samples []PromSample
+	Types   map[string]string // metric family name to TYPE (counter, gauge, histogram, ...)
+	Help    map[string]string // metric family name to HELP text
+}
+
+// ParsePromExposition reads the full text exposition format,
+// keeping HELP and TYPE metadata alongside every sample.
+// Malformed sample lines are logged and skipped, like ParseMetricKV.
+func ParsePromExposition(reader io.Reader) (*PromExposition, error) {
+	expo := &PromExposition{
+		Samples: make([]PromSample, 0),
+		Types:   make(map[string]string),
+		Help:    make(map[string]string),
+	}
+
+	scanner := bufio.NewScanner(reader)
+	// Label sets can make for long lines, allow up to 1MB
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		// Comments carry HELP and TYPE metadata, everything else is ignored
+		if strings.HasPrefix(line, "#") {
+			fields := strings.Fields(line[1:])
+			if len(fields) < 3 {
+				continue
+			}
+			switch fields[0] {
+			case "TYPE":
+				expo.Types[fields[1]] = fields[2]
+			case "HELP":
+				help := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line[1:]), "HELP"))
+				help = strings.TrimPrefix(help, fields[1])
+				expo.Help[fields[1]] = unescapePromHelp(strings.TrimSpace(help))
+			}
+			continue
+		}
+
+		sample, err := ParsePromLine(line)
+		if err != nil {
+			slog.Error("WARNING: Invalid exposition line", slog.String("line", line), slog.Any("error", err))
+			continue
+		}
+		expo.Samples = append(expo.Samples, sample)
+	}
+
+	if err := scanner.Err(); err != nil {
+		slog.Error("Problem scanning input", slog.Any("Error", err))
+		return nil, fmt.Errorf("scanning error: %w", err)
+	}
+
+	return expo, nil
+}
+
+// ParsePromLine parses one sample line: name[{labels}] value [timestamp]
+func ParsePromLine(line string) (PromSample, error) {
+	sample := PromSample{Labels: make(map[string]string)}
+
+	// The name ends at the label set or the first whitespace
+	end := strings.IndexAny(line, "{ \t")
+	if end == -1 {
+		return sample, errors.New("missing value")
+	}
+	sample.Name = line[:end]
+	if !validPromName(sample.Name) {
+		return sample, fmt.Errorf("invalid metric name %q", sample.Name)
+	}
+
+	rest := line[end:]
+	if strings.HasPrefix(rest, "{") {
+		labels, n, err := parsePromLabels(rest)
+		if err != nil {
+			return sample, err
+		}
+		sample.Labels = labels
+		rest = rest[n:]
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) < 1 || len(fields) > 2 {
+		return sample, fmt.Errorf("expected value and optional timestamp, got %d fields", len(fields))
+	}
+
+	value, err := ParsePromValue(fields[0])
+	if err != nil {
+		return sample, err
+	}
+	sample.Value = value
+
+	if len(fields) == 2 {
+		ts, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return sample, fmt.Errorf("invalid timestamp %q: %w", fields[1], err)
+		}
+		sample.Timestamp = ts
+	}
+
+	return sample, nil
+}
+
+// ParsePromValue handles the float forms allowed by the exposition format,
+// including NaN, +Inf and -Inf
+func ParsePromValue(s string) (float64, error) {
+	switch s {
+	case "NaN":
+		return math.NaN(), nil
+	case "+Inf", "Inf":
+		return math.Inf(1), nil
+	case "-Inf":
+		return math.Inf(-1), nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q: %w", s, err)
+	}
+	return v, nil
+}
+
+// PromValueToInt64 converts a sample value to the int64 used by Mdata.
+// Infinities are clamped, NaN has no integer form and reports false.
+func PromValueToInt64(v float64) (int64, bool) {
+	switch {
+	case math.IsNaN(v):
+		return 0, false
+	case v >= math.MaxInt64:
+		return math.MaxInt64, true
+	case v <= math.MinInt64:
+		return math.MinInt64, true
+	}
+	return int64(v), true
+}
+
+// parsePromLabels reads a label set starting at '{' and
+// returns the labels and the number of bytes consumed
+func parsePromLabels(s string) (map[string]string, int, error) {
+	labels := make(map[string]string)
+	i := 1 // skip '{'
+
+	for {
+		i = skipPromSpace(s, i)
+		if i >= len(s) {
+			return nil, 0, errors.New("unterminated label set")
+		}
+		if s[i] == '}' {
+			return labels, i + 1, nil
+		}
+
+		// label name
+		start := i
+		for i < len(s) && isPromNameChar(s[i], i == start) {
+			i++
+		}
+		name := s[start:i]
+		if name == "" {
+			return nil, 0, fmt.Errorf("invalid label name at position %d", start)
+		}
+
+		i = skipPromSpace(s, i)
+		if i >= len(s) || s[i] != '=' {
+			return nil, 0, fmt.Errorf("expected '=' after label %q", name)
+		}
+		i = skipPromSpace(s, i+1)
+
+		value, n, err := parsePromQuoted(s[i:])
+		if err != nil {
+			return nil, 0, fmt.Errorf("label %q: %w", name, err)
+		}
+		labels[name] = value
+		i = skipPromSpace(s, i+n)
+
+		if i < len(s) && s[i] == ',' {
+			i++
+		} else if i < len(s) && s[i] != '}' {
+			return nil, 0, fmt.Errorf("expected ',' or '}' after label %q", name)
+		}
+	}
+}
+
+// parsePromQuoted reads a double-quoted string with \\, \" and \n escapes
+// and returns the unescaped value and the number of bytes consumed
+func parsePromQuoted(s string) (string, int, error) {
+	if len(s) == 0 || s[0] != '"' {
+		return "", 0, errors.New("expected quoted value")
+	}
+
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return b.String(), i + 1, nil
+		case '\\':
+			if i+1 >= len(s) {
+				return "", 0, errors.New("unterminated escape")
+			}
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case '\\', '"':
+				b.WriteByte(s[i])
+			default:
+				// Unknown escapes are kept as written
+				b.WriteByte('\\')
+				b.WriteByte(s[i])
+			}
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+
+	return "", 0, errors.New("unterminated quoted value")
+}
+
+// unescapePromHelp reverses the \\ and \n escapes allowed in HELP text
+func unescapePromHelp(s string) string {
+	return strings.NewReplacer(`\\`, `\`, `\n`, "\n").Replace(s)
+}
+
+// escapePromLabel is the inverse of parsePromQuoted
+func escapePromLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func skipPromSpace(s string, i int) int {
+	for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+		i++
+	}
+	return i
+}
+
+func isPromNameChar(c byte, first bool) bool {
+	if c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') {
+		return true
+	}
+	return !first && c >= '0' && c <= '9'
+}
+
+func validPromName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isPromNameChar(s[i], i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// SeriesID returns the canonical key for a series,
+// the name followed by its labels in sorted order:
+//
+//	http_requests_total{code="200",method="GET"}
+//
+// A series without labels is just its name.
+func (ps *PromSample) SeriesID() string {
+	return PromSeriesID(ps.Name, ps.Labels)
+}
+
+// PromSeriesID builds the canonical key from a name and label set
+func PromSeriesID(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteString(`="`)
+		b.WriteString(escapePromLabel(labels[k]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+
+	return b.String()
+}
+
+// MatchType is the comparison a LabelMatcher performs
+type MatchType int
+
+const (
+	MatchEqual     MatchType = iota // =
+	MatchNotEqual                   // !=
+	MatchRegexp                     // =~
+	MatchNotRegexp                  // !~
+)
+
+// LabelMatcher compares one label of a series
+type LabelMatcher struct {
+	Name  string
+	Type  MatchType
+	Value string
+	re    *regexp.Regexp
+}
+
+// NewLabelMatcher builds a matcher, compiling the regex when needed.
+// Like Prometheus, regexes are fully anchored.
+func NewLabelMatcher(t MatchType, name, value string) (*LabelMatcher, error) {
+	lm := &LabelMatcher{Name: name, Type: t, Value: value}
+	if t == MatchRegexp || t == MatchNotRegexp {
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex for label %q: %w", name, err)
+		}
+		lm.re = re
+	}
+	return lm, nil
+}
+
+// Matches reports whether the label value satisfies the matcher,
+// a missing label is treated as the empty string
+func (lm *LabelMatcher) Matches(v string) bool {
+	switch lm.Type {
+	case MatchEqual:
+		return v == lm.Value
+	case MatchNotEqual:
+		return v != lm.Value
+	case MatchRegexp:
+		return lm.re.MatchString(v)
+	case MatchNotRegexp:
+		return !lm.re.MatchString(v)
+	}
+	return false
+}
+
+// PromSelector picks series out of an exposition by name and label matchers
+type PromSelector struct {
+	Name     string
+	Matchers []*LabelMatcher
+}
+
+// ParsePromSelector parses a series selector, e.g.:
+//
+//	http_requests_total{code=~"5..",method!="OPTIONS"}
+//	{__name__=~"go_memstats_.*_bytes"}
+func ParsePromSelector(s string) (*PromSelector, error) {
+	s = strings.TrimSpace(s)
+	sel := &PromSelector{}
+
+	end := strings.IndexByte(s, '{')
+	if end == -1 {
+		end = len(s)
+	}
+	sel.Name = strings.TrimSpace(s[:end])
+	if sel.Name != "" && !validPromName(sel.Name) {
+		return nil, fmt.Errorf("invalid metric name %q", sel.Name)
+	}
+
+	if end < len(s) {
+		n, err := sel.parseMatchers(s[end:])
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(s[end+n:]) != "" {
+			return nil, fmt.Errorf("unexpected trailing input %q", s[end+n:])
+		}
+	}
+
+	if sel.Name == "" && len(sel.Matchers) == 0 {
+		return nil, errors.New("empty selector")
+	}
+
+	return sel, nil
+}
+
+// parseMatchers reads the {...} matcher list into the selector
+func (sel *PromSelector) parseMatchers(s string) (int, error) {
+	i := 1 // skip '{'
+
+	for {
+		i = skipPromSpace(s, i)
+		if i >= len(s) {
+			return 0, errors.New("unterminated selector")
+		}
+		if s[i] == '}' {
+			return i + 1, nil
+		}
+
+		start := i
+		for i < len(s) && isPromNameChar(s[i], i == start) {
+			i++
+		}
+		name := s[start:i]
+		if name == "" {
+			return 0, fmt.Errorf("invalid label name at position %d", start)
+		}
+		i = skipPromSpace(s, i)
+
+		var t MatchType
+		switch {
+		case strings.HasPrefix(s[i:], "=~"):
+			t, i = MatchRegexp, i+2
+		case strings.HasPrefix(s[i:], "!~"):
+			t, i = MatchNotRegexp, i+2
+		case strings.HasPrefix(s[i:], "!="):
+			t, i = MatchNotEqual, i+2
+		case strings.HasPrefix(s[i:], "="):
+			t, i = MatchEqual, i+1
+		default:
+			return 0, fmt.Errorf("expected match operator after label %q", name)
+		}
+		i = skipPromSpace(s, i)
+
+		value, n, err := parsePromQuoted(s[i:])
+		if err != nil {
+			return 0, fmt.Errorf("label %q: %w", name, err)
+		}
+		i = skipPromSpace(s, i+n)
+
+		lm, err := NewLabelMatcher(t, name, value)
+		if err != nil {
+			return 0, err
+		}
+		sel.Matchers = append(sel.Matchers, lm)
+
+		if i < len(s) && s[i] == ',' {
+			i++
+		} else if i < len(s) && s[i] != '}' {
+			return 0, fmt.Errorf("expected ',' or '}' after label %q", name)
+		}
+	}
+}
+
+// Matches reports whether the sample is selected
+func (sel *PromSelector) Matches(sample *PromSample) bool {
+	if sel.Name != "" && sel.Name != sample.Name {
+		return false
+	}
+	for _, lm := range sel.Matchers {
+		v := sample.Labels[lm.Name]
+		if lm.Name == "__name__" {
+			v = sample.Name
+		}
+		if !lm.Matches(v) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,461 @@
+package monteverdi_test
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	Mp "github.com/maroda/monteverdi/plugin"
+	Ms "github.com/maroda/monteverdi/server"
+)
+
+const promBody = `# HELP http_requests_total The total number of HTTP requests.
+# TYPE http_requests_total counter
+http_requests_total{method="GET",code="200"} 1027 1395066363000
+http_requests_total{method="POST",code="200"} 3 1395066363000
+http_requests_total{method="GET",code="500"} 12
+# HELP go_goroutines Number of goroutines that currently exist.
+# TYPE go_goroutines gauge
+go_goroutines 42
+# A plain comment
+msdos_file_access_time_seconds{path="C:\\DIR\\FILE.TXT",error="Cannot find file:\n\"FILE.TXT\""} 1.458255915e9
+missing_value_total NaN
+temperature_max +Inf
+temperature_min -Inf
+`
+
+func TestParsePromExposition(t *testing.T) {
+	expo, err := Ms.ParsePromExposition(strings.NewReader(promBody))
+	assertError(t, err, nil)
+
+	t.Run("Reads every sample line", func(t *testing.T) {
+		assertInt(t, len(expo.Samples), 8)
+	})
+
+	t.Run("Records TYPE and HELP metadata", func(t *testing.T) {
+		assertString(t, expo.Types["http_requests_total"], "counter")
+		assertString(t, expo.Types["go_goroutines"], "gauge")
+		assertString(t, expo.Help["go_goroutines"], "Number of goroutines that currently exist.")
+	})
+
+	t.Run("Splits name, labels, value and timestamp", func(t *testing.T) {
+		s := expo.Samples[0]
+		assertString(t, s.Name, "http_requests_total")
+		assertString(t, s.Labels["method"], "GET")
+		assertString(t, s.Labels["code"], "200")
+		assertInt64(t, int64(s.Value), 1027)
+		assertInt64(t, s.Timestamp, 1395066363000)
+
+		// No timestamp exposed
+		assertInt64(t, expo.Samples[2].Timestamp, 0)
+	})
+
+	t.Run("Unescapes label values", func(t *testing.T) {
+		s := expo.Samples[4]
+		assertString(t, s.Labels["path"], `C:\DIR\FILE.TXT`)
+		assertString(t, s.Labels["error"], "Cannot find file:\n\"FILE.TXT\"")
+	})
+
+	t.Run("Handles NaN and Inf", func(t *testing.T) {
+		if !math.IsNaN(expo.Samples[5].Value) {
+			t.Errorf("Expected NaN, got %f", expo.Samples[5].Value)
+		}
+		if !math.IsInf(expo.Samples[6].Value, 1) {
+			t.Errorf("Expected +Inf, got %f", expo.Samples[6].Value)
+		}
+		if !math.IsInf(expo.Samples[7].Value, -1) {
+			t.Errorf("Expected -Inf, got %f", expo.Samples[7].Value)
+		}
+	})
+
+	t.Run("Skips malformed lines", func(t *testing.T) {
+		bad := `good_metric 1
+bad metric name 1
+no_value
+unterminated{code="200 1
+missing_comma{a="1"b="2"} 1
+bad_value abc
+bad_ts 1 yesterday
+`
+		e, err := Ms.ParsePromExposition(strings.NewReader(bad))
+		assertError(t, err, nil)
+		assertInt(t, len(e.Samples), 1)
+		assertString(t, e.Samples[0].Name, "good_metric")
+	})
+
+	t.Run("Errors on labels without a comma between them", func(t *testing.T) {
+		_, err := Ms.ParsePromLine(`metric{a="1"b="2"} 1`)
+		assertGotError(t, err)
+
+		s, err := Ms.ParsePromLine(`metric{a="1" , b="2",} 1`)
+		assertError(t, err, nil)
+		assertString(t, s.Labels["b"], "2")
+	})
+
+	t.Run("Returns scanner errors", func(t *testing.T) {
+		failingReader := &FailingReader{
+			data:      []byte("CPU1 100\nCPU2 200\n"),
+			failAfter: 5,
+		}
+		_, err := Ms.ParsePromExposition(failingReader)
+		assertGotError(t, err)
+	})
+}
+
+func TestPromSample_SeriesID(t *testing.T) {
+	t.Run("Sorts labels", func(t *testing.T) {
+		s, err := Ms.ParsePromLine(`http_requests_total{method="GET",code="200"} 1`)
+		assertError(t, err, nil)
+		assertString(t, s.SeriesID(), `http_requests_total{code="200",method="GET"}`)
+	})
+
+	t.Run("Is just the name without labels", func(t *testing.T) {
+		s, err := Ms.ParsePromLine(`go_goroutines 42`)
+		assertError(t, err, nil)
+		assertString(t, s.SeriesID(), "go_goroutines")
+	})
+
+	t.Run("Escapes label values", func(t *testing.T) {
+		id := Ms.PromSeriesID("m", map[string]string{"path": `C:\DIR "x"`})
+		assertString(t, id, `m{path="C:\\DIR \"x\""}`)
+	})
+}
+
+func TestPromValueToInt64(t *testing.T) {
+	_, ok := Ms.PromValueToInt64(math.NaN())
+	if ok {
+		t.Errorf("NaN should not convert")
+	}
+
+	got, _ := Ms.PromValueToInt64(math.Inf(1))
+	assertInt64(t, got, math.MaxInt64)
+
+	got, _ = Ms.PromValueToInt64(math.Inf(-1))
+	assertInt64(t, got, math.MinInt64)
+
+	got, _ = Ms.PromValueToInt64(4.21909151744e+11)
+	assertInt64(t, got, 421909151744)
+}
+
+func TestParsePromSelector(t *testing.T) {
+	expo, err := Ms.ParsePromExposition(strings.NewReader(promBody))
+	assertError(t, err, nil)
+
+	count := func(sel *Ms.PromSelector) int {
+		n := 0
+		for _, s := range expo.Samples {
+			if sel.Matches(&s) {
+				n++
+			}
+		}
+		return n
+	}
+
+	tests := []struct {
+		selector string
+		want     int
+	}{
+		{`http_requests_total`, 3},
+		{`http_requests_total{code="200"}`, 2},
+		{`http_requests_total{code!="200"}`, 1},
+		{`http_requests_total{code=~"2..|5.."}`, 3},
+		{`http_requests_total{code=~"5"}`, 0}, // anchored
+		{`http_requests_total{method!~"GET|PUT"}`, 1},
+		{`http_requests_total{method="GET", code="200"}`, 1},
+		{`{__name__=~"temperature_.*"}`, 2},
+		{`go_goroutines{job=""}`, 1}, // missing label is empty
+		{`go_goroutines{job="api"}`, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			sel, err := Ms.ParsePromSelector(tt.selector)
+			assertError(t, err, nil)
+			assertInt(t, count(sel), tt.want)
+		})
+	}
+
+	t.Run("Errors on invalid selectors", func(t *testing.T) {
+		invalid := []string{
+			``,
+			`{}`,
+			`bad name`,
+			`metric{code}`,
+			`metric{code="200"`,
+			`metric{code=200}`,
+			`metric{code=~"("}`,
+			`metric{code="200"} extra`,
+			`metric{a="1"b="2"}`,
+		}
+		for _, s := range invalid {
+			_, err := Ms.ParsePromSelector(s)
+			if err == nil {
+				t.Errorf("Expected an error for selector %q", s)
+			}
+		}
+	})
+}
+
+func TestQNet_PollPrometheus(t *testing.T) {
+	mockWWW := makeMockWebServBody(0*time.Millisecond, promBody)
+	defer mockWWW.Close()
+
+	config := []Ms.ConfigFile{{
+		ID:       "PROM",
+		URL:      mockWWW.URL,
+		Delim:    " ",
+		Format:   "prometheus",
+		Interval: 1,
+		Metrics: map[string]Ms.MetricConfig{
+			"requests_200":        {Type: "counter", Max: 10, Selector: `http_requests_total{code="200"}`},
+			"go_goroutines":       {Type: "gauge", Max: 100},
+			"missing_value_total": {Type: "gauge", Max: 1},
+		},
+	}}
+	eps := Ms.NewEndpointsFromConfig(config)
+	qn := Ms.NewQNet(*eps)
+	qn.PollEndpoint(0)
+	ep := qn.Network[0]
+
+	t.Run("Each matched series becomes its own metric", func(t *testing.T) {
+		get := `http_requests_total{code="200",method="GET"}`
+		post := `http_requests_total{code="200",method="POST"}`
+		assertInt64(t, ep.Mdata[get], 1027)
+		assertInt64(t, ep.Mdata[post], 3)
+		assertInt64(t, ep.Maxval[post], 10)
+		assertString(t, ep.Series[get], "requests_200")
+
+		// placeholder slot is reused, one more row is added
+		assertInt(t, len(ep.Metric), 4)
+		for _, m := range ep.Metric {
+			if ep.Layer[m] == nil {
+				t.Errorf("Metric %s has no timeseries layer", m)
+			}
+			if m == "requests_200" {
+				t.Errorf("Selector placeholder should be replaced by a series")
+			}
+		}
+	})
+
+	t.Run("Unlabelled metrics keep their config key", func(t *testing.T) {
+		assertInt64(t, ep.Mdata["go_goroutines"], 42)
+	})
+
+	t.Run("NaN samples are skipped", func(t *testing.T) {
+		if _, ok := ep.Mdata["missing_value_total"]; ok {
+			t.Errorf("NaN sample should not be recorded")
+		}
+	})
+
+	t.Run("Accents are found per series", func(t *testing.T) {
+		get := `http_requests_total{code="200",method="GET"}`
+		post := `http_requests_total{code="200",method="POST"}`
+		if seq := ep.Sequence[get]; seq == nil || !seq.Events[0].IsAccent {
+			t.Errorf("Expected an accent ictus for %s", get)
+		}
+		if seq := ep.Sequence[post]; seq == nil || seq.Events[0].IsAccent {
+			t.Errorf("Expected a non-accent ictus for %s", post)
+		}
+	})
+
+	t.Run("Repeat polls do not add rows", func(t *testing.T) {
+		qn.PollEndpoint(0)
+		assertInt(t, len(ep.Metric), 4)
+	})
+
+	t.Run("No error returned on bad URL (code continues)", func(t *testing.T) {
+		qn.Network[0].URL = "http://unreachable-craquemattic:2345/metrics"
+		qn.PollEndpoint(0)
+	})
+}
+
+func TestQNet_PollPrometheusSeriesChurn(t *testing.T) {
+	var mu sync.Mutex
+	body := promBody
+	mockWWW := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprint(w, body)
+	}))
+	defer mockWWW.Close()
+	expose := func(b string) {
+		mu.Lock()
+		defer mu.Unlock()
+		body = b
+	}
+
+	config := []Ms.ConfigFile{{
+		ID:       "PROM",
+		URL:      mockWWW.URL,
+		Format:   "prometheus",
+		Interval: 1,
+		Metrics: map[string]Ms.MetricConfig{
+			"requests_200":  {Type: "counter", Max: 10, Selector: `http_requests_total{code="200"}`},
+			"requests_get":  {Type: "counter", Max: 10, Selector: `http_requests_total{method="GET"}`},
+			"go_goroutines": {Type: "gauge", Max: 100},
+		},
+	}}
+	eps := Ms.NewEndpointsFromConfig(config)
+	qn := Ms.NewQNet(*eps)
+	ep := qn.Network[0]
+	ep.SeriesTTL = 2
+	qn.PollEndpoint(0)
+
+	get200 := `http_requests_total{code="200",method="GET"}`
+	get500 := `http_requests_total{code="500",method="GET"}`
+	post200 := `http_requests_total{code="200",method="POST"}`
+
+	t.Run("Overlapping selectors ingest a series once per poll", func(t *testing.T) {
+		assertInt(t, ep.Layer[get200].Current, 1)
+		assertInt(t, len(ep.Metric), 4)
+	})
+
+	t.Run("Series that are not seen for the TTL are removed", func(t *testing.T) {
+		expose("http_requests_total{method=\"GET\",code=\"200\"} 1030\ngo_goroutines 40\n")
+		qn.PollEndpoint(0)
+		if _, ok := ep.Series[post200]; !ok {
+			t.Errorf("Series %s should be kept before its TTL", post200)
+		}
+
+		qn.PollEndpoint(0)
+		for _, id := range []string{post200, get500} {
+			if _, ok := ep.Series[id]; ok {
+				t.Errorf("Series %s should have expired", id)
+			}
+			if _, ok := ep.Layer[id]; ok {
+				t.Errorf("Series %s should have no timeseries layer", id)
+			}
+		}
+		assertInt(t, len(ep.Series), 2) // with go_goroutines under its own key
+		assertInt64(t, ep.Mdata["go_goroutines"], 40)
+	})
+
+	t.Run("Display slots are compacted and placeholders restored", func(t *testing.T) {
+		assertInt(t, len(ep.Metric), 3)
+		keys := make(map[string]bool)
+		for i := 0; i < len(ep.Metric); i++ {
+			m := ep.Metric[i]
+			keys[m] = true
+			if ep.Layer[m] == nil {
+				t.Errorf("Metric %s has no timeseries layer", m)
+			}
+		}
+		if !keys[get200] || !keys["go_goroutines"] {
+			t.Errorf("Expected the remaining series and config key, got %v", ep.Metrics())
+		}
+		if keys["requests_200"] == keys["requests_get"] {
+			t.Errorf("Expected one selector placeholder back, got %v", ep.Metrics())
+		}
+	})
+
+	t.Run("Returning series are registered again", func(t *testing.T) {
+		expose(promBody)
+		qn.PollEndpoint(0)
+		assertString(t, ep.Series[post200], "requests_200")
+		assertInt64(t, ep.Mdata[post200], 3)
+		assertInt(t, len(ep.Metric), 4)
+	})
+}
+
+const histBody = `# TYPE http_request_duration_seconds histogram
+http_request_duration_seconds_bucket{pod="api-1",le="0.1"} 50
+http_request_duration_seconds_bucket{pod="api-1",le="0.5"} 90
+http_request_duration_seconds_bucket{pod="api-1",le="1"} 98
+http_request_duration_seconds_bucket{pod="api-1",le="+Inf"} 100
+http_request_duration_seconds_bucket{pod="api-2",le="0.1"} 0
+http_request_duration_seconds_bucket{pod="api-2",le="0.5"} 0
+http_request_duration_seconds_bucket{pod="api-2",le="1"} 0
+http_request_duration_seconds_bucket{pod="api-2",le="+Inf"} 0
+http_request_duration_seconds_sum{pod="api-1"} 25
+http_request_duration_seconds_count{pod="api-1"} 100
+# TYPE rpc_duration_seconds summary
+rpc_duration_seconds{quantile="0.5"} 0.05
+rpc_duration_seconds{quantile="0.99"} 0.8
+rpc_duration_seconds_sum 17
+rpc_duration_seconds_count 200
+`
+
+func TestQNet_PollPrometheusQuantile(t *testing.T) {
+	mockWWW := makeMockWebServBody(0*time.Millisecond, histBody)
+	defer mockWWW.Close()
+
+	config := []Ms.ConfigFile{{
+		ID:       "HIST",
+		URL:      mockWWW.URL,
+		Format:   "prometheus",
+		Interval: 1,
+		Metrics: map[string]Ms.MetricConfig{
+			"http_request_duration_seconds": {
+				Type:        "gauge",
+				Transformer: "histogram_quantile",
+				Quantile:    float64p(0.7),
+				Scale:       1000,
+				Max:         250,
+			},
+			"latency_all": {
+				Type:        "gauge",
+				Transformer: "histogram_quantile",
+				Selector:    "http_request_duration_seconds",
+				Aggregate:   "sum",
+				Quantile:    float64p(0.7),
+				Scale:       1000,
+				Max:         250,
+			},
+			"rpc_duration_seconds": {
+				Type:        "gauge",
+				Transformer: "histogram_quantile",
+				Quantile:    float64p(0.99),
+				Scale:       1000,
+				Max:         500,
+			},
+			"bad_quantile":     {Type: "gauge", Transformer: "histogram_quantile", Quantile: float64p(2)},
+			"zero_quantile":    {Type: "gauge", Transformer: "histogram_quantile", Quantile: float64p(0)},
+			"default_quantile": {Type: "gauge", Transformer: "histogram_quantile"},
+		},
+	}}
+	eps := Ms.NewEndpointsFromConfig(config)
+	qn := Ms.NewQNet(*eps)
+	qn.PollEndpoint(0)
+	ep := qn.Network[0]
+
+	t.Run("Buckets become one quantile per label set", func(t *testing.T) {
+		assertInt64(t, ep.Mdata[`http_request_duration_seconds{pod="api-1"}`], 300)
+		assertInt64(t, ep.Mdata[`http_request_duration_seconds{pod="api-2"}`], 0)
+		if seq := ep.Sequence[`http_request_duration_seconds{pod="api-1"}`]; seq == nil || !seq.Events[0].IsAccent {
+			t.Errorf("Expected an accent for the p70 of api-1")
+		}
+	})
+
+	t.Run("Aggregated buckets are summed", func(t *testing.T) {
+		assertInt64(t, ep.Mdata["latency_all"], 300)
+	})
+
+	t.Run("Summary quantiles are read directly", func(t *testing.T) {
+		assertInt64(t, ep.Mdata["rpc_duration_seconds"], 800)
+	})
+
+	t.Run("Invalid quantile is not configured", func(t *testing.T) {
+		if _, ok := ep.Transformers["bad_quantile"]; ok {
+			t.Errorf("Invalid quantile should not configure a transformer")
+		}
+	})
+
+	t.Run("Quantile of zero is kept, unset is p95", func(t *testing.T) {
+		for metric, want := range map[string]float64{"zero_quantile": 0, "default_quantile": 0.95} {
+			hq, ok := ep.Transformers[metric].(*Mp.HistogramQuantilePlugin)
+			if !ok {
+				t.Fatalf("Expected a histogram_quantile transformer for %s", metric)
+			}
+			if hq.Quantile != want {
+				t.Errorf("Expected quantile %v for %s, got %v", want, metric, hq.Quantile)
+			}
+		}
+	})
+}
+
+func float64p(v float64) *float64 { return &v }
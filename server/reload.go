@@ -0,0 +1,212 @@
+package monteverdi
+
+/*
+
+	Incremental reload
+
+	A new config is compared with the running endpoints, matched by ID:
+
+		unchanged   nothing to do
+		updated     only thresholds (max, min, band, enter, exit) or period ratios
+		            changed, they are updated in place and nothing else is touched
+		restarted   anything else changed, the endpoint is rebuilt and
+		            its unchanged metrics keep their state
+		added       new in the config
+		removed     no longer in the config
+
+*/
+
+import (
+	"sort"
+	"time"
+)
+
+// ConfigDiff is what a new config changes, by endpoint ID
+type ConfigDiff struct {
+	Added     []string            `json:"added,omitempty"`     // endpoints new in the config
+	Removed   []string            `json:"removed,omitempty"`   // endpoints no longer in the config
+	Restarted []string            `json:"restarted,omitempty"` // endpoints rebuilt with a new poller
+	Updated   map[string][]string `json:"updated,omitempty"`   // metrics updated in place, by endpoint
+	Unchanged []string            `json:"unchanged,omitempty"` // endpoints left as they are
+}
+
+// DiffConfig compares a new config with the running endpoints
+func (q *QNet) DiffConfig(cf []ConfigFile) ConfigDiff {
+	q.MU.RLock()
+	defer q.MU.RUnlock()
+
+	var diff ConfigDiff
+	matched := q.match(cf)
+	kept := make(map[int]bool)
+	for i, c := range cf {
+		old := matched[i]
+		if old < 0 {
+			diff.Added = append(diff.Added, c.ID)
+			continue
+		}
+		kept[old] = true
+
+		ep := q.Network[old]
+		ep.MU.RLock()
+		running := ep.Config
+		ep.MU.RUnlock()
+
+		switch tuned, ok := tunedMetrics(running, c); {
+		case !ok || running.ID != ep.ID:
+			diff.Restarted = append(diff.Restarted, c.ID)
+		case len(tuned) == 0:
+			diff.Unchanged = append(diff.Unchanged, c.ID)
+		default:
+			if diff.Updated == nil {
+				diff.Updated = make(map[string][]string)
+			}
+			diff.Updated[c.ID] = tuned
+		}
+	}
+
+	for i, ep := range q.Network {
+		if !kept[i] {
+			diff.Removed = append(diff.Removed, ep.ID)
+		}
+	}
+
+	return diff
+}
+
+// Reconfigure applies a new config as DiffConfig found it:
+// updated endpoints are tuned in place, added and restarted
+// ones are built from the config, and removed ones are dropped.
+// The Network follows the order of the config.
+// NB: Nothing may poll the Network until this returns
+func (q *QNet) Reconfigure(cf []ConfigFile, diff ConfigDiff) {
+	q.MU.Lock()
+	defer q.MU.Unlock()
+
+	restart := make(map[string]bool, len(diff.Restarted))
+	for _, id := range diff.Restarted {
+		restart[id] = true
+	}
+
+	matched := q.match(cf)
+	network := make(Endpoints, 0, len(cf))
+	for i, c := range cf {
+		old := matched[i]
+		if old >= 0 && !restart[c.ID] {
+			ep := q.Network[old]
+			if _, ok := diff.Updated[c.ID]; ok {
+				ep.MU.Lock()
+				ep.Tune(c)
+				ep.MU.Unlock()
+			}
+			network = append(network, ep)
+			continue
+		}
+
+		ep := (*NewEndpointsFromConfig([]ConfigFile{c}))[0]
+		ep.Clock = q.Clock
+		ep.Pulses.Clock = q.Clock
+
+		// A rebuilt endpoint keeps what its unchanged metrics have seen
+		if old >= 0 {
+			prev := q.Network[old]
+			prev.MU.RLock()
+			st := prev.State()
+			prev.MU.RUnlock()
+
+			window := ep.Pulses.WindowSize
+			if window <= 0 {
+				window = time.Hour
+			}
+			ep.Restore(st, clockNow(q.Clock).Add(-window))
+		}
+		network = append(network, ep)
+	}
+
+	q.Network = network
+}
+
+// Tune updates the thresholds and period ratios of every metric to the config,
+// which must differ from the endpoint's only in those.
+// NB: Caller must hold ep.MU.Lock()
+func (ep *Endpoint) Tune(c ConfigFile) {
+	base := endpointPeriods(c)
+	for k, mc := range c.Metrics {
+		th := metricThreshold(k, mc)
+		pc := metricPeriods(k, mc, base)
+
+		// Series matched under the metric share its settings
+		ids := []string{k}
+		for id, key := range ep.Series {
+			if key == k && id != k {
+				ids = append(ids, id)
+			}
+		}
+		for _, id := range ids {
+			ep.Maxval[id] = mc.Max
+			if th != nil {
+				ep.Thresholds[id] = th
+			} else {
+				delete(ep.Thresholds, id)
+			}
+			ep.Periods[id] = pc
+		}
+	}
+	ep.Config = c
+}
+
+// match finds the running endpoint of each config by ID, -1 for none.
+// Each running endpoint matches at most one config.
+func (q *QNet) match(cf []ConfigFile) []int {
+	byID := make(map[string][]int)
+	for i, ep := range q.Network {
+		byID[ep.ID] = append(byID[ep.ID], i)
+	}
+
+	matched := make([]int, len(cf))
+	for i, c := range cf {
+		matched[i] = -1
+		if idx := byID[c.ID]; len(idx) > 0 {
+			matched[i] = idx[0]
+			byID[c.ID] = idx[1:]
+		}
+	}
+	return matched
+}
+
+// tunedMetrics returns the metrics whose thresholds or period ratios differ,
+// all of them when the endpoint's period ratios do.
+// It is false when anything else differs.
+func tunedMetrics(old, c ConfigFile) ([]string, bool) {
+	if len(old.Metrics) != len(c.Metrics) {
+		return nil, false
+	}
+
+	periodsChanged := !sameJSON(old.Periods, c.Periods)
+	old.Periods, c.Periods = nil, nil
+	oldMetrics, newMetrics := old.Metrics, c.Metrics
+	old.Metrics, c.Metrics = nil, nil
+	if !sameJSON(old, c) {
+		return nil, false
+	}
+
+	var tuned []string
+	for k, mc := range newMetrics {
+		prev, ok := oldMetrics[k]
+		if !ok || !sameJSON(untuned(prev), untuned(mc)) {
+			return nil, false
+		}
+		if periodsChanged || !sameJSON(prev, mc) {
+			tuned = append(tuned, k)
+		}
+	}
+
+	sort.Strings(tuned)
+	return tuned, true
+}
+
+// untuned is the metric config without what Tune can change
+func untuned(mc MetricConfig) MetricConfig {
+	mc.Max, mc.Min, mc.Band, mc.Enter, mc.Exit = 0, nil, nil, nil, nil
+	mc.Periods = nil
+	return mc
+}
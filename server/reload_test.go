@@ -0,0 +1,200 @@
+package monteverdi_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	Ms "github.com/maroda/monteverdi/server"
+)
+
+func makeReloadConfig(id string, metrics map[string]Ms.MetricConfig) Ms.ConfigFile {
+	return Ms.ConfigFile{
+		ID:       id,
+		URL:      "http://localhost:8090/" + id,
+		Delim:    "=",
+		Interval: 5,
+		Metrics:  metrics,
+	}
+}
+
+func TestQNet_DiffConfig(t *testing.T) {
+	ratio := func(f float64) *float64 { return &f }
+	running := []Ms.ConfigFile{
+		makeReloadConfig("db", map[string]Ms.MetricConfig{
+			"latency":     {Type: "gauge", Max: 100},
+			"connections": {Type: "gauge", Max: 50},
+		}),
+		makeReloadConfig("api", map[string]Ms.MetricConfig{"errors": {Type: "gauge", Max: 10}}),
+	}
+	qn := Ms.NewQNet(*Ms.NewEndpointsFromConfig(running))
+
+	diff := func(change func(cf []Ms.ConfigFile) []Ms.ConfigFile) Ms.ConfigDiff {
+		cf := make([]Ms.ConfigFile, len(running))
+		for i, c := range running {
+			cf[i] = c
+			cf[i].Metrics = make(map[string]Ms.MetricConfig)
+			for k, mc := range c.Metrics {
+				cf[i].Metrics[k] = mc
+			}
+		}
+		return qn.DiffConfig(change(cf))
+	}
+
+	t.Run("Finds nothing in the same config", func(t *testing.T) {
+		d := diff(func(cf []Ms.ConfigFile) []Ms.ConfigFile { return cf })
+		assertString(t, strings.Join(d.Unchanged, ","), "db,api")
+		assertInt(t, len(d.Updated)+len(d.Restarted)+len(d.Added)+len(d.Removed), 0)
+	})
+
+	t.Run("Updates thresholds in place", func(t *testing.T) {
+		d := diff(func(cf []Ms.ConfigFile) []Ms.ConfigFile {
+			min := int64(5)
+			cf[0].Metrics["latency"] = Ms.MetricConfig{Type: "gauge", Max: 200}
+			cf[0].Metrics["connections"] = Ms.MetricConfig{Type: "gauge", Min: &min}
+			return cf
+		})
+		assertString(t, strings.Join(d.Updated["db"], ","), "connections,latency")
+		assertString(t, strings.Join(d.Unchanged, ","), "api")
+		assertInt(t, len(d.Restarted), 0)
+	})
+
+	t.Run("Updates every metric for endpoint periods", func(t *testing.T) {
+		d := diff(func(cf []Ms.ConfigFile) []Ms.ConfigFile {
+			cf[0].Periods = &Ms.PeriodConfig{IambStart: ratio(0.25)}
+			return cf
+		})
+		assertString(t, strings.Join(d.Updated["db"], ","), "connections,latency")
+	})
+
+	t.Run("Restarts for anything else", func(t *testing.T) {
+		d := diff(func(cf []Ms.ConfigFile) []Ms.ConfigFile {
+			cf[0].Metrics["latency"] = Ms.MetricConfig{Type: "gauge", Max: 100, Transformer: "calc_rate"}
+			cf[1].URL = "http://localhost:9090/api"
+			return cf
+		})
+		assertString(t, strings.Join(d.Restarted, ","), "db,api")
+	})
+
+	t.Run("Restarts when metrics are added", func(t *testing.T) {
+		d := diff(func(cf []Ms.ConfigFile) []Ms.ConfigFile {
+			cf[1].Metrics["timeouts"] = Ms.MetricConfig{Type: "gauge", Max: 1}
+			return cf
+		})
+		assertString(t, strings.Join(d.Restarted, ","), "api")
+	})
+
+	t.Run("Adds and removes endpoints by ID", func(t *testing.T) {
+		d := diff(func(cf []Ms.ConfigFile) []Ms.ConfigFile {
+			return []Ms.ConfigFile{cf[1], makeReloadConfig("cache", map[string]Ms.MetricConfig{"hits": {Max: 1}})}
+		})
+		assertString(t, strings.Join(d.Added, ","), "cache")
+		assertString(t, strings.Join(d.Removed, ","), "db")
+		assertString(t, strings.Join(d.Unchanged, ","), "api")
+	})
+}
+
+func TestQNet_Reconfigure(t *testing.T) {
+	start := time.Date(2023, 10, 1, 14, 0, 0, 0, time.UTC)
+	running := []Ms.ConfigFile{
+		makeReloadConfig("db", map[string]Ms.MetricConfig{
+			"latency":     {Type: "gauge", Max: 100},
+			"connections": {Type: "gauge", Max: 50},
+		}),
+		makeReloadConfig("api", map[string]Ms.MetricConfig{"errors": {Type: "gauge", Max: 10}}),
+	}
+
+	setup := func() (*Ms.QNet, *Ms.ManualClock) {
+		qn := Ms.NewQNet(*Ms.NewEndpointsFromConfig(running))
+		clock := Ms.NewManualClock(start)
+		qn.SetClock(clock)
+		for i := 0; i < 12; i++ {
+			qn.IngestMetric(0, "latency", int64(i%2)*150, clock.Now())
+			qn.IngestMetric(0, "connections", 20, clock.Now())
+			clock.Advance(5 * time.Second)
+		}
+		return qn, clock
+	}
+
+	t.Run("Tunes an endpoint in place", func(t *testing.T) {
+		qn, _ := setup()
+		db := qn.Network[0]
+		seq := db.Sequence["latency"]
+
+		cf := []Ms.ConfigFile{makeReloadConfig("db", map[string]Ms.MetricConfig{
+			"latency":     {Type: "gauge", Max: 300},
+			"connections": {Type: "gauge", Max: 50, Periods: &Ms.PeriodConfig{}},
+		}), running[1]}
+		qn.Reconfigure(cf, qn.DiffConfig(cf))
+
+		if qn.Network[0] != db || db.Sequence["latency"] != seq {
+			t.Error("Expected the endpoint and its state to be kept")
+		}
+		assertInt64(t, db.Threshold("latency").Enter, 300)
+		assertInt64(t, db.Config.Metrics["latency"].Max, 300)
+	})
+
+	t.Run("Rebuilds a restarted endpoint with its unchanged metrics", func(t *testing.T) {
+		qn, clock := setup()
+		db := qn.Network[0]
+		events := len(db.Sequence["latency"].Events)
+
+		cf := []Ms.ConfigFile{makeReloadConfig("db", map[string]Ms.MetricConfig{
+			"latency":     {Type: "gauge", Max: 100},
+			"connections": {Type: "counter", Max: 50},
+		}), running[1]}
+		qn.Reconfigure(cf, qn.DiffConfig(cf))
+
+		ep := qn.Network[0]
+		if ep == db {
+			t.Fatal("Expected a new endpoint")
+		}
+		assertInt(t, len(ep.Sequence["latency"].Events), events)
+		if ep.Sequence["connections"] != nil {
+			t.Error("Expected the changed metric to start fresh")
+		}
+		if !ep.Now().Equal(clock.Now()) {
+			t.Error("Expected the new endpoint on the QNet's clock")
+		}
+	})
+
+	t.Run("Follows the order of the config", func(t *testing.T) {
+		qn, _ := setup()
+		api := qn.Network[1]
+
+		cf := []Ms.ConfigFile{running[1], makeReloadConfig("cache", map[string]Ms.MetricConfig{"hits": {Max: 1}})}
+		qn.Reconfigure(cf, qn.DiffConfig(cf))
+
+		assertInt(t, len(qn.Network), 2)
+		if qn.Network[0] != api {
+			t.Error("Expected api to be kept first")
+		}
+		assertString(t, qn.Network[1].ID, "cache")
+	})
+}
+
+func TestEndpoint_Tune(t *testing.T) {
+	c := Ms.ConfigFile{
+		ID:      "prom",
+		URL:     "http://localhost:9090/metrics",
+		Format:  "prometheus",
+		Metrics: map[string]Ms.MetricConfig{"http_errors": {Type: "gauge", Max: 10}},
+	}
+	ep := (*Ms.NewEndpointsFromConfig([]Ms.ConfigFile{c}))[0]
+	ep.RegisterSeries(`http_errors{code="500"}`, "http_errors")
+
+	c.Metrics = map[string]Ms.MetricConfig{"http_errors": {Type: "gauge", Band: []int64{5, 20}}}
+	ep.Tune(c)
+
+	t.Run("Tunes matched series with their metric", func(t *testing.T) {
+		th := ep.Threshold(`http_errors{code="500"}`)
+		assertInt64(t, th.Low, 5)
+		assertInt64(t, th.High, 20)
+	})
+
+	t.Run("Keeps the config", func(t *testing.T) {
+		if len(ep.Config.Metrics["http_errors"].Band) != 2 {
+			t.Error("Expected the new config on the endpoint")
+		}
+	})
+}
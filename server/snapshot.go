@@ -0,0 +1,413 @@
+package monteverdi
+
+/*
+
+	Engine state snapshots
+
+	The live state of each endpoint — ictus sequences, hysteresis,
+	TUI layers, accents, learned thresholds, and its TemporalGrouper —
+	can be saved and restored, so patterns survive a restart without the warmup:
+
+		MONTEVERDI_SNAPSHOT_PATH              file to save to and restore from, off when unset
+		MONTEVERDI_SNAPSHOT_INTERVAL_SECONDS  how often to save while running (default 60)
+
+	On restore, ictus and pulses older than the pulse window are discarded,
+	and a metric is only restored when its config, and the rest of its
+	endpoint's, is the same as when the snapshot was taken.
+	Endpoints rebuilt by a config reload carry their state the same way.
+
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	Mt "github.com/maroda/monteverdi/types"
+)
+
+// SnapshotVersion is bumped whenever the snapshot format changes
+const SnapshotVersion = 1
+
+// Snapshot is the engine state of a QNet
+type Snapshot struct {
+	Version   int             `json:"version"`
+	Taken     time.Time       `json:"taken"`
+	Endpoints []EndpointState `json:"endpoints"`
+	Cascades  []CascadePulse  `json:"cascades,omitempty"`
+}
+
+// EndpointState is the engine state of one endpoint and the config it was built from
+type EndpointState struct {
+	ID      string                  `json:"id"`
+	Config  ConfigFile              `json:"config"`           // redacted
+	Metrics map[string]*MetricState `json:"metrics"`          // by metric key or series ID
+	Series  map[string]string       `json:"series,omitempty"` // series IDs to their metric key
+	Grouper GrouperState            `json:"grouper"`
+}
+
+// MetricState is the engine state of one metric
+type MetricState struct {
+	Mdata      int64          `json:"mdata"`
+	Accent     *Mt.Accent     `json:"accent,omitempty"`
+	Layer      *Mt.Timeseries `json:"layer,omitempty"`
+	Hysteresis *CycBuffer     `json:"hysteresis,omitempty"`
+	Sequence   *IctusSequence `json:"sequence,omitempty"`
+	Adaptive   *AdaptiveState `json:"adaptive,omitempty"`
+}
+
+// GrouperState is the pulses of a TemporalGrouper and what it needs to keep detecting
+type GrouperState struct {
+	Buffer        []Mt.PulseEvent         `json:"buffer"`
+	Groups        []*Mt.PulseTree         `json:"groups,omitempty"`
+	PulseSequence *PulseSequence          `json:"pulseSequence,omitempty"`
+	Sequences     map[int]*PulseSequence  `json:"sequences,omitempty"`
+	History       map[int][]Mt.PulseEvent `json:"history,omitempty"`
+	LastCustom    map[string]time.Time    `json:"lastCustom,omitempty"`
+	DetectedKeys  map[string]bool         `json:"detectedKeys,omitempty"`
+}
+
+// State returns the endpoint's engine state.
+// NB: Caller must hold ep.MU.RLock()
+func (ep *Endpoint) State() EndpointState {
+	st := EndpointState{
+		ID:      ep.ID,
+		Config:  RedactConfig([]ConfigFile{ep.Config})[0],
+		Metrics: make(map[string]*MetricState),
+		Series:  ep.Series,
+	}
+
+	for _, m := range ep.Metric {
+		ms := &MetricState{
+			Mdata:      ep.Mdata[m],
+			Accent:     ep.Accent[m],
+			Layer:      ep.Layer[m],
+			Hysteresis: ep.Hysteresis[m],
+			Sequence:   ep.Sequence[m],
+		}
+		if a, ok := ep.Adaptive[m]; ok {
+			s := a.State()
+			ms.Adaptive = &s
+		}
+		st.Metrics[m] = ms
+	}
+
+	if tg := ep.Pulses; tg != nil {
+		st.Grouper = GrouperState{
+			Buffer:        tg.Buffer,
+			Groups:        tg.Groups,
+			PulseSequence: tg.PulseSequence,
+			Sequences:     tg.Sequences,
+			History:       tg.History,
+			LastCustom:    tg.LastCustom,
+			DetectedKeys:  tg.DetectedKeys,
+		}
+	}
+
+	return st
+}
+
+// Restore brings back the state of each metric whose config has not changed,
+// dropping ictus and pulses that started before limit.
+// It returns the metrics restored, by metric key or series ID.
+// NB: Caller must hold ep.MU.Lock()
+func (ep *Endpoint) Restore(st EndpointState, limit time.Time) map[string]bool {
+	restored := make(map[string]bool)
+	if st.ID != ep.ID || !sameEndpointConfig(ep.Config, st.Config) {
+		return restored
+	}
+
+	// Metrics are kept by their config key, series go with theirs
+	kept := make(map[string]bool)
+	for k, mc := range ep.Config.Metrics {
+		if prev, ok := st.Config.Metrics[k]; ok && sameJSON(mc, prev) {
+			kept[k] = true
+		}
+	}
+	configKey := func(m string) string {
+		if key, ok := st.Series[m]; ok {
+			return key
+		}
+		return m
+	}
+
+	for m, ms := range st.Metrics {
+		key := configKey(m)
+		if !kept[key] {
+			continue
+		}
+		if m != key {
+			if ep.Series == nil {
+				ep.Series = make(map[string]string)
+			}
+			ep.RegisterSeries(m, key)
+		}
+
+		ep.Mdata[m] = ms.Mdata
+		if ms.Accent != nil {
+			ep.Accent[m] = ms.Accent
+		}
+		if ms.Layer != nil {
+			ep.Layer[m] = ms.Layer
+		}
+		if ms.Hysteresis != nil {
+			ep.Hysteresis[m] = ms.Hysteresis
+		}
+		if ms.Sequence != nil {
+			ep.Sequence[m] = trimSequence(ms.Sequence, limit)
+		}
+		if a, ok := ep.Adaptive[m]; ok && ms.Adaptive != nil {
+			a.Restore(*ms.Adaptive)
+		}
+		restored[m] = true
+	}
+
+	// A pulse is kept when every metric it spans was restored
+	keep := func(p Mt.PulseEvent) bool {
+		if !p.StartTime.After(limit) || len(p.Metric) == 0 {
+			return false
+		}
+		for _, m := range p.Metric {
+			if !restored[m] {
+				return false
+			}
+		}
+		return true
+	}
+
+	if ep.Pulses == nil {
+		return restored
+	}
+	tg := ep.Pulses
+	g := st.Grouper
+	tg.Buffer = append(tg.Buffer, filterPulses(g.Buffer, keep)...)
+	for _, tree := range g.Groups {
+		if len(tree.OGEvents) > 0 && keep(tree.OGEvents[0]) {
+			tg.Groups = append(tg.Groups, tree)
+		}
+	}
+	if g.PulseSequence != nil {
+		tg.PulseSequence = &PulseSequence{
+			Metric:    g.PulseSequence.Metric,
+			Events:    filterPulses(g.PulseSequence.Events, keep),
+			StartTime: g.PulseSequence.StartTime,
+			EndTime:   g.PulseSequence.EndTime,
+		}
+	}
+	for d, ps := range g.Sequences {
+		if tg.Sequences == nil {
+			tg.Sequences = make(map[int]*PulseSequence)
+		}
+		tg.Sequences[d] = &PulseSequence{Metric: ps.Metric, Events: filterPulses(ps.Events, keep)}
+	}
+	for d, history := range g.History {
+		if tg.History == nil {
+			tg.History = make(map[int][]Mt.PulseEvent)
+		}
+		tg.History[d] = filterPulses(history, keep)
+	}
+	for name, last := range g.LastCustom {
+		if tg.LastCustom == nil {
+			tg.LastCustom = make(map[string]time.Time)
+		}
+		tg.LastCustom[name] = last
+	}
+	for k, v := range g.DetectedKeys {
+		if tg.DetectedKeys == nil {
+			tg.DetectedKeys = make(map[string]bool)
+		}
+		tg.DetectedKeys[k] = v
+	}
+
+	return restored
+}
+
+// Snapshot returns a copy of the engine state of every endpoint,
+// safe to save while polling goes on
+func (q *QNet) Snapshot() (*Snapshot, error) {
+	q.MU.RLock()
+	defer q.MU.RUnlock()
+
+	s := &Snapshot{
+		Version:  SnapshotVersion,
+		Taken:    q.Now(),
+		Cascades: q.Cascade.Cascades(),
+	}
+	for _, ep := range q.Network {
+		ep.MU.RLock()
+		data, err := json.Marshal(ep.State())
+		ep.MU.RUnlock()
+		if err != nil {
+			return nil, fmt.Errorf("could not copy state of %s: %w", ep.ID, err)
+		}
+
+		var st EndpointState
+		if err = json.Unmarshal(data, &st); err != nil {
+			return nil, fmt.Errorf("could not copy state of %s: %w", ep.ID, err)
+		}
+		s.Endpoints = append(s.Endpoints, st)
+	}
+
+	return s, nil
+}
+
+// Restore brings back the state of every endpoint in the snapshot,
+// matched by ID, and returns how many metrics were restored
+func (q *QNet) Restore(s *Snapshot) int {
+	if s == nil {
+		return 0
+	}
+
+	q.MU.RLock()
+	defer q.MU.RUnlock()
+
+	now := q.Now()
+	count := 0
+	restored := make(map[string]map[string]bool)
+	var oldest time.Time
+	for _, ep := range q.Network {
+		window := time.Hour
+		if ep.Pulses != nil && ep.Pulses.WindowSize > 0 {
+			window = ep.Pulses.WindowSize
+		}
+		limit := now.Add(-window)
+		if oldest.IsZero() || limit.Before(oldest) {
+			oldest = limit
+		}
+
+		// Nothing in a snapshot older than the window is worth keeping
+		if s.Taken.Before(limit) {
+			continue
+		}
+
+		for _, st := range s.Endpoints {
+			if st.ID != ep.ID {
+				continue
+			}
+			ep.MU.Lock()
+			restored[ep.ID] = ep.Restore(st, limit)
+			ep.MU.Unlock()
+			count += len(restored[ep.ID])
+		}
+	}
+
+	// Cascades come back when both of their metrics did
+	if q.Cascade != nil {
+		q.Cascade.MU.Lock()
+		for _, c := range s.Cascades {
+			if !c.StartTime.After(oldest) || len(c.Endpoints) != len(c.Metric) {
+				continue
+			}
+			linked := true
+			for i, m := range c.Metric {
+				if !restored[c.Endpoints[i]][m] {
+					linked = false
+				}
+			}
+			if linked {
+				q.Cascade.Buffer = append(q.Cascade.Buffer, c)
+			}
+		}
+		q.Cascade.MU.Unlock()
+	}
+
+	return count
+}
+
+// SaveSnapshot writes the snapshot to path,
+// through a temporary file so a crash never leaves half a snapshot
+func SaveSnapshot(path string, s *Snapshot) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("could not encode snapshot: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("could not create snapshot: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write snapshot: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("could not write snapshot: %w", err)
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("could not save snapshot: %w", err)
+	}
+
+	slog.Debug("SNAPSHOT_SAVED", slog.String("path", path), slog.Int("bytes", len(data)))
+	return nil
+}
+
+// LoadSnapshot reads a snapshot written by SaveSnapshot
+func LoadSnapshot(path string) (*Snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var s Snapshot
+	if err = json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("could not decode snapshot: %w", err)
+	}
+	if s.Version != SnapshotVersion {
+		return nil, fmt.Errorf("snapshot version %d is not supported, want %d", s.Version, SnapshotVersion)
+	}
+
+	return &s, nil
+}
+
+// trimSequence drops ictus that started before limit
+func trimSequence(seq *IctusSequence, limit time.Time) *IctusSequence {
+	trimmed := *seq
+	trimmed.Events = make([]Mt.Ictus, 0, len(seq.Events))
+	for _, e := range seq.Events {
+		if e.Timestamp.After(limit) {
+			trimmed.Events = append(trimmed.Events, e)
+		}
+	}
+
+	// Dropped ictus were processed first
+	dropped := len(seq.Events) - len(trimmed.Events)
+	trimmed.LastProcessedEventCount = Max(0, seq.LastProcessedEventCount-dropped)
+	return &trimmed
+}
+
+// filterPulses returns a new slice of the pulses to keep
+func filterPulses(pulses []Mt.PulseEvent, keep func(Mt.PulseEvent) bool) []Mt.PulseEvent {
+	kept := make([]Mt.PulseEvent, 0, len(pulses))
+	for _, p := range pulses {
+		if keep(p) {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// sameEndpointConfig compares everything but the metrics and credentials
+func sameEndpointConfig(a, b ConfigFile) bool {
+	a.Metrics, b.Metrics = nil, nil
+	a.Auth, b.Auth = nil, nil
+	return sameJSON(a, b)
+}
+
+// sameJSON compares two configs as they would be written to config.json
+func sameJSON(a, b interface{}) bool {
+	ja, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	jb, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(ja, jb)
+}
@@ -0,0 +1,189 @@
+package monteverdi_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	Ms "github.com/maroda/monteverdi/server"
+)
+
+// makeSnapshotQNet runs a toggling latency and a steady connections metric
+// through the pipeline, returning the QNet and its clock
+func makeSnapshotQNet(t *testing.T, cf []Ms.ConfigFile, start time.Time) (*Ms.QNet, *Ms.ManualClock) {
+	t.Helper()
+	qn := Ms.NewQNet(*Ms.NewEndpointsFromConfig(cf))
+	clock := Ms.NewManualClock(start)
+	qn.SetClock(clock)
+
+	for i := 0; i < 12; i++ {
+		var value int64
+		if i%2 == 1 {
+			value = 150
+		}
+		qn.IngestMetric(0, "latency", value, clock.Now())
+		qn.IngestMetric(0, "connections", 20, clock.Now())
+		clock.Advance(5 * time.Second)
+	}
+	return qn, clock
+}
+
+func makeSnapshotConfig() []Ms.ConfigFile {
+	return []Ms.ConfigFile{{
+		ID:       "DB",
+		URL:      "http://localhost:8090/db",
+		Delim:    "=",
+		Interval: 5,
+		Metrics: map[string]Ms.MetricConfig{
+			"latency":     {Type: "gauge", Max: 100},
+			"connections": {Type: "gauge", Adaptive: &Ms.AdaptiveConfig{Method: "stddev", Window: 4}},
+		},
+	}}
+}
+
+func TestSnapshot_SaveLoad(t *testing.T) {
+	start := time.Date(2023, 10, 1, 14, 0, 0, 0, time.UTC)
+	qn, _ := makeSnapshotQNet(t, makeSnapshotConfig(), start)
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+
+	s, err := qn.Snapshot()
+	assertError(t, err, nil)
+	assertError(t, Ms.SaveSnapshot(path, s), nil)
+
+	t.Run("Round trips the engine state", func(t *testing.T) {
+		got, err := Ms.LoadSnapshot(path)
+		assertError(t, err, nil)
+		assertInt(t, got.Version, Ms.SnapshotVersion)
+		assertInt(t, len(got.Endpoints), 1)
+
+		ep := got.Endpoints[0]
+		assertString(t, ep.ID, "DB")
+		assertInt(t, len(ep.Metrics["latency"].Sequence.Events), len(qn.Network[0].Sequence["latency"].Events))
+		assertInt(t, len(ep.Grouper.Buffer), len(qn.Network[0].Pulses.Buffer))
+		if ep.Metrics["connections"].Adaptive == nil {
+			t.Error("Expected the learned threshold")
+		}
+	})
+
+	t.Run("Leaves no temporary files", func(t *testing.T) {
+		entries, err := os.ReadDir(filepath.Dir(path))
+		assertError(t, err, nil)
+		assertInt(t, len(entries), 1)
+	})
+
+	t.Run("Errors on a missing file", func(t *testing.T) {
+		_, err := Ms.LoadSnapshot(filepath.Join(t.TempDir(), "craquemattic.json"))
+		assertGotError(t, err)
+	})
+
+	t.Run("Errors on another version", func(t *testing.T) {
+		other := *s
+		other.Version = Ms.SnapshotVersion + 1
+		versioned := filepath.Join(t.TempDir(), "snapshot.json")
+		assertError(t, Ms.SaveSnapshot(versioned, &other), nil)
+
+		_, err := Ms.LoadSnapshot(versioned)
+		assertGotError(t, err)
+		assertStringContains(t, err.Error(), "version")
+	})
+}
+
+func TestQNet_Restore(t *testing.T) {
+	start := time.Date(2023, 10, 1, 14, 0, 0, 0, time.UTC)
+	qn, clock := makeSnapshotQNet(t, makeSnapshotConfig(), start)
+	s, err := qn.Snapshot()
+	assertError(t, err, nil)
+
+	restore := func(cf []Ms.ConfigFile, now time.Time) (*Ms.QNet, int) {
+		fresh := Ms.NewQNet(*Ms.NewEndpointsFromConfig(cf))
+		fresh.SetClock(Ms.NewManualClock(now))
+		return fresh, fresh.Restore(s)
+	}
+
+	t.Run("Restores every metric of an unchanged config", func(t *testing.T) {
+		fresh, count := restore(makeSnapshotConfig(), clock.Now())
+		assertInt(t, count, 2)
+
+		ep, old := fresh.Network[0], qn.Network[0]
+		assertInt(t, len(ep.Sequence["latency"].Events), len(old.Sequence["latency"].Events))
+		assertInt(t, ep.Sequence["latency"].LastProcessedEventCount, old.Sequence["latency"].LastProcessedEventCount)
+		assertInt(t, len(ep.Pulses.Buffer), len(old.Pulses.Buffer))
+		assertInt64(t, ep.Mdata["latency"], old.Mdata["latency"])
+		if !ep.Adaptive["connections"].Ready {
+			t.Error("Expected the learned threshold to be ready without the warmup")
+		}
+	})
+
+	t.Run("Skips metrics whose config changed", func(t *testing.T) {
+		cf := makeSnapshotConfig()
+		cf[0].Metrics["latency"] = Ms.MetricConfig{Type: "gauge", Max: 50}
+		fresh, count := restore(cf, clock.Now())
+		assertInt(t, count, 1)
+
+		ep := fresh.Network[0]
+		if ep.Sequence["latency"] != nil {
+			t.Error("Expected the changed metric to start fresh")
+		}
+		assertInt(t, len(ep.Pulses.Buffer), 0)
+		if !ep.Adaptive["connections"].Ready {
+			t.Error("Expected the unchanged metric to keep its threshold")
+		}
+	})
+
+	t.Run("Skips endpoints whose config changed", func(t *testing.T) {
+		cf := makeSnapshotConfig()
+		cf[0].URL = "http://localhost:8090/other"
+		_, count := restore(cf, clock.Now())
+		assertInt(t, count, 0)
+	})
+
+	t.Run("Drops what is older than the window", func(t *testing.T) {
+		fresh, count := restore(makeSnapshotConfig(), start.Add(time.Hour+30*time.Second))
+		assertInt(t, count, 2)
+
+		ep := fresh.Network[0]
+		for _, e := range ep.Sequence["latency"].Events {
+			if !e.Timestamp.After(start.Add(30 * time.Second)) {
+				t.Errorf("Expected ictus older than the window to be dropped, got %v", e.Timestamp)
+			}
+		}
+		for _, p := range ep.Pulses.Buffer {
+			if !p.StartTime.After(start.Add(30 * time.Second)) {
+				t.Errorf("Expected pulses older than the window to be dropped, got %v", p.StartTime)
+			}
+		}
+		if len(ep.Sequence["latency"].Events) >= len(qn.Network[0].Sequence["latency"].Events) {
+			t.Error("Expected some ictus to be dropped")
+		}
+	})
+
+	t.Run("Skips a snapshot older than the window", func(t *testing.T) {
+		_, count := restore(makeSnapshotConfig(), clock.Now().Add(2*time.Hour))
+		assertInt(t, count, 0)
+	})
+
+	t.Run("Keeps detecting after a restore", func(t *testing.T) {
+		fresh, _ := restore(makeSnapshotConfig(), clock.Now())
+		fclock := Ms.NewManualClock(clock.Now())
+		fresh.SetClock(fclock)
+		before := len(fresh.Network[0].Pulses.Buffer)
+
+		for i := 0; i < 6; i++ {
+			var value int64
+			if i%2 == 0 {
+				value = 150
+			}
+			fresh.IngestMetric(0, "latency", value, fclock.Now())
+			fclock.Advance(5 * time.Second)
+		}
+		if len(fresh.Network[0].Pulses.Buffer) <= before {
+			t.Error("Expected new pulses after the restored ones")
+		}
+	})
+
+	t.Run("Ignores a nil snapshot", func(t *testing.T) {
+		fresh := Ms.NewQNet(*Ms.NewEndpointsFromConfig(makeSnapshotConfig()))
+		assertInt(t, fresh.Restore(nil), 0)
+	})
+}
@@ -0,0 +1,170 @@
+package monteverdi
+
+/*
+
+	Accent thresholds
+
+	By default a metric is accented at or above its Max.
+	A Threshold can also accent low values, a band of values,
+	and hold an accent until the value has clearly left (hysteresis):
+
+		"metrics": {
+			"cpu":      { "max": 90, "exit": 75 },         // accent at 90, until below 75
+			"mem_free": { "min": 512 },                    // accent at or below 512
+			"temp":     { "band": [60, 80] },              // accent from 60 to 80
+			"queue":    { "enter": 10, "exit": 50 }        // accent at or below 10, until above 50
+		}
+
+	With enter/exit the direction comes from their order:
+	enter above exit accents high values, enter below exit accents low values.
+
+*/
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Threshold modes
+const (
+	ThresholdAbove  = "above"  // accent at or above Enter
+	ThresholdBelow  = "below"  // accent at or below Enter
+	ThresholdBand   = "band"   // accent from Low to High
+	ThresholdWarmup = "warmup" // adaptive, still learning: no accent
+)
+
+// Threshold decides whether a value is an accent
+type Threshold struct {
+	Mode  string `json:"mode"`           // above, below, band, or warmup
+	Enter int64  `json:"enter"`          // above/below: the accent starts here
+	Exit  int64  `json:"exit"`           // above/below: the accent holds until the value passes here
+	Low   int64  `json:"low,omitempty"`  // band: lowest accented value
+	High  int64  `json:"high,omitempty"` // band: highest accented value
+}
+
+// NewThreshold reads the accent settings of a metric.
+// Without min, band, or enter it is the classic accent at Max.
+func NewThreshold(mc MetricConfig) (*Threshold, error) {
+	switch {
+	case mc.Adaptive != nil && (mc.Min != nil || len(mc.Band) > 0 || mc.Enter != nil || mc.Exit != nil):
+		return nil, errors.New("adaptive cannot be combined with min, band, enter, or exit")
+
+	case len(mc.Band) > 0:
+		if mc.Min != nil || mc.Enter != nil || mc.Exit != nil {
+			return nil, errors.New("band cannot be combined with min, enter, or exit")
+		}
+		if len(mc.Band) != 2 {
+			return nil, fmt.Errorf("band needs [low, high], got %d values", len(mc.Band))
+		}
+		if mc.Band[0] > mc.Band[1] {
+			return nil, fmt.Errorf("band low %d is above high %d", mc.Band[0], mc.Band[1])
+		}
+		return &Threshold{Mode: ThresholdBand, Low: mc.Band[0], High: mc.Band[1]}, nil
+
+	case mc.Enter != nil:
+		if mc.Min != nil {
+			return nil, errors.New("enter cannot be combined with min")
+		}
+		if mc.Exit == nil {
+			return nil, errors.New("enter needs an exit")
+		}
+		mode := ThresholdAbove
+		if *mc.Enter < *mc.Exit {
+			mode = ThresholdBelow
+		}
+		return &Threshold{Mode: mode, Enter: *mc.Enter, Exit: *mc.Exit}, nil
+
+	case mc.Min != nil:
+		if mc.Max != 0 {
+			return nil, errors.New("min cannot be combined with max, use a band")
+		}
+		th := &Threshold{Mode: ThresholdBelow, Enter: *mc.Min, Exit: *mc.Min}
+		if mc.Exit != nil {
+			if *mc.Exit < *mc.Min {
+				return nil, fmt.Errorf("exit %d is below min %d", *mc.Exit, *mc.Min)
+			}
+			th.Exit = *mc.Exit
+		}
+		return th, nil
+	}
+
+	th := &Threshold{Mode: ThresholdAbove, Enter: mc.Max, Exit: mc.Max}
+	if mc.Exit != nil {
+		if *mc.Exit > mc.Max {
+			return nil, fmt.Errorf("exit %d is above max %d", *mc.Exit, mc.Max)
+		}
+		th.Exit = *mc.Exit
+	}
+	return th, nil
+}
+
+// IsAccent tells whether v is an accent,
+// given whether the previous value was one
+func (th *Threshold) IsAccent(v int64, wasAccent bool) bool {
+	switch th.Mode {
+	case ThresholdWarmup:
+		return false
+	case ThresholdBand:
+		return v >= th.Low && v <= th.High
+	case ThresholdBelow:
+		if wasAccent {
+			return v <= th.Exit
+		}
+		return v <= th.Enter
+	default:
+		if wasAccent {
+			return v >= th.Exit
+		}
+		return v >= th.Enter
+	}
+}
+
+// Percent is how close v is to an accent, 100 is on the threshold
+func (th *Threshold) Percent(v int64) float64 {
+	switch th.Mode {
+	case ThresholdWarmup:
+		return 0
+	case ThresholdBand:
+		switch {
+		case v < th.Low:
+			return percentOf(v, th.Low)
+		case v > th.High:
+			return percentOf(th.High, v)
+		}
+		return 100
+	case ThresholdBelow:
+		if v <= 0 && th.Enter >= v {
+			return 100 // as low as it gets
+		}
+		return percentOf(th.Enter, v)
+	default:
+		return percentOf(v, th.Enter)
+	}
+}
+
+// Depth maps v onto the classic accent above Max,
+// so that ValToRuneWithCheckMax can draw every mode:
+// the further into the accent, the higher the returned value.
+func (th *Threshold) Depth(v int64) (int64, int64) {
+	switch th.Mode {
+	case ThresholdBand:
+		// Low to High fills the eight levels
+		width := th.High - th.Low
+		if width <= 0 {
+			return 8, 8
+		}
+		return 8 + (v-th.Low)*8/width, 8
+	case ThresholdBelow:
+		return th.Enter + (th.Enter - v), th.Enter
+	default:
+		return v, th.Enter
+	}
+}
+
+// percentOf returns part/whole as a percentage, 0 for no whole
+func percentOf(part, whole int64) float64 {
+	if whole == 0 {
+		return 0
+	}
+	return FloatPrecise((float64(part)/float64(whole))*100, 2)
+}
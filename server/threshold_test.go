@@ -0,0 +1,168 @@
+package monteverdi_test
+
+import (
+	"testing"
+
+	Ms "github.com/maroda/monteverdi/server"
+)
+
+func int64p(v int64) *int64 { return &v }
+
+func TestNewThreshold(t *testing.T) {
+	tests := []struct {
+		name  string
+		mc    Ms.MetricConfig
+		want  Ms.Threshold
+		fails bool
+	}{
+		{"Max by default", Ms.MetricConfig{Max: 90}, Ms.Threshold{Mode: Ms.ThresholdAbove, Enter: 90, Exit: 90}, false},
+		{"Max with exit", Ms.MetricConfig{Max: 90, Exit: int64p(75)}, Ms.Threshold{Mode: Ms.ThresholdAbove, Enter: 90, Exit: 75}, false},
+		{"Min", Ms.MetricConfig{Min: int64p(512)}, Ms.Threshold{Mode: Ms.ThresholdBelow, Enter: 512, Exit: 512}, false},
+		{"Min of zero", Ms.MetricConfig{Min: int64p(0)}, Ms.Threshold{Mode: Ms.ThresholdBelow}, false},
+		{"Min with exit", Ms.MetricConfig{Min: int64p(512), Exit: int64p(1024)}, Ms.Threshold{Mode: Ms.ThresholdBelow, Enter: 512, Exit: 1024}, false},
+		{"Band", Ms.MetricConfig{Band: []int64{60, 80}}, Ms.Threshold{Mode: Ms.ThresholdBand, Low: 60, High: 80}, false},
+		{"Enter above exit", Ms.MetricConfig{Enter: int64p(90), Exit: int64p(70)}, Ms.Threshold{Mode: Ms.ThresholdAbove, Enter: 90, Exit: 70}, false},
+		{"Enter below exit", Ms.MetricConfig{Enter: int64p(10), Exit: int64p(50)}, Ms.Threshold{Mode: Ms.ThresholdBelow, Enter: 10, Exit: 50}, false},
+		{"Max exit above max", Ms.MetricConfig{Max: 90, Exit: int64p(95)}, Ms.Threshold{}, true},
+		{"Min exit below min", Ms.MetricConfig{Min: int64p(512), Exit: int64p(100)}, Ms.Threshold{}, true},
+		{"Min with max", Ms.MetricConfig{Max: 90, Min: int64p(10)}, Ms.Threshold{}, true},
+		{"Band of one", Ms.MetricConfig{Band: []int64{60}}, Ms.Threshold{}, true},
+		{"Band upside down", Ms.MetricConfig{Band: []int64{80, 60}}, Ms.Threshold{}, true},
+		{"Band with exit", Ms.MetricConfig{Band: []int64{60, 80}, Exit: int64p(50)}, Ms.Threshold{}, true},
+		{"Enter without exit", Ms.MetricConfig{Enter: int64p(90)}, Ms.Threshold{}, true},
+		{"Enter with min", Ms.MetricConfig{Enter: int64p(90), Exit: int64p(70), Min: int64p(5)}, Ms.Threshold{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Ms.NewThreshold(tt.mc)
+			if tt.fails {
+				assertGotError(t, err)
+				return
+			}
+			assertError(t, err, nil)
+			if *got != tt.want {
+				t.Errorf("got %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestThreshold_IsAccent(t *testing.T) {
+	t.Run("Hysteresis holds the accent until the exit", func(t *testing.T) {
+		th := &Ms.Threshold{Mode: Ms.ThresholdAbove, Enter: 90, Exit: 75}
+		values := []int64{80, 91, 85, 89, 76, 74, 89, 90}
+		want := []bool{false, true, true, true, true, false, false, true}
+
+		wasAccent := false
+		for i, v := range values {
+			got := th.IsAccent(v, wasAccent)
+			if got != want[i] {
+				t.Errorf("value %d: got %v, want %v", v, got, want[i])
+			}
+			wasAccent = got
+		}
+	})
+
+	t.Run("Below accents low values", func(t *testing.T) {
+		th := &Ms.Threshold{Mode: Ms.ThresholdBelow, Enter: 512, Exit: 1024}
+		values := []int64{2048, 512, 800, 1024, 1025, 900}
+		want := []bool{false, true, true, true, false, false}
+
+		wasAccent := false
+		for i, v := range values {
+			got := th.IsAccent(v, wasAccent)
+			if got != want[i] {
+				t.Errorf("value %d: got %v, want %v", v, got, want[i])
+			}
+			wasAccent = got
+		}
+	})
+
+	t.Run("Band accents inside its bounds", func(t *testing.T) {
+		th := &Ms.Threshold{Mode: Ms.ThresholdBand, Low: 60, High: 80}
+		for v, want := range map[int64]bool{59: false, 60: true, 70: true, 80: true, 81: false} {
+			if got := th.IsAccent(v, true); got != want {
+				t.Errorf("value %d: got %v, want %v", v, got, want)
+			}
+		}
+	})
+}
+
+func TestThreshold_Percent(t *testing.T) {
+	tests := []struct {
+		name string
+		th   Ms.Threshold
+		v    int64
+		want float64
+	}{
+		{"Above, half way", Ms.Threshold{Mode: Ms.ThresholdAbove, Enter: 100, Exit: 100}, 50, 50},
+		{"Above, no max", Ms.Threshold{Mode: Ms.ThresholdAbove}, 50, 0},
+		{"Below, twice the min", Ms.Threshold{Mode: Ms.ThresholdBelow, Enter: 512}, 1024, 50},
+		{"Below, at zero", Ms.Threshold{Mode: Ms.ThresholdBelow, Enter: 512}, 0, 100},
+		{"Band, inside", Ms.Threshold{Mode: Ms.ThresholdBand, Low: 60, High: 80}, 70, 100},
+		{"Band, under", Ms.Threshold{Mode: Ms.ThresholdBand, Low: 60, High: 80}, 30, 50},
+		{"Band, over", Ms.Threshold{Mode: Ms.ThresholdBand, Low: 60, High: 80}, 160, 50},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.th.Percent(tt.v); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQNet_FindAccentThreshold(t *testing.T) {
+	eps := Ms.NewEndpointsFromConfig([]Ms.ConfigFile{{
+		ID:    "THRESH",
+		URL:   "http://localhost:8090/metrics",
+		Delim: "=",
+		Metrics: map[string]Ms.MetricConfig{
+			"CPU1":    {Type: "gauge", Max: 90, Exit: int64p(75)},
+			"MEMFREE": {Type: "gauge", Min: int64p(512)},
+			"TEMP":    {Type: "gauge", Band: []int64{60, 80}},
+		},
+	}})
+	qn := Ms.NewQNet(*eps)
+	ep := qn.Network[0]
+
+	t.Run("Hovering at the max does not flap", func(t *testing.T) {
+		for _, v := range []int64{91, 89, 90, 88, 91, 89} {
+			qn.IngestMetric(0, "CPU1", v, ep.Now())
+		}
+		seq := ep.Sequence["CPU1"]
+		assertInt(t, len(seq.Events), 1)
+		if !seq.Events[0].IsAccent || !ep.InAccent("CPU1") {
+			t.Error("Expected one long accent")
+		}
+	})
+
+	t.Run("Low free memory is an accent", func(t *testing.T) {
+		qn.IngestMetric(0, "MEMFREE", 4096, ep.Now())
+		if ep.InAccent("MEMFREE") {
+			t.Error("Expected no accent with plenty of memory")
+		}
+		qn.IngestMetric(0, "MEMFREE", 256, ep.Now())
+		if !ep.InAccent("MEMFREE") {
+			t.Error("Expected an accent with low memory")
+		}
+		layer := ep.Layer["MEMFREE"]
+		if r := layer.Runes[layer.Current]; r == ' ' {
+			t.Error("Expected an accent rune")
+		}
+	})
+
+	t.Run("A band accents in between", func(t *testing.T) {
+		qn.IngestMetric(0, "TEMP", 95, ep.Now())
+		if ep.InAccent("TEMP") {
+			t.Error("Expected no accent above the band")
+		}
+		qn.IngestMetric(0, "TEMP", 80, ep.Now())
+		layer := ep.Layer["TEMP"]
+		if !ep.InAccent("TEMP") || layer.Runes[layer.Current] != '█' {
+			t.Errorf("Expected a full accent at the top of the band, got %q", layer.Runes[layer.Current])
+		}
+	})
+}
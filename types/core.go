@@ -67,15 +67,27 @@ const (
 	Iamb       PulsePattern = iota // Iamb: non-accent → accent
 	Trochee                        // Trochee: accent → non-accent
 	Amphibrach                     // Amphibrach: non-accent → accent → non-accent
-	Anapest                        // Anapest: non-accent → non-accent → accent (not yet implemented)
-	Dactyl                         // Dactyl: accent → non-accent → non-accent (not yet implemented)
+	Anapest                        // Anapest: non-accent → non-accent → accent
+	Dactyl                         // Dactyl: accent → non-accent → non-accent
+	Period                         // Period: three D2 or higher pulses in a row, D3 and up
+	Cascade                        // Cascade: the same pulse on two metrics, one following the other
+	Custom                         // Custom: user-defined, named by PulseEvent.Name
 )
 
+// StartsOnAccent tells whether the pattern's first place is an accent.
+// This is the pattern's accent when it is one place of a higher dimension.
+func (p PulsePattern) StartsOnAccent() bool {
+	return p == Trochee || p == Dactyl
+}
+
 // PulseEvent is the pulse metadata
 type PulseEvent struct {
 	Dimension int
 	Metric    []string
+	Endpoint  string   // ID of the Endpoint the pulse was detected on
+	Endpoints []string // ID of the Endpoint of each Metric, when they can differ as in a Cascade
 	Pattern   PulsePattern
+	Name      string      // Pattern name of a Custom pulse
 	Parent    time.Time   // Primary Keys of a parent (D2 or greater)
 	Children  []time.Time // Primary Keys of children (D1 or greater)
 	StartTime time.Time   // This is a Primary Key
@@ -106,7 +118,7 @@ type PulseVizPoint struct {
 
 // PulseConfig is the Dimension 1 period configuration,
 // typically all are set to the middle (.5) to detect the pattern.
-// This is mostly here for future configuration UI features
+// Each endpoint and metric can set its own in the "periods" config.
 type PulseConfig struct {
 	IambStartPeriod    float64 // 0.0 = start of non-accent, 0.5 = middle, 1.0 = end
 	IambEndPeriod      float64 // 0.0 = start of accent, 0.5 = middle, 1.0 = end
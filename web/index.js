@@ -180,18 +180,17 @@ function updatePulsesFromBackend(backendData) {
     const filteredData = backendData.filter(d => {
         const dimension = d.dimension || 1;
         const ring = d.ring || 0;
-        return (dimension === 1 && ring === 0) || (dimension === 2 && ring === 1);
+        return (dimension === 1 && ring === 0) || (dimension >= 2 && ring === 1);
     });
 
-    // Track new amphibrachs for animation
-    const newAmphibrachs = filteredData.filter(d =>
+    // Track new D2 pulses (amphibrach, anapest, dactyl) for animation
+    const newConsorts = filteredData.filter(d =>
         d.dimension === 2 &&
-        d.type === 'amphibrach' &&
         !seenPulses.has(`${d.metric}-${d.startTime}-${d.type}`)
     );
 
-    // Animate transitions for new amphibrachs
-    newAmphibrachs.forEach(d2Pulse => {
+    // Animate transitions for new D2 pulses
+    newConsorts.forEach(d2Pulse => {
         animateD1ToD2Transition(null, d2Pulse);
     });
 
@@ -205,7 +204,7 @@ function updatePulsesFromBackend(backendData) {
             // If we havent' seen this pulse, it's NEW, blink!
             if (!seenPulses.has(pulseKey)) {
                 seenPulses.add(pulseKey);
-                activePulseTypes.add(d.type);
+                activePulseTypes.add(d.custom ? 'custom' : d.type);
             }
         }
     });
@@ -215,7 +214,7 @@ function updatePulsesFromBackend(backendData) {
 
     // Simple data join with good keys
     const pulses = svg.selectAll('.pulse')
-        .data(filteredData, d => `${d.metric}-${d.startTime}-${d.dimension}`);
+        .data(filteredData, d => `${d.metric}-${d.startTime}-${d.dimension}-${d.type}`);
 
     // Remove dots that are no longer in data
     pulses.exit().remove();
@@ -223,7 +222,7 @@ function updatePulsesFromBackend(backendData) {
     // Add new dots
     pulses.enter()
         .append('ellipse')
-        .attr('class', d => `pulse pulse-${d.type}`)
+        .attr('class', d => `pulse pulse-${d.custom ? 'custom' : d.type}`)
         .attr('cx', d => getPulsePosition(d.ring, d.angle, d.metric).x)
         .attr('cy', d => getPulsePosition(d.ring, d.angle, d.metric).y)
         .attr('rx', d => calculatePulseLength(d)) // horizontal radius (length)
@@ -262,7 +261,10 @@ function updatePulseIndicators() {
         'trochee': 'trocheePulse',
         'amphibrach': 'amphibrachPulse',
         'anapest': 'anapestPulse',
-        'dactyl': 'dactylPulse'
+        'dactyl': 'dactylPulse',
+        'period': 'periodPulse',
+        'cascade': 'cascadePulse',
+        'custom': 'customPulse'
     };
 
     // Flash indicators for active pulses
@@ -512,13 +514,16 @@ function showPulseMeta(pulseData) {
 
     // Format the metadata
     const lines = [
-        `Type: ${pulseData.type}`,
+        `Type: ${pulseData.type}${pulseData.custom ? ' (custom)' : ''}`,
         `Metric: ${pulseData.metric}`,
         `Ring: ${pulseData.ring} (D${pulseData.dimension})`,
         `Intensity: ${(pulseData.intensity * 100).toFixed(0)}%`,
         `Duration: ${(pulseData.duration / 1e9).toFixed(1)}s`,
         `Endpoint: ${pulseData.endpoint}`
     ];
+    if (pulseData.linked) {
+        lines.push(`Cascade: ${pulseData.linked.join(' → ')}`);
+    }
 
     // Create background box
     const boxHeight = lines.length * 16 + 10;
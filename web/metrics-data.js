@@ -44,7 +44,7 @@ function updateMetricsTable() {
 
                 // Max value
                 const maxCell = row.insertCell();
-                maxCell.textContent = metric.maxVal.toLocaleString();
+                maxCell.textContent = thresholdLabel(metric);
                 maxCell.style.textAlign = 'right';
                 maxCell.style.fontFamily = 'monospace';
 
@@ -55,7 +55,7 @@ function updateMetricsTable() {
                 pctCell.style.fontFamily = 'monospace';
 
                 // Color code the percentage
-                if (metric.percentUsed >= 100) {
+                if (metric.isAccent || metric.percentUsed >= 100) {
                     pctCell.style.color = '#ff7f00'; // Orange - accent triggered
                 } else if (metric.percentUsed >= 80) {
                     pctCell.style.color = '#ffcc00'; // Yellow - getting close
@@ -86,4 +86,25 @@ function updateMetricsTable() {
 
 // Update table every 2 seconds
 setInterval(updateMetricsTable, 2000);
-updateMetricsTable(); // Initial load
\ No newline at end of file
+updateMetricsTable(); // Initial load
+
+// Describe the accent threshold: max, min, band, or enter/exit
+// Learned thresholds are marked with ~, or show their warmup progress
+function thresholdLabel(metric) {
+    const th = metric.threshold;
+    if (!th) return metric.maxVal.toLocaleString();
+    if (metric.adaptive) {
+        if (th.mode === 'warmup') {
+            return 'learning ' + metric.adaptive.seen + '/' + metric.adaptive.config.warmup;
+        }
+        return '~' + (th.mode === 'below' ? '≤ ' : '') + th.enter.toLocaleString();
+    }
+    switch (th.mode) {
+        case 'band':
+            return th.low.toLocaleString() + '–' + th.high.toLocaleString();
+        case 'below':
+            return '≤ ' + th.enter.toLocaleString() + (th.exit !== th.enter ? ' / ' + th.exit.toLocaleString() : '');
+        default:
+            return th.enter.toLocaleString() + (th.exit !== th.enter ? ' / ' + th.exit.toLocaleString() : '');
+    }
+}
@@ -81,12 +81,35 @@ async function submitConfig() {
         }
 
         const result = await response.json();
-        showStatus('Configuration updated successfully! ✓', 'success');
+        showStatus('Configuration updated successfully! ✓ ' + describeChanges(result.changes), 'success');
     } catch (error) {
         showStatus('Failed to update config ' + error.message, 'error');
     }
 }
 
+// Summarize what a reload changed, e.g. "1 updated, 1 added"
+function describeChanges(changes) {
+    if (!changes) {
+        return '';
+    }
+    const parts = [];
+    const counts = {
+        updated: Object.keys(changes.updated || {}).length,
+        restarted: (changes.restarted || []).length,
+        added: (changes.added || []).length,
+        removed: (changes.removed || []).length,
+    };
+    for (const [change, count] of Object.entries(counts)) {
+        if (count > 0) {
+            parts.push(`${count} ${change}`);
+        }
+    }
+    if (changes.output === 'reopened') {
+        parts.push('output reopened');
+    }
+    return parts.length > 0 ? '(' + parts.join(', ') + ')' : '(no changes)';
+}
+
 // Value picker functions
 // Fetch all metrics and populate dropdown
 async function loadMetricsList() {
@@ -160,7 +183,7 @@ async function displaySelectedMetric() {
 
         // Max value
         const maxCell = row.insertCell();
-        maxCell.textContent = metricData.maxVal.toLocaleString();
+        maxCell.textContent = thresholdLabel(metricData);
         maxCell.style.textAlign = 'right';
         maxCell.style.fontFamily = 'monospace';
 
@@ -171,7 +194,7 @@ async function displaySelectedMetric() {
         pctCell.style.fontFamily = 'monospace';
 
         // Color code the percentage
-        if (metricData.percentUsed >= 100) {
+        if (metricData.isAccent || metricData.percentUsed >= 100) {
             pctCell.style.color = '#ff7f00';
         } else if (metricData.percentUsed >= 80) {
             pctCell.style.color = '#ffcc00';
@@ -212,11 +235,142 @@ document.addEventListener('DOMContentLoaded', () => {
 
     // Attach dropdown handler
     document.getElementById('metric-select').addEventListener('change', displaySelectedMetric);
+    document.getElementById('metric-select').addEventListener('change', () => loadPeriodPreview(true));
+
+    // Period sliders preview as they move
+    Object.keys(periodRatios).forEach(name => {
+        document.getElementById(name).addEventListener('input', () => loadPeriodPreview(false));
+    });
+    document.getElementById('period-apply-button').addEventListener('click', applyPeriods);
 
     // Auto-refresh selected metric every 2 seconds
     setInterval(() => {
         if (document.getElementById('metric-select').value) {
             displaySelectedMetric();
+            loadPeriodPreview(false);
         }
     }, 2000);
-});
\ No newline at end of file
+});
+
+// Period ratios by config name, and their field in the preview response
+const periodRatios = {
+    'iamb_start': 'IambStartPeriod',
+    'iamb_end': 'IambEndPeriod',
+    'trochee_start': 'TrocheeStartPeriod',
+    'trochee_end': 'TrocheeEndPeriod'
+};
+
+// Preview how the slider ratios move the selected metric's recent pulses
+// reset sets the sliders back to the metric's current ratios
+async function loadPeriodPreview(reset) {
+    const selectedValue = document.getElementById('metric-select').value;
+    if (!selectedValue) return;
+
+    const [endpoint, metric] = selectedValue.split(':');
+    const params = new URLSearchParams({ endpoint, metric });
+    if (!reset) {
+        Object.keys(periodRatios).forEach(name => {
+            params.set(name, document.getElementById(name).value);
+        });
+    }
+
+    try {
+        const response = await fetch('/api/period-preview?' + params.toString());
+        if (!response.ok) {
+            throw new Error(`HTTP error! status: ${response.status}`);
+        }
+        const data = await response.json();
+
+        // Show the ratios being previewed
+        Object.entries(periodRatios).forEach(([name, field]) => {
+            const slider = document.getElementById(name);
+            if (reset) slider.value = data.current[field];
+            slider.nextElementSibling.textContent = Number(slider.value).toFixed(2);
+        });
+
+        const tbody = document.getElementById('period-preview-tbody');
+        tbody.innerHTML = '';
+        (data.pulses || []).forEach(p => {
+            const row = tbody.insertRow();
+            row.insertCell().textContent = p.pattern === 'iamb' ? '⚍ Iamb' : '⚎ Trochee';
+            row.insertCell().textContent = new Date(p.newStart).toLocaleTimeString();
+            row.insertCell().textContent = new Date(p.newEnd).toLocaleTimeString();
+            row.insertCell().textContent = formatShift(p.start, p.newStart);
+            row.insertCell().textContent = formatShift(p.end, p.newEnd);
+            Array.from(row.cells).forEach((cell, i) => {
+                cell.style.padding = '8px';
+                cell.style.fontFamily = 'monospace';
+                if (i > 0) cell.style.textAlign = 'right';
+            });
+        });
+        if (!data.pulses || data.pulses.length === 0) {
+            const cell = tbody.insertRow().insertCell();
+            cell.colSpan = 5;
+            cell.textContent = 'No recent pulses on this metric yet';
+            cell.style.padding = '8px';
+            cell.style.color = '#888';
+        }
+    } catch (error) {
+        console.error('Failed to preview periods:', error);
+    }
+}
+
+// Seconds a pulse boundary moves, signed
+function formatShift(from, to) {
+    const shift = (new Date(to) - new Date(from)) / 1000;
+    if (shift === 0) return '0s';
+    return (shift > 0 ? '+' : '') + shift.toFixed(1) + 's';
+}
+
+// Write the slider ratios into the selected metric's config,
+// they take effect with Update Configuration
+function applyPeriods() {
+    const selectedValue = document.getElementById('metric-select').value;
+    if (!selectedValue) return;
+    const [endpoint, metric] = selectedValue.split(':');
+
+    const textarea = document.getElementById('config-textarea');
+    let config;
+    try {
+        config = JSON.parse(textarea.value);
+    } catch (error) {
+        showStatus('Invalid JSON: ' + error.message, 'error');
+        return;
+    }
+
+    const ep = config.find(c => c.id === endpoint);
+    if (!ep || !ep.metrics || !ep.metrics[metric]) {
+        showStatus(`${endpoint} → ${metric} is not in the configuration`, 'error');
+        return;
+    }
+
+    const periods = {};
+    Object.keys(periodRatios).forEach(name => {
+        periods[name] = Number(document.getElementById(name).value);
+    });
+    ep.metrics[metric].periods = periods;
+
+    textarea.value = JSON.stringify(config, null, 2);
+    showStatus('Periods set for ' + metric + ', click Update Configuration to apply', 'success');
+}
+
+// Describe the accent threshold: max, min, band, or enter/exit
+// Learned thresholds are marked with ~, or show their warmup progress
+function thresholdLabel(metric) {
+    const th = metric.threshold;
+    if (!th) return metric.maxVal.toLocaleString();
+    if (metric.adaptive) {
+        if (th.mode === 'warmup') {
+            return 'learning ' + metric.adaptive.seen + '/' + metric.adaptive.config.warmup;
+        }
+        return '~' + (th.mode === 'below' ? '≤ ' : '') + th.enter.toLocaleString();
+    }
+    switch (th.mode) {
+        case 'band':
+            return th.low.toLocaleString() + '–' + th.high.toLocaleString();
+        case 'below':
+            return '≤ ' + th.enter.toLocaleString() + (th.exit !== th.enter ? ' / ' + th.exit.toLocaleString() : '');
+        default:
+            return th.enter.toLocaleString() + (th.exit !== th.enter ? ' / ' + th.exit.toLocaleString() : '');
+    }
+}